@@ -0,0 +1,243 @@
+// Package aferofs exposes spgz compressed files through the afero.Fs interface.
+//
+// Every regular file in the underlying filesystem is stored in spgz format, reads and writes
+// operate on the uncompressed content and Stat and Readdir report the uncompressed size. Other
+// metadata operations are passed through unchanged.
+package aferofs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/dop251/spgz"
+)
+
+type spgzFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	spgz.Truncatable
+
+	Sync() error
+	Size() (int64, error)
+}
+
+type Fs struct {
+	base      afero.Fs
+	blockSize int64
+}
+
+// NewFs returns an afero.Fs that stores files in base in spgz format using the default block size.
+func NewFs(base afero.Fs) *Fs {
+	return NewFsSize(base, 0)
+}
+
+// NewFsSize is like NewFs but uses the given block size for newly created files.
+func NewFsSize(base afero.Fs, blockSize int64) *Fs {
+	return &Fs{
+		base:      base,
+		blockSize: blockSize,
+	}
+}
+
+func (fs *Fs) Name() string {
+	return "SpgzFs"
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	// Writing requires read access because blocks are read-modify-written.
+	if flag&os.O_WRONLY != 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	// The blocks are written at their offsets, the spgz file keeps track of the end in append mode
+	// (see OpenFileOptions).
+	f, err := fs.base.OpenFile(name, flag&^os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dir{
+			File: f,
+			fs:   fs,
+			name: name,
+		}, nil
+	}
+	if !info.Mode().IsRegular() {
+		return f, nil
+	}
+
+	c, err := spgz.NewFromSparseFileSize(newSparseFile(f), flag, fs.blockSize)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{
+		File: f,
+		c:    c,
+	}, nil
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.base.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	return fs.uncompressed(name, info)
+}
+
+// uncompressed returns info (of the regular file name) with the uncompressed size.
+func (fs *Fs) uncompressed(name string, info os.FileInfo) (os.FileInfo, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.(*file).c.Size()
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{
+		FileInfo: info,
+		size:     size,
+	}, nil
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	return fs.base.Mkdir(name, perm)
+}
+
+func (fs *Fs) MkdirAll(path string, perm os.FileMode) error {
+	return fs.base.MkdirAll(path, perm)
+}
+
+func (fs *Fs) Remove(name string) error {
+	return fs.base.Remove(name)
+}
+
+func (fs *Fs) RemoveAll(path string) error {
+	return fs.base.RemoveAll(path)
+}
+
+func (fs *Fs) Rename(oldname, newname string) error {
+	return fs.base.Rename(oldname, newname)
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.base.Chmod(name, mode)
+}
+
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	return fs.base.Chown(name, uid, gid)
+}
+
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.base.Chtimes(name, atime, mtime)
+}
+
+// file embeds the underlying afero.File for Name, Readdir and Readdirnames, all data access
+// goes through the spgz file.
+type file struct {
+	afero.File
+	c spgzFile
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	return f.c.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	return f.c.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.c.Seek(offset, whence)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	return f.c.Write(p)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	return f.c.WriteAt(p, off)
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.c.Write([]byte(s))
+}
+
+func (f *file) Truncate(size int64) error {
+	return f.c.Truncate(size)
+}
+
+func (f *file) Sync() error {
+	return f.c.Sync()
+}
+
+func (f *file) Close() error {
+	return f.c.Close()
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.c.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{
+		FileInfo: info,
+		size:     size,
+	}, nil
+}
+
+// dir embeds a directory of the underlying filesystem, the regular files it lists report their
+// uncompressed size.
+type dir struct {
+	afero.File
+	fs   *Fs
+	name string
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		info, uerr := d.fs.uncompressed(filepath.Join(d.name, info.Name()), info)
+		if uerr != nil {
+			return infos[:i], uerr
+		}
+		infos[i] = info
+	}
+	return infos, err
+}
+
+type fileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
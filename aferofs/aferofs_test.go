@@ -0,0 +1,108 @@
+package aferofs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestFs(t *testing.T) {
+	t.Run("mem", func(t *testing.T) {
+		testFs(t, afero.NewMemMapFs())
+	})
+	t.Run("os", func(t *testing.T) {
+		// os.File doesn't accept WriteAt in append mode
+		testFs(t, afero.NewBasePathFs(afero.NewOsFs(), t.TempDir()))
+	})
+}
+
+func testFs(t *testing.T, base afero.Fs) {
+	fs := NewFsSize(base, 64*1024)
+	data := bytes.Repeat([]byte("afero "), 40000)
+
+	err := fs.MkdirAll("/dir", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want []byte) {
+		t.Helper()
+		f, err := fs.Open("/dir/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		buf, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, want) {
+			t.Fatal("Data mismatch")
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(want)) {
+			t.Fatalf("Unexpected size: %d", info.Size())
+		}
+		info, err = fs.Stat("/dir/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(want)) {
+			t.Fatalf("Unexpected size from Stat: %d", info.Size())
+		}
+		infos, err := afero.ReadDir(fs, "/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Size() != int64(len(want)) {
+			t.Fatalf("Unexpected directory listing: %v", infos)
+		}
+	}
+	check(data)
+
+	// The underlying file is in spgz format
+	raw, err := afero.ReadFile(base, "/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) == len(data) || bytes.Contains(raw, data[:100]) {
+		t.Fatal("The file is not stored compressed")
+	}
+
+	// Writes in append mode go to the end regardless of the offset
+	f, err = fs.OpenFile("/dir/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = f.Write([]byte("appended"))
+	}
+	if err == nil {
+		_, err = f.WriteString(" twice")
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(append(data, "appended twice"...))
+}
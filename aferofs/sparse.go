@@ -0,0 +1,73 @@
+package aferofs
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+
+	"github.com/dop251/spgz"
+)
+
+// sparseFile adapts an afero.File to spgz.SparseFile. Holes are punched natively when the file is
+// backed by an *os.File on a filesystem that supports it, otherwise the range is filled with zeroes.
+type sparseFile struct {
+	afero.File
+	native spgz.SparseFile
+}
+
+func newSparseFile(f afero.File) *sparseFile {
+	s := &sparseFile{
+		File: f,
+	}
+	if osf, ok := f.(*os.File); ok {
+		s.native = spgz.NewSparseFile(osf)
+	}
+	return s
+}
+
+// ReadAt makes up for the afero.File implementations that don't quite follow io.ReaderAt (e.g.
+// mem.File returns no error for a short read and io.ErrUnexpectedEOF past the end), spgz expects
+// io.EOF in both cases.
+func (f *sparseFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if n < len(p) && (err == nil || err == io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *sparseFile) PunchHole(offset, size int64) error {
+	if f.native != nil {
+		err := f.native.PunchHole(offset, size)
+		if !errors.Is(err, spgz.ErrPunchHoleNotSupported) {
+			return err
+		}
+		f.native = nil
+	}
+
+	// Unlike a real hole, writing zeroes past the end would grow the file.
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if end := info.Size(); offset+size > end {
+		size = end - offset
+	}
+
+	var buf [spgz.BUFSIZE]byte
+	for size > 0 {
+		s := size
+		if s > spgz.BUFSIZE {
+			s = spgz.BUFSIZE
+		}
+		_, err := f.WriteAt(buf[:s], offset)
+		if err != nil {
+			return err
+		}
+		offset += s
+		size -= s
+	}
+	return nil
+}
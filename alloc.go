@@ -0,0 +1,41 @@
+// +build linux
+
+package spgz
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the disk space used by the file or -1 if it's not an *os.File.
+func allocatedSize(f SparseFile) int64 {
+	sf, ok := f.(interface {
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return -1
+	}
+	fi, err := sf.Stat()
+	if err != nil {
+		return -1
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return -1
+}
+
+// freeSpace returns the space available on the filesystem of the file or -1 if it's unknown.
+func freeSpace(f SparseFile) int64 {
+	sf, ok := f.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return -1
+	}
+	var st syscall.Statfs_t
+	if syscall.Fstatfs(int(sf.Fd()), &st) != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package spgz
+
+func allocatedSize(f SparseFile) int64 {
+	return -1
+}
+
+func freeSpace(f SparseFile) int64 {
+	return -1
+}
@@ -0,0 +1,55 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// With Options.CompactThreshold Sync and Close measure the file (see fragmentation.go) when the
+// allocated space (which is cheap to get) exceeds the threshold relative to the ideal size found
+// by the last measurement, and compact it if it's confirmed. The last measurement is kept in the
+// header, so a file that grows steadily is measured each time it has grown by the threshold, not
+// on every Sync.
+
+// CompactIfNeeded measures the file and compacts it if the allocated space exceeds threshold
+// percent of the ideal size. It returns true if the file has been compacted.
+func (f *compFile) CompactIfNeeded(threshold int) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.readOnly {
+		return false, os.ErrPermission
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return false, err
+	}
+	fr, err := f.fragmentation()
+	if err != nil || fr.Percent() <= threshold {
+		return false, err
+	}
+	return true, f.compact()
+}
+
+// autoCompact is called by Sync and Close, see Options.CompactThreshold.
+func (f *compFile) autoCompact() error {
+	if f.compactThreshold <= 0 || f.readOnly {
+		return nil
+	}
+	allocated := allocatedSize(f.f)
+	if allocated < 0 {
+		return nil
+	}
+	if f.lastIdeal == 0 {
+		if data := f.meta[metaIdealSize]; len(data) == 8 {
+			f.lastIdeal = int64(binary.LittleEndian.Uint64(data))
+		}
+	}
+	if f.lastIdeal > 0 && allocated*100 <= f.lastIdeal*int64(f.compactThreshold) {
+		return nil
+	}
+	fr, err := f.fragmentation()
+	if err != nil || fr.Percent() <= f.compactThreshold {
+		return err
+	}
+	return f.compact()
+}
@@ -0,0 +1,91 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutoCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "autocompact.spgz")
+	f, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := bytes.Repeat([]byte("autocompact"), int(8*bs)/11)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := (int64(len(data)) + bs - 1) / bs
+	ends := make([]int64, blocks)
+	for num := range ends {
+		raw, _, err := f.ReadBlockRaw(int64(num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends[num] = f.blockOffset(int64(num)) + 1 + int64(len(raw))
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the slack of all slots but the last one
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num := int64(0); num < blocks-1 && err == nil; num++ {
+		_, err = file.WriteAt(bytes.Repeat([]byte{0xff}, int(f.blockOffset(num+1)-ends[num])), ends[num])
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDWR, 0, &Options{CompactThreshold: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err := f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Allocated < 0 {
+		f.Close()
+		t.Skip("The allocated size is not known")
+	}
+	if fr.Percent() <= 150 {
+		t.Fatalf("Not fragmented: %+v", fr)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fr, err = f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Percent() > 150 {
+		t.Fatalf("Not compacted: %+v", fr)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data mismatch")
+	}
+}
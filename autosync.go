@@ -0,0 +1,64 @@
+package spgz
+
+import (
+	"time"
+)
+
+// Sync stores all modified blocks, the current one and those in the write-back cache, and then
+// syncs the underlying file once: the periodic syncs of Options.SyncEvery and
+// Options.SyncInterval are held back while it does so. The cached blocks are stored in the order
+// of their slots and the file is synced with fdatasync(2) where the underlying file supports it
+// (see dataSyncer), as the blocks only need their data and the size of the file to be durable.
+
+// dataSyncer is an underlying file that can sync its data without the rest of its metadata.
+type dataSyncer interface {
+	Datasync() error
+}
+
+// autoSync is called after a block is stored and syncs the file if Options.SyncEvery or
+// Options.SyncInterval say so.
+func (f *compFile) autoSync() error {
+	if f.syncEvery <= 0 && f.syncInterval <= 0 {
+		return nil
+	}
+	f.unsynced++
+	if f.syncing {
+		return nil
+	}
+	if f.syncEvery > 0 && f.unsynced >= f.syncEvery ||
+		f.syncInterval > 0 && time.Since(f.lastSync) >= f.syncInterval {
+		return f.syncFile()
+	}
+	return nil
+}
+
+// flushAndSync stores all modified blocks and syncs the file once.
+func (f *compFile) flushAndSync() error {
+	f.syncing = true
+	err := f.flushBlock()
+	f.syncing = false
+	if err == nil {
+		err = f.autoCompact()
+	}
+	if err != nil {
+		return err
+	}
+	return f.syncFile()
+}
+
+func (f *compFile) syncFile() error {
+	var err error
+	if ds, ok := f.f.(dataSyncer); ok {
+		err = ds.Datasync()
+	} else {
+		err = f.f.Sync()
+	}
+	if err == nil && f.parity != nil && !f.readOnly {
+		err = f.updateParity()
+	}
+	if err == nil {
+		f.unsynced = 0
+		f.lastSync = time.Now()
+	}
+	return err
+}
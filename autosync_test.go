@@ -0,0 +1,99 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+type syncCountingFile struct {
+	memSparseFile
+	syncs int
+}
+
+func (s *syncCountingFile) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestAutoSync(t *testing.T) {
+	var sf syncCountingFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize: 4096,
+		SyncEvery: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{1}, int(10*f.BlockSize()))
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last block is still in memory
+	if sf.syncs != 3 {
+		t.Fatalf("Unexpected number of syncs: %d", sf.syncs)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.syncs != 4 || f.unsynced != 0 {
+		t.Fatalf("Unexpected state after Sync: %d, %d", sf.syncs, f.unsynced)
+	}
+}
+
+func TestSyncBatch(t *testing.T) {
+	var sf syncCountingFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	_, err = f.WriteAt(bytes.Repeat([]byte{1}, int(8*bs)), 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	sf.syncs = 0
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		WriteBack:      8,
+		WriteBackDelay: time.Hour,
+		SyncEvery:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, num := range []int64{6, 1, 4, 3} {
+		_, err = f.WriteAt([]byte{2}, num*bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sf.syncs != 0 {
+		t.Fatalf("Unexpected number of syncs before Sync: %d", sf.syncs)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.syncs != 1 || f.unsynced != 0 {
+		t.Fatalf("Unexpected state after Sync: %d, %d", sf.syncs, f.unsynced)
+	}
+	buf := make([]byte, 1)
+	for _, num := range []int64{1, 3, 4, 6} {
+		_, err = f.ReadAt(buf, num*bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != 2 {
+			t.Fatalf("Block %d was not stored", num)
+		}
+	}
+}
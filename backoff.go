@@ -0,0 +1,81 @@
+package spgz
+
+import (
+	"compress/flate"
+	"sync"
+)
+
+// With Options.RawBackoff set to n, once n blocks in a row have been stored raw because they
+// don't compress, a block is only compressed if a sample of it does: a few pieces spread over the
+// block are compressed with the fastest level, which costs a fraction of compressing the whole
+// block. A block whose sample fails is stored raw straight away. As soon as a block is stored
+// compressed again the run ends and every block is compressed. This keeps the throughput up over
+// stretches of incompressible data (compressed or encrypted files) in otherwise compressible
+// images, at the cost of storing raw the odd block that would have just made it.
+//
+// The run is counted in the order the blocks are stored. With Options.CompressJobs the blocks are
+// compressed ahead of that, so which of them are sampled depends on the timing and the resulting
+// file may differ between runs. With Options.Reproducible they are compressed one at a time
+// instead.
+
+const (
+	samplePieces = 4
+	samplePiece  = 1024
+)
+
+var sampleWriters = sync.Pool{
+	New: func() interface{} {
+		z, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return z
+	},
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// backingOff returns true if the blocks are sampled before they are compressed.
+func (f *compFile) backingOff() bool {
+	return f.rawBackoff > 0 && f.rawRun.Load() >= int64(f.rawBackoff)
+}
+
+// countRaw updates the run of blocks stored raw.
+func (f *compFile) countRaw(raw bool) {
+	if f.rawBackoff <= 0 {
+		return
+	}
+	if raw {
+		f.rawRun.Add(1)
+	} else {
+		f.rawRun.Store(0)
+	}
+}
+
+// sampleCompresses returns true if a sample of data compresses well enough for data to be worth
+// compressing, i.e. for the compressed data to save the 2 pages compressImage requires.
+func sampleCompresses(data []byte) bool {
+	var sample [samplePieces * samplePiece]byte
+	if len(data) <= len(sample) {
+		return true
+	}
+	step := (len(data) - samplePiece) / (samplePieces - 1)
+	for i := 0; i < samplePieces; i++ {
+		copy(sample[i*samplePiece:(i+1)*samplePiece], data[i*step:])
+	}
+	var c countingWriter
+	z := sampleWriters.Get().(*flate.Writer)
+	z.Reset(&c)
+	z.Write(sample[:])
+	z.Close()
+	sampleWriters.Put(z)
+	return int64(c)*int64(len(data)) < int64(len(sample))*int64(len(data)-2*4096)
+}
+
+// rawImage returns the content of the slot for data stored uncompressed.
+func rawImage(buf, data []byte) []byte {
+	buf = append(buf[:0], blkUncompressed)
+	return append(buf, data...)
+}
@@ -0,0 +1,92 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestRawBackoff(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize:  65536,
+		RawBackoff: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	f.SetMetrics(m)
+	bs := f.BlockSize()
+	// 2 compressible blocks, 6 random ones and 2 compressible ones again
+	data := make([]byte, 10*bs)
+	for i := range data {
+		data[i] = byte(i / 100)
+	}
+	rand.New(rand.NewSource(1)).Read(data[2*bs : 8*bs])
+	if !sampleCompresses(data[:bs]) || sampleCompresses(data[2*bs:3*bs]) {
+		t.Fatal("Unexpected samples")
+	}
+
+	for num := int64(0); num < 10; num++ {
+		_, err = f.ReadFrom(bytes.NewReader(data[num*bs : (num+1)*bs]))
+		if err == nil {
+			err = f.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backingOff := num >= 4 && num < 8; f.backingOff() != backingOff {
+			t.Fatalf("Block %d: unexpected state: %v", num, f.backingOff())
+		}
+	}
+	if m.BlocksRaw.Value() != 6 || m.BlocksCompressed.Value() != 4 {
+		t.Fatalf("Unexpected counts: %s", m)
+	}
+
+	f.Seek(0, io.SeekStart)
+	res, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRawBackoffReproducible(t *testing.T) {
+	data := make([]byte, 20*65536)
+	rand.New(rand.NewSource(1)).Read(data[:12*65536])
+	create := func() []byte {
+		var sf memSparseFile
+		f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+			BlockSize:    65536,
+			RawBackoff:   2,
+			CompressJobs: 4,
+			Reproducible: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.compressJobs != 0 {
+			t.Fatalf("Blocks are compressed in parallel: %d jobs", f.compressJobs)
+		}
+		_, err = f.ReadFrom(bytes.NewReader(data))
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sf.data
+	}
+	if !bytes.Equal(create(), create()) {
+		t.Fatal("The files differ")
+	}
+}
@@ -0,0 +1,329 @@
+package spgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A bgzfFile provides random access to a BGZF (blocked gzip) file, as used by samtools/htslib:
+// a series of gzip members of up to 64KB of uncompressed data each, whose compressed size is
+// recorded in a "BC" extra subfield. The offsets of the blocks are taken from the .gzi index if
+// there is one, otherwise they are found by scanning the block headers.
+
+const (
+	bgzfHeaderSize = 18
+	bgzfMaxBlock   = 64 * 1024
+)
+
+type bgzfBlock struct {
+	cOffset, uOffset int64
+}
+
+type bgzfFile struct {
+	sync.Mutex
+	r      io.ReaderAt
+	blocks []bgzfBlock // the uncompressed size of the last one is size - uOffset
+	size   int64
+	offset int64
+	closer io.Closer
+
+	// the most recently used block
+	cur     int
+	curData []byte
+	z       *gzip.Reader
+	cbuf    []byte
+}
+
+// bgzfBlockSize returns the total size of the block whose header is in h, or 0 if it's not a
+// BGZF block.
+func bgzfBlockSize(h []byte) int64 {
+	if len(h) < 12 || h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 || h[3]&4 == 0 {
+		return 0
+	}
+	xlen := int(binary.LittleEndian.Uint16(h[10:]))
+	extra := h[12:]
+	if len(extra) > xlen {
+		extra = extra[:xlen]
+	}
+	for len(extra) >= 4 {
+		l := int(binary.LittleEndian.Uint16(extra[2:]))
+		if extra[0] == 'B' && extra[1] == 'C' && l == 2 && len(extra) >= 6 {
+			return int64(binary.LittleEndian.Uint16(extra[4:])) + 1
+		}
+		if len(extra) < 4+l {
+			break
+		}
+		extra = extra[4+l:]
+	}
+	return 0
+}
+
+// NewBGZFReader returns a random access reader of the BGZF file of the given physical size
+// stored in r. index is the content of the .gzi file, it can be nil.
+func NewBGZFReader(r io.ReaderAt, physSize int64, index io.Reader) (*bgzfFile, error) {
+	f := &bgzfFile{
+		r:   r,
+		cur: -1,
+	}
+	var err error
+	if index != nil {
+		err = f.readIndex(index, physSize)
+	} else {
+		err = f.scan(physSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenBGZF opens the named BGZF file for reading, using name.gzi as the index if it exists.
+func OpenBGZF(name string) (*bgzfFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var index io.Reader
+	if gzi, err := os.Open(name + ".gzi"); err == nil {
+		defer gzi.Close()
+		index = gzi
+	}
+	f, err := NewBGZFReader(file, size, index)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.closer = file
+	return f, nil
+}
+
+// blockAt returns the total size and the uncompressed size of the block at the given offset.
+func (f *bgzfFile) blockAt(offset, physSize int64) (int64, int64, error) {
+	var h [bgzfHeaderSize]byte
+	n, err := f.r.ReadAt(h[:], offset)
+	if n < len(h) {
+		if err == nil || err == io.EOF {
+			err = ErrInvalidFormat
+		}
+		return 0, 0, err
+	}
+	bsize := bgzfBlockSize(h[:])
+	if bsize < bgzfHeaderSize+8 || offset+bsize > physSize {
+		return 0, 0, ErrInvalidFormat
+	}
+	var isize [4]byte
+	_, err = f.r.ReadAt(isize[:], offset+bsize-4)
+	if err != nil {
+		return 0, 0, err
+	}
+	usize := int64(binary.LittleEndian.Uint32(isize[:]))
+	if usize > bgzfMaxBlock {
+		return 0, 0, ErrInvalidFormat
+	}
+	return bsize, usize, nil
+}
+
+func (f *bgzfFile) scan(physSize int64) error {
+	var coff, uoff int64
+	for coff < physSize {
+		bsize, usize, err := f.blockAt(coff, physSize)
+		if err != nil {
+			return err
+		}
+		if usize > 0 {
+			f.blocks = append(f.blocks, bgzfBlock{cOffset: coff, uOffset: uoff})
+		}
+		coff += bsize
+		uoff += usize
+	}
+	if coff == 0 {
+		return ErrInvalidFormat
+	}
+	f.size = uoff
+	return nil
+}
+
+// readIndex reads a .gzi index: the number of entries followed by pairs of compressed and
+// uncompressed offsets (all uint64), the first block is not included.
+func (f *bgzfFile) readIndex(r io.Reader, physSize int64) error {
+	var n uint64
+	err := binary.Read(r, binary.LittleEndian, &n)
+	if err != nil {
+		return err
+	}
+	if n > uint64(physSize/(bgzfHeaderSize+8)) {
+		return ErrInvalidFormat
+	}
+	entries := make([]uint64, 2*n)
+	err = binary.Read(r, binary.LittleEndian, entries)
+	if err != nil {
+		return err
+	}
+	f.blocks = append(f.blocks, bgzfBlock{})
+	for i := 0; i < len(entries); i += 2 {
+		b := bgzfBlock{cOffset: int64(entries[i]), uOffset: int64(entries[i+1])}
+		last := f.blocks[len(f.blocks)-1]
+		if b.cOffset <= last.cOffset || b.uOffset < last.uOffset || b.cOffset >= physSize {
+			return ErrInvalidFormat
+		}
+		if b.uOffset == last.uOffset {
+			// The previous block is empty (e.g. the EOF marker)
+			f.blocks[len(f.blocks)-1] = b
+			continue
+		}
+		f.blocks = append(f.blocks, b)
+	}
+	last := f.blocks[len(f.blocks)-1]
+	_, usize, err := f.blockAt(last.cOffset, physSize)
+	if err != nil {
+		return err
+	}
+	f.size = last.uOffset + usize
+	if usize == 0 {
+		f.blocks = f.blocks[:len(f.blocks)-1]
+	}
+	return nil
+}
+
+// loadBlock decompresses block i into f.curData.
+func (f *bgzfFile) loadBlock(i int) error {
+	if i == f.cur {
+		return nil
+	}
+	f.cur = -1
+	var h [bgzfHeaderSize]byte
+	_, err := f.r.ReadAt(h[:], f.blocks[i].cOffset)
+	if err != nil {
+		return err
+	}
+	bsize := bgzfBlockSize(h[:])
+	if bsize == 0 {
+		return ErrInvalidFormat
+	}
+	if int64(cap(f.cbuf)) < bsize {
+		f.cbuf = make([]byte, bsize)
+	}
+	cbuf := f.cbuf[:bsize]
+	_, err = f.r.ReadAt(cbuf, f.blocks[i].cOffset)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if f.z == nil {
+		f.z, err = gzip.NewReader(bytes.NewReader(cbuf))
+	} else {
+		err = f.z.Reset(bytes.NewReader(cbuf))
+	}
+	if err != nil {
+		return err
+	}
+	f.z.Multistream(false)
+	if f.curData == nil {
+		f.curData = make([]byte, 0, bgzfMaxBlock)
+	}
+	buf := bytes.NewBuffer(f.curData[:0])
+	_, err = io.Copy(buf, f.z)
+	if err != nil {
+		return err
+	}
+	f.curData = buf.Bytes()
+	if want := f.blockEnd(i) - f.blocks[i].uOffset; int64(len(f.curData)) != want {
+		return ErrInvalidFormat
+	}
+	f.cur = i
+	return nil
+}
+
+func (f *bgzfFile) blockEnd(i int) int64 {
+	if i+1 < len(f.blocks) {
+		return f.blocks[i+1].uOffset
+	}
+	return f.size
+}
+
+func (f *bgzfFile) readAt(buf []byte, offset int64) (n int, err error) {
+	if offset >= f.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(f.blocks), func(i int) bool {
+		return f.blocks[i].uOffset > offset
+	}) - 1
+	for n < len(buf) && i < len(f.blocks) {
+		err = f.loadBlock(i)
+		if err != nil {
+			return
+		}
+		c := copy(buf[n:], f.curData[offset-f.blocks[i].uOffset:])
+		n += c
+		offset += int64(c)
+		i++
+	}
+	if n < len(buf) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *bgzfFile) ReadAt(buf []byte, offset int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.readAt(buf, offset)
+}
+
+func (f *bgzfFile) Read(buf []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	n, err = f.readAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+// WriteTo writes the rest of the uncompressed data to w.
+func (f *bgzfFile) WriteTo(w io.Writer) (int64, error) {
+	// f is wrapped so that io.Copy doesn't call this method again
+	return io.Copy(w, struct{ io.Reader }{f})
+}
+
+func (f *bgzfFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch whence {
+	case os.SEEK_SET:
+		f.offset = offset
+		return f.offset, nil
+	case os.SEEK_CUR:
+		f.offset += offset
+		return f.offset, nil
+	case os.SEEK_END:
+		f.offset = f.size + offset
+		return f.offset, nil
+	}
+	return f.offset, os.ErrInvalid
+}
+
+func (f *bgzfFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+func (f *bgzfFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package spgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// writeBGZF compresses data into BGZF blocks of up to blockSize bytes followed by the EOF marker,
+// returns the file and its .gzi index.
+func writeBGZF(data []byte, blockSize int) (file, gzi []byte) {
+	var buf bytes.Buffer
+	var entries [][2]uint64
+	uoff := 0
+	for {
+		l := blockSize
+		if l > len(data) {
+			l = len(data)
+		}
+		if buf.Len() > 0 {
+			entries = append(entries, [2]uint64{uint64(buf.Len()), uint64(uoff)})
+		}
+		start := buf.Len()
+		z := gzip.NewWriter(&buf)
+		z.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		z.Write(data[:l])
+		z.Close()
+		binary.LittleEndian.PutUint16(buf.Bytes()[start+16:], uint16(buf.Len()-start-1))
+		data = data[l:]
+		uoff += l
+		if l == 0 {
+			// The EOF marker
+			break
+		}
+	}
+	var index bytes.Buffer
+	binary.Write(&index, binary.LittleEndian, uint64(len(entries)))
+	binary.Write(&index, binary.LittleEndian, entries)
+	return buf.Bytes(), index.Bytes()
+}
+
+func TestBGZF(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data[:100000])
+	file, gzi := writeBGZF(data, 65280)
+
+	info, err := Sniff(bytes.NewReader(file))
+	if err != nil || info.Format != FormatBGZF {
+		t.Fatalf("Sniff: %v, %v", info, err)
+	}
+
+	for _, index := range [][]byte{nil, gzi} {
+		var f *bgzfFile
+		if index == nil {
+			f, err = NewBGZFReader(bytes.NewReader(file), int64(len(file)), nil)
+		} else {
+			f, err = NewBGZFReader(bytes.NewReader(file), int64(len(file)), bytes.NewReader(index))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, _ := f.Size(); size != int64(len(data)) || len(f.blocks) != 4 {
+			t.Fatalf("Size: %d, %d blocks", size, len(f.blocks))
+		}
+		// Within a block, across two and across three of them
+		for _, r := range [][2]int{{100, 1000}, {65000, 1000}, {60000, 80000}, {199000, 1000}} {
+			buf := make([]byte, r[1])
+			n, err := f.ReadAt(buf, int64(r[0]))
+			if err != nil || n != len(buf) || !bytes.Equal(buf, data[r[0]:r[0]+r[1]]) {
+				t.Fatalf("ReadAt(%d, %d): %d, %v", r[0], r[1], n, err)
+			}
+		}
+		var out bytes.Buffer
+		_, err = f.WriteTo(&out)
+		if err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("WriteTo: %v", err)
+		}
+	}
+
+	var plain bytes.Buffer
+	z := gzip.NewWriter(&plain)
+	z.Write(data)
+	z.Close()
+	_, err = NewBGZFReader(bytes.NewReader(plain.Bytes()), int64(plain.Len()), nil)
+	if err != ErrInvalidFormat {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package spgz
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCache keeps decompressed blocks in memory for the handles of any number of Shared files, so
+// that concurrent readers of a hot image decompress every block once rather than once per handle.
+// A cache is meant to be created once and passed to every OpenShared call (in Options.BlockCache),
+// the blocks are keyed by the identity of the underlying file (its device and inode), so that the
+// same archive opened more than once shares them as well. Files without an identity (i.e. on
+// platforms other than Linux) are not cached.
+//
+// The blocks of a file are dropped when the last Shared that uses it is closed. Because an open
+// file's inode can't be reused, a file that is deleted and recreated is never confused with the
+// old one.
+//
+// Blocks stored through a Shared invalidate the blocks of its archive, in every Shared using the
+// cache. Modifications made by other means are not detected, as with the blocks cached by the
+// handles themselves.
+type BlockCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	entries map[cacheKey]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+	files   map[fileID]*cachedFile
+	serial  uint64
+
+	hits, misses int64
+}
+
+// cachedFile is a file registered with the cache. Its fields are protected by the cache's lock.
+type cachedFile struct {
+	id     fileID
+	serial uint64 // distinguishes the registrations of the same identity
+	refs   int
+	gen    uint64
+}
+
+type cacheKey struct {
+	file uint64
+	gen  uint64
+	num  int64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// NewBlockCache returns a cache that holds up to size bytes of blocks.
+func NewBlockCache(size int64) *BlockCache {
+	return &BlockCache{
+		max:     size,
+		entries: make(map[cacheKey]*list.Element),
+		files:   make(map[fileID]*cachedFile),
+	}
+}
+
+// Stats returns the number of lookups that found the block and those that didn't.
+func (c *BlockCache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// register returns the cache's record of the file, which must be passed to release when the file
+// is closed.
+func (c *BlockCache) register(id fileID) *cachedFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf := c.files[id]
+	if cf == nil {
+		c.serial++
+		cf = &cachedFile{
+			id:     id,
+			serial: c.serial,
+		}
+		c.files[id] = cf
+	}
+	cf.refs++
+	return cf
+}
+
+// release drops the file's blocks once it's no longer used.
+func (c *BlockCache) release(cf *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf.refs--
+	if cf.refs > 0 {
+		return
+	}
+	delete(c.files, cf.id)
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cacheEntry).key.file == cf.serial {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// get returns the data of block num of the file, nil if it's not cached. It must not be modified.
+func (c *BlockCache) get(cf *cachedFile, num int64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[cacheKey{file: cf.serial, gen: cf.gen, num: num}]
+	if e == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data
+}
+
+// put adds a copy of data as block num of the file, unless the file has been modified since gen
+// was returned by generation.
+func (c *BlockCache) put(cf *cachedFile, gen uint64, num int64, data []byte) {
+	l := int64(len(data))
+	if l > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{file: cf.serial, gen: gen, num: num}
+	if gen != cf.gen || cf.refs == 0 || c.entries[key] != nil {
+		return
+	}
+	for c.size+l > c.max {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:  key,
+		data: append([]byte(nil), data...),
+	})
+	c.size += l
+}
+
+func (c *BlockCache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, ce.key)
+	c.size -= int64(len(ce.data))
+}
+
+// generation returns the current generation of the file's blocks.
+func (c *BlockCache) generation(cf *cachedFile) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cf.gen
+}
+
+// invalidate drops the blocks of the file. The entries are left to age out of the cache.
+func (c *BlockCache) invalidate(cf *cachedFile) {
+	c.mu.Lock()
+	cf.gen++
+	c.mu.Unlock()
+}
+
+// invalidateCache is called once a block has been written to the file, so that the handles of
+// other files don't keep using the blocks they loaded before. Loads that were already in progress
+// are not added to the cache either, see BlockCache.put.
+func (f *compFile) invalidateCache() {
+	if f.cached != nil {
+		f.cache.invalidate(f.cached)
+	}
+}
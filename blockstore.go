@@ -0,0 +1,135 @@
+package spgz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With a block store the data of non-empty blocks lives outside the file in a content-addressable
+// store, shared between any number of files. The slot of such a block holds the blkStored type
+// byte followed by the SHA-256 digest of the block content, the rest of the slot is a hole. The
+// store keeps the gzip compressed content under the digest.
+
+var (
+	ErrStoreRequired = errors.New("The file keeps its blocks in a block store which has to be supplied")
+	ErrBlockMismatch = errors.New("Block content does not match its digest")
+)
+
+// BlockStore is a content-addressable store for block data.
+type BlockStore interface {
+	// Get returns the data stored under the digest.
+	Get(digest []byte) ([]byte, error)
+
+	// Put stores data under the digest. Storing the same digest again must be harmless.
+	Put(digest, data []byte) error
+}
+
+// DirStore is a BlockStore keeping each blob in a file named after the hex encoded digest in
+// a subdirectory named after the first byte of the digest.
+type DirStore struct {
+	dir string
+}
+
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{
+		dir: dir,
+	}
+}
+
+func (s *DirStore) path(digest []byte) string {
+	name := hex.EncodeToString(digest)
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *DirStore) Get(digest []byte) ([]byte, error) {
+	return ioutil.ReadFile(s.path(digest))
+}
+
+func (s *DirStore) Put(digest, data []byte) error {
+	name := s.path(digest)
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeStored puts the block into the block store and writes a reference to it into the slot.
+// It returns the offset of the end of the slot.
+func (b *block) writeStored() (int64, error) {
+	digest := sha256.Sum256(b.data)
+	var buf bytes.Buffer
+	start := time.Now()
+	span := b.f.startSpan("compress", b.num)
+	w := newGzipWriter(&buf)
+	w.Write(b.data)
+	err := w.Close()
+	span.End(err)
+	if err != nil {
+		return 0, err
+	}
+	m := b.f.metrics
+	if m != nil {
+		m.CompressTime.Observe(time.Since(start))
+	}
+	err = b.f.blockStore.Put(digest[:], buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	b.physSize = int64(buf.Len())
+	if m != nil {
+		m.BlocksCompressed.Add(1)
+		m.BytesWritten.Add(b.physSize)
+	}
+
+	ref := append([]byte{blkStored}, digest[:]...)
+	err = b.writeImage(ref, int64(len(b.data))+1)
+	if err != nil {
+		return 0, err
+	}
+	return b.f.blockOffset(b.num) + int64(len(b.data)) + 1, nil
+}
+
+func (b *block) loadStored() error {
+	if b.f.blockStore == nil || len(b.rawBlock) < 1+sha256.Size {
+		return ErrInvalidFormat
+	}
+	digest := b.rawBlock[1 : 1+sha256.Size]
+	data, err := b.f.blockStore.Get(digest)
+	if err != nil {
+		return err
+	}
+	err = b.inflate(data)
+	if err != nil {
+		return b.corrupt(err)
+	}
+	if sum := sha256.Sum256(b.data); !bytes.Equal(sum[:], digest) {
+		return b.corrupt(ErrBlockMismatch)
+	}
+	return b.padShort()
+}
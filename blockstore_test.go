@@ -0,0 +1,72 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewDirStore(dir)
+
+	data := make([]byte, 3*4095+100)
+	rand.Read(data[:2*4095])
+	copy(data[3*4095:], data[:100])
+
+	var files [2]memSparseFile
+	for i := range files {
+		f, err := NewFromSparseFileOptions(&files[i], os.O_RDWR|os.O_CREATE, &Options{
+			BlockSize: 4096,
+			Store:     store,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i].Seek(0, os.SEEK_SET)
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two random blocks and the partial last one, the zero block is a hole
+	if len(blobs) != 3 {
+		t.Fatalf("Unexpected number of blobs: %d", len(blobs))
+	}
+
+	_, err = NewFromSparseFile(&files[0], os.O_RDONLY)
+	if err != ErrStoreRequired {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	files[0].Seek(0, os.SEEK_SET)
+	f, err := NewFromSparseFileOptions(&files[0], os.O_RDONLY, &Options{
+		Store: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Content differs")
+	}
+}
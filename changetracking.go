@@ -0,0 +1,257 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Change tracking keeps a table of 32-bit generation numbers, one per block, between the header
+// and the first block. Every time a block is stored (or punched, or truncated away) its entry is
+// set to the current generation. A backup tool calls Snapshot() after taking a backup and later
+// uses ChangedBlocks() with the returned number to find out what needs to be copied.
+
+const (
+	defMaxTrackedSize = 1024 * 1024 * 1024 * 1024
+)
+
+var (
+	ErrChangeTrackingDisabled = errors.New("Change tracking is not enabled for this file")
+)
+
+// BlockSize returns the size of a block. Block n covers the range [n*BlockSize(), (n+1)*BlockSize()).
+func (f *compFile) BlockSize() int64 {
+	return f.blockSize
+}
+
+// ChangeTracking returns true if the file maintains a per-block generation table.
+func (f *compFile) ChangeTracking() bool {
+	return f.features&featChangeTracking != 0
+}
+
+// Generation returns the current generation. Blocks modified from now on are tagged with it.
+func (f *compFile) Generation() uint32 {
+	f.Lock()
+	defer f.Unlock()
+	return f.generation
+}
+
+// Snapshot ends the current generation and returns its number. Blocks that are modified
+// afterwards are reported by ChangedBlocks(n).
+func (f *compFile) Snapshot() (uint32, error) {
+	f.Lock()
+	defer f.Unlock()
+	if !f.ChangeTracking() {
+		return 0, ErrChangeTrackingDisabled
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return 0, err
+	}
+	gen := f.generation
+	err = f.writeGeneration(gen + 1)
+	if err != nil {
+		return 0, err
+	}
+	return gen, nil
+}
+
+// ChangedBlocks returns the numbers of the blocks that have been modified since generation
+// since was ended by Snapshot(), in ascending order. ChangedBlocks(0) returns all blocks modified
+// since the file was created or the table was reset.
+func (f *compFile) ChangedBlocks(since uint32) ([]int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	if !f.ChangeTracking() {
+		return nil, ErrChangeTrackingDisabled
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	if o <= f.dataOffset {
+		return nil, nil
+	}
+	blocks := (o-f.dataOffset)/(f.blockSize+1) + 1
+
+	var changed []int64
+	var buf [BUFSIZE]byte
+	for num := int64(0); num < blocks && num < f.tableEntries; {
+		chunk := buf[:]
+		if remaining := (f.tableEntries - num) * 4; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := f.f.ReadAt(chunk, headerSize+num*4)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for i := n; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		for i := 0; i < len(chunk) && num < blocks; i += 4 {
+			if binary.LittleEndian.Uint32(chunk[i:]) > since {
+				changed = append(changed, num)
+			}
+			num++
+		}
+	}
+	for num := f.tableEntries; num < blocks; num++ {
+		changed = append(changed, num)
+	}
+	return changed, nil
+}
+
+// BlockGenerations returns the generation in which each of the blocks [from, to) was last
+// modified (0 if it hasn't been since the table was reset), so that external tools can keep
+// their own record and compare it later. Blocks past the end of the table (see
+// Options.MaxTrackedSize) are not tracked and are reported with the current generation.
+func (f *compFile) BlockGenerations(from, to int64) ([]uint32, error) {
+	f.Lock()
+	defer f.Unlock()
+	if !f.ChangeTracking() {
+		return nil, ErrChangeTrackingDisabled
+	}
+	if from < 0 || to < from {
+		return nil, os.ErrInvalid
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]uint32, 0, to-from)
+	var buf [BUFSIZE]byte
+	for num := from; num < to && num < f.tableEntries; {
+		chunk := buf[:]
+		if remaining := (f.tableEntries - num) * 4; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if remaining := (to - num) * 4; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := f.f.ReadAt(chunk, headerSize+num*4)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for i := n; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		for i := 0; i < len(chunk); i += 4 {
+			gens = append(gens, binary.LittleEndian.Uint32(chunk[i:]))
+			num++
+		}
+	}
+	for len(gens) < int(to-from) {
+		gens = append(gens, f.generation)
+	}
+	return gens, nil
+}
+
+// ResetChangeTracking clears the generation table and starts over from generation 1.
+func (f *compFile) ResetChangeTracking() error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.ChangeTracking() {
+		return ErrChangeTrackingDisabled
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+	err = f.punchHole(headerSize, f.tableEntries*4)
+	if err != nil {
+		return err
+	}
+	return f.writeGeneration(1)
+}
+
+func (f *compFile) flushBlock() error {
+	if f.block.dirty {
+		err := f.block.store(false)
+		if err != nil {
+			return err
+		}
+	}
+	return f.flushWriteBack()
+}
+
+func (f *compFile) writeGeneration(gen uint32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], gen)
+	_, err := f.f.WriteAt(buf[:], hdrGenerationOffset)
+	if err != nil {
+		return err
+	}
+	f.generation = gen
+	return nil
+}
+
+// markChanged sets the generation of blocks [from, to) to the current one.
+func (f *compFile) markChanged(from, to int64) error {
+	if !f.ChangeTracking() {
+		return nil
+	}
+	if to > f.tableEntries {
+		to = f.tableEntries
+	}
+	var buf [BUFSIZE]byte
+	for from < to {
+		n := (to - from) * 4
+		if n > BUFSIZE {
+			n = BUFSIZE
+		}
+		for i := int64(0); i < n; i += 4 {
+			binary.LittleEndian.PutUint32(buf[i:], f.generation)
+		}
+		_, err := f.f.WriteAt(buf[:n], headerSize+from*4)
+		if err != nil {
+			return err
+		}
+		from += n / 4
+	}
+	return nil
+}
+
+// markTruncated marks the blocks that disappear or appear when the file is truncated so that
+// blockNum becomes the last block. Such blocks read as zeroes afterwards, so they also stop
+// being read from the base.
+func (f *compFile) markTruncated(blockNum int64) error {
+	if !f.ChangeTracking() && f.base == nil && f.features&featDedup == 0 {
+		return nil
+	}
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	var last int64
+	if o > f.dataOffset {
+		last = (o - f.dataOffset) / (f.blockSize + 1)
+	}
+	if f.loaded && f.block.dirty && f.block.num > last {
+		// Not stored yet
+		last = f.block.num
+	}
+	from, to := last, blockNum
+	if last > blockNum {
+		from, to = blockNum+1, last+1
+		err = f.releaseRange(from, to)
+		if err != nil {
+			return err
+		}
+	} else if last < blockNum && o > f.dataOffset && !f.isPresent(last) {
+		// The current last block is about to be extended with zeroes, so it can't stay in the base
+		err = f.copyUp(last)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.markChanged(from, to)
+	if err != nil {
+		return err
+	}
+	return f.setPresent(from, to, true)
+}
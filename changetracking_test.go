@@ -0,0 +1,119 @@
+package spgz
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestChangeTracking(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize:      4096,
+		ChangeTracking: true,
+		MaxTrackedSize: 5 * 4095,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3*f.BlockSize())
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 1 {
+		t.Fatalf("Unexpected generation: %d", gen)
+	}
+
+	_, err = f.WriteAt(buf[:10], f.BlockSize()+5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Extends the file to 7 blocks, the last 2 are past the table
+	err = f.Truncate(6*f.BlockSize() + 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectChanged := func(since uint32, expected ...int64) {
+		changed, err := f.ChangedBlocks(since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changed, expected) {
+			t.Fatalf("ChangedBlocks(%d): %v, expected %v", since, changed, expected)
+		}
+	}
+
+	expectChanged(0, 0, 1, 2, 3, 4, 5, 6)
+	expectChanged(gen, 1, 3, 4, 5, 6)
+
+	gens, err := f.BlockGenerations(0, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gens, []uint32{1, 2, 1, 2, 2, 2, 2}) {
+		t.Fatalf("Unexpected generations: %v", gens)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = NewFromSparseFile(&sf, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.ChangeTracking() || f.Generation() != 2 {
+		t.Fatalf("Unexpected state after reopening: %v, %d", f.ChangeTracking(), f.Generation())
+	}
+	expectChanged(gen, 1, 3, 4, 5, 6)
+
+	gen, err = f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.PunchHole(0, f.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(2 * f.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChanged(gen, 0, 2)
+
+	err = f.ResetChangeTracking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Generation() != 1 {
+		t.Fatalf("Unexpected generation after reset: %d", f.Generation())
+	}
+	expectChanged(0)
+}
+
+func TestChangeTrackingDisabled(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFile(&sf, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sf.data[:8]) != headerMagic {
+		t.Fatal("Files without optional features must use the version 1 header")
+	}
+	_, err = f.ChangedBlocks(0)
+	if err != ErrChangeTrackingDisabled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package spgz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A checksum manifest lists the SHA-256 of every chunk of the logical content as comment lines,
+// followed by the digest of the whole content in the format of sha256sum, so that
+// `sha256sum -c` can check an extracted file or device (it ignores the comments), and
+// VerifyChecksums() can find out which chunks are damaged.
+//
+//  # spgz checksums, chunk size 1048576
+//  # <sha256> <offset> <length>
+//  ...
+//  <sha256>  <name>
+
+const (
+	checksumHeader = "# spgz checksums, chunk size "
+)
+
+var (
+	ErrInvalidManifest = errors.New("Invalid checksum manifest")
+)
+
+// WriteChecksums writes the checksum manifest of the first size bytes of r to w. name is the file
+// name in the last line.
+func WriteChecksums(w io.Writer, r io.ReaderAt, size, chunkSize int64, name string) error {
+	if chunkSize <= 0 {
+		return ErrInvalidOptions
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s%d\n", checksumHeader, chunkSize)
+	total := sha256.New()
+	chunk := sha256.New()
+	buf := make([]byte, 64*1024)
+	for off := int64(0); off < size; off += chunkSize {
+		l := chunkSize
+		if remaining := size - off; l > remaining {
+			l = remaining
+		}
+		chunk.Reset()
+		err := hashRange(io.MultiWriter(chunk, total), r, off, l, buf)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "# %x %d %d\n", chunk.Sum(nil), off, l)
+	}
+	if strings.ContainsAny(name, "\\\n") {
+		// Escaped the way sha256sum does it
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		bw.WriteByte('\\')
+	}
+	fmt.Fprintf(bw, "%x  %s\n", total.Sum(nil), name)
+	return bw.Flush()
+}
+
+// VerifyChecksums checks r against the chunk checksums in a manifest written by WriteChecksums()
+// and returns the offsets of the chunks that don't match.
+func VerifyChecksums(r io.ReaderAt, manifest io.Reader) ([]int64, error) {
+	s := bufio.NewScanner(manifest)
+	if !s.Scan() || !strings.HasPrefix(s.Text(), checksumHeader) {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidManifest
+	}
+	chunkSize, err := strconv.ParseInt(strings.TrimPrefix(s.Text(), checksumHeader), 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return nil, ErrInvalidManifest
+	}
+	var (
+		bad []int64
+		h   = sha256.New()
+		buf = make([]byte, 64*1024)
+	)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 4 || f[0] != "#" {
+			// The whole content line
+			continue
+		}
+		sum, err1 := hex.DecodeString(f[1])
+		off, err2 := strconv.ParseInt(f[2], 10, 64)
+		l, err3 := strconv.ParseInt(f[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || len(sum) != sha256.Size || l > chunkSize {
+			return nil, ErrInvalidManifest
+		}
+		h.Reset()
+		err := hashRange(h, r, off, l, buf)
+		if err == io.ErrUnexpectedEOF {
+			bad = append(bad, off)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(h.Sum(nil), sum) {
+			bad = append(bad, off)
+		}
+	}
+	return bad, s.Err()
+}
+
+func hashRange(h io.Writer, r io.ReaderAt, off, l int64, buf []byte) error {
+	for l > 0 {
+		b := buf
+		if int64(len(b)) > l {
+			b = b[:l]
+		}
+		n, err := r.ReadAt(b, off)
+		if n < len(b) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		h.Write(b)
+		off += int64(n)
+		l -= int64(n)
+	}
+	return nil
+}
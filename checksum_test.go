@@ -0,0 +1,43 @@
+package spgz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	var manifest bytes.Buffer
+	err := WriteChecksums(&manifest, bytes.NewReader(data), int64(len(data)), 4096, "disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(manifest.String(), "\n"), "\n")
+	if len(lines) != 5 || lines[0] != "# spgz checksums, chunk size 4096" {
+		t.Fatalf("Unexpected manifest: %q", manifest.String())
+	}
+	if expected := fmt.Sprintf("# %x 8192 1808", sha256.Sum256(data[8192:])); lines[3] != expected {
+		t.Fatalf("Unexpected chunk line: %q", lines[3])
+	}
+	// The last line is what sha256sum would print
+	if expected := fmt.Sprintf("%x  disk.img", sha256.Sum256(data)); lines[4] != expected {
+		t.Fatalf("Unexpected last line: %q", lines[4])
+	}
+
+	bad, err := VerifyChecksums(bytes.NewReader(data), bytes.NewReader(manifest.Bytes()))
+	if err != nil || len(bad) != 0 {
+		t.Fatalf("Verify: %v, %v", bad, err)
+	}
+	data[5000]++
+	bad, err = VerifyChecksums(bytes.NewReader(data[:9000]), bytes.NewReader(manifest.Bytes()))
+	if err != nil || !reflect.DeepEqual(bad, []int64{4096, 8192}) {
+		t.Fatalf("Verify: %v, %v", bad, err)
+	}
+}
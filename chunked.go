@@ -0,0 +1,467 @@
+package spgz
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A chunked archive is an alternative to the block format for backups. The input is split into
+// variable-size chunks at content-defined boundaries (a gear rolling hash), so inserting or
+// removing data only changes the chunks around the modification and the rest still deduplicate.
+// Identical chunks are stored once. The price is that a chunked archive is written sequentially
+// and cannot be modified afterwards.
+//
+// Layout: a 16 byte header, the gzip compressed chunks, the chunk index (one chunkEntry per
+// chunk in logical order) and a trailer pointing to the index.
+
+const (
+	chunkedMagic        = "SPGZCDC1"
+	chunkedTrailerMagic = "SPGZCDCI"
+	chunkedHeaderSize   = 16
+	chunkedTrailerSize  = 32
+
+	defAvgChunkSize = 1024 * 1024
+	minAvgChunkSize = 4096
+	maxAvgChunkSize = 16 * 1024 * 1024
+)
+
+// ChunkOptions control the creation of chunked archives. The zero value selects the defaults.
+type ChunkOptions struct {
+	// AvgChunkSize is the desired average chunk size, a power of 2 between 4KB and 16MB.
+	// Chunks are between a quarter and 4 times that size. Defaults to 1MB.
+	AvgChunkSize int64
+}
+
+type chunkedHeader struct {
+	Magic        [8]byte
+	AvgChunkSize uint32
+	Reserved     uint32
+}
+
+// chunkEntry describes a chunk, a PhysLength of 0 means the chunk is all zeroes.
+type chunkEntry struct {
+	PhysOffset uint64
+	PhysLength uint32
+	Length     uint32
+	Digest     [sha256.Size]byte
+}
+
+type chunkedTrailer struct {
+	IndexOffset uint64
+	Chunks      uint64
+	Size        uint64
+	Magic       [8]byte
+}
+
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64, the table must never change or the chunk boundaries would move
+	x := uint64(0x5350475a43444331)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type chunkWriter struct {
+	w      io.Writer
+	closer io.Closer
+
+	min, max int
+	mask     uint64
+
+	buf     []byte
+	scanned int
+	hash    uint64
+
+	pos   int64
+	size  int64
+	index []chunkEntry
+	seen  map[[sha256.Size]byte]int
+
+	comp   bytes.Buffer
+	z      *gzip.Writer
+	closed bool
+}
+
+// NewChunkWriter starts a chunked archive in w. The archive is not complete until Close() is
+// called.
+func NewChunkWriter(w io.Writer, opts *ChunkOptions) (*chunkWriter, error) {
+	avg := int64(defAvgChunkSize)
+	if opts != nil && opts.AvgChunkSize != 0 {
+		avg = opts.AvgChunkSize
+		if avg < minAvgChunkSize || avg > maxAvgChunkSize || avg&(avg-1) != 0 {
+			return nil, ErrInvalidOptions
+		}
+	}
+	h := chunkedHeader{
+		AvgChunkSize: uint32(avg),
+	}
+	copy(h.Magic[:], chunkedMagic)
+	err := binary.Write(w, binary.LittleEndian, &h)
+	if err != nil {
+		return nil, err
+	}
+	cw := &chunkWriter{
+		w:    w,
+		min:  int(avg / 4),
+		max:  int(avg * 4),
+		mask: uint64(avg - 1),
+		pos:  chunkedHeaderSize,
+		seen: make(map[[sha256.Size]byte]int),
+	}
+	cw.z = newGzipWriter(&cw.comp)
+	return cw, nil
+}
+
+// CreateChunked creates a chunked archive with the given name. flag is passed to os.OpenFile()
+// and must allow writing.
+func CreateChunked(name string, flag int, perm os.FileMode, opts *ChunkOptions) (*chunkWriter, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := NewChunkWriter(file, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	cw.closer = file
+	return cw, nil
+}
+
+func (w *chunkWriter) Write(buf []byte) (n int, err error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.buf = append(w.buf, buf...)
+	start := 0
+	for {
+		l := w.boundary(w.buf[start:])
+		if l < 0 {
+			break
+		}
+		err = w.writeChunk(w.buf[start : start+l])
+		if err != nil {
+			return 0, err
+		}
+		start += l
+	}
+	if start > 0 {
+		w.buf = w.buf[:copy(w.buf, w.buf[start:])]
+	}
+	return len(buf), nil
+}
+
+// boundary returns the length of the chunk at the start of buf or -1 if more data is needed to
+// find the end. The hash state is kept between calls.
+func (w *chunkWriter) boundary(buf []byte) int {
+	for ; w.scanned < len(buf); w.scanned++ {
+		w.hash = (w.hash << 1) + gearTable[buf[w.scanned]]
+		l := w.scanned + 1
+		if l >= w.max || l >= w.min && w.hash&w.mask == 0 {
+			w.scanned = 0
+			w.hash = 0
+			return l
+		}
+	}
+	return -1
+}
+
+func (w *chunkWriter) writeChunk(data []byte) error {
+	e := chunkEntry{
+		Length: uint32(len(data)),
+		Digest: sha256.Sum256(data),
+	}
+	if i, exists := w.seen[e.Digest]; exists {
+		e.PhysOffset = w.index[i].PhysOffset
+		e.PhysLength = w.index[i].PhysLength
+	} else if !IsBlockZero(data) {
+		w.comp.Reset()
+		w.z.Reset(&w.comp)
+		w.z.Write(data)
+		err := w.z.Close()
+		if err != nil {
+			return err
+		}
+		_, err = w.w.Write(w.comp.Bytes())
+		if err != nil {
+			return err
+		}
+		e.PhysOffset = uint64(w.pos)
+		e.PhysLength = uint32(w.comp.Len())
+		w.pos += int64(w.comp.Len())
+		w.seen[e.Digest] = len(w.index)
+	}
+	w.index = append(w.index, e)
+	w.size += int64(len(data))
+	return nil
+}
+
+// Close writes the remaining data and the index. If the archive was created by CreateChunked()
+// the file is closed as well.
+func (w *chunkWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	err := w.finish()
+	if w.closer != nil {
+		cerr := w.closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (w *chunkWriter) finish() error {
+	if len(w.buf) > 0 {
+		err := w.writeChunk(w.buf)
+		if err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	bw := bufio.NewWriter(w.w)
+	for i := range w.index {
+		err := binary.Write(bw, binary.LittleEndian, &w.index[i])
+		if err != nil {
+			return err
+		}
+	}
+	t := chunkedTrailer{
+		IndexOffset: uint64(w.pos),
+		Chunks:      uint64(len(w.index)),
+		Size:        uint64(w.size),
+	}
+	copy(t.Magic[:], chunkedTrailerMagic)
+	err := binary.Write(bw, binary.LittleEndian, &t)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type chunkedFile struct {
+	sync.Mutex
+	r      io.ReaderAt
+	closer io.Closer
+
+	index   []chunkEntry
+	offsets []int64 // logical offset of each chunk followed by the size
+	size    int64
+	offset  int64
+
+	cached   int
+	data     []byte
+	physData []byte
+	z        *gzip.Reader
+}
+
+// NewChunkedReader opens the chunked archive of the given physical size stored in r.
+func NewChunkedReader(r io.ReaderAt, size int64) (*chunkedFile, error) {
+	if size < chunkedHeaderSize+chunkedTrailerSize {
+		return nil, ErrInvalidFormat
+	}
+	var h chunkedHeader
+	err := binary.Read(io.NewSectionReader(r, 0, chunkedHeaderSize), binary.LittleEndian, &h)
+	if err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != chunkedMagic {
+		return nil, ErrInvalidFormat
+	}
+	var t chunkedTrailer
+	err = binary.Read(io.NewSectionReader(r, size-chunkedTrailerSize, chunkedTrailerSize), binary.LittleEndian, &t)
+	if err != nil {
+		return nil, err
+	}
+	entrySize := uint64(binary.Size(chunkEntry{}))
+	if string(t.Magic[:]) != chunkedTrailerMagic || t.IndexOffset < chunkedHeaderSize ||
+		t.Chunks > uint64(size)/entrySize || t.IndexOffset+t.Chunks*entrySize != uint64(size-chunkedTrailerSize) {
+		return nil, ErrInvalidFormat
+	}
+
+	f := &chunkedFile{
+		r:       r,
+		index:   make([]chunkEntry, t.Chunks),
+		offsets: make([]int64, t.Chunks+1),
+		cached:  -1,
+	}
+	ir := bufio.NewReader(io.NewSectionReader(r, int64(t.IndexOffset), int64(t.Chunks*entrySize)))
+	var pos int64
+	for i := range f.index {
+		e := &f.index[i]
+		err = binary.Read(ir, binary.LittleEndian, e)
+		if err != nil {
+			return nil, err
+		}
+		if e.Length == 0 || e.PhysLength != 0 && (e.PhysOffset < chunkedHeaderSize ||
+			e.PhysOffset+uint64(e.PhysLength) > t.IndexOffset) {
+			return nil, ErrInvalidFormat
+		}
+		f.offsets[i] = pos
+		pos += int64(e.Length)
+	}
+	if pos != int64(t.Size) {
+		return nil, ErrInvalidFormat
+	}
+	f.offsets[len(f.index)] = pos
+	f.size = pos
+	return f, nil
+}
+
+// OpenChunked opens a chunked archive for reading. ErrInvalidFormat is returned if the file is
+// not a chunked archive.
+func OpenChunked(name string) (*chunkedFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f, err := NewChunkedReader(file, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.closer = file
+	return f, nil
+}
+
+// Size returns the size of the original data.
+func (f *chunkedFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+// Chunks returns the number of chunks and the number of distinct chunks that are stored.
+func (f *chunkedFile) Chunks() (total, stored int) {
+	seen := make(map[uint64]struct{})
+	for i := range f.index {
+		if f.index[i].PhysLength != 0 {
+			seen[f.index[i].PhysOffset] = struct{}{}
+		}
+	}
+	return len(f.index), len(seen)
+}
+
+func (f *chunkedFile) load(i int) error {
+	if f.cached == i {
+		return nil
+	}
+	e := &f.index[i]
+	if cap(f.data) < int(e.Length) {
+		f.data = make([]byte, e.Length)
+	}
+	f.data = f.data[:e.Length]
+	f.cached = -1
+	if e.PhysLength == 0 {
+		for j := range f.data {
+			f.data[j] = 0
+		}
+		f.cached = i
+		return nil
+	}
+
+	if cap(f.physData) < int(e.PhysLength) {
+		f.physData = make([]byte, e.PhysLength)
+	}
+	f.physData = f.physData[:e.PhysLength]
+	_, err := f.r.ReadAt(f.physData, int64(e.PhysOffset))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if f.z == nil {
+		f.z, err = gzip.NewReader(bytes.NewReader(f.physData))
+	} else {
+		err = f.z.Reset(bytes.NewReader(f.physData))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(f.z, f.data)
+	if err != nil {
+		return ErrInvalidFormat
+	}
+	f.cached = i
+	return nil
+}
+
+func (f *chunkedFile) readAt(buf []byte, offset int64) (n int, err error) {
+	for n < len(buf) {
+		if offset >= f.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(f.index), func(i int) bool {
+			return f.offsets[i+1] > offset
+		})
+		err = f.load(i)
+		if err != nil {
+			return
+		}
+		c := copy(buf[n:], f.data[offset-f.offsets[i]:])
+		n += c
+		offset += int64(c)
+	}
+	return
+}
+
+func (f *chunkedFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.readAt(buf, offset)
+}
+
+func (f *chunkedFile) Read(buf []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	n, err = f.readAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (f *chunkedFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch whence {
+	case os.SEEK_SET:
+		f.offset = offset
+		return f.offset, nil
+	case os.SEEK_CUR:
+		f.offset += offset
+		return f.offset, nil
+	case os.SEEK_END:
+		f.offset = f.size + offset
+		return f.offset, nil
+	}
+	return f.offset, os.ErrInvalid
+}
+
+func (f *chunkedFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func writeChunked(t *testing.T, data ...[]byte) *chunkedFile {
+	var buf bytes.Buffer
+	w, err := NewChunkWriter(&buf, &ChunkOptions{AvgChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range data {
+		_, err = w.Write(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewChunkedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestChunked(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.Read(data)
+	zeroes := make([]byte, 50000)
+	shifted := append([]byte("inserted"), data...)
+
+	f := writeChunked(t, data[:1000], data[1000:], zeroes, shifted)
+	expected := append(append(append([]byte(nil), data...), zeroes...), shifted...)
+
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(expected)) {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatal("Content differs")
+	}
+
+	buf := make([]byte, 10000)
+	_, err = f.ReadAt(buf, 123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected[123456:133456]) {
+		t.Fatal("ReadAt content differs")
+	}
+
+	// Apart from the chunks around the insertion the shifted copy should be deduplicated
+	total, stored := f.Chunks()
+	if stored > total/2+5 {
+		t.Fatalf("Poor deduplication: %d of %d chunks stored", stored, total)
+	}
+}
+
+func TestChunkedEmpty(t *testing.T) {
+	f := writeChunked(t)
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+}
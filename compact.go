@@ -0,0 +1,61 @@
+package spgz
+
+import (
+	"os"
+)
+
+// Compact releases the space in the file that doesn't hold data: slots of zeroes are punched out
+// entirely and compressed slots after the end of the compressed data. Normally that space is
+// released when a block is stored, but it can remain allocated if punching a hole failed or the
+// file was copied by a tool that doesn't preserve holes. The content, the stored form of the
+// blocks and the generations of change tracking are not changed. Blocks shared with others
+// (see dedup.go), kept in a block store or read from the base are skipped.
+func (f *compFile) Compact() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.compact()
+}
+
+func (f *compFile) compact() error {
+	if f.readOnly {
+		return os.ErrPermission
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+	size, err := f.size()
+	if err != nil {
+		return err
+	}
+	b := &block{
+		f: f,
+	}
+	buf := make([]byte, f.blockSize+1)
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	for num := int64(0); num < blocks; num++ {
+		if !f.isPresent(num) || f.slotOf(num) != num || f.shadow != nil && f.shadow.num == num {
+			continue
+		}
+		typ, hole, err := f.slotType(num, buf)
+		if err != nil {
+			return err
+		}
+		b.num = num
+		switch {
+		case hole:
+			if num < blocks-1 {
+				err = b.writeImage(nil, f.blockSize+1)
+			}
+		case typ == blkCompressed:
+			err = b.load(num)
+			if err == nil {
+				err = b.trimSlot(f.blockOffset(num)+b.physSize, false)
+			}
+		}
+		if err != nil {
+			return b.wrapErr("store", err)
+		}
+	}
+	return f.autoSync()
+}
@@ -0,0 +1,87 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "compact.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{ChangeTracking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 3*bs+100)
+	copy(data, bytes.Repeat([]byte("compact"), int(bs)/7))
+	copy(data[2*bs:], bytes.Repeat([]byte("more"), int(bs)/4))
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := f.ReadBlockRaw(0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the slack of the compressed slot 0 and write slot 1 (a hole) out as zeroes
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := f.blockOffset(0) + 1 + int64(len(raw))
+	_, err = file.WriteAt(bytes.Repeat([]byte{0xff}, int(f.blockOffset(1)-end)), end)
+	if err == nil {
+		_, err = file.WriteAt(make([]byte, bs+1), f.blockOffset(1))
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Allocated >= 0 && after.Allocated > before.Allocated-bs {
+		t.Fatalf("Not enough space released: %d -> %d", before.Allocated, after.Allocated)
+	}
+	if changed, err := f.ChangedBlocks(gen); err != nil || len(changed) != 0 {
+		t.Fatalf("Unexpected changes: %v, %v", changed, err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data mismatch")
+	}
+}
@@ -3,16 +3,39 @@ package spgz
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"io"
+	"log/slog"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	headerMagic = "SPGZ0001"
-	headerSize  = 4096
+	headerMagic   = "SPGZ0001"
+	headerMagicV2 = "SPGZ0002"
+	headerSize    = 4096
+)
+
+// Features recorded in a version 2 header
+const (
+	featChangeTracking uint32 = 1 << iota
+	featBase
+	featDiff
+	featDedup
+	featStore
+	featCopyOnRead
+	featJournal
+	featShadow
+	featExactBlockSize
+
+	knownFeatures = featChangeTracking | featBase | featDiff | featDedup | featStore | featCopyOnRead |
+		featJournal | featShadow | featExactBlockSize
 )
 
 const (
@@ -22,11 +45,205 @@ const (
 const (
 	blkUncompressed byte = iota
 	blkCompressed
+	blkStored
 )
 
 var (
 	ErrInvalidFormat         = errors.New("Invalid file format")
 	ErrFileIsDirectory       = errors.New("File cannot be a directory")
+	ErrUnsupportedFeatures   = errors.New("File uses unsupported features")
+	ErrInvalidOptions        = errors.New("Invalid options")
+	ErrWriteAtInAppendMode   = errors.New("WriteAt is not allowed in append mode")
+	ErrNegativeOffset        = errors.New("Negative offset")
+	ErrOffsetTooLarge        = errors.New("Offset is too large")
+)
+
+// Options control the creation of new files, they are ignored when an existing file is opened.
+// The zero value selects the defaults.
+type Options struct {
+	// BlockSize is the size of a block. Defaults to 128KB, which is also used if it's less than
+	// 4096. A size that is not a multiple of 4096 is recorded in a version 2 header, such files
+	// can't be opened by versions of this package that only support multiples of 4096.
+	BlockSize int64
+
+	// ChangeTracking enables the per-block generation table, see ChangedBlocks().
+	ChangeTracking bool
+
+	// MaxTrackedSize is the size up to which changes are tracked per block. Blocks beyond it
+	// are always reported as changed and are not deduplicated. Defaults to 1TB.
+	MaxTrackedSize int64
+
+	// Dedup stores identical blocks only once, see dedup.go. It cannot be combined with Base or
+	// Parent.
+	Dedup bool
+
+	// Store keeps the data of the blocks in a content-addressable block store instead of the
+	// file, see blockstore.go. Like Base it must also be supplied when opening such a file.
+	Store BlockStore
+
+	// Base makes a new file a differential archive which only stores the blocks that differ from
+	// the corresponding blocks of Base, see diff.go. Unlike the other options it must also be
+	// supplied when opening an existing differential archive. Only its size is checked then, a
+	// different base of the same size is not detected unless VerifyBase() is called.
+	Base Base
+
+	// Parent makes a new file an overlay of the named spgz file, see overlay.go. A relative path
+	// is relative to the directory of the overlay.
+	Parent string
+
+	// Source makes a new file a copy-on-read cache of a raw file, block device or http(s) URL,
+	// see copyonread.go. Like Parent it is recorded in the file and opened automatically.
+	Source string
+
+	// CopyOnRead makes a file created with Base or Parent store the blocks that are read from
+	// them, so that they are only read once. With Base the file is not a differential archive:
+	// it starts with the whole content of the base.
+	CopyOnRead bool
+
+	// ConcurrentReads lets ReadAt run without locking the file, see concurrent.go. It requires
+	// the file to be opened read-only and, like Base, applies when an existing file is opened.
+	ConcurrentReads bool
+
+	// BlockCache is shared by the handles of files opened with OpenShared (and ignored otherwise),
+	// see BlockCache.
+	BlockCache *BlockCache
+
+	// Mmap makes a file opened read-only decompress the blocks straight from a memory mapping of
+	// it, see mmap.go. Where the file can't be mapped it's read as usual.
+	Mmap bool
+
+	// WriteBack is the number of modified blocks that are kept in memory and stored in the
+	// background, see writeback.go. It applies when an existing file is opened. Defaults to 0,
+	// i.e. a modified block is stored as soon as another block is accessed.
+	WriteBack int
+
+	// WriteBackDelay defers the background stores until a block hasn't been modified for this
+	// long, see writeback.go. Unlike WriteBack it also applies to the current block.
+	WriteBackDelay time.Duration
+
+	// Journal makes every write into a block's slot go through a write-ahead record, so that
+	// a block that was being written during a crash is completed when the file is next opened,
+	// see journal.go.
+	Journal bool
+
+	// AtomicReplace is an alternative to Journal: a block is written into a scratch slot first
+	// and committed by a pointer to it, so that either version of the block survives a crash and
+	// readers that open the file read-only after a crash see the committed one. See shadow.go.
+	AtomicReplace bool
+
+	// RepairTail makes opening an existing file for writing remove a final block that cannot be
+	// decoded (e.g. because a crash interrupted its write) instead of failing with ErrTornTail.
+	RepairTail bool
+
+	// Logger is the logger the file starts with, so that the events that happen while it's
+	// opened (e.g. the removal of a damaged final block with RepairTail) are logged as well, see
+	// SetLogger().
+	Logger *slog.Logger
+
+	// SyncEvery and SyncInterval make the file call Sync on the underlying file after this many
+	// blocks have been stored or when a block is stored this long after the last sync, so that
+	// long streams of writes bound the amount of data lost on a crash. They apply when an
+	// existing file is opened. 0 disables them.
+	SyncEvery    int
+	SyncInterval time.Duration
+
+	// Preallocate makes the whole slot of a block allocated when the block is first written, before
+	// the rest of the slot is punched out, so that the data of the file stays in fewer extents under
+	// random writes, see prealloc.go.
+	Preallocate bool
+
+	// SkipUnchanged makes a block that is stored with the same bytes its slot already holds not
+	// be written, at the cost of reading the slot first, see unchanged.go.
+	SkipUnchanged bool
+
+	// CompactThreshold makes Sync and Close compact the file when the space allocated for it
+	// exceeds this percentage (e.g. 150) of what its data needs, see autocompact.go. It applies
+	// when an existing file is opened. 0 disables it.
+	CompactThreshold int
+
+	// ReadChunkSize and WriteChunkSize limit the size of the reads ReadFrom() makes from its
+	// source and set the size of the writes WriteTo() makes to its destination (smaller writes
+	// are combined), see stream.go. 0 means a block (or what's left of it) at a time.
+	ReadChunkSize  int
+	WriteChunkSize int
+
+	// PipelineDepth is the number of blocks WriteTo() reads and decompresses in the background
+	// while the previous ones are being written, see stream.go. 0 disables it.
+	PipelineDepth int
+
+	// CompressJobs is the number of goroutines ReadFrom() compresses blocks with, see
+	// parallel.go. 0 or 1 compresses each block in the calling goroutine when it's stored.
+	CompressJobs int
+
+	// RawBackoff makes the file sample the blocks before compressing them once this many blocks in
+	// a row have been stored raw because they don't compress, see backoff.go. With Reproducible it
+	// disables CompressJobs. 0 disables it.
+	RawBackoff int
+
+	// MemoryLimit bounds the memory (in bytes) used for the blocks kept in memory by reducing
+	// WriteBack, PipelineDepth and CompressJobs as needed, see memlimit.go. 0 means no limit.
+	MemoryLimit int64
+
+	// SegmentSize makes OpenFileOptions() store the file in segments of this size named
+	// <name>.000, <name>.001 etc., see segment.go. An existing segmented file is opened as such
+	// regardless (if <name> itself does not exist) and its own segment size is used.
+	// SegmentParity and SegmentStripe enable erasure coding across the segments of a new file,
+	// see SegmentOptions.
+	SegmentSize   int64
+	SegmentParity int
+	SegmentStripe int
+
+	// Creator and Comment are recorded in the header of a new file, see creator.go. Creator
+	// defaults to the name and the version of the library.
+	Creator string
+	Comment string
+
+	// Reproducible leaves the creation time and the host name out of the header of a new file, so
+	// that writing the same data produces an identical file (blocks are always compressed with
+	// fixed parameters, see newGzipWriter()).
+	Reproducible bool
+
+	// Xattrs are extended attributes (e.g. of the source, see GetXattrs()) to record in the header
+	// of a new file, see xattr.go.
+	Xattrs map[string][]byte
+
+	// FileAttrs are the ownership, the mode and the timestamps (e.g. of the source, see
+	// GetFileAttrs()) to record in the header of a new file, see fileattrs.go.
+	FileAttrs *FileAttrs
+
+	// Parity enables parity records which allow Repair() to reconstruct damaged slots, see
+	// parity.go. They are kept in this file (which is not closed with the file). An empty file is
+	// initialised with ParityGroup slots per group (16 if 0) and ParityShards parity shards per
+	// group (2 if 0), otherwise the values it was created with are used. Like Base, it should be
+	// supplied every time the file is opened for writing or the parity will be recomputed.
+	Parity       SparseFile
+	ParityGroup  int
+	ParityShards int
+}
+
+// headerV2 is used when any of the optional features are enabled. The blocks start at DataOffset
+// rather than right after the header, the space in between is used by the features.
+type headerV2 struct {
+	Magic      [8]byte
+	BlockSize  uint32 // in 4096 units, rounded up
+	Features   uint32
+	DataOffset uint64
+	Generation uint32
+
+	// The block size in bytes if it's not a multiple of 4096 (featExactBlockSize)
+	ExactBlockSize uint32
+
+	// Number of entries in the change tracking table
+	TrackedBlocks uint64
+
+	// Location and number of entries of the present block map and the size of the base, see diff.go
+	MapOffset uint64
+	MapBlocks uint64
+	BaseSize  uint64
+}
+
+const (
+	hdrGenerationOffset = 24
 )
 
 type block struct {
@@ -35,17 +252,124 @@ type block struct {
 	data                []byte
 	rawBlock, dataBlock []byte
 	blockIsRaw          bool
+	mapped              bool // rawBlock is a slice of f.mapping, see mmap.go
 	dirty               bool
+	image               []byte // compressed in advance, see parallel.go
+	preallocated        bool   // the slot was allocated before storing, see prealloc.go
+	unchanged           bool   // the slot already held the image, see unchanged.go
+
+	// physSize is the number of bytes the block takes on disk (or in the block store), as of the
+	// last load or store. It's approximate for compressed blocks that have been loaded.
+	physSize int64
 }
 
 type compFile struct {
 	sync.Mutex
 	f         SparseFile
+	name      string
+	readOnly  bool
 	blockSize int64
 	block     block
 	loaded    bool
 
+	dataOffset int64
+	features   uint32
+	version    int // of the format, 1 or 2
+
+	// change tracking, see changetracking.go
+	generation   uint32
+	tableEntries int64
+
+	// header metadata records, see metadata.go
+	meta map[uint16][]byte
+
+	// block deduplication, see dedup.go
+	dedupOffset  int64
+	dedupEntries int64
+	digests      map[int64][sha256.Size]byte
+	owners       map[[sha256.Size]byte]int64
+	links        map[int64]int64
+	refs         map[int64][]int64
+
+	// see blockstore.go
+	blockStore BlockStore
+
+	// see progress.go
+	progress ProgressFunc
+
+	// see logging.go and metrics.go
+	log     *slog.Logger
+	metrics *Metrics
+
+	// see tracing.go
+	tracer Tracer
+
+	// see concurrent.go
+	concurrentReads bool
+
+	// see mmap.go
+	mapping []byte
+	snapshot        atomic.Pointer[snapshot]
+
+	// see writeback.go
+	writeBack *writeBack
+
+	// see journal.go
+	journalOffset  int64
+	journalPending bool
+	shadow         *shadowSlot
+
+	// see stream.go
+	readChunk, writeChunk, pipelineDepth int
+
+	// see parallel.go
+	compressJobs     int
+	compressInFlight int
+
+	// see parity.go
+	parity *parity
+
+	// see autosync.go
+	syncEvery    int
+	syncInterval time.Duration
+	unsynced     int
+	lastSync     time.Time
+	syncing      bool
+
+	// see autocompact.go
+	compactThreshold int
+	lastIdeal        int64
+
+	// see prealloc.go
+	preallocate bool
+
+	// see unchanged.go
+	skipUnchanged bool
+	compareBuf    []byte
+
+	// see backoff.go
+	rawBackoff int
+	rawRun     atomic.Int64
+
+	// see blockcache.go
+	cache  *BlockCache
+	cached *cachedFile
+
+	// base and present block map, see diff.go
+	base      Base
+	ownBase   bool
+	baseSize  int64
+	mapOffset int64
+	mapBlocks int64
+	present   []byte
+	baseBuf   []byte
+
 	offset int64
+	// opened with os.O_APPEND: every Write and ReadFrom starts at the end of the file
+	append bool
+
+	// set by Close, after that the methods return os.ErrClosed
+	closed atomic.Bool
 }
 
 func (b *block) init(f *compFile) {
@@ -54,20 +378,24 @@ func (b *block) init(f *compFile) {
 	b.blockIsRaw = false
 }
 
-func (b *block) load(num int64) error {
+func (b *block) load(num int64) (err error) {
 	// log.Printf("Loading block %d", num)
 	b.num = num
-	if b.rawBlock == nil {
-		b.rawBlock = make([]byte, b.f.blockSize+1)
-	} else {
-		b.rawBlock = b.rawBlock[:b.f.blockSize+1]
-	}
-
+	b.physSize = 0
+	span := b.f.startSpan("load", num)
+	defer func() {
+		endLoadSpan(span, err)
+	}()
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = b.wrapErr("load", err)
+		}
+	}()
 	if b.dataBlock == nil {
 		b.dataBlock = make([]byte, b.f.blockSize)
 	}
 
-	n, err := b.f.f.ReadAt(b.rawBlock, headerSize+num*(b.f.blockSize+1))
+	n, err := b.readSlot(num)
 	if err != nil {
 		if err == io.EOF {
 			if n > 0 {
@@ -86,12 +414,25 @@ func (b *block) load(num int64) error {
 		}
 	}
 
+	if !b.f.isPresent(num) {
+		err = b.loadBase(n - 1)
+		if err == nil && b.f.features&featCopyOnRead != 0 && !b.f.readOnly {
+			err = b.populate()
+		}
+		return err
+	}
+
 	switch b.rawBlock[0] {
 	case blkUncompressed:
 		b.data = b.rawBlock[1:]
 		b.blockIsRaw = true
+		b.physSize = int64(len(b.rawBlock))
 	case blkCompressed:
 		err = b.loadCompressed()
+	case blkStored:
+		err = b.loadStored()
+	default:
+		err = b.corrupt(ErrInvalidFormat)
 	}
 	b.dirty = false
 	// log.Printf("Loaded, size %d\n", len(b.data))
@@ -99,9 +440,41 @@ func (b *block) load(num int64) error {
 
 }
 
+// readSlot reads the slot of block num into b.rawBlock (or makes it a slice of the mapping).
+func (b *block) readSlot(num int64) (n int, err error) {
+	slot := b.f.slotOf(num)
+	s := b.f.shadow
+	if end := b.f.blockOffset(slot) + b.f.blockSize + 1; end <= int64(len(b.f.mapping)) && (s == nil || s.num != slot) {
+		b.rawBlock = b.f.mapping[b.f.blockOffset(slot):end:end]
+		b.mapped = true
+		return len(b.rawBlock), nil
+	}
+	if b.rawBlock == nil || b.mapped {
+		b.rawBlock = make([]byte, b.f.blockSize+1)
+		b.mapped = false
+	} else {
+		b.rawBlock = b.rawBlock[:b.f.blockSize+1]
+	}
+	if s != nil && s.num == slot {
+		return s.read(b.rawBlock)
+	}
+	return b.f.f.ReadAt(b.rawBlock, b.f.blockOffset(slot))
+}
+
 func (b *block) loadCompressed() error {
 	// log.Println("Block is compressed")
-	z, err := gzip.NewReader(bytes.NewBuffer(b.rawBlock[1:]))
+	err := b.inflate(b.rawBlock[1:])
+	if err != nil {
+		return b.corrupt(err)
+	}
+	b.physSize++
+	return b.padShort()
+}
+
+// inflate decompresses gzip data into the block.
+func (b *block) inflate(src []byte) error {
+	r := bytes.NewBuffer(src)
+	z, err := gzip.NewReader(r)
 	if err != nil {
 		return err
 	}
@@ -109,20 +482,25 @@ func (b *block) loadCompressed() error {
 
 	buf := bytes.NewBuffer(b.dataBlock[:0])
 
-	_, err = io.Copy(buf, z)
+	_, err = io.Copy(buf, io.LimitReader(z, b.f.blockSize))
 	if err != nil {
 		return err
 	}
 	b.data = buf.Bytes()
 	b.blockIsRaw = false
+	b.physSize = int64(len(src) - r.Len())
+	return nil
+}
 
+// padShort pads a short block with zeroes unless it's the last one.
+func (b *block) padShort() error {
 	l := int64(len(b.data))
 	if l < b.f.blockSize {
 		o, err := b.f.f.Seek(0, os.SEEK_END)
 		if err != nil {
 			return err
 		}
-		lastBlockNum := (o - headerSize) / (b.f.blockSize + 1)
+		lastBlockNum := (o - b.f.dataOffset) / (b.f.blockSize + 1)
 		if lastBlockNum > b.num {
 			b.data = b.data[:b.f.blockSize]
 			for i := l; i < b.f.blockSize; i++ {
@@ -134,66 +512,133 @@ func (b *block) loadCompressed() error {
 	return nil
 }
 
-func (b *block) store(truncate bool) (err error) {
+func (b *block) store(truncate bool) error {
+	return b.storeBlock(truncate, false)
+}
+
+// storeBlock stores the block. If zero is true the caller has already established that the block
+// consists entirely of zeroes and it's recorded as a hole without any further checks.
+func (b *block) storeBlock(truncate, zero bool) (err error) {
 	// log.Printf("Storing block %d", b.num)
+	span := b.f.startSpan("store", b.num)
+	defer func() {
+		span.End(err)
+	}()
+	defer func() {
+		if err != nil {
+			err = b.wrapErr("store", err)
+		}
+	}()
 
 	var curOffset int64
+	b.physSize = 0
 
-	if len(b.data) == 0 {
-		curOffset = headerSize + b.num*(b.f.blockSize+1)
-	} else if IsBlockZero(b.data) {
-		// log.Println("Block is all zeroes")
-		err = b.f.f.PunchHole(headerSize+b.num*(b.f.blockSize+1), int64(len(b.data))+1)
+	err = b.f.markChanged(b.num, b.num+1)
+	if err != nil {
+		return err
+	}
+
+	err = b.f.release(b.num)
+	if err != nil {
+		return err
+	}
+
+	var inBase, dedup bool
+	var digest [sha256.Size]byte
+	owner := int64(-1)
+	if !zero {
+		inBase, err = b.matchesBase()
 		if err != nil {
 			return err
 		}
-		curOffset = headerSize + b.num*(b.f.blockSize+1) + int64(len(b.data)) + 1
-	} else {
-		b.prepareWrite()
-
-		buf := bytes.NewBuffer(b.rawBlock[:0])
-
-		reader := bytes.NewBuffer(b.data)
-
-		buf.WriteByte(blkCompressed)
+		dedup, digest, owner = b.dedup(inBase)
+	}
 
-		w := gzip.NewWriter(buf)
-		_, err = io.Copy(w, reader)
+	if len(b.data) == 0 {
+		curOffset = b.f.blockOffset(b.num)
+	} else if inBase {
+		// The block will be read from the base
+		err = b.f.setPresent(b.num, b.num+1, false)
 		if err != nil {
 			return err
 		}
-		err = w.Close()
+		err = b.writeImage(nil, int64(len(b.data))+1)
 		if err != nil {
 			return err
 		}
-		bb := buf.Bytes()
-		n := len(bb)
-		if n+1 < len(b.data)-2*4096 { // save at least 2 blocks
-			// log.Printf("Storing compressed, size %d\n", n - 1)
-			_, err = b.f.f.WriteAt(bb, headerSize+b.num*(b.f.blockSize+1))
-			if err != nil {
-				return err
+		curOffset = b.f.blockOffset(b.num) + int64(len(b.data)) + 1
+	} else if owner >= 0 {
+		// The block shares the slot of an identical one
+		err = b.writeImage(nil, int64(len(b.data))+1)
+		if err != nil {
+			return err
+		}
+		curOffset = b.f.blockOffset(b.num) + int64(len(b.data)) + 1
+	} else if zero || IsBlockZero(b.data) {
+		// log.Println("Block is all zeroes")
+		b.unchanged, err = b.keepSlot(nil, int64(len(b.data))+1)
+		if err == nil && !b.unchanged {
+			err = b.writeImage(nil, int64(len(b.data))+1)
+			if m := b.f.metrics; m != nil && err == nil {
+				m.BlocksHole.Add(1)
 			}
-
-			curOffset = headerSize + b.num*(b.f.blockSize+1) + int64(n)
-		} else {
-			// log.Println("Storing uncompressed")
-			buf.Reset()
-			buf.WriteByte(blkUncompressed)
-			buf.Write(b.data)
-			_, err = b.f.f.WriteAt(buf.Bytes(), headerSize+b.num*(b.f.blockSize+1))
-			curOffset = headerSize + b.num*(b.f.blockSize+1) + int64(len(b.data)) + 1
 		}
+		if err != nil {
+			return err
+		}
+		curOffset = b.f.blockOffset(b.num) + int64(len(b.data)) + 1
+	} else if b.f.blockStore != nil {
+		curOffset, err = b.writeStored()
+	} else {
+		if b.f.preallocate {
+			b.preallocated = b.f.preallocateSlot(b.num)
+		}
+		curOffset, err = b.writeSlot()
 	}
 
 	if err != nil {
 		return err
 	}
 
+	if dedup {
+		err = b.f.addDedup(b.num, digest, owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !inBase {
+		err = b.f.setPresent(b.num, b.num+1, true)
+		if err != nil {
+			return err
+		}
+	}
+
 	b.dirty = false
+	unchanged := b.unchanged
+	b.unchanged = false
+	if unchanged && !truncate {
+		// The slot holds the same data, see unchanged.go. A truncating store still has to cut
+		// off the blocks that follow.
+		return nil
+	}
+	b.f.invalidateCache()
+	defer func() {
+		if err == nil {
+			err = b.f.autoSync()
+		}
+	}()
 
+	return b.trimSlot(curOffset, truncate)
+}
+
+// trimSlot makes the data of the block's slot end at curOffset: the file is truncated there if
+// truncate is set or if it's the last slot, otherwise the rest of the slot is punched out.
+func (b *block) trimSlot(curOffset int64, truncate bool) (err error) {
+	preallocated := b.preallocated
+	b.preallocated = false
 	if truncate {
-		err = b.f.f.Truncate(curOffset)
+		err = b.f.truncateFile(curOffset)
 	} else {
 		var o int64
 		o, err = b.f.f.Seek(0, os.SEEK_END)
@@ -201,21 +646,120 @@ func (b *block) store(truncate bool) (err error) {
 			return err
 		}
 		if o < curOffset {
-			err = b.f.f.Truncate(curOffset)
+			err = b.f.truncateFile(curOffset)
 		} else if o > curOffset {
-			endOfBlock := headerSize+(b.num+1)*(b.f.blockSize+1)
+			endOfBlock := b.f.blockOffset(b.num + 1)
 			if o < endOfBlock {
-				err = b.f.f.Truncate(curOffset)
+				err = b.f.truncateFile(curOffset)
 			}
 			if holesize := endOfBlock - curOffset; holesize > 0 {
-				err = b.f.f.PunchHole(curOffset, endOfBlock - curOffset)
+				err = b.f.punchHole(curOffset, endOfBlock - curOffset)
 			}
+		} else if preallocated {
+			// The rest of the slot is past the end of the file, but it's still allocated. Holes
+			// can't be punched there, truncating releases it.
+			err = b.f.truncateFile(curOffset)
 		}
 	}
 
 	return
 }
 
+// writeSlot compresses the block (if it's worth it) and writes it into its slot. It returns the
+// offset of the end of the written data. If the block has been compressed already (see
+// parallel.go), that image is written.
+func (b *block) writeSlot() (curOffset int64, err error) {
+	image := b.image
+	b.image = nil
+	if image == nil {
+		b.prepareWrite()
+		image, err = b.compress(b.rawBlock[:0])
+		if err != nil {
+			return
+		}
+	}
+	m := b.f.metrics
+	curOffset = b.f.blockOffset(b.num) + int64(len(image))
+	b.physSize = int64(len(image))
+	b.f.countRaw(image[0] != blkCompressed)
+	b.unchanged, err = b.keepSlot(image, 0)
+	if err != nil || b.unchanged {
+		return
+	}
+	err = b.writeImage(image, 0)
+	if image[0] == blkCompressed {
+		if m != nil {
+			m.BlocksCompressed.Add(1)
+		}
+	} else {
+		if b.f.log != nil {
+			b.f.log.Debug("spgz: block does not compress, storing raw", "file", b.f.name, "block", b.num)
+		}
+		if m != nil {
+			m.BlocksRaw.Add(1)
+		}
+	}
+	if m != nil && err == nil {
+		m.BytesWritten.Add(b.physSize)
+	}
+	return
+}
+
+// compress returns the image of the block's slot in buf (which is grown if necessary): the
+// compressed data or, if that doesn't save at least 2 pages, the raw data. It doesn't modify the
+// block, so blocks can be compressed concurrently.
+func (b *block) compress(buf []byte) (image []byte, err error) {
+	start := time.Now()
+	span := b.f.startSpan("compress", b.num)
+	if b.f.backingOff() && !sampleCompresses(b.data) {
+		// See backoff.go
+		image = rawImage(buf, b.data)
+	} else {
+		image, err = compressImage(buf, b.data)
+	}
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	if m := b.f.metrics; m != nil {
+		m.CompressTime.Observe(time.Since(start))
+	}
+	return image, nil
+}
+
+// compressImage returns the content of the slot for data, compressed unless that doesn't save
+// enough. buf is used if it's large enough.
+func compressImage(buf, data []byte) ([]byte, error) {
+	w := bytes.NewBuffer(buf[:0])
+	w.WriteByte(blkCompressed)
+	z := newGzipWriter(w)
+	_, err := z.Write(data)
+	if err == nil {
+		err = z.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.Len()+1 < len(data)-2*4096 { // save at least 2 blocks
+		return w.Bytes(), nil
+	}
+	w.Reset()
+	w.WriteByte(blkUncompressed)
+	w.Write(data)
+	return w.Bytes(), nil
+}
+
+// newGzipWriter returns a gzip writer with the compression level and the header fields pinned, so
+// that the same data always compresses to the same bytes (with a given version of compress/flate),
+// regardless of when and where it's done.
+func newGzipWriter(w io.Writer) *gzip.Writer {
+	z, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	z.Header = gzip.Header{
+		OS: 255, // unknown
+	}
+	return z
+}
+
 func (b *block) prepareWrite() {
 	if b.blockIsRaw {
 		if b.dataBlock == nil {
@@ -238,7 +782,9 @@ func (f *compFile) Read(buf []byte) (n int, err error) {
 		return 0, err
 	}
 	o := f.offset - f.block.num*f.blockSize
-	n = copy(buf, f.block.data[o:])
+	if o < int64(len(f.block.data)) {
+		n = copy(buf, f.block.data[o:])
+	}
 	f.offset += int64(n)
 	if n == 0 {
 		err = io.EOF
@@ -248,6 +794,18 @@ func (f *compFile) Read(buf []byte) (n int, err error) {
 }
 
 func (f *compFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if offset >= f.maxOffset() {
+		return 0, io.EOF
+	}
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if f.concurrentReads {
+		return f.readAtConcurrent(buf, offset)
+	}
 	f.Lock()
 	for n < len(buf) {
 		err = f.loadAt(offset)
@@ -256,6 +814,11 @@ func (f *compFile) ReadAt(buf []byte, offset int64) (n int, err error) {
 			return
 		}
 		o := offset - f.block.num*f.blockSize
+		if o >= int64(len(f.block.data)) {
+			// Past the end of the last block
+			err = io.EOF
+			break
+		}
 		n1 := copy(buf[n:], f.block.data[o:])
 		n += n1
 		offset += int64(n1)
@@ -265,14 +828,21 @@ func (f *compFile) ReadAt(buf []byte, offset int64) (n int, err error) {
 }
 
 func (f *compFile) loadAt(offset int64) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
 	num := offset / f.blockSize
 	if num != f.block.num || !f.loaded {
 		if f.block.dirty {
-			err := f.block.store(false)
+			err := f.evict()
 			if err != nil {
 				return err
 			}
 		}
+		if f.takeDirty(num) {
+			f.loaded = true
+			return nil
+		}
 		err := f.block.load(num)
 		f.loaded = true
 		return err
@@ -281,6 +851,13 @@ func (f *compFile) loadAt(offset int64) error {
 }
 
 func (f *compFile) write(buf[] byte, offset int64) (n int, err error) {
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	err = f.checkRange(offset, int64(len(buf)))
+	if err != nil {
+		return
+	}
 	for len(buf) > 0 {
 		// log.Printf("Writing %d bytes\n", len(buf))
 		err = f.loadAt(offset)
@@ -303,8 +880,12 @@ func (f *compFile) write(buf[] byte, offset int64) (n int, err error) {
 				f.block.data[i] = 0
 			}
 		}
+		unchanged := f.skipUnchanged && !f.block.dirty && newBlockSize <= l && f.block.sameData(o, buf)
 		nn := copy(f.block.data[o:], buf)
-		f.block.dirty = true
+		if !unchanged {
+			f.block.dirty = true
+			f.touch()
+		}
 		n += nn
 		offset += int64(nn)
 		buf = buf[nn:]
@@ -313,15 +894,33 @@ func (f *compFile) write(buf[] byte, offset int64) (n int, err error) {
 	return
 }
 
+// seekAppend moves the offset to the end of the file in append mode.
+func (f *compFile) seekAppend() (err error) {
+	if f.append {
+		f.offset, err = f.size()
+	}
+	return
+}
+
 func (f *compFile) Write(buf []byte) (n int, err error) {
 	f.Lock()
+	err = f.seekAppend()
+	if err != nil {
+		f.Unlock()
+		return
+	}
 	n, err = f.write(buf, f.offset)
 	f.offset += int64(n)
 	f.Unlock()
 	return
 }
 
+// WriteAt returns ErrWriteAtInAppendMode if the file was opened with os.O_APPEND, like
+// os.File does.
 func (f *compFile) WriteAt(buf []byte, offset int64) (n int, err error) {
+	if f.append {
+		return 0, ErrWriteAtInAppendMode
+	}
 	f.Lock()
 	n, err = f.write(buf, offset)
 	f.Unlock()
@@ -331,9 +930,15 @@ func (f *compFile) WriteAt(buf []byte, offset int64) (n int, err error) {
 func (f *compFile) PunchHole(offset, size int64) error {
 	num := offset / f.blockSize
 	l := offset - num * f.blockSize
-	blocks := size / f.blockSize
 	f.Lock()
 	defer f.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	err := f.flushWriteBack()
+	if err != nil {
+		return err
+	}
 	if l > 0 {
 		err := f.loadAt(offset)
 		if err != nil {
@@ -346,23 +951,45 @@ func (f *compFile) PunchHole(offset, size int64) error {
 			return nil
 		}
 		tail := f.block.data[l:]
+		if int64(len(tail)) > size {
+			tail = tail[:size]
+		}
 		for i := range tail {
 			tail[i] = 0
 		}
 		f.block.dirty = true
-		l = int64(len(f.block.data)) - l
+		l = f.blockSize - l
 		offset += l
 		size -= l
 		num++
-	} else {
-		if f.loaded && f.block.num >= num && f.block.num < num + blocks {
-			// The currently loaded block falls in the hole, discard it
-			f.loaded = false
+		if size <= 0 {
+			return nil
 		}
 	}
 
+	blocks := size / f.blockSize
+	if f.loaded && f.block.num >= num && f.block.num < num + blocks {
+		// The currently loaded block falls in the hole, discard it
+		f.loaded = false
+		f.block.dirty = false
+	}
+
 	if blocks > 0 {
-		err := f.f.PunchHole(headerSize+(num)*(f.blockSize+1), blocks*(f.blockSize+1))
+		// Loading the head block may have put the current one into the write-back cache
+		f.discardWriteBack(num, num+blocks)
+		err := f.markChanged(num, num+blocks)
+		if err != nil {
+			return err
+		}
+		err = f.releaseRange(num, num+blocks)
+		if err != nil {
+			return err
+		}
+		err = f.punchHole(f.blockOffset(num), blocks*(f.blockSize+1))
+		if err != nil {
+			return err
+		}
+		err = f.setPresent(num, num+blocks, true)
 		if err != nil {
 			return err
 		}
@@ -393,16 +1020,23 @@ func (f *compFile) PunchHole(offset, size int64) error {
 }
 
 func (f *compFile) Size() (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.size()
+}
+
+func (f *compFile) size() (int64, error) {
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
 	o, err := f.f.Seek(0, os.SEEK_END)
 	if err != nil {
 		return 0, err
 	}
-	if o <= headerSize {
+	if o <= f.dataOffset {
 		return 0, nil
 	}
-	lastBlockNum := (o - headerSize) / (f.blockSize + 1)
-	f.Lock()
-	defer f.Unlock()
+	lastBlockNum := (o - f.dataOffset) / (f.blockSize + 1)
 	if f.loaded && f.block.num >= lastBlockNum {
 		return f.block.num*f.blockSize + int64(len(f.block.data)), nil
 	}
@@ -419,29 +1053,77 @@ func (f *compFile) Size() (int64, error) {
 	return lastBlockNum*f.blockSize + int64(len(b.data)), nil
 }
 
+// maxOffset returns the largest size of the file, past it the offsets of the blocks would
+// overflow.
+func (f *compFile) maxOffset() int64 {
+	return ((math.MaxInt64-f.dataOffset)/(f.blockSize+1) - 1) * f.blockSize
+}
+
+// checkRange returns an error if [offset, offset+length) is not a valid range of the file.
+func (f *compFile) checkRange(offset, length int64) error {
+	if offset < 0 {
+		return ErrNegativeOffset
+	}
+	if offset > f.maxOffset()-length {
+		return ErrOffsetTooLarge
+	}
+	return nil
+}
+
+// Seek returns ErrNegativeOffset or ErrOffsetTooLarge (and leaves the offset unchanged) if the
+// resulting offset is out of range.
 func (f *compFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed.Load() {
+		return f.offset, os.ErrClosed
+	}
+
+	var base int64
 	switch whence {
 	case os.SEEK_SET:
-		f.offset = offset
-		return f.offset, nil
 	case os.SEEK_CUR:
-		f.offset += offset
-		return f.offset, nil
+		base = f.offset
 	case os.SEEK_END:
-		size, err := f.Size()
+		size, err := f.size()
 		if err != nil {
 			return f.offset, err
 		}
-		f.offset = size + offset
-		return f.offset, nil
+		base = size
+	default:
+		return f.offset, os.ErrInvalid
+	}
+	if offset > 0 && base > math.MaxInt64-offset {
+		return f.offset, ErrOffsetTooLarge
+	}
+	err := f.checkRange(base+offset, 0)
+	if err != nil {
+		return f.offset, err
 	}
-	return f.offset, os.ErrInvalid
+	f.offset = base + offset
+	return f.offset, nil
 }
 
 func (f *compFile) Truncate(size int64) error {
+	err := f.checkRange(size, 0)
+	if err != nil {
+		return err
+	}
 	blockNum := size / f.blockSize
 	var b *block
 	f.Lock()
+	if f.closed.Load() {
+		f.Unlock()
+		return os.ErrClosed
+	}
+	err = f.flushWriteBack()
+	if err == nil {
+		err = f.markTruncated(blockNum)
+	}
+	if err != nil {
+		f.Unlock()
+		return err
+	}
 	if f.loaded && f.block.num == blockNum {
 		b = &f.block
 	} else {
@@ -461,11 +1143,23 @@ func (f *compFile) Truncate(size int64) error {
 
 	newLen := int(size - blockNum*f.blockSize)
 
-	b.data = b.data[:newLen]
-	err := b.store(true)
+	if l := len(b.data); newLen > l {
+		b.data = b.data[:newLen]
+		for i := l; i < newLen; i++ {
+			b.data[i] = 0
+		}
+	} else {
+		b.data = b.data[:newLen]
+	}
+	err = b.store(true)
 
 	if f.loaded && f.block.num > blockNum {
+		// The cached block is past the new end, it must not be stored
 		f.loaded = false
+		f.block.dirty = false
+	} else if err == nil && f.loaded && f.block.num < blockNum {
+		// The file may have been extended past the cached block, which is no longer the last one
+		err = f.block.padShort()
 	}
 
 	f.Unlock()
@@ -473,36 +1167,163 @@ func (f *compFile) Truncate(size int64) error {
 }
 
 func (f *compFile) WriteTo(w io.Writer) (n int64, err error) {
+	return f.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo but stops with ctx.Err() if the context is done. It's checked
+// before every block.
+func (f *compFile) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
 	f.Lock()
 	defer f.Unlock()
 
+	hw := newHoleWriter(w, f.writeChunk)
+	defer func() {
+		if err == nil {
+			err = hw.flush()
+		}
+	}()
+
+	// Slots are copied as they are to another compressed file if possible
+	var dst *compFile
+	var slotBuf []byte
+	var blocks *prefetcher
+	var zc *zeroCopier
+	if c, ok := w.(*compFile); ok && f.slotsCompatible(c) {
+		err = f.flushBlock()
+		if err != nil {
+			return
+		}
+		dst = c
+		slotBuf = make([]byte, f.blockSize+1)
+	} else if f.pipelineDepth > 0 && f.features&featCopyOnRead == 0 {
+		var pf *prefetcher
+		pf, err = f.startPrefetch(f.pipelineDepth)
+		if err != nil {
+			return
+		}
+		defer pf.close()
+		blocks = pf
+	} else if f.writeChunk == 0 {
+		// Raw blocks are copied without reading them, see zerocopy.go
+		zc, err = f.newZeroCopier(w)
+		if err != nil {
+			return
+		}
+	}
+
+	p := f.newProgress(true)
 	for {
-		err = f.loadAt(f.offset)
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		if dst != nil && f.offset%f.blockSize == 0 {
+			err = hw.flush()
+			if err != nil {
+				return
+			}
+			var copied bool
+			var physSize int64
+			copied, physSize, err = f.copySlot(dst, f.offset/f.blockSize, slotBuf)
+			if err != nil {
+				return
+			}
+			if copied {
+				f.offset += f.blockSize
+				n += f.blockSize
+				p.add(physSize, f.blockSize)
+				continue
+			}
+		}
+		if zc != nil {
+			var copied int64
+			copied, err = f.copyRaw(zc, hw)
+			f.offset += copied
+			n += copied
+			if err == errNoZeroCopy {
+				zc, err = nil, nil
+			}
+			if err != nil {
+				return
+			}
+			if copied > 0 {
+				p.add(copied, copied)
+				continue
+			}
+		}
+		b := &f.block
+		if blocks != nil {
+			b, err = blocks.next()
+		} else {
+			err = f.loadAt(f.offset)
+		}
 		if err != nil {
 			if err == io.EOF {
 				err = nil
 			}
 			return
 		}
-		buf := f.block.data[f.offset-f.block.num*f.blockSize:]
+		buf := b.data[f.offset-b.num*f.blockSize:]
 		if len(buf) == 0 {
 			return
 		}
 		var written int
-		written, err = w.Write(buf)
+		written, err = hw.Write(buf)
 		f.offset += int64(written)
 		n += int64(written)
 		if err != nil {
 			return
 		}
+		p.add(b.physSize, int64(written))
 	}
 }
 
 func (f *compFile) ReadFrom(rd io.Reader) (n int64, err error) {
+	return f.ReadFromContext(context.Background(), rd)
+}
+
+// ReadFromContext is like ReadFrom but stops with ctx.Err() if the context is done. It's checked
+// once per block.
+func (f *compFile) ReadFromContext(ctx context.Context, rd io.Reader) (n int64, err error) {
 	f.Lock()
 	defer f.Unlock()
 
+	if f.readChunk > 0 {
+		rd = &sizedReader{
+			r:    rd,
+			size: f.readChunk,
+		}
+	}
+	err = f.seekAppend()
+	if err != nil {
+		return
+	}
+	p := f.newProgress(false)
+	pending := 0 // bytes read into the current block since it was last reported
+	parallel := f.compressJobs > 1
 	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		err = f.checkRange(f.offset, 1)
+		if err != nil {
+			return
+		}
+		if parallel && f.offset%f.blockSize == 0 {
+			// Once a block boundary is reached the full blocks are compressed in parallel
+			var m int64
+			var tail []byte
+			m, tail, err = f.readFromParallel(ctx, rd, p)
+			n += m
+			if err != nil || len(tail) == 0 {
+				return
+			}
+			// The rest of the source is a partial block which may have to be merged with the data
+			// that's already there
+			rd = bytes.NewReader(tail)
+			parallel = false
+		}
 		err = f.loadAt(f.offset)
 		if err != nil {
 			if err != io.EOF {
@@ -512,21 +1333,50 @@ func (f *compFile) ReadFrom(rd io.Reader) (n int64, err error) {
 		o := int(f.offset - f.block.num*f.blockSize)
 		buf := f.block.data[o:f.blockSize]
 		var r int
-		r, err = rd.Read(buf)
+		// Fill the block completely so that it's not stored (and compressed) over and over again
+		// if rd returns small chunks
+		r, err = io.ReadFull(rd, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
 		nl := o + r
-		l := len(f.block.data)
-		if nl > l {
-			f.block.data = f.block.data[:nl]
-		}
-		if l < o {
-			a := f.block.data[l:o]
-			for i := range a {
-				a[i] = 0
+		if r > 0 {
+			l := len(f.block.data)
+			if nl > l {
+				f.block.data = f.block.data[:nl]
 			}
+			if l < o {
+				a := f.block.data[l:o]
+				for i := range a {
+					a[i] = 0
+				}
+			}
+			f.block.dirty = true
 		}
 		f.offset += int64(r)
 		n += int64(r)
-		f.block.dirty = true
+		if nl == int(f.blockSize) && IsBlockZero(f.block.data) {
+			// Record the hole straight away rather than keeping a block of zeroes around
+			serr := f.block.storeBlock(false, true)
+			if serr != nil {
+				return n, serr
+			}
+			if p != nil {
+				p.add(int64(pending+r), 0)
+				pending = 0
+			}
+		} else if p != nil {
+			pending += r
+			if pending > 0 && (err == io.EOF || nl == int(f.blockSize)) {
+				// Store the block now so that its compressed size is known
+				serr := f.block.store(false)
+				if serr != nil {
+					return n, serr
+				}
+				p.add(int64(pending), f.block.physSize)
+				pending = 0
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				err = nil
@@ -536,34 +1386,155 @@ func (f *compFile) ReadFrom(rd io.Reader) (n int64, err error) {
 	}
 }
 
-func (f *compFile) Sync() error {
+// ReadFromN is like ReadFrom but reads at most n bytes. The file is extended to its final size
+// upfront rather than growing block by block. Only the logical size is set up front, the slots
+// stay holes until they are written (Options.Preallocate allocates each one then). If rd returns
+// fewer than n bytes the file is truncated back to the end of the data and io.EOF is returned,
+// like io.CopyN() does. In append mode the file is not extended upfront.
+func (f *compFile) ReadFromN(rd io.Reader, n int64) (written int64, err error) {
 	f.Lock()
-	defer f.Unlock()
-
-	if f.block.dirty {
-		err := f.block.store(false)
+	start := f.offset
+	size, err := f.size()
+	f.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	extended := start+n > size && !f.append
+	if extended {
+		err = f.Truncate(start + n)
 		if err != nil {
-			return err
+			return 0, err
+		}
+	}
+	written, err = f.ReadFrom(io.LimitReader(rd, n))
+	if err == nil && written < n {
+		err = io.EOF
+		if extended {
+			end := start + written
+			if end < size {
+				end = size
+			}
+			if terr := f.Truncate(end); terr != nil {
+				err = terr
+			}
 		}
 	}
-	return f.f.Sync()
+	return
+}
+
+// Sync stores all modified blocks and syncs the underlying file once, see autosync.go.
+func (f *compFile) Sync() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+
+	return f.flushAndSync()
 }
 
+// Close stores the pending changes and closes the underlying file. The file is closed even if
+// storing the changes fails, the error is then a *FlushError. Calling Close again does nothing.
 func (f *compFile) Close() error {
+	if f.closed.Load() {
+		return nil
+	}
+	f.stopWriteBack()
 	f.Lock()
 	defer f.Unlock()
+	if f.closed.Load() {
+		return nil
+	}
 
-	if f.block.dirty {
-		err := f.block.store(false)
-		if err != nil {
-			return err
+	err := f.flushBlock()
+	if err == nil {
+		// Before the file is marked as closed, compaction needs its size
+		err = f.autoCompact()
+	}
+	f.closed.Store(true)
+	if err == nil && f.parity != nil && !f.readOnly {
+		err = f.updateParity()
+	}
+	f.closeBase()
+	if f.mapping != nil {
+		munmap(f.mapping)
+		f.mapping = nil
+	}
+	cerr := f.f.Close()
+	if err != nil {
+		return &FlushError{Err: err}
+	}
+	return cerr
+}
+
+func (f *compFile) blockOffset(num int64) int64 {
+	return f.dataOffset + num*(f.blockSize+1)
+}
+
+func (f *compFile) init(flag int, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	f.log = opts.Logger
+	err := f.initFile(flag, opts)
+	if err == nil && !f.readOnly {
+		err = f.checkTail(opts.RepairTail)
+	}
+	if err == nil && opts.Parity != nil {
+		err = f.initParity(opts)
+	}
+	writeBack := opts.WriteBack
+	f.readChunk = opts.ReadChunkSize
+	f.writeChunk = opts.WriteChunkSize
+	f.pipelineDepth = opts.PipelineDepth
+	f.compressJobs = opts.CompressJobs
+	if opts.Reproducible && opts.RawBackoff > 0 {
+		// The blocks that are sampled would depend on the timing, see backoff.go
+		f.compressJobs = 0
+	}
+	f.compressInFlight = compressInFlight(f.compressJobs)
+	if err == nil && opts.MemoryLimit > 0 {
+		writeBack, f.pipelineDepth, f.compressJobs, f.compressInFlight, err = f.fitMemory(opts.MemoryLimit, writeBack, f.pipelineDepth, f.compressJobs)
+	}
+	if err == nil && opts.Mmap {
+		f.mapping = mmapFile(f.f)
+	}
+	if err == nil && !f.readOnly {
+		if writeBack > 0 || opts.WriteBackDelay > 0 {
+			f.startWriteBack(writeBack, opts.WriteBackDelay)
 		}
+		f.syncEvery = opts.SyncEvery
+		f.syncInterval = opts.SyncInterval
+		f.lastSync = time.Now()
+		f.compactThreshold = opts.CompactThreshold
+		f.preallocate = opts.Preallocate
+		f.skipUnchanged = opts.SkipUnchanged
+		f.rawBackoff = opts.RawBackoff
 	}
-	return f.f.Close()
+	return err
 }
 
-func (f *compFile) init(flag int, blockSize int64) error {
-	if flag&os.O_WRONLY != 0 || flag&os.O_RDWR != 0 {
+func (f *compFile) initFile(flag int, opts *Options) error {
+	f.readOnly = flag&(os.O_WRONLY|os.O_RDWR) == 0
+	f.append = flag&os.O_APPEND != 0 && !f.readOnly
+	if flag&os.O_TRUNC != 0 && !f.readOnly {
+		// OpenFile() has done it already, but NewFromFile() and NewFromSparseFile() get an open
+		// file
+		err := f.f.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ConcurrentReads {
+		if !f.readOnly {
+			return ErrInvalidOptions
+		}
+		f.concurrentReads = true
+	}
+	if opts.Mmap && !f.readOnly {
+		return ErrInvalidOptions
+	}
+	if !f.readOnly {
 		// Check if punching holes is supported
 		off, err := f.f.Seek(0, os.SEEK_END)
 		if err != nil {
@@ -579,14 +1550,18 @@ func (f *compFile) init(flag int, blockSize int64) error {
 		}
 	}
 
-	blockSize &= 0xffffffffffff000
-	if blockSize == 0 {
+	blockSize := opts.BlockSize
+	if blockSize < 4096 {
 		blockSize = defBlockSize
 	} else {
+		if blockSize%4096 != 0 && blockSize > math.MaxUint32 {
+			return ErrInvalidOptions
+		}
 		blockSize--
 	}
 
 	f.block.init(f)
+	f.dataOffset = headerSize
 
 	// Trying to read the header
 	buf := make([]byte, len(headerMagic)+4)
@@ -596,15 +1571,27 @@ func (f *compFile) init(flag int, blockSize int64) error {
 		if err == io.EOF {
 			// Empty file
 			if flag&os.O_WRONLY != 0 || flag&os.O_RDWR != 0 {
-				w := bytes.NewBuffer(buf[:0])
-				w.WriteString(headerMagic)
-				binary.Write(w, binary.LittleEndian, uint32((blockSize+1)/4096))
-				_, err = f.f.Write(w.Bytes())
+				f.blockSize = blockSize
+				f.setCreatorMeta(opts)
+				if len(opts.Xattrs) > 0 {
+					f.setMeta(metaXattrs, marshalXattrs(opts.Xattrs))
+				}
+				if opts.FileAttrs != nil {
+					f.setMeta(metaFileAttrs, opts.FileAttrs.marshal())
+				}
+				if opts.needsHeaderV2() {
+					err = f.writeHeaderV2(opts)
+					if err != nil {
+						f.closeBase()
+					}
+					return err
+				}
+				page, err := f.headerV1()
 				if err != nil {
 					return err
 				}
-				f.blockSize = blockSize
-				return nil
+				_, err = f.f.Write(page)
+				return err
 			}
 		}
 		if err == io.ErrUnexpectedEOF {
@@ -612,13 +1599,241 @@ func (f *compFile) init(flag int, blockSize int64) error {
 		}
 		return err
 	}
-	if string(buf[:8]) != headerMagic {
+	switch string(buf[:8]) {
+	case headerMagic:
+	case headerMagicV2:
+		return f.readHeaderV2(opts)
+	default:
 		return ErrInvalidFormat
 	}
 	w := bytes.NewBuffer(buf[8:])
 	var bs uint32
 	binary.Read(w, binary.LittleEndian, &bs)
 	f.blockSize = int64(bs*4096) - 1
+	f.version = 1
+	// Creator metadata in the unused part of the page
+	page := make([]byte, headerSize)
+	_, err = f.f.ReadAt(page, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return f.unmarshalMeta(page[metaOffset:])
+}
+
+// needsHeaderV2 returns true if a new file with these options can't have a version 1 header.
+func (opts *Options) needsHeaderV2() bool {
+	return opts.ChangeTracking || opts.Base != nil || opts.Parent != "" || opts.Source != "" ||
+		opts.Dedup || opts.Store != nil || opts.Journal || opts.AtomicReplace ||
+		opts.BlockSize >= 4096 && opts.BlockSize%4096 != 0
+}
+
+// headerV1 returns the header page of a version 1 file.
+func (f *compFile) headerV1() ([]byte, error) {
+	f.version = 1
+	page := make([]byte, headerSize)
+	w := bytes.NewBuffer(page[:0])
+	w.WriteString(headerMagic)
+	binary.Write(w, binary.LittleEndian, uint32((f.blockSize+1)/4096))
+	err := f.marshalMeta(page[metaOffset:])
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (f *compFile) writeHeaderV2(opts *Options) error {
+	f.version = 2
+	h := headerV2{
+		BlockSize:  uint32((f.blockSize + 4096) / 4096),
+		DataOffset: headerSize,
+	}
+	copy(h.Magic[:], headerMagicV2)
+	if (f.blockSize+1)%4096 != 0 {
+		h.Features |= featExactBlockSize
+		h.ExactBlockSize = uint32(f.blockSize + 1)
+	}
+	if opts.ChangeTracking {
+		maxSize := opts.MaxTrackedSize
+		if maxSize <= 0 {
+			maxSize = defMaxTrackedSize
+		}
+		f.tableEntries = (maxSize + f.blockSize - 1) / f.blockSize
+		h.Features |= featChangeTracking
+		h.Generation = 1
+		h.TrackedBlocks = uint64(f.tableEntries)
+		h.DataOffset += uint64((f.tableEntries*4 + headerSize - 1) &^ (headerSize - 1))
+	}
+	hasBase := opts.Base != nil || opts.Parent != "" || opts.Source != ""
+	if opts.Base != nil && opts.Parent != "" || opts.Source != "" && (opts.Base != nil || opts.Parent != "") {
+		return ErrInvalidOptions
+	}
+	if opts.Base != nil {
+		err := f.initBase(&h, opts.Base, !opts.CopyOnRead)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Parent != "" {
+		err := f.initParent(&h, opts.Parent)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Source != "" {
+		err := f.initSource(&h, opts.Source)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.CopyOnRead {
+		if !hasBase {
+			return ErrInvalidOptions
+		}
+		h.Features |= featCopyOnRead
+	}
+	if opts.Dedup {
+		if hasBase {
+			return ErrInvalidOptions
+		}
+		f.initDedup(&h, opts)
+	}
+	if opts.Store != nil {
+		h.Features |= featStore
+		f.blockStore = opts.Store
+	}
+	if opts.Journal && opts.AtomicReplace {
+		return ErrInvalidOptions
+	}
+	if opts.Journal {
+		f.initJournal(&h, featJournal)
+	}
+	if opts.AtomicReplace {
+		f.initJournal(&h, featShadow)
+	}
+	f.features = h.Features
+	f.generation = h.Generation
+	f.dataOffset = int64(h.DataOffset)
+
+	buf := bytes.NewBuffer(make([]byte, 0, headerSize))
+	binary.Write(buf, binary.LittleEndian, &h)
+	page := buf.Bytes()[:headerSize]
+	err := f.marshalMeta(page[metaOffset:])
+	if err != nil {
+		return err
+	}
+	_, err = f.f.WriteAt(page, 0)
+	if err != nil {
+		return err
+	}
+	if opts.Parent != "" || h.Features&featCopyOnRead != 0 {
+		return f.initOverlaySize()
+	}
+	return nil
+}
+
+func (f *compFile) readHeaderV2(opts *Options) error {
+	page := make([]byte, headerSize)
+	n, err := f.f.ReadAt(page, 0)
+	if err != nil && !(err == io.EOF && n >= binary.Size(&headerV2{})) {
+		if err == io.EOF {
+			return ErrInvalidFormat
+		}
+		return err
+	}
+	var h headerV2
+	binary.Read(bytes.NewReader(page), binary.LittleEndian, &h)
+	f.version = 2
+	if h.Features&^knownFeatures != 0 {
+		return ErrUnsupportedFeatures
+	}
+	if h.BlockSize == 0 || h.DataOffset < headerSize || h.DataOffset%headerSize != 0 {
+		return ErrInvalidFormat
+	}
+	f.blockSize = int64(h.BlockSize)*4096 - 1
+	if h.Features&featExactBlockSize != 0 {
+		if h.ExactBlockSize < 4096 || (int64(h.ExactBlockSize)+4095)/4096 != int64(h.BlockSize) {
+			return ErrInvalidFormat
+		}
+		f.blockSize = int64(h.ExactBlockSize) - 1
+	}
+	f.features = h.Features
+	f.dataOffset = int64(h.DataOffset)
+	err = f.unmarshalMeta(page[metaOffset:])
+	if err != nil {
+		return err
+	}
+	if h.Features&featChangeTracking != 0 {
+		f.generation = h.Generation
+		f.tableEntries = int64(h.TrackedBlocks)
+		if f.tableEntries > (f.dataOffset-headerSize)/4 {
+			return ErrInvalidFormat
+		}
+	}
+	if h.Features&featStore != 0 {
+		if opts.Store == nil {
+			return ErrStoreRequired
+		}
+		f.blockStore = opts.Store
+	}
+	if h.Features&(featJournal|featShadow) != 0 {
+		err = f.recoverJournal()
+		if err != nil {
+			return err
+		}
+	}
+	if h.Features&featDedup != 0 {
+		err = f.loadDedup()
+		if err != nil {
+			return err
+		}
+	}
+	if h.Features&featBase != 0 {
+		base := opts.Base
+		if base == nil && f.meta[metaParentPath] != nil {
+			parent, err := f.openParent(string(f.meta[metaParentPath]))
+			if err != nil {
+				return err
+			}
+			base = parent
+			f.ownBase = true
+		} else if base == nil && f.meta[metaSourcePath] != nil {
+			source, err := f.openSource(string(f.meta[metaSourcePath]))
+			if err != nil {
+				return err
+			}
+			base = source
+			f.ownBase = true
+		}
+		err = f.openBase(&h, base)
+		if err != nil {
+			f.closeBase()
+		}
+		return err
+	}
+	return nil
+}
+
+// updateHeaderV2 re-reads the header, lets fn modify it (and the metadata) and writes it back.
+func (f *compFile) updateHeaderV2(fn func(h *headerV2)) error {
+	page := make([]byte, headerSize)
+	_, err := f.f.ReadAt(page, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var h headerV2
+	binary.Read(bytes.NewReader(page), binary.LittleEndian, &h)
+	fn(&h)
+	buf := bytes.NewBuffer(page[:0])
+	binary.Write(buf, binary.LittleEndian, &h)
+	err = f.marshalMeta(page[metaOffset:])
+	if err != nil {
+		return err
+	}
+	_, err = f.f.WriteAt(page, 0)
+	if err != nil {
+		return err
+	}
+	f.features = h.Features
 	return nil
 }
 
@@ -627,17 +1842,36 @@ func OpenFile(name string, flag int, perm os.FileMode) (f *compFile, err error)
 }
 
 func OpenFileSize(name string, flag int, perm os.FileMode, blockSize int64) (f *compFile, err error) {
-	var ff *os.File
-	ff, err = os.OpenFile(name, flag, perm)
+	return OpenFileOptions(name, flag, perm, &Options{BlockSize: blockSize})
+}
+
+func OpenFileOptions(name string, flag int, perm os.FileMode, opts *Options) (f *compFile, err error) {
+	var sf SparseFile
+	if opts != nil && opts.SegmentSize > 0 || !exists(name) && IsSegmented(name) {
+		var so SegmentOptions
+		if opts != nil {
+			so = SegmentOptions{Size: opts.SegmentSize, Parity: opts.SegmentParity, Stripe: opts.SegmentStripe}
+		}
+		sf, err = OpenSegmentedOptions(name, flag&^os.O_APPEND, perm, &so)
+	} else {
+		// The blocks are written with WriteAt(), which os.File doesn't allow in append mode, and
+		// the end of the compressed file is not the end of the data anyway
+		var ff *os.File
+		ff, err = os.OpenFile(name, flag&^os.O_APPEND, perm)
+		if ff != nil {
+			sf = NewSparseFile(ff)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	f = &compFile{
-		f: NewSparseFile(ff),
+		f:    sf,
+		name: name,
 	}
 
-	err = f.init(flag, blockSize)
+	err = f.init(flag, opts)
 	if err != nil {
 		f.f.Close()
 		return nil, err
@@ -651,6 +1885,10 @@ func NewFromFile(file *os.File, flag int) (f *compFile, err error) {
 }
 
 func NewFromFileSize(file *os.File, flag int, blockSize int64) (f *compFile, err error) {
+	return NewFromFileOptions(file, flag, &Options{BlockSize: blockSize})
+}
+
+func NewFromFileOptions(file *os.File, flag int, opts *Options) (f *compFile, err error) {
 	info, err := file.Stat()
 	if err != nil {
 		return nil, err
@@ -660,10 +1898,11 @@ func NewFromFileSize(file *os.File, flag int, blockSize int64) (f *compFile, err
 	}
 
 	f = &compFile{
-		f: NewSparseFile(file),
+		f:    NewSparseFile(file),
+		name: file.Name(),
 	}
 
-	err = f.init(flag, blockSize)
+	err = f.init(flag, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -676,11 +1915,15 @@ func NewFromSparseFile(file SparseFile, flag int) (f *compFile, err error) {
 }
 
 func NewFromSparseFileSize(file SparseFile, flag int, blockSize int64) (f *compFile, err error) {
+	return NewFromSparseFileOptions(file, flag, &Options{BlockSize: blockSize})
+}
+
+func NewFromSparseFileOptions(file SparseFile, flag int, opts *Options) (f *compFile, err error) {
 	f = &compFile{
 		f: file,
 	}
 
-	err = f.init(flag, blockSize)
+	err = f.init(flag, opts)
 	if err != nil {
 		return nil, err
 	}
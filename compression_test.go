@@ -2,11 +2,15 @@ package spgz
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 )
 
 type memSparseFile struct {
@@ -467,3 +471,539 @@ func TestIsBlockZero(t *testing.T) {
 		t.Fatal("empty block is not zero")
 	}
 }
+
+func TestTruncateExtend(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2*f.blockSize+100)
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	_, err = f.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Truncate(2*f.blockSize + 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Truncate(2*f.blockSize + 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf = make([]byte, 3000)
+	_, err = f.ReadAt(buf, 2*f.blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRange(buf, 0, 50, 'x', t)
+	expectRange(buf, 50, 2950, 0, t)
+}
+
+func TestTruncateExtendShortBlock(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The short block 0 stays loaded while the file is extended past it
+	data := make([]byte, 7418)
+	for i := range data {
+		data[i] = 'x'
+	}
+	_, err = f.WriteAt(data, 1021)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(43422)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 43422)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Fatalf("Unexpected n: %d", n)
+	}
+	expectRange(buf, 0, 1021, 0, t)
+	expectRange(buf, 1021, 7418, 'x', t)
+	expectRange(buf, 1021+7418, len(buf)-1021-7418, 0, t)
+}
+
+func TestReadAtEOF(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, f.blockSize+100)
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	_, err = f.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf = make([]byte, 200)
+	n, err := f.ReadAt(buf, f.blockSize)
+	if err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 100 {
+		t.Fatalf("Unexpected n: %d", n)
+	}
+	expectRange(buf, 0, 100, 'x', t)
+
+	n, err = f.ReadAt(buf, f.blockSize+150)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("Unexpected result past the end: %d, %v", n, err)
+	}
+}
+
+func TestBlockError(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3*f.BlockSize())
+	for i := range buf {
+		buf[i] = byte(i % 7)
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the gzip header of block 1
+	sf.data[f.blockOffset(1)+1] ^= 0xff
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ReadAt(buf, 0)
+	var be *BlockError
+	if !errors.As(err, &be) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if be.Num != 1 || be.Offset != f.BlockSize() || be.Op != "load" {
+		t.Fatalf("Unexpected error: %+v", be)
+	}
+	var ce *ErrCorruptBlock
+	if !errors.As(err, &ce) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ce.Num != 1 || ce.PhysOffset != f.blockOffset(1) || ce.Cause == nil {
+		t.Fatalf("Unexpected error: %+v", ce)
+	}
+}
+
+func TestReadFromZeroes(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	f.SetMetrics(m)
+
+	bs := f.BlockSize()
+	data := make([]byte, 8*bs)
+	for i := 2 * bs; i < 3*bs; i++ {
+		data[i] = 'x'
+	}
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := m.BlocksHole.Value(); h != 7 {
+		t.Fatalf("Unexpected number of holes: %d", h)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+func TestReadFromSmallChunks(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	f.SetMetrics(m)
+	calls := 0
+	f.SetProgress(func(Progress) {
+		calls++
+	})
+
+	data := bytes.Repeat([]byte("chunk"), int(3*f.BlockSize())/5)
+	_, err = f.ReadFrom(iotest.OneByteReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || m.BlocksCompressed.Value() != 3 {
+		t.Fatalf("Unexpected number of stores: %d, %d", calls, m.BlocksCompressed.Value())
+	}
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+type countingSparseWriter struct {
+	SparseWriter
+	written int64
+}
+
+func (w *countingSparseWriter) Write(p []byte) (int, error) {
+	n, err := w.SparseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func TestWriteToHoles(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 6*bs+10)
+	for i := 2 * bs; i < 3*bs; i++ {
+		data[i] = 'x'
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dst memSparseFile
+	// Existing data in the destination must be overwritten with zeroes
+	dst.data = bytes.Repeat([]byte{'y'}, int(4*bs))
+	w := &countingSparseWriter{
+		SparseWriter: SparseWriter{&dst},
+	}
+	n, err := f.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Unexpected length: %d", n)
+	}
+	if w.written != bs {
+		t.Fatalf("Unexpected number of bytes written: %d", w.written)
+	}
+	if !bytes.Equal(dst.data, data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+func TestReadFromN(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("readfromn"), 2000)
+	n, err := f.ReadFromN(iotest.HalfReader(bytes.NewReader(data)), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10000 {
+		t.Fatalf("Unexpected length: %d", n)
+	}
+	size, err := f.Size()
+	if err != nil || size != 10000 {
+		t.Fatalf("Unexpected size: %d, %v", size, err)
+	}
+
+	// The source is shorter than the hint
+	n, err = f.ReadFromN(bytes.NewReader(data[10000:]), 20000)
+	if err != io.EOF || n != int64(len(data)-10000) {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	size, err = f.Size()
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("Unexpected size after a short read: %d, %v", size, err)
+	}
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+func TestExactBlockSize(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 128*1024+512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := f.BlockSize(); bs != 128*1024+511 {
+		t.Fatalf("Unexpected block size: %d", bs)
+	}
+	data := make([]byte, 5*f.BlockSize()+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data[f.BlockSize():], bytes.Repeat([]byte("exact"), int(f.BlockSize())/5))
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := f.BlockSize(); bs != 128*1024+511 {
+		t.Fatalf("Unexpected block size after reopening: %d", bs)
+	}
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exact size must agree with the size in 4096 units
+	binary.LittleEndian.PutUint32(sf.data[8:], 40)
+	sf.Seek(0, os.SEEK_SET)
+	_, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "append.spgz")
+	for i, chunk := range []string{"first ", "second "} {
+		f, err := OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The offset is ignored
+		_, err = f.Seek(0, os.SEEK_SET)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			_, err = f.ReadFrom(bytes.NewReader([]byte("third")))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := f.WriteAt([]byte("x"), 0); err != ErrWriteAtInAppendMode {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first second third" {
+		t.Fatalf("Unexpected data: %q", data)
+	}
+}
+
+func TestTruncateOnOpen(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{ChangeTracking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(bytes.Repeat([]byte("stale"), 100000), 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := f.Size()
+	if err != nil || size != 0 {
+		t.Fatalf("Unexpected size: %d, %v", size, err)
+	}
+	if f.ChangeTracking() {
+		t.Fatal("The old header was kept")
+	}
+	_, err = f.Write([]byte("fresh"))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "fresh" {
+		t.Fatalf("Unexpected data: %q, %v", data, err)
+	}
+}
+
+func TestSeekRange(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(-5, os.SEEK_END); err != ErrNegativeOffset {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.Seek(math.MaxInt64, os.SEEK_CUR); err != ErrOffsetTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.Seek(0, 3); err != os.ErrInvalid {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The offset is unchanged
+	if pos, err := f.Seek(0, os.SEEK_CUR); err != nil || pos != 4 {
+		t.Fatalf("Unexpected position: %d, %v", pos, err)
+	}
+
+	max := f.maxOffset()
+	if _, err := f.WriteAt([]byte("x"), max); err != ErrOffsetTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), -1); err != ErrNegativeOffset {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), -1); err != ErrNegativeOffset {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n, err := f.ReadAt(make([]byte, 1), max); n != 0 || err != io.EOF {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if err := f.Truncate(max + 1); err != ErrOffsetTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+type failingSparseFile struct {
+	memSparseFile
+	fail   bool
+	closed bool
+}
+
+func (s *failingSparseFile) WriteAt(buf []byte, offset int64) (int, error) {
+	if s.fail {
+		return 0, errors.New("write failed")
+	}
+	return s.memSparseFile.WriteAt(buf, offset)
+}
+
+func (s *failingSparseFile) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	var sf failingSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.fail = true
+	err = f.Close()
+	var fe *FlushError
+	if !errors.As(err, &fe) || !sf.closed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Second Close: %v", err)
+	}
+	if _, err := f.Write([]byte("more")); err != os.ErrClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), 0); err != os.ErrClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := f.Seek(0, os.SEEK_END); err != os.ErrClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := f.Truncate(0); err != os.ErrClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
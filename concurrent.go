@@ -0,0 +1,47 @@
+package spgz
+
+import (
+	"io"
+)
+
+// With Options.ConcurrentReads ReadAt doesn't lock the file and doesn't use the file's block.
+// Blocks are loaded into fresh buffers, so any number of goroutines can read at the same time,
+// only the underlying file (which must support concurrent ReadAt, as *os.File does) is shared.
+// The last loaded block is kept as an immutable snapshot which readers of the same block copy
+// from. Refresh and DiscardCache must not be called while ReadAt is in progress.
+
+type snapshot struct {
+	num  int64
+	data []byte
+}
+
+func (f *compFile) readAtConcurrent(buf []byte, offset int64) (n int, err error) {
+	for n < len(buf) {
+		num := offset / f.blockSize
+		s := f.snapshot.Load()
+		if s == nil || s.num != num {
+			b := &block{
+				f: f,
+			}
+			err = b.load(num)
+			if err != nil {
+				return
+			}
+			s = &snapshot{
+				num:  num,
+				data: b.data,
+			}
+			f.snapshot.Store(s)
+		}
+		o := offset - num*f.blockSize
+		if o >= int64(len(s.data)) {
+			// Past the end of the last block
+			err = io.EOF
+			break
+		}
+		n1 := copy(buf[n:], s.data[o:])
+		n += n1
+		offset += int64(n1)
+	}
+	return
+}
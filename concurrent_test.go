@@ -0,0 +1,71 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentReads(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "concurrent.spgz")
+	f, err := OpenFileSize(name, os.O_RDWR|os.O_CREATE, 0666, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 20*f.BlockSize()+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenFileOptions(name, os.O_RDWR, 0666, &Options{
+		ConcurrentReads: true,
+	})
+	if err != ErrInvalidOptions {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDONLY, 0, &Options{
+		ConcurrentReads: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			buf := make([]byte, 3000)
+			for j := 0; j < 200; j++ {
+				off := rnd.Int63n(int64(len(data)))
+				n, err := f.ReadAt(buf, off)
+				if err != nil && err != io.EOF {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+					t.Errorf("Data differs at %d", off)
+					return
+				}
+				if err == io.EOF && off+int64(n) != int64(len(data)) {
+					t.Errorf("Unexpected EOF at %d", off+int64(n))
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
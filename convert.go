@@ -0,0 +1,109 @@
+package spgz
+
+import (
+	"io"
+	"os"
+)
+
+// ConvertInPlace turns the raw (possibly sparse) file name into a compressed file with a
+// version 1 header, without needing the space for a copy. The blocks are compressed from the last
+// one to the first: the slot of a block never starts before the end of the preceding raw block,
+// so it only overwrites data that has been converted already, and the header goes over the
+// beginning of the first block at the end. The file only grows by the size of the header and a
+// byte per block and the space of compressed blocks and zeroes is released as it goes.
+//
+// The conversion can't be resumed: if it's interrupted (e.g. by a crash), the file is lost.
+// opts must not require a version 2 header, only BlockSize and the creator metadata apply. A
+// file that is already compressed is rejected with ErrInvalidFormat.
+func ConvertInPlace(name string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.needsHeaderV2() {
+		return ErrInvalidOptions
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if info, err := Sniff(file); err != nil || info.Format == FormatSPGZ {
+		if err == nil {
+			err = ErrInvalidFormat
+		}
+		return err
+	}
+
+	f := &compFile{
+		f:          NewSparseFile(file),
+		name:       name,
+		blockSize:  defBlockSize,
+		dataOffset: headerSize,
+	}
+	if opts.BlockSize >= 4096 {
+		f.blockSize = opts.BlockSize - 1
+	}
+	f.block.init(f)
+	f.setCreatorMeta(opts)
+	if len(opts.Xattrs) > 0 {
+		f.setMeta(metaXattrs, marshalXattrs(opts.Xattrs))
+	}
+	if opts.FileAttrs != nil {
+		f.setMeta(metaFileAttrs, opts.FileAttrs.marshal())
+	}
+	page, err := f.headerV1()
+	if err != nil {
+		return err
+	}
+
+	size, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	// Check if punching holes is supported before anything is overwritten
+	err = f.f.PunchHole(size, 4096)
+	if err != nil {
+		return err
+	}
+
+	b := &block{
+		f:         f,
+		dataBlock: make([]byte, f.blockSize),
+	}
+	last := (size - 1) / f.blockSize
+	for num := last; num >= 0 && size > 0; num-- {
+		l := f.blockSize
+		if num == last {
+			l = size - num*f.blockSize
+		}
+		b.num = num
+		b.data = b.dataBlock[:l]
+		n, err := f.f.ReadAt(b.data, num*f.blockSize)
+		if n < len(b.data) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		b.dirty = true
+		err = b.store(num == last)
+		if err != nil {
+			return err
+		}
+	}
+	if size == 0 {
+		err = f.f.Truncate(headerSize)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = f.f.WriteAt(page, 0)
+	if err != nil {
+		return err
+	}
+	err = f.f.Sync()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
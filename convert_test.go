@@ -0,0 +1,56 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertInPlace(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int64{0, 100, 3*4096 + 10, 9 * 4096} {
+		name := filepath.Join(dir, "raw")
+		data := make([]byte, size)
+		rnd := rand.New(rand.NewSource(size))
+		for i := int64(0); i < size; i += 4096 {
+			switch (i / 4096) % 3 {
+			case 0:
+				copy(data[i:], bytes.Repeat([]byte("convert"), 600))
+			case 1:
+				end := i + 4096
+				if end > size {
+					end = size
+				}
+				rnd.Read(data[i:end])
+			}
+		}
+		err := os.WriteFile(name, data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ConvertInPlace(name, &Options{BlockSize: 4096})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ConvertInPlace(name, nil); err != ErrInvalidFormat {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		f, err := OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d: data mismatch", size)
+		}
+	}
+}
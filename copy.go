@@ -0,0 +1,424 @@
+package spgz
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// DataSeeker is implemented by sources that know where their holes are: the values returned by
+// NewSparseFile() (using SEEK_DATA and SEEK_HOLE where supported) and by OpenFile() and friends
+// (using the block map). Both methods may change the current position.
+type DataSeeker interface {
+	// SeekData returns the start of the first range of data at or after offset or the size of
+	// the file if there is none.
+	SeekData(offset int64) (int64, error)
+
+	// SeekHole returns the start of the first hole at or after offset. The end of the file counts
+	// as a hole.
+	SeekHole(offset int64) (int64, error)
+}
+
+// holeWriter passes writes to w except for ranges of zeroes which, if w is a HolePuncher, are
+// accumulated and skipped over in one go. If chunk is not 0 the writes are made in chunks of
+// that size. flush() must be called at the end.
+type holeWriter struct {
+	w      io.Writer
+	bw     *bufio.Writer
+	hp     HolePuncher
+	zeroes int64
+}
+
+func newHoleWriter(w io.Writer, chunk int) *holeWriter {
+	hp, _ := w.(HolePuncher)
+	h := &holeWriter{
+		w:  w,
+		hp: hp,
+	}
+	if chunk > 0 {
+		h.bw = bufio.NewWriterSize(w, chunk)
+	}
+	return h
+}
+
+func (h *holeWriter) Write(p []byte) (int, error) {
+	if h.hp != nil && IsBlockZero(p) {
+		h.zeroes += int64(len(p))
+		return len(p), nil
+	}
+	if h.zeroes > 0 {
+		err := h.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if h.bw == nil {
+		return h.w.Write(p)
+	}
+	// bufio.Writer would write large buffers directly
+	n := 0
+	for len(p) > 0 {
+		if h.bw.Available() == 0 {
+			err := h.bw.Flush()
+			if err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if a := h.bw.Available(); len(chunk) > a {
+			chunk = chunk[:a]
+		}
+		written, err := h.bw.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
+// skip writes l zeroes.
+func (h *holeWriter) skip(l int64) error {
+	if h.hp != nil {
+		h.zeroes += l
+		return nil
+	}
+	var buf [BUFSIZE]byte
+	for l > 0 {
+		chunk := buf[:]
+		if l < int64(len(chunk)) {
+			chunk = chunk[:l]
+		}
+		n, err := h.Write(chunk)
+		if err != nil {
+			return err
+		}
+		l -= int64(n)
+	}
+	return nil
+}
+
+func (h *holeWriter) flush() error {
+	if h.bw != nil {
+		// Buffered data goes before the zeroes
+		err := h.bw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if h.zeroes == 0 {
+		return nil
+	}
+	err := skipZeroes(h.hp, h.zeroes)
+	h.zeroes = 0
+	return err
+}
+
+// Copy copies from src to dst until EOF like io.Copy() but never transfers ranges of zeroes if
+// it can avoid it. If src is an io.Seeker and a DataSeeker its holes are not read, and if dst is
+// a HolePuncher zeroes are skipped rather than written (see SparseWriter). Both ends can be
+// compressed files, in which case blocks are transferred without being decompressed whenever
+// possible.
+func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
+	if s, ok := src.(*compFile); ok {
+		if d, ok := dst.(*compFile); ok {
+			return s.WriteTo(d)
+		}
+	}
+	hw := newHoleWriter(dst, 0)
+	defer func() {
+		if err == nil {
+			err = hw.flush()
+		}
+	}()
+	buf := make([]byte, 64*1024)
+
+	ds, isDataSeeker := src.(DataSeeker)
+	rs, isSeeker := src.(io.Seeker)
+	if !isDataSeeker || !isSeeker {
+		// src is wrapped so that its WriteTo() is not used, it would see hw as a plain writer
+		return io.CopyBuffer(hw, struct{ io.Reader }{src}, buf)
+	}
+
+	offset, err := rs.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return
+	}
+	size, err := rs.Seek(0, os.SEEK_END)
+	if err != nil {
+		return
+	}
+	for offset < size {
+		var data, hole int64
+		data, err = ds.SeekData(offset)
+		if err != nil {
+			return
+		}
+		if data > size {
+			data = size
+		}
+		if data > offset {
+			err = hw.skip(data - offset)
+			if err != nil {
+				return
+			}
+			written += data - offset
+			offset = data
+		}
+		if offset == size {
+			break
+		}
+		hole, err = ds.SeekHole(offset)
+		if err != nil {
+			return
+		}
+		if hole > size {
+			hole = size
+		}
+		_, err = rs.Seek(offset, os.SEEK_SET)
+		if err != nil {
+			return
+		}
+		var n int64
+		if d, ok := dst.(*compFile); ok && d.compressJobs > 1 {
+			// ReadFrom() compresses the blocks in parallel, see parallel.go
+			err = hw.flush()
+			if err != nil {
+				return
+			}
+			n, err = d.ReadFrom(io.LimitReader(src, hole-offset))
+		} else {
+			n, err = io.CopyBuffer(hw, io.LimitReader(src, hole-offset), buf)
+		}
+		written += n
+		offset += n
+		if err != nil {
+			return
+		}
+		if offset < hole {
+			// The source has been truncated in the meantime
+			break
+		}
+	}
+	_, err = rs.Seek(offset, os.SEEK_SET)
+	return
+}
+
+// SeekData implements DataSeeker. Blocks read from the base are treated as data.
+func (f *compFile) SeekData(offset int64) (int64, error) {
+	return f.seekBlock(offset, false)
+}
+
+// SeekHole implements DataSeeker. Only blocks that consist entirely of zeroes are holes.
+func (f *compFile) SeekHole(offset int64) (int64, error) {
+	return f.seekBlock(offset, true)
+}
+
+// seekBlock returns the offset of the first block at or after offset that is (or is not) a hole.
+func (f *compFile) seekBlock(offset int64, hole bool) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.flushBlock()
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, f.blockSize+1)
+	for num := offset / f.blockSize; num*f.blockSize < size; num++ {
+		isHole := false
+		if _, isLink := f.links[num]; f.isPresent(num) && !isLink {
+			_, isHole, err = f.slotType(num, buf)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if isHole == hole {
+			if o := num * f.blockSize; o > offset {
+				return o, nil
+			}
+			return offset, nil
+		}
+	}
+	return size, nil
+}
+
+// slotsCompatible returns true if slots of f can be copied to dst verbatim, i.e. dst has the same
+// block size and doesn't need to look at the data to store it (see storeImage()).
+func (f *compFile) slotsCompatible(dst *compFile) bool {
+	return dst != f && dst.blockSize == f.blockSize && !dst.readOnly && dst.base == nil &&
+		dst.blockStore == nil && dst.features&featDedup == 0
+}
+
+// copySlot stores block num of f in dst without decompressing it, if it's present, compressed or
+// raw, and not the last one (the length of which depends on the end of the file). It must be
+// called with f locked and its blocks flushed. It returns false if the block has to be copied
+// the normal way, otherwise the number of bytes the block occupies in dst.
+func (f *compFile) copySlot(dst *compFile, num int64, buf []byte) (bool, int64, error) {
+	if !f.isPresent(num) || f.shadow != nil {
+		return false, 0, nil
+	}
+	if _, isLink := f.links[num]; isLink {
+		return false, 0, nil
+	}
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return false, 0, err
+	}
+	if f.blockOffset(num+1) >= o {
+		return false, 0, nil
+	}
+	n, err := f.f.ReadAt(buf[:f.blockSize+1], f.blockOffset(num))
+	if err != nil && err != io.EOF {
+		return false, 0, err
+	}
+	image := buf[:n]
+	if n > 0 && image[0] != blkUncompressed && image[0] != blkCompressed {
+		return false, 0, nil
+	}
+	// The rest of the slot is punched, so it reads as zeroes anyway
+	for len(image) > 0 && image[len(image)-1] == 0 {
+		image = image[:len(image)-1]
+	}
+
+	dst.Lock()
+	defer dst.Unlock()
+	if dst.offset != num*dst.blockSize {
+		return false, 0, nil
+	}
+	err = dst.flushBlock()
+	if err != nil {
+		return false, 0, err
+	}
+	if dst.loaded && dst.block.num == num {
+		dst.loaded = false
+	}
+	b := &block{
+		f:   dst,
+		num: num,
+	}
+	err = b.storeImage(image)
+	if err != nil {
+		return false, 0, err
+	}
+	dst.offset += dst.blockSize
+	return true, int64(len(image)), nil
+}
+
+// storeImage writes a ready-made slot image of a block that is not the last one. An empty image
+// is a hole.
+func (b *block) storeImage(image []byte) (err error) {
+	span := b.f.startSpan("store", b.num)
+	defer func() {
+		span.End(err)
+	}()
+	defer func() {
+		if err != nil {
+			err = b.wrapErr("store", err)
+		}
+	}()
+
+	err = b.f.markChanged(b.num, b.num+1)
+	if err != nil {
+		return err
+	}
+	err = b.writeImage(image, 0)
+	if err != nil {
+		return err
+	}
+	if m := b.f.metrics; m != nil {
+		switch {
+		case len(image) == 0:
+			m.BlocksHole.Add(1)
+		case image[0] == blkCompressed:
+			m.BlocksCompressed.Add(1)
+		default:
+			m.BlocksRaw.Add(1)
+		}
+		m.BytesWritten.Add(int64(len(image)))
+	}
+
+	curOffset := b.f.blockOffset(b.num) + int64(len(image))
+	endOfBlock := b.f.blockOffset(b.num + 1)
+	o, err := b.f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if o < endOfBlock {
+		// Make sure the block doesn't become the last one
+		err = b.f.truncateFile(endOfBlock)
+		if err != nil {
+			return err
+		}
+		o = endOfBlock
+	}
+	if holeSize := o - curOffset; holeSize > 0 {
+		if holeSize > endOfBlock-curOffset {
+			holeSize = endOfBlock - curOffset
+		}
+		err = b.f.punchHole(curOffset, holeSize)
+		if err != nil {
+			return err
+		}
+	}
+	b.physSize = int64(len(image))
+	return b.f.autoSync()
+}
+
+// Range returns a reader of n bytes of the content starting at off, e.g. a partition of a disk
+// image. It uses ReadAt, so it has its own offset and the readers of different ranges can be
+// used concurrently.
+func (f *compFile) Range(off, n int64) *io.SectionReader {
+	return io.NewSectionReader(f, off, n)
+}
+
+// WriteRange writes length bytes of the content starting at offset to w, only loading the
+// blocks that cover the range. A negative length means up to the end of the file. The current
+// offset is not changed. Like with WriteTo, zeroes are skipped if w is a HolePuncher.
+func (f *compFile) WriteRange(w io.Writer, offset, length int64) (written int64, err error) {
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	end := size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	hw := newHoleWriter(w, f.writeChunk)
+	defer func() {
+		if err == nil {
+			err = hw.flush()
+		}
+	}()
+	buf := make([]byte, f.blockSize)
+	for offset < end {
+		// Read up to the end of the block, so that each block is only loaded once
+		chunk := buf[:f.blockSize-offset%f.blockSize]
+		if l := end - offset; int64(len(chunk)) > l {
+			chunk = chunk[:l]
+		}
+		n, rerr := f.ReadAt(chunk, offset)
+		if n > 0 {
+			_, err = hw.Write(chunk[:n])
+			if err != nil {
+				return
+			}
+			written += int64(n)
+			offset += int64(n)
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			return
+		}
+	}
+	return
+}
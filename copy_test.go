@@ -0,0 +1,233 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 8*bs+10)
+	for i := 3 * bs; i < 4*bs+5; i++ {
+		data[i] = 'x'
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := f.SeekData(0)
+	if err != nil || o != 3*bs {
+		t.Fatalf("SeekData: %d, %v", o, err)
+	}
+	o, err = f.SeekHole(3*bs + 1)
+	if err != nil || o != 5*bs {
+		t.Fatalf("SeekHole: %d, %v", o, err)
+	}
+	o, err = f.SeekData(5 * bs)
+	if err != nil || o != int64(len(data)) {
+		t.Fatalf("SeekData at the end: %d, %v", o, err)
+	}
+
+	// spgz to spgz, only the data blocks are transferred
+	var df memSparseFile
+	dst, err := NewFromSparseFileSize(&df, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	dst.SetMetrics(m)
+	n, err := Copy(dst, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Unexpected length: %d", n)
+	}
+	buf := make([]byte, len(data)+1)
+	r, _ := dst.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:r], data) {
+		t.Fatal("Data mismatch")
+	}
+	if c := m.BlocksCompressed.Value() + m.BlocksRaw.Value(); c != 2 {
+		t.Fatalf("Unexpected number of blocks written: %d", c)
+	}
+
+	// A sparse file to a plain writer
+	name := filepath.Join(t.TempDir(), "sparse")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = Copy(&out, NewSparseFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("Data mismatch (sparse file)")
+	}
+}
+
+func TestCopySlots(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 5*bs+100)
+	copy(data, bytes.Repeat([]byte("slots"), int(2*bs)/5))
+	rand.New(rand.NewSource(1)).Read(data[2*bs : 3*bs])
+	copy(data[4*bs:], bytes.Repeat([]byte("last"), int(bs)))
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var df memSparseFile
+	dst, err := NewFromSparseFileSize(&df, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwritten by the copy
+	_, err = dst.WriteAt(bytes.Repeat([]byte{'y'}, int(3*bs)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dst.Seek(0, os.SEEK_SET)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	dst.SetMetrics(m)
+	n, err := Copy(dst, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Unexpected length: %d", n)
+	}
+	// All blocks except the last one (which is not stored yet) are copied as they are
+	if c, _ := m.CompressTime.Count(); c != 0 {
+		t.Fatalf("Unexpected number of compressed blocks: %d", c)
+	}
+	if m.BlocksCompressed.Value() != 3 || m.BlocksRaw.Value() != 1 || m.BlocksHole.Value() != 1 {
+		t.Fatalf("Unexpected block counts: %s", m)
+	}
+	err = dst.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	df.Seek(0, os.SEEK_SET)
+	dst, err = NewFromSparseFile(&df, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data)+1)
+	r, _ := dst.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:r], data) {
+		t.Fatal("Data mismatch")
+	}
+	err = dst.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRange(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 10*bs)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tracer testTracer
+	f.SetTracer(&tracer)
+	var buf bytes.Buffer
+	n, err := f.WriteRange(&buf, 3*bs+10, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != bs || !bytes.Equal(buf.Bytes(), data[3*bs+10:4*bs+10]) {
+		t.Fatal("Data mismatch")
+	}
+	// The size is determined by loading the last block
+	if len(tracer.spans) != 3 || tracer.spans[1] != "load 3" || tracer.spans[2] != "load 4" {
+		t.Fatalf("Unexpected loads: %v", tracer.spans)
+	}
+
+	buf.Reset()
+	n, err = f.WriteRange(&buf, 8*bs, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2*bs || !bytes.Equal(buf.Bytes(), data[8*bs:]) {
+		t.Fatal("Data mismatch at the end")
+	}
+}
+
+func TestRange(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 4*bs)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := f.Range(bs+10, 2*bs)
+	if r.Size() != 2*bs {
+		t.Fatalf("Unexpected size: %d", r.Size())
+	}
+	_, err = r.Seek(5, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[bs+15:3*bs+10]) {
+		t.Fatal("Data mismatch")
+	}
+
+	// Past the end of the file
+	got, err = io.ReadAll(f.Range(3*bs, 2*bs))
+	if err != nil || !bytes.Equal(got, data[3*bs:]) {
+		t.Fatalf("Unexpected result: %d bytes, %v", len(got), err)
+	}
+}
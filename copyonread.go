@@ -0,0 +1,162 @@
+package spgz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A copy-on-read file starts out with the content of its base (a raw source or a parent) and,
+// unlike a differential archive or an overlay, stores every block it reads from the base, so that
+// the base is read at most once per block. This makes it a persistent cache in front of a slow
+// source such as a remote image. Files opened read-only don't store anything.
+
+var (
+	ErrRangesNotSupported = errors.New("The server does not support range requests")
+)
+
+// OpenSource opens a raw source for Options.Base: an http(s) URL or a local file or block device.
+func OpenSource(path string) (Base, error) {
+	if isURL(path) {
+		return NewHTTPBase(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewRawBase(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func (f *compFile) openSource(path string) (Base, error) {
+	if !isURL(path) {
+		path = f.resolvePath(path)
+	}
+	source, err := OpenSource(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open source %s: %w", path, err)
+	}
+	return source, nil
+}
+
+func (f *compFile) initSource(h *headerV2, path string) error {
+	source, err := f.openSource(path)
+	if err != nil {
+		return err
+	}
+	f.base = source
+	f.ownBase = true
+	f.setMeta(metaSourcePath, []byte(path))
+	h.Features |= featCopyOnRead
+	return f.initBase(h, source, false)
+}
+
+// populate stores a block that has just been read from the base.
+func (b *block) populate() error {
+	if !IsBlockZero(b.data) {
+		var err error
+		if b.f.blockStore != nil {
+			_, err = b.writeStored()
+		} else {
+			_, err = b.writeSlot()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.f.setPresent(b.num, b.num+1, true)
+}
+
+type rawBase struct {
+	*os.File
+	size int64
+}
+
+// NewRawBase makes a Base out of a regular file or a block device.
+func NewRawBase(file *os.File) (*rawBase, error) {
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	return &rawBase{
+		File: file,
+		size: size,
+	}, nil
+}
+
+func (b *rawBase) Size() (int64, error) {
+	return b.size, nil
+}
+
+type httpBase struct {
+	url    string
+	client *http.Client
+	size   int64
+}
+
+// NewHTTPBase makes a Base out of an http(s) URL. The server must support range requests.
+func NewHTTPBase(url string) (*httpBase, error) {
+	b := &httpBase{
+		url:    url,
+		client: http.DefaultClient,
+	}
+	resp, err := b.client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil, ErrRangesNotSupported
+	}
+	b.size = resp.ContentLength
+	return b, nil
+}
+
+func (b *httpBase) Size() (int64, error) {
+	return b.size, nil
+}
+
+func (b *httpBase) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset >= b.size {
+		return 0, io.EOF
+	}
+	l := int64(len(buf))
+	if remaining := b.size - offset; l > remaining {
+		l = remaining
+	}
+	if l == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+l-1))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, ErrRangesNotSupported
+	}
+	n, err := io.ReadFull(resp.Body, buf[:l])
+	if err == nil && l < int64(len(buf)) {
+		err = io.EOF
+	}
+	return n, err
+}
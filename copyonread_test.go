@@ -0,0 +1,121 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type countingBase struct {
+	*bytes.Reader
+	reads int
+}
+
+func (b *countingBase) ReadAt(p []byte, off int64) (int, error) {
+	b.reads++
+	return b.Reader.ReadAt(p, off)
+}
+
+func (b *countingBase) Size() (int64, error) {
+	return b.Reader.Size(), nil
+}
+
+func TestCopyOnRead(t *testing.T) {
+	data := make([]byte, 5*4095+123)
+	rand.Read(data[:3*4095])
+	base := &countingBase{Reader: bytes.NewReader(data)}
+
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize:  4096,
+		Base:       base,
+		CopyOnRead: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readAll := func() {
+		buf := make([]byte, len(data))
+		_, err := f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatal("Content differs")
+		}
+	}
+
+	readAll()
+	if base.reads == 0 {
+		t.Fatal("Nothing was read from the base")
+	}
+	base.reads = 0
+	readAll()
+	if base.reads != 0 {
+		t.Fatalf("%d reads from the base after the blocks were stored", base.reads)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		Base: base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll()
+	if base.reads != 0 {
+		t.Fatalf("%d reads from the base after reopening", base.reads)
+	}
+}
+
+func TestCopyOnReadHTTP(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.Read(data)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "spgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "cache.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		Source: srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source is opened automatically
+	f, err = OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("Content differs")
+	}
+}
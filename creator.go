@@ -0,0 +1,84 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// When a file is created, the program that created it, the time, the host name and an optional
+// comment are recorded as metadata records (see metadata.go). With Options.Reproducible the time
+// and the host name are left out. A version 1 header has no metadata
+// but the rest of its page is unused, so the records are written there; older versions of the
+// library ignore them.
+
+// Header describes the header of a file, see compFile.Header().
+type Header struct {
+	FormatVersion int // 1 or 2
+	BlockSize     int64
+
+	// Creator metadata, empty (or zero) if not recorded
+	Creator  string
+	Created  time.Time
+	Hostname string
+	Comment  string
+}
+
+// defaultCreator returns "spgz" followed by the version of the library if it's known.
+func defaultCreator() string {
+	creator := "spgz"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version := bi.Main.Version
+		if bi.Main.Path != "github.com/dop251/spgz" {
+			version = ""
+			for _, dep := range bi.Deps {
+				if dep.Path == "github.com/dop251/spgz" {
+					version = dep.Version
+				}
+			}
+		}
+		if version != "" {
+			creator += " " + version
+		}
+	}
+	return creator
+}
+
+func (f *compFile) setCreatorMeta(opts *Options) {
+	creator := opts.Creator
+	if creator == "" {
+		creator = defaultCreator()
+	}
+	f.setMeta(metaCreator, []byte(creator))
+	if !opts.Reproducible {
+		f.setMeta(metaCreated, binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+		if host, err := os.Hostname(); err == nil {
+			f.setMeta(metaHostname, []byte(host))
+		}
+	}
+	if opts.Comment != "" {
+		f.setMeta(metaComment, []byte(opts.Comment))
+	}
+}
+
+// Header returns the format version, the block size and the creator metadata of the file.
+func (f *compFile) Header() *Header {
+	f.Lock()
+	defer f.Unlock()
+	h := &Header{
+		FormatVersion: f.version,
+		BlockSize:     f.blockSize + 1,
+	}
+	h.setCreator(f.meta)
+	return h
+}
+
+func (h *Header) setCreator(meta map[uint16][]byte) {
+	h.Creator = string(meta[metaCreator])
+	h.Hostname = string(meta[metaHostname])
+	h.Comment = string(meta[metaComment])
+	if t := meta[metaCreated]; len(t) == 8 {
+		h.Created = time.Unix(0, int64(binary.LittleEndian.Uint64(t)))
+	}
+}
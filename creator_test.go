@@ -0,0 +1,73 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	for _, opts := range []*Options{{}, {ChangeTracking: true}} {
+		var sf memSparseFile
+		opts.Comment = "golden image"
+		f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte("data"), 0)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sf.Seek(0, os.SEEK_SET)
+		f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := f.Header()
+		version := 1
+		if opts.ChangeTracking {
+			version = 2
+		}
+		if h.FormatVersion != version || h.BlockSize != defBlockSize+1 {
+			t.Fatalf("Unexpected header: %+v", h)
+		}
+		if !strings.HasPrefix(h.Creator, "spgz") || h.Comment != "golden image" || time.Since(h.Created) > time.Minute {
+			t.Fatalf("Unexpected creator metadata: %+v", h)
+		}
+		if host, _ := os.Hostname(); h.Hostname != host {
+			t.Fatalf("Unexpected hostname: %s", h.Hostname)
+		}
+		f.Close()
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	data := bytes.Repeat([]byte("reproducible"), 100000)
+	var files [2]memSparseFile
+	for i := range files {
+		f, err := NewFromSparseFileOptions(&files[i], os.O_RDWR|os.O_CREATE, &Options{Reproducible: true, Comment: "build"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// Let the clock move
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if !bytes.Equal(files[0].data, files[1].data) {
+		t.Fatal("The files differ")
+	}
+}
@@ -0,0 +1,259 @@
+package spgz
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// Deduplication keeps a table with an entry per block after the other feature regions. An entry
+// holds the SHA-256 digest of a full block and, if the block has the same content as a block that
+// was stored before, the number of that block plus one. Such a block doesn't use its own slot,
+// it's read from the slot of the other block. The table is loaded into memory when the file is
+// opened.
+//
+// When a block whose slot is shared is overwritten, its data is first moved into the slot of one
+// of the blocks that refer to it and the others are pointed there.
+
+type dedupEntry struct {
+	Digest [sha256.Size]byte
+	Link   uint64
+}
+
+const (
+	dedupEntrySize = sha256.Size + 8
+)
+
+func (f *compFile) initDedup(h *headerV2, opts *Options) {
+	maxSize := opts.MaxTrackedSize
+	if maxSize <= 0 {
+		maxSize = defMaxTrackedSize
+	}
+	f.dedupEntries = (maxSize + f.blockSize - 1) / f.blockSize
+	f.dedupOffset = int64(h.DataOffset)
+	h.Features |= featDedup
+	h.DataOffset += uint64((f.dedupEntries*dedupEntrySize + headerSize - 1) &^ (headerSize - 1))
+
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(f.dedupOffset))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(f.dedupEntries))
+	f.setMeta(metaDedupTable, buf[:])
+	f.resetDedup()
+}
+
+func (f *compFile) resetDedup() {
+	f.digests = make(map[int64][sha256.Size]byte)
+	f.owners = make(map[[sha256.Size]byte]int64)
+	f.links = make(map[int64]int64)
+	f.refs = make(map[int64][]int64)
+}
+
+func (f *compFile) loadDedup() error {
+	meta := f.meta[metaDedupTable]
+	if len(meta) != 16 {
+		return ErrInvalidFormat
+	}
+	f.dedupOffset = int64(binary.LittleEndian.Uint64(meta))
+	f.dedupEntries = int64(binary.LittleEndian.Uint64(meta[8:]))
+	if f.dedupOffset < headerSize || f.dedupEntries < 0 ||
+		f.dedupEntries > (f.dataOffset-f.dedupOffset)/dedupEntrySize {
+		return ErrInvalidFormat
+	}
+	f.resetDedup()
+
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if o <= f.dataOffset {
+		return nil
+	}
+	blocks := (o-f.dataOffset)/(f.blockSize+1) + 1
+	if blocks > f.dedupEntries {
+		blocks = f.dedupEntries
+	}
+	r := bufio.NewReader(io.NewSectionReader(f.f, f.dedupOffset, blocks*dedupEntrySize))
+	var e dedupEntry
+	var empty [sha256.Size]byte
+	for num := int64(0); num < blocks; num++ {
+		err = binary.Read(r, binary.LittleEndian, &e)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// The rest of the table has never been written
+				break
+			}
+			return err
+		}
+		if e.Digest == empty {
+			continue
+		}
+		f.digests[num] = e.Digest
+		if e.Link != 0 {
+			f.links[num] = int64(e.Link - 1)
+		} else {
+			f.owners[e.Digest] = num
+		}
+	}
+	for num, owner := range f.links {
+		if _, isLink := f.links[owner]; isLink || f.digests[owner] != f.digests[num] {
+			return ErrInvalidFormat
+		}
+		f.refs[owner] = append(f.refs[owner], num)
+	}
+	for _, refs := range f.refs {
+		sortBlocks(refs)
+	}
+	return nil
+}
+
+func sortBlocks(a []int64) {
+	sort.Slice(a, func(i, j int) bool {
+		return a[i] < a[j]
+	})
+}
+
+// slotOf returns the number of the block whose slot holds the data of block num.
+func (f *compFile) slotOf(num int64) int64 {
+	if owner, exists := f.links[num]; exists {
+		return owner
+	}
+	return num
+}
+
+func (f *compFile) writeDedupEntry(num int64, digest [sha256.Size]byte, link int64) error {
+	var buf [dedupEntrySize]byte
+	copy(buf[:], digest[:])
+	binary.LittleEndian.PutUint64(buf[sha256.Size:], uint64(link+1))
+	_, err := f.f.WriteAt(buf[:], f.dedupOffset+num*dedupEntrySize)
+	return err
+}
+
+// dedup returns whether the block is eligible for deduplication and if so, its digest and
+// the number of an identical block that is already stored or -1.
+func (b *block) dedup(inBase bool) (bool, [sha256.Size]byte, int64) {
+	f := b.f
+	if f.features&featDedup == 0 || inBase || b.num >= f.dedupEntries ||
+		int64(len(b.data)) != f.blockSize || IsBlockZero(b.data) {
+		return false, [sha256.Size]byte{}, -1
+	}
+	digest := sha256.Sum256(b.data)
+	if owner, exists := f.owners[digest]; exists {
+		return true, digest, owner
+	}
+	return true, digest, -1
+}
+
+// addDedup records the digest of a stored block, owner is the block it shares the slot with or -1.
+func (f *compFile) addDedup(num int64, digest [sha256.Size]byte, owner int64) error {
+	f.digests[num] = digest
+	if owner >= 0 {
+		f.links[num] = owner
+		f.refs[owner] = append(f.refs[owner], num)
+	} else {
+		f.owners[digest] = num
+	}
+	return f.writeDedupEntry(num, digest, owner)
+}
+
+// release removes block num from the table before its slot is overwritten. If other blocks
+// share the slot, the data is moved to the first of them.
+func (f *compFile) release(num int64) error {
+	digest, exists := f.digests[num]
+	if !exists {
+		return nil
+	}
+	delete(f.digests, num)
+	if owner, isLink := f.links[num]; isLink {
+		delete(f.links, num)
+		refs := f.refs[owner]
+		for i, r := range refs {
+			if r == num {
+				refs = append(refs[:i], refs[i+1:]...)
+				break
+			}
+		}
+		if len(refs) > 0 {
+			f.refs[owner] = refs
+		} else {
+			delete(f.refs, owner)
+		}
+		return f.writeDedupEntry(num, [sha256.Size]byte{}, -1)
+	}
+
+	refs := f.refs[num]
+	delete(f.refs, num)
+	if len(refs) == 0 {
+		delete(f.owners, digest)
+		return f.writeDedupEntry(num, [sha256.Size]byte{}, -1)
+	}
+
+	newOwner := refs[0]
+	b := &block{
+		f: f,
+	}
+	err := b.load(num)
+	if err != nil {
+		return err
+	}
+	if int64(len(b.data)) != f.blockSize {
+		return ErrInvalidFormat
+	}
+	b.num = newOwner
+	_, err = b.writeSlot()
+	if err != nil {
+		return err
+	}
+	delete(f.links, newOwner)
+	f.owners[digest] = newOwner
+	err = f.writeDedupEntry(newOwner, digest, -1)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs[1:] {
+		f.links[r] = newOwner
+		err = f.writeDedupEntry(r, digest, newOwner)
+		if err != nil {
+			return err
+		}
+	}
+	if len(refs) > 1 {
+		f.refs[newOwner] = refs[1:]
+	}
+	return f.writeDedupEntry(num, [sha256.Size]byte{}, -1)
+}
+
+// releaseRange releases blocks [from, to), see release().
+func (f *compFile) releaseRange(from, to int64) error {
+	if len(f.digests) == 0 {
+		return nil
+	}
+	var links, owners []int64
+	for num := range f.digests {
+		if num >= from && num < to {
+			if _, isLink := f.links[num]; isLink {
+				links = append(links, num)
+			} else {
+				owners = append(owners, num)
+			}
+		}
+	}
+	// Releasing the links first avoids moving data into slots that are about to be released
+	for _, num := range append(links, owners...) {
+		err := f.release(num)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DedupStats returns the number of blocks that are deduplicated (i.e. share the slot of another
+// block) and the number of distinct stored blocks they refer to.
+func (f *compFile) DedupStats() (shared, distinct int) {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.links), len(f.refs)
+}
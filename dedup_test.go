@@ -0,0 +1,110 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize:      4096,
+		Dedup:          true,
+		MaxTrackedSize: 16 * 4095,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := int(f.BlockSize())
+
+	blocks := make([][]byte, 4)
+	for i := range blocks {
+		blocks[i] = make([]byte, bs)
+		rand.Read(blocks[i])
+	}
+	// A B A A C B and a partial A
+	var expected []byte
+	for _, i := range []int{0, 1, 0, 0, 2, 1} {
+		expected = append(expected, blocks[i]...)
+	}
+	expected = append(expected, blocks[0][:100]...)
+
+	check := func(shared, distinct int) {
+		s, d := f.DedupStats()
+		if s != shared || d != distinct {
+			t.Fatalf("DedupStats: %d, %d, expected %d, %d", s, d, shared, distinct)
+		}
+		_, err := f.Seek(0, os.SEEK_SET)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatal("Content differs")
+		}
+	}
+
+	_, err = f.WriteAt(expected, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(3, 2)
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(3, 2)
+
+	// Overwriting the block the others refer to moves the data
+	_, err = f.WriteAt(blocks[3], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(expected, blocks[3])
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(2, 2)
+
+	err = f.PunchHole(int64(2*bs), int64(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[2*bs:3*bs], make([]byte, bs))
+	check(1, 1)
+
+	err = f.Truncate(int64(4*bs + 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = expected[:4*bs+10]
+	check(0, 0)
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(0, 0)
+}
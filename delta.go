@@ -0,0 +1,424 @@
+package spgz
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The delta protocol transfers the content of a source to a target over a stream, sending only
+// the blocks that differ. All integers are little endian.
+//
+//  source -> target: "SPGZDLT1", block size (u64), source size (u64)
+//  target -> source: number of digests (u64), SHA-256 digest of each block of the target
+//  source -> target: records of block number (u64), type (u8), length (u32), data;
+//                    terminated by a block number of 0xffffffffffffffff
+//  target -> source: status (u8), 0 for success, otherwise followed by the length of the
+//                    error message (u32) and the message
+//
+// The data of a deltaData record is the content of the block compressed as a single gzip member,
+// which is what the slot of a compressed block holds, so blocks of spgz files are sent in their
+// stored form (see rawblock.go) when both ends use the same block size. The data of a deltaRaw
+// record is the content itself, a deltaZero record has no data.
+
+const (
+	deltaMagic = "SPGZDLT1"
+	deltaEnd   = ^uint64(0)
+
+	maxDeltaBlockSize = 64 * 1024 * 1024
+)
+
+const (
+	deltaData byte = iota
+	deltaZero
+	deltaRaw
+)
+
+var (
+	ErrDeltaProtocol = errors.New("Delta protocol error")
+)
+
+// DeltaTarget is the receiving end of a delta transfer, normally an spgz file.
+type DeltaTarget interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncatable
+	PunchHole(offset, size int64) error
+	Size() (int64, error)
+}
+
+// DeltaStats describes a completed delta transfer.
+type DeltaStats struct {
+	Blocks    int64 // total number of blocks in the source
+	Changed   int64 // number of blocks that were transferred
+	BytesSent int64 // size of the transferred block data
+}
+
+// DeltaError is an error reported by the target.
+type DeltaError struct {
+	Message string
+}
+
+func (e *DeltaError) Error() string {
+	return "Target: " + e.Message
+}
+
+// rawBlockReader and rawBlockWriter are implemented by spgz files, see rawblock.go.
+type rawBlockReader interface {
+	BlockSize() int64
+	ReadBlockRaw(num int64) ([]byte, BlockType, error)
+}
+
+type rawBlockWriter interface {
+	BlockSize() int64
+	WriteBlockRaw(num int64, typ BlockType, payload []byte) error
+}
+
+type deltaHeader struct {
+	Magic     [8]byte
+	BlockSize uint64
+	Size      uint64
+}
+
+type deltaRecord struct {
+	Num    uint64
+	Type   byte
+	Length uint32
+}
+
+// SendDelta transfers size bytes of src to the target on the other end of conn in blocks of
+// blockSize bytes. If src is an spgz file with that block size, the blocks are sent in their
+// stored form rather than compressed again.
+func SendDelta(conn io.ReadWriter, src io.ReaderAt, size, blockSize int64) (*DeltaStats, error) {
+	if blockSize <= 0 || blockSize > maxDeltaBlockSize {
+		return nil, ErrInvalidOptions
+	}
+	w := bufio.NewWriter(conn)
+	h := deltaHeader{
+		BlockSize: uint64(blockSize),
+		Size:      uint64(size),
+	}
+	copy(h.Magic[:], deltaMagic)
+	err := binary.Write(w, binary.LittleEndian, &h)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint64
+	err = binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	blocks := (size + blockSize - 1) / blockSize
+	if count > uint64(blocks)+1 {
+		return nil, ErrDeltaProtocol
+	}
+	digests := make([]byte, count*sha256.Size)
+	_, err = io.ReadFull(conn, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DeltaStats{
+		Blocks: blocks,
+	}
+	buf := make([]byte, blockSize)
+	var e deltaEncoder
+	if raw, ok := src.(rawBlockReader); ok && raw.BlockSize() == blockSize {
+		e.raw = raw
+	}
+	for num := int64(0); num < blocks; num++ {
+		data := buf
+		if remaining := size - num*blockSize; remaining < blockSize {
+			data = buf[:remaining]
+		}
+		n, err := src.ReadAt(data, num*blockSize)
+		if err != nil && !(err == io.EOF && n == len(data)) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return stats, err
+		}
+		if uint64(num) < count {
+			digest := sha256.Sum256(data)
+			if bytes.Equal(digest[:], digests[num*sha256.Size:(num+1)*sha256.Size]) {
+				continue
+			}
+		}
+		typ, payload, err := e.encode(num, data)
+		if err != nil {
+			return stats, err
+		}
+		rec := deltaRecord{
+			Num:    uint64(num),
+			Type:   typ,
+			Length: uint32(len(payload)),
+		}
+		err = binary.Write(w, binary.LittleEndian, &rec)
+		if err == nil {
+			_, err = w.Write(payload)
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Changed++
+		stats.BytesSent += int64(len(payload))
+	}
+	err = binary.Write(w, binary.LittleEndian, &deltaRecord{Num: deltaEnd})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, readDeltaStatus(conn)
+}
+
+// deltaEncoder returns the type and the data of the records of the blocks that are sent.
+type deltaEncoder struct {
+	raw  rawBlockReader
+	comp bytes.Buffer
+	z    *gzip.Writer
+}
+
+func (e *deltaEncoder) encode(num int64, data []byte) (byte, []byte, error) {
+	if IsBlockZero(data) {
+		return deltaZero, nil, nil
+	}
+	if e.raw != nil {
+		payload, typ, err := e.raw.ReadBlockRaw(num)
+		if err == nil {
+			switch typ {
+			case BlockCompressed:
+				return deltaData, payload, nil
+			case BlockUncompressed:
+				return deltaRaw, payload, nil
+			}
+			return deltaZero, nil, nil
+		}
+		if !errors.Is(err, ErrUnsupportedFeatures) {
+			return 0, nil, err
+		}
+		// The blocks are not in the slots (e.g. they are in a block store)
+		e.raw = nil
+	}
+	e.comp.Reset()
+	if e.z == nil {
+		e.z = newGzipWriter(&e.comp)
+	} else {
+		e.z.Reset(&e.comp)
+	}
+	e.z.Write(data)
+	e.z.Close()
+	if e.comp.Len() >= len(data) {
+		return deltaRaw, data, nil
+	}
+	return deltaData, e.comp.Bytes(), nil
+}
+
+// readDeltaStatus reads the status sent by the target, see reportDeltaError.
+func readDeltaStatus(r io.Reader) error {
+	var status [1]byte
+	_, err := io.ReadFull(r, status[:])
+	if err != nil {
+		return err
+	}
+	if status[0] != 0 {
+		var l uint32
+		err = binary.Read(r, binary.LittleEndian, &l)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, l)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return err
+		}
+		return &DeltaError{Message: string(msg)}
+	}
+	return nil
+}
+
+// ReceiveDelta applies a transfer from SendDelta on the other end of conn to t. Errors that
+// happen while applying the changes are also reported to the sender.
+func ReceiveDelta(conn io.ReadWriter, t DeltaTarget) error {
+	r := bufio.NewReader(conn)
+	var h deltaHeader
+	err := binary.Read(r, binary.LittleEndian, &h)
+	if err != nil {
+		return err
+	}
+	if string(h.Magic[:]) != deltaMagic || h.BlockSize == 0 || h.BlockSize > maxDeltaBlockSize {
+		return ErrDeltaProtocol
+	}
+	blockSize := int64(h.BlockSize)
+
+	err = sendDigests(conn, t, blockSize)
+	if err != nil {
+		return err
+	}
+
+	err = applyDelta(r, t, blockSize, int64(h.Size))
+	if err != nil {
+		if !errors.Is(err, ErrDeltaProtocol) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			reportDeltaError(conn, err)
+		}
+		return err
+	}
+	_, err = conn.Write([]byte{0})
+	return err
+}
+
+func sendDigests(conn io.Writer, t DeltaTarget, blockSize int64) error {
+	size, err := t.Size()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	count := (size + blockSize - 1) / blockSize
+	err = binary.Write(w, binary.LittleEndian, uint64(count))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, blockSize)
+	for num := int64(0); num < count; num++ {
+		data := buf
+		if remaining := size - num*blockSize; remaining < blockSize {
+			data = buf[:remaining]
+		}
+		n, err := t.ReadAt(data, num*blockSize)
+		if err != nil && !(err == io.EOF && n == len(data)) {
+			return err
+		}
+		digest := sha256.Sum256(data)
+		_, err = w.Write(digest[:])
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// applyDelta writes the records to t. If t is an spgz file with the transfer's block size, the
+// blocks are stored in the form they are received in.
+func applyDelta(r io.Reader, t DeltaTarget, blockSize, size int64) error {
+	raw, ok := t.(rawBlockWriter)
+	if !ok || raw.BlockSize() != blockSize {
+		raw = nil
+	}
+	buf := make([]byte, blockSize)
+	var payload []byte
+	var z *gzip.Reader
+	for {
+		var rec deltaRecord
+		err := binary.Read(r, binary.LittleEndian, &rec)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if rec.Num == deltaEnd {
+			break
+		}
+		off := int64(rec.Num) * blockSize
+		if rec.Num > uint64(size/blockSize) || off >= size {
+			return ErrDeltaProtocol
+		}
+		l := blockSize
+		if remaining := size - off; remaining < l {
+			l = remaining
+		}
+		switch rec.Type {
+		case deltaZero:
+			if rec.Length != 0 {
+				return ErrDeltaProtocol
+			}
+			err = t.PunchHole(off, l)
+		case deltaRaw:
+			if int64(rec.Length) != l {
+				return ErrDeltaProtocol
+			}
+			err = readDeltaPayload(r, buf[:l])
+			if err != nil {
+				return err
+			}
+			if raw != nil {
+				err = raw.WriteBlockRaw(int64(rec.Num), BlockUncompressed, buf[:l])
+				if !errors.Is(err, ErrUnsupportedFeatures) {
+					break
+				}
+				raw = nil
+			}
+			_, err = t.WriteAt(buf[:l], off)
+		case deltaData:
+			// The data is smaller than the block, otherwise it would have been sent raw
+			if rec.Length < 18 || int64(rec.Length) > l {
+				return ErrDeltaProtocol
+			}
+			if cap(payload) < int(rec.Length) {
+				payload = make([]byte, rec.Length)
+			}
+			payload = payload[:rec.Length]
+			err = readDeltaPayload(r, payload)
+			if err != nil {
+				return err
+			}
+			if raw != nil {
+				if int64(binary.LittleEndian.Uint32(payload[len(payload)-4:])) != l {
+					return ErrDeltaProtocol
+				}
+				err = raw.WriteBlockRaw(int64(rec.Num), BlockCompressed, payload)
+				if !errors.Is(err, ErrUnsupportedFeatures) {
+					break
+				}
+				// Deduplicated files need the data of the blocks
+				raw = nil
+			}
+			if z == nil {
+				z, err = gzip.NewReader(bytes.NewReader(payload))
+			} else {
+				err = z.Reset(bytes.NewReader(payload))
+			}
+			if err != nil {
+				return ErrDeltaProtocol
+			}
+			z.Multistream(false)
+			if _, err = io.ReadFull(z, buf[:l]); err != nil {
+				return ErrDeltaProtocol
+			}
+			_, err = t.WriteAt(buf[:l], off)
+		default:
+			return ErrDeltaProtocol
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return t.Truncate(size)
+}
+
+func readDeltaPayload(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func reportDeltaError(w io.Writer, err error) {
+	msg := err.Error()
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(msg)))
+	buf.WriteString(msg)
+	w.Write(buf.Bytes())
+}
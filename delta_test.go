@@ -0,0 +1,145 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	var sf, df memSparseFile
+	src, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewFromSparseFileSize(&df, os.O_RDWR|os.O_CREATE, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := src.BlockSize()
+
+	data := make([]byte, 10*bs+123)
+	rand.Read(data)
+	_, err = dst.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The target has an extra block which must be truncated away
+	_, err = dst.WriteAt(data[:bs], int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[3*bs] ^= 1
+	for i := 5 * bs; i < 6*bs; i++ {
+		data[i] = 0
+	}
+	_, err = src.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ReceiveDelta(c2, dst)
+		c2.Close()
+	}()
+	stats, err := SendDelta(c1, src, int64(len(data)), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+	// block 3, block 5 and the last (partial) block
+	if stats.Blocks != 11 || stats.Changed != 3 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	size, err := dst.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	buf := make([]byte, len(data))
+	_, err = dst.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data differs")
+	}
+}
+
+func TestDeltaRaw(t *testing.T) {
+	var sf, df memSparseFile
+	src, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewFromSparseFileSize(&df, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := src.BlockSize()
+
+	data := make([]byte, 3*bs)
+	rand.Read(data[:bs])
+	copy(data[bs:], bytes.Repeat([]byte("delta "), int(2*bs/6)))
+	_, err = src.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ReceiveDelta(c2, dst)
+		c2.Close()
+	}()
+	stats, err := SendDelta(c1, src, int64(len(data)), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks are sent and stored as they are in the source
+	var sent int64
+	for num := int64(0); num < 3; num++ {
+		payload, typ, err := src.ReadBlockRaw(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []BlockType{BlockUncompressed, BlockCompressed, BlockCompressed}[num]; typ != want {
+			t.Fatalf("Block %d: unexpected type %d", num, typ)
+		}
+		sent += int64(len(payload))
+		dpayload, dtyp, err := dst.ReadBlockRaw(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dtyp != typ || !bytes.Equal(dpayload, payload) {
+			t.Fatalf("Block %d is stored differently", num)
+		}
+	}
+	if stats.Changed != 3 || stats.BytesSent != sent {
+		t.Fatalf("Unexpected stats: %+v, expected %d bytes", stats, sent)
+	}
+	buf := make([]byte, len(data))
+	_, err = dst.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data differs")
+	}
+}
@@ -0,0 +1,229 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// A differential archive refers to a base (normally another spgz file) and only stores the blocks
+// that differ from it. A bitmap between the header and the first block records which blocks are
+// present in the archive itself, the rest are read from the base. The size and the SHA-256 digest
+// of the base are recorded in the header.
+
+var (
+	ErrBaseRequired = errors.New("The file is a differential archive and requires a base")
+	ErrBaseMismatch = errors.New("The base does not match the one the archive was created with")
+)
+
+// Base is the read-only image a differential archive refers to. It is satisfied by the values
+// returned by OpenFile() and friends.
+type Base interface {
+	io.ReaderAt
+	Size() (int64, error)
+}
+
+// Digest returns the SHA-256 digest of the first size bytes of r.
+func Digest(r io.ReaderAt, size int64) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (f *compFile) initBase(h *headerV2, base Base, diff bool) error {
+	size, err := base.Size()
+	if err != nil {
+		return err
+	}
+	if diff {
+		digest, err := Digest(base, size)
+		if err != nil {
+			return err
+		}
+		f.setMeta(metaBaseDigest, digest)
+		h.Features |= featDiff
+	}
+	f.base = base
+	f.baseSize = size
+	f.mapBlocks = (size + f.blockSize - 1) / f.blockSize
+	f.present = make([]byte, (f.mapBlocks+7)/8)
+	f.mapOffset = int64(h.DataOffset)
+
+	h.Features |= featBase
+	h.MapOffset = h.DataOffset
+	h.MapBlocks = uint64(f.mapBlocks)
+	h.BaseSize = uint64(size)
+	h.DataOffset += uint64((int64(len(f.present)) + headerSize - 1) &^ (headerSize - 1))
+	return nil
+}
+
+// openBase only checks the size of the base, reading all of it on every open would defeat the
+// purpose of a differential archive. See VerifyBase().
+func (f *compFile) openBase(h *headerV2, base Base) error {
+	if base == nil {
+		return ErrBaseRequired
+	}
+	size, err := base.Size()
+	if err != nil {
+		return err
+	}
+	if size != int64(h.BaseSize) {
+		return ErrBaseMismatch
+	}
+	mapBytes := (int64(h.MapBlocks) + 7) / 8
+	if h.MapOffset < headerSize || int64(h.MapOffset)+mapBytes > f.dataOffset {
+		return ErrInvalidFormat
+	}
+	f.base = base
+	f.baseSize = size
+	f.mapBlocks = int64(h.MapBlocks)
+	f.mapOffset = int64(h.MapOffset)
+	f.present = make([]byte, mapBytes)
+	n, err := f.f.ReadAt(f.present, f.mapOffset)
+	if err == io.EOF {
+		for i := n; i < len(f.present); i++ {
+			f.present[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+// BaseDigest returns the SHA-256 digest of the base recorded in a differential archive or nil.
+func (f *compFile) BaseDigest() []byte {
+	return f.meta[metaBaseDigest]
+}
+
+// VerifyBase reads the whole base and checks it against the recorded digest. It returns
+// ErrBaseMismatch if it does not match. Overlays don't record a digest, for them it does nothing.
+func (f *compFile) VerifyBase() error {
+	if f.BaseDigest() == nil {
+		return nil
+	}
+	digest, err := Digest(f.base, f.baseSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, f.BaseDigest()) {
+		return ErrBaseMismatch
+	}
+	return nil
+}
+
+// Materialize writes the content of the file to t, skipping blocks that consist entirely of
+// zeroes, and truncates t to the size of the file. For a differential archive this produces a
+// full copy that no longer depends on the base.
+func (f *compFile) Materialize(t Target) error {
+	return f.MaterializeContext(context.Background(), t)
+}
+
+// MaterializeContext is like Materialize but stops with ctx.Err() if the context is done.
+func (f *compFile) MaterializeContext(ctx context.Context, t Target) error {
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, f.blockSize)
+	for off := int64(0); off < size; off += f.blockSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.ReadAt(buf, off)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+		if IsBlockZero(buf[:n]) {
+			continue
+		}
+		_, err = t.WriteAt(buf[:n], off)
+		if err != nil {
+			return err
+		}
+	}
+	return t.Truncate(size)
+}
+
+func (f *compFile) isPresent(num int64) bool {
+	if num >= f.mapBlocks {
+		return true
+	}
+	return f.present[num/8]&(1<<uint(num%8)) != 0
+}
+
+// setPresent updates the map for blocks [from, to). Blocks past the end of the base are always present.
+func (f *compFile) setPresent(from, to int64, present bool) error {
+	if to > f.mapBlocks {
+		to = f.mapBlocks
+	}
+	if from >= to {
+		return nil
+	}
+	changed := false
+	for num := from; num < to; num++ {
+		if f.isPresent(num) != present {
+			f.present[num/8] ^= 1 << uint(num%8)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err := f.f.WriteAt(f.present[from/8:(to-1)/8+1], f.mapOffset+from/8)
+	return err
+}
+
+// copyUp stores the base content of a block in the file itself.
+func (f *compFile) copyUp(num int64) error {
+	if f.loaded && f.block.num == num {
+		f.block.prepareWrite()
+		f.block.dirty = true
+		return nil
+	}
+	b := &block{
+		f: f,
+	}
+	err := b.load(num)
+	if err != nil {
+		return err
+	}
+	return b.store(false)
+}
+
+// loadBase loads l bytes of the block from the base.
+func (b *block) loadBase(l int) error {
+	b.data = b.dataBlock[:l]
+	b.blockIsRaw = false
+	b.dirty = false
+	n, err := b.f.base.ReadAt(b.data, b.num*b.f.blockSize)
+	if err == io.EOF {
+		for i := n; i < l; i++ {
+			b.data[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+// matchesBase returns true if the block is full and identical to the corresponding block of the
+// base, in which case a differential archive doesn't need to store it.
+func (b *block) matchesBase() (bool, error) {
+	if b.f.features&featDiff == 0 || b.num >= b.f.mapBlocks || int64(len(b.data)) != b.f.blockSize {
+		return false, nil
+	}
+	if b.f.baseBuf == nil {
+		b.f.baseBuf = make([]byte, b.f.blockSize)
+	}
+	n, err := b.f.base.ReadAt(b.f.baseBuf, b.num*b.f.blockSize)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for i := n; i < len(b.f.baseBuf); i++ {
+		b.f.baseBuf[i] = 0
+	}
+	return bytes.Equal(b.data, b.f.baseBuf), nil
+}
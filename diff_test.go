@@ -0,0 +1,157 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	var bf memSparseFile
+	base, err := NewFromSparseFileSize(&bf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := base.BlockSize()
+	data := make([]byte, 4*bs+100)
+	rand.Read(data)
+	_, err = base.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = base.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify block 1, extend past the base and zero the last block of the base
+	modified := append([]byte(nil), data...)
+	modified[bs+10] ^= 0xff
+	modified = append(modified, make([]byte, bs)...)
+	for i := 4 * bs; i < 5*bs; i++ {
+		modified[i] = 0
+	}
+
+	var df memSparseFile
+	f, err := NewFromSparseFileOptions(&df, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize: 4096,
+		Base:      base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, bytes.NewReader(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	df.Seek(0, os.SEEK_SET)
+	_, err = NewFromSparseFile(&df, os.O_RDONLY)
+	if err != ErrBaseRequired {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	df.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&df, os.O_RDONLY, &Options{Base: base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, present := range []bool{false, true, false, false, true, true} {
+		if f.isPresent(int64(num)) != present {
+			t.Fatalf("Block %d: present is %v", num, !present)
+		}
+	}
+
+	buf := make([]byte, len(modified))
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, modified) {
+		t.Fatal("Merged view differs")
+	}
+	err = f.VerifyBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mf memSparseFile
+	m, err := NewFromSparseFileSize(&mf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Materialize(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, len(modified))
+	_, err = m.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, modified) {
+		t.Fatal("Materialized file differs")
+	}
+
+	_, err = base.WriteAt([]byte{1}, 10*bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df.Seek(0, os.SEEK_SET)
+	_, err = NewFromSparseFileOptions(&df, os.O_RDONLY, &Options{Base: base})
+	if err != ErrBaseMismatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDiffTruncate(t *testing.T) {
+	var bf memSparseFile
+	base, err := NewFromSparseFileSize(&bf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := base.BlockSize()
+	data := make([]byte, 3*bs)
+	for i := range data {
+		data[i] = 'x'
+	}
+	_, err = base.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var df memSparseFile
+	f, err := NewFromSparseFileOptions(&df, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize: 4096,
+		Base:      base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks that are truncated away must not reappear from the base
+	err = f.Truncate(bs + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(3 * bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3*bs)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRange(buf, 0, int(bs+10), 'x', t)
+	expectRange(buf, int(bs+10), int(2*bs-10), 0, t)
+}
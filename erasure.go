@@ -0,0 +1,470 @@
+package spgz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Erasure coding across segments. The data segments are divided into stripes of Stripe
+// consecutive segments and for each stripe Parity parity segments are kept, named <name>.p000,
+// <name>.p001 and so on (Parity per stripe, in stripe order). Byte n of a parity segment is a
+// Reed-Solomon parity symbol (see reedsolomon.go) computed over byte n of the data segments in the
+// stripe, so any Parity files of a stripe (data or parity) can be lost and rebuilt from the rest
+// by RepairSegments(). It's meant for long term storage where a segment is on a separate disk or
+// medium.
+//
+// The layout is recorded in a manifest, <name>.ec, along with the size of the file, so that the
+// number and the sizes of the segments are known even if the last ones are lost. Like the parity
+// records (see parity.go), the parity segments are brought up to date when the file is synced or
+// closed, and the manifest has a dirty flag which is set before the first modification. A dirty
+// manifest found on opening for writing causes all parity to be recomputed.
+
+const (
+	ecMagic = "SPGZEC01"
+
+	defSegmentStripe = 4
+	ecChunk          = 1024 * 1024
+)
+
+var (
+	ErrSegmentParityOutdated = errors.New("The segment parity is not up to date, open the file for writing and close it first")
+)
+
+type ecManifest struct {
+	Magic       [8]byte
+	Stripe      uint32
+	Parity      uint32
+	SegmentSize uint64
+	Size        uint64
+	Dirty       uint32
+	Reserved    uint32
+}
+
+type segmentErasure struct {
+	m     ecManifest
+	codec *rsCodec
+	dirty map[int64]map[int64]struct{} // stripe -> chunks
+	all   bool
+}
+
+func manifestName(name string) string {
+	return name + ".ec"
+}
+
+func paritySegmentName(name string, i int) string {
+	return fmt.Sprintf("%s.p%03d", name, i)
+}
+
+func readManifest(name string) (*ecManifest, error) {
+	data, err := os.ReadFile(manifestName(name))
+	if err != nil {
+		return nil, err
+	}
+	var m ecManifest
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &m)
+	if err != nil || string(m.Magic[:]) != ecMagic || m.SegmentSize == 0 {
+		return nil, ErrInvalidFormat
+	}
+	return &m, nil
+}
+
+func writeManifest(name string, m *ecManifest, perm os.FileMode) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, m)
+	file, err := os.OpenFile(manifestName(name), os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(buf.Bytes(), 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// segments returns the number of data segments.
+func (m *ecManifest) segments() int {
+	n := int((int64(m.Size) + int64(m.SegmentSize) - 1) / int64(m.SegmentSize))
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// segmentLen returns the expected size of data segment i.
+func (m *ecManifest) segmentLen(i int) int64 {
+	n := m.segments()
+	switch {
+	case i < n-1:
+		return int64(m.SegmentSize)
+	case i == n-1:
+		return int64(m.Size) - int64(i)*int64(m.SegmentSize)
+	}
+	return 0
+}
+
+func (f *segmentedFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *segmentedFile) initErasure(m *ecManifest, opts *SegmentOptions) error {
+	ec := &segmentErasure{
+		dirty: make(map[int64]map[int64]struct{}),
+	}
+	if m == nil {
+		stripe := opts.Stripe
+		if stripe <= 0 {
+			stripe = defSegmentStripe
+		}
+		copy(ec.m.Magic[:], ecMagic)
+		ec.m.Stripe = uint32(stripe)
+		ec.m.Parity = uint32(opts.Parity)
+		ec.m.SegmentSize = uint64(f.size)
+		ec.m.Dirty = 1
+		err := writeManifest(f.name, &ec.m, f.perm)
+		if err != nil {
+			return err
+		}
+	} else {
+		ec.m = *m
+	}
+	var err error
+	ec.codec, err = newRSCodec(int(ec.m.Stripe), int(ec.m.Parity))
+	if err != nil {
+		return err
+	}
+	ec.all = ec.m.Dirty != 0 && f.writable()
+	f.ec = ec
+	return nil
+}
+
+// markDirty marks the range of segment i as modified.
+func (f *segmentedFile) markDirty(i int, offset, size int64) error {
+	ec := f.ec
+	if ec == nil || size <= 0 {
+		return nil
+	}
+	stripe := int64(i / int(ec.m.Stripe))
+	chunks := ec.dirty[stripe]
+	if chunks == nil {
+		chunks = make(map[int64]struct{})
+		ec.dirty[stripe] = chunks
+	}
+	for c := offset / ecChunk; c <= (offset+size-1)/ecChunk; c++ {
+		chunks[c] = struct{}{}
+	}
+	if ec.m.Dirty == 0 {
+		ec.m.Dirty = 1
+		return writeManifest(f.name, &ec.m, f.perm)
+	}
+	return nil
+}
+
+// readChunk reads a chunk of a segment, the part beyond the end reads as zeroes.
+func readChunk(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+func (ec *segmentErasure) newShards() [][]byte {
+	shards := make([][]byte, ec.m.Stripe+ec.m.Parity)
+	for i := range shards {
+		shards[i] = make([]byte, ecChunk)
+	}
+	return shards
+}
+
+// updateErasure recomputes the parity of the modified chunks and writes a clean manifest.
+func (f *segmentedFile) updateErasure() error {
+	ec := f.ec
+	if ec == nil || !f.writable() || ec.m.Dirty == 0 {
+		return nil
+	}
+	k, p := int(ec.m.Stripe), int(ec.m.Parity)
+	stripes := int64((len(f.segments) + k - 1) / k)
+	if ec.all {
+		for s := int64(0); s < stripes; s++ {
+			f.markDirty(int(s)*k, 0, f.size)
+		}
+	}
+	shards := ec.newShards()
+	for s, chunks := range ec.dirty {
+		if s >= stripes {
+			continue
+		}
+		var maxLen int64
+		for i := int(s) * k; i < int(s+1)*k && i < len(f.segments); i++ {
+			l, err := f.segments[i].Seek(0, os.SEEK_END)
+			if err != nil {
+				return err
+			}
+			if l > maxLen {
+				maxLen = l
+			}
+		}
+		files := make([]*os.File, p)
+		closeAll := func() {
+			for _, file := range files {
+				if file != nil {
+					file.Close()
+				}
+			}
+		}
+		for j := range files {
+			file, err := os.OpenFile(paritySegmentName(f.name, int(s)*p+j), os.O_RDWR|os.O_CREATE, f.perm)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			files[j] = file
+		}
+		for c := range chunks {
+			offset := c * ecChunk
+			if offset >= maxLen {
+				continue
+			}
+			l := maxLen - offset
+			if l > ecChunk {
+				l = ecChunk
+			}
+			sh := make([][]byte, k+p)
+			for i := range sh {
+				sh[i] = shards[i][:l]
+			}
+			for d := 0; d < k; d++ {
+				if seg := int(s)*k + d; seg < len(f.segments) {
+					err := readChunk(f.segments[seg], sh[d], offset)
+					if err != nil {
+						closeAll()
+						return err
+					}
+				} else {
+					clear(sh[d])
+				}
+			}
+			ec.codec.encode(sh)
+			for j, file := range files {
+				_, err := file.WriteAt(sh[k+j], offset)
+				if err != nil {
+					closeAll()
+					return err
+				}
+			}
+		}
+		for _, file := range files {
+			err := file.Truncate(maxLen)
+			if err == nil {
+				err = file.Sync()
+			}
+			if err != nil {
+				closeAll()
+				return err
+			}
+		}
+		closeAll()
+	}
+	// The parity of the stripes that no longer exist
+	for i := int(stripes) * p; exists(paritySegmentName(f.name, i)); i++ {
+		err := os.Remove(paritySegmentName(f.name, i))
+		if err != nil {
+			return err
+		}
+	}
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	ec.m.Size = uint64(size)
+	ec.m.Dirty = 0
+	err = writeManifest(f.name, &ec.m, f.perm)
+	if err != nil {
+		return err
+	}
+	ec.all = false
+	clear(ec.dirty)
+	return nil
+}
+
+// RepairSegments rebuilds the segments (data or parity) of an erasure coded segmented file that
+// are missing or have the wrong size. It returns the names of the rebuilt files. If a stripe has
+// lost more files than it has parity segments, the other stripes are still repaired and an error
+// wrapping ErrUnrepairable is returned.
+func RepairSegments(name string) ([]string, error) {
+	m, err := readManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	if m.Dirty != 0 {
+		return nil, ErrSegmentParityOutdated
+	}
+	k, p := int(m.Stripe), int(m.Parity)
+	codec, err := newRSCodec(k, p)
+	if err != nil {
+		return nil, err
+	}
+	n := m.segments()
+	var (
+		repaired     []string
+		unrepairable error
+	)
+	shards := make([][]byte, k+p)
+	for i := range shards {
+		shards[i] = make([]byte, ecChunk)
+	}
+	for s := 0; s*k < n; s++ {
+		names := make([]string, k+p)
+		sizes := make([]int64, k+p)
+		var maxLen int64
+		for d := 0; d < k; d++ {
+			names[d] = segmentName(name, s*k+d)
+			sizes[d] = m.segmentLen(s*k + d)
+			if sizes[d] > maxLen {
+				maxLen = sizes[d]
+			}
+		}
+		for j := 0; j < p; j++ {
+			names[k+j] = paritySegmentName(name, s*p+j)
+			sizes[k+j] = maxLen
+		}
+		present := make([]bool, k+p)
+		lost := 0
+		for i := range names {
+			if i < k && s*k+i >= n {
+				// Beyond the end, reads as zeroes
+				present[i] = true
+				continue
+			}
+			fi, err := os.Stat(names[i])
+			present[i] = err == nil && fi.Size() == sizes[i]
+			if !present[i] {
+				lost++
+			}
+		}
+		if lost == 0 {
+			continue
+		}
+		if lost > p {
+			if unrepairable == nil {
+				unrepairable = fmt.Errorf("%w: stripe %d has lost %d files", ErrUnrepairable, s, lost)
+			}
+			continue
+		}
+		err := repairStripe(codec, names, sizes, present, maxLen, shards)
+		if err != nil {
+			return repaired, err
+		}
+		for i, ok := range present {
+			if !ok {
+				repaired = append(repaired, names[i])
+			}
+		}
+	}
+	return repaired, unrepairable
+}
+
+func repairStripe(codec *rsCodec, names []string, sizes []int64, present []bool, maxLen int64, shards [][]byte) error {
+	files := make([]*os.File, len(names))
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for i, name := range names {
+		if sizes[i] == 0 && present[i] {
+			continue
+		}
+		var err error
+		if present[i] {
+			files[i], err = os.Open(name)
+		} else {
+			files[i], err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sh := make([][]byte, len(shards))
+	for offset := int64(0); offset < maxLen; offset += ecChunk {
+		l := maxLen - offset
+		if l > ecChunk {
+			l = ecChunk
+		}
+		for i := range sh {
+			sh[i] = shards[i][:l]
+			if present[i] {
+				if files[i] == nil {
+					clear(sh[i])
+				} else {
+					err := readChunk(files[i], sh[i], offset)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		err := codec.reconstruct(sh, present)
+		if err != nil {
+			return err
+		}
+		for i, file := range files {
+			if present[i] || offset >= sizes[i] {
+				continue
+			}
+			data := sh[i]
+			if r := sizes[i] - offset; r < int64(len(data)) {
+				data = data[:r]
+			}
+			if IsBlockZero(data) {
+				// Keep it sparse
+				continue
+			}
+			_, err = file.WriteAt(data, offset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i, file := range files {
+		if present[i] {
+			continue
+		}
+		err := file.Truncate(sizes[i])
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeErasure removes the parity segments and the manifest.
+func removeErasure(name string) error {
+	for i := 0; exists(paritySegmentName(name, i)); i++ {
+		err := os.Remove(paritySegmentName(name, i))
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Remove(manifestName(name))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
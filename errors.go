@@ -0,0 +1,76 @@
+package spgz
+
+import (
+	"fmt"
+)
+
+// BlockError is returned when loading or storing a block fails. Err is the underlying error,
+// which errors.Is() and errors.As() see through.
+type BlockError struct {
+	Op     string // "load" or "store"
+	Num    int64  // block number
+	Offset int64  // offset of the block in the uncompressed data
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("Could not %s block %d (offset %d): %v", e.Op, e.Num, e.Offset, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+func (b *block) wrapErr(op string, err error) error {
+	if _, ok := err.(*BlockError); ok {
+		return err
+	}
+	return &BlockError{
+		Op:     op,
+		Num:    b.num,
+		Offset: b.num * b.f.blockSize,
+		Err:    err,
+	}
+}
+
+// FlushError is returned by Close() when the pending changes could not be stored. The underlying
+// file is closed nevertheless.
+type FlushError struct {
+	Err error
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("Could not store the pending changes: %v", e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCorruptBlock is returned (wrapped in a BlockError) when the stored data of a block cannot be
+// decoded. PhysOffset is the location of the block's slot in the file.
+type ErrCorruptBlock struct {
+	Num        int64
+	PhysOffset int64
+	Cause      error
+}
+
+func (e *ErrCorruptBlock) Error() string {
+	return fmt.Sprintf("Block %d at physical offset %d is corrupt: %v", e.Num, e.PhysOffset, e.Cause)
+}
+
+func (e *ErrCorruptBlock) Unwrap() error {
+	return e.Cause
+}
+
+func (b *block) corrupt(cause error) error {
+	err := &ErrCorruptBlock{
+		Num:        b.num,
+		PhysOffset: b.f.blockOffset(b.f.slotOf(b.num)),
+		Cause:      cause,
+	}
+	if b.f.log != nil {
+		b.f.log.Error("spgz: corrupt block", "file", b.f.name, "block", err.Num, "physOffset", err.PhysOffset, "err", cause)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package spgz
+
+import (
+	"io"
+	"math"
+)
+
+// EstimateOptions control EstimateSize.
+type EstimateOptions struct {
+	// BlockSize is the block size of the archive, as in Options.
+	BlockSize int64
+
+	// Blocks is the number of randomly chosen blocks to compress, 0 to compress all of them.
+	// Seed seeds the choice.
+	Blocks int
+	Seed   int64
+}
+
+// SizeEstimate is the result of EstimateSize.
+type SizeEstimate struct {
+	Size   int64 // size of the source
+	Blocks int64 // number of blocks in the source
+
+	Sampled    int64 // number of blocks that were compressed
+	ZeroBlocks int64 // sampled blocks of zeroes
+	RawBlocks  int64 // sampled blocks that would be stored uncompressed
+	Stored     int64 // total stored size of the sampled blocks
+
+	// Allocated is the predicted space allocated for the archive, Margin the half-width of the
+	// 95% confidence interval of the prediction (0 if all blocks were compressed).
+	Allocated int64
+	Margin    int64
+}
+
+// Ratio returns Allocated divided by Size, 0 if Size is 0.
+func (e *SizeEstimate) Ratio() float64 {
+	if e.Size == 0 {
+		return 0
+	}
+	return float64(e.Allocated) / float64(e.Size)
+}
+
+// EstimateSize predicts the space an archive of src, which is size bytes long, would take without
+// writing it. The blocks are checked for zeroes and compressed as they would be, each taking the
+// pages its slot spans (see fragmentation.go). With Blocks set only a sample is compressed and the
+// result is extrapolated, otherwise the prediction is the ideal size of a new file without
+// features, as reported by Fragmentation().
+func EstimateSize(src io.ReaderAt, size int64, opts *EstimateOptions) (*SizeEstimate, error) {
+	if opts == nil {
+		opts = &EstimateOptions{}
+	}
+	blockSize := int64(defBlockSize)
+	if opts.BlockSize >= 4096 {
+		blockSize = opts.BlockSize - 1
+	}
+	e := &SizeEstimate{
+		Size:   size,
+		Blocks: (size + blockSize - 1) / blockSize,
+	}
+	n := opts.Blocks
+	if n <= 0 || int64(n) > e.Blocks {
+		n = int(e.Blocks)
+	}
+	sample := sampleBlocks(e.Blocks, n, opts.Seed)
+
+	data := make([]byte, blockSize)
+	var buf []byte
+	var sum, sumSq float64
+	for _, num := range sample {
+		offset := num * blockSize
+		l := min(blockSize, size-offset)
+		_, err := src.ReadAt(data[:l], offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		e.Sampled++
+		var alloc int64
+		if IsBlockZero(data[:l]) {
+			e.ZeroBlocks++
+		} else {
+			var image []byte
+			image, err = compressImage(buf, data[:l])
+			if err != nil {
+				return nil, err
+			}
+			buf = image
+			if image[0] == blkUncompressed {
+				e.RawBlocks++
+			}
+			stored := int64(len(image))
+			e.Stored += stored
+			start := headerSize + num*(blockSize+1)
+			alloc = roundUp(start+stored, allocPage) - start&^(allocPage-1)
+		}
+		sum += float64(alloc)
+		sumSq += float64(alloc) * float64(alloc)
+	}
+
+	e.Allocated = headerSize
+	if e.Sampled == 0 {
+		return e, nil
+	}
+	N, m := float64(e.Blocks), float64(e.Sampled)
+	mean := sum / m
+	e.Allocated += int64(math.Round(mean * N))
+	if e.Sampled < e.Blocks && e.Sampled > 1 {
+		variance := (sumSq - sum*mean) / (m - 1)
+		// Sampling without replacement from a finite number of blocks
+		fpc := (N - m) / (N - 1)
+		e.Margin = int64(math.Round(1.96 * N * math.Sqrt(max(variance, 0)/m*fpc)))
+	}
+	return e, nil
+}
@@ -0,0 +1,55 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateSize(t *testing.T) {
+	bs := int64(defBlockSize)
+	// Compressible, zero and random blocks
+	data := bytes.Repeat([]byte("estimate "), int(40*bs)/9)
+	clear(data[10*bs : 20*bs])
+	rand.Read(data[30*bs : 35*bs])
+
+	name := filepath.Join(t.TempDir(), "estimate.spgz")
+	f, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err := f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := bytes.NewReader(data)
+	e, err := EstimateSize(src, int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Blocks != 40 || e.Sampled != 40 || e.ZeroBlocks != 10 || e.Margin != 0 {
+		t.Fatalf("Unexpected counts: %+v", e)
+	}
+	if e.Allocated != fr.Ideal || e.Stored != fr.Stored {
+		t.Fatalf("Estimate %+v does not match %+v", e, fr)
+	}
+
+	s, err := EstimateSize(src, int64(len(data)), &EstimateOptions{Blocks: 20, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Sampled != 20 || s.Margin <= 0 {
+		t.Fatalf("Unexpected sample: %+v", s)
+	}
+	if s.Allocated < e.Allocated-2*s.Margin || s.Allocated > e.Allocated+2*s.Margin {
+		t.Fatalf("Sample estimate %d ± %d is too far off %d", s.Allocated, s.Margin, e.Allocated)
+	}
+}
@@ -0,0 +1,72 @@
+package spgz
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrInsufficientSpace = errors.New("Not enough free space")
+)
+
+// ExpandInPlace is the reverse of ConvertInPlace(): it turns the compressed file name into its
+// raw content, without needing the space for a copy. The blocks are expanded from the first one
+// to the last: the raw data of a block never reaches past the end of its own slot, so it only
+// overwrites slots that have been read already. Blocks of zeroes become holes. opts is passed
+// to OpenFileOptions(), e.g. for the base of a differential archive.
+//
+// The free space of the filesystem is checked first and ErrInsufficientSpace is returned if the
+// data (except the zeroes) doesn't fit. Like ConvertInPlace, the expansion can't be resumed if
+// it's interrupted. Segmented files and files that use dedup are rejected with
+// ErrUnsupportedFeatures.
+func ExpandInPlace(name string, opts *Options) error {
+	f, err := OpenFileOptions(name, os.O_RDWR, 0, opts)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, ok := f.f.(*sparseFile); !ok || f.features&featDedup != 0 {
+		return ErrUnsupportedFeatures
+	}
+
+	s, err := f.Stats()
+	if err != nil {
+		return err
+	}
+	if free := freeSpace(f.f); free >= 0 && s.Allocated >= 0 {
+		if needed := (s.Blocks-s.HoleBlocks)*f.blockSize - s.Allocated; needed > free {
+			return ErrInsufficientSpace
+		}
+	}
+
+	f.Lock()
+	b := &block{
+		f: f,
+	}
+	for num := int64(0); num < s.Blocks; num++ {
+		err = b.load(num)
+		if err != nil {
+			break
+		}
+		if IsBlockZero(b.data) {
+			err = f.f.PunchHole(num*f.blockSize, int64(len(b.data)))
+		} else {
+			_, err = f.f.WriteAt(b.data, num*f.blockSize)
+		}
+		if err != nil {
+			err = b.wrapErr("store", err)
+			break
+		}
+	}
+	if err == nil {
+		err = f.f.Truncate(s.Size)
+	}
+	if err == nil {
+		err = f.f.Sync()
+	}
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,53 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandInPlace(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int64{0, 100, 3*4096 + 10, 9 * 4096} {
+		name := filepath.Join(dir, "expand.spgz")
+		data := make([]byte, size)
+		rnd := rand.New(rand.NewSource(size))
+		for i := int64(0); i < size; i += 4096 {
+			end := i + 4096
+			if end > size {
+				end = size
+			}
+			switch (i / 4096) % 3 {
+			case 0:
+				copy(data[i:end], bytes.Repeat([]byte("expand"), 700))
+			case 1:
+				rnd.Read(data[i:end])
+			}
+		}
+		f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, &Options{BlockSize: 4096})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(data, 0)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ExpandInPlace(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d: data mismatch", size)
+		}
+	}
+}
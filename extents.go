@@ -0,0 +1,124 @@
+package spgz
+
+// Extent is a range of a file with the same status, see Extents().
+type Extent struct {
+	Start, Length int64
+
+	// Depth is the number of bases (or parents) the range is read through: 0 for blocks stored in
+	// the file itself, 1 for blocks read from its base and so on.
+	Depth int
+
+	// Present is false for holes that don't hide anything: the ones at the bottom of the chain
+	// (or past the end of the base). Zero is true for ranges that read as zeroes.
+	Present bool
+	Zero    bool
+}
+
+// Extents returns the layout of the file, much like qemu-img map: consecutive ranges that are
+// stored in the same file of the chain of bases and are either data or holes. Blocks are holes if
+// they consist entirely of zeroes, see SeekHole(). A base that is not an spgz file is reported as
+// data.
+func (f *compFile) Extents() ([]Extent, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	return f.extents(nil, 0, size, 0)
+}
+
+// extents appends the extents of [start, end) to e, their depth is increased by depth.
+func (f *compFile) extents(e []Extent, start, end int64, depth int) ([]Extent, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.flushBlock()
+	if err != nil {
+		return e, err
+	}
+	buf := make([]byte, f.blockSize+1)
+	for start < end {
+		num := start / f.blockSize
+		next := (num + 1) * f.blockSize
+		if next > end {
+			next = end
+		}
+		if !f.isPresent(num) {
+			// Read from the base, as are the blocks that follow
+			for next < end && !f.isPresent(next/f.blockSize) {
+				next += f.blockSize
+				if next > end {
+					next = end
+				}
+			}
+			e, err = f.baseExtents(e, start, next, depth+1)
+			if err != nil {
+				return e, err
+			}
+			start = next
+			continue
+		}
+		hole := false
+		if _, isLink := f.links[num]; !isLink {
+			_, hole, err = f.slotType(num, buf)
+			if err != nil {
+				return e, err
+			}
+		}
+		e = appendExtent(e, Extent{
+			Start:   start,
+			Length:  next - start,
+			Depth:   depth,
+			Present: !hole || f.base != nil && num < f.mapBlocks,
+			Zero:    hole,
+		})
+		start = next
+	}
+	return e, nil
+}
+
+// baseExtents appends the extents of [start, end) of the base. The file must be locked.
+func (f *compFile) baseExtents(e []Extent, start, end int64, depth int) ([]Extent, error) {
+	baseEnd := end
+	if baseEnd > f.baseSize {
+		baseEnd = f.baseSize
+	}
+	var err error
+	if start < baseEnd {
+		if b, ok := f.base.(*compFile); ok {
+			e, err = b.extents(e, start, baseEnd, depth)
+			if err != nil {
+				return e, err
+			}
+		} else {
+			e = appendExtent(e, Extent{
+				Start:   start,
+				Length:  baseEnd - start,
+				Depth:   depth,
+				Present: true,
+			})
+		}
+		start = baseEnd
+	}
+	if start < end {
+		// The part of the last block past the end of the base
+		e = appendExtent(e, Extent{
+			Start:  start,
+			Length: end - start,
+			Depth:  depth,
+			Zero:   true,
+		})
+	}
+	return e, nil
+}
+
+// appendExtent appends x to e, merging it with the last extent if they have the same status.
+func appendExtent(e []Extent, x Extent) []Extent {
+	if l := len(e); l > 0 {
+		last := &e[l-1]
+		if last.Start+last.Length == x.Start && last.Depth == x.Depth && last.Present == x.Present && last.Zero == x.Zero {
+			last.Length += x.Length
+			return e
+		}
+	}
+	return append(e, x)
+}
@@ -0,0 +1,82 @@
+package spgz
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExtents(t *testing.T) {
+	var bf, df memSparseFile
+	base, err := NewFromSparseFileSize(&bf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := base.BlockSize()
+	rnd := rand.New(rand.NewSource(1))
+
+	// Data, a hole, data, data and 2 holes
+	data := make([]byte, 6*bs)
+	rnd.Read(data[:bs])
+	rnd.Read(data[2*bs : 4*bs])
+	_, err = base.WriteAt(data, 0)
+	if err == nil {
+		err = base.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base.Extents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: bs, Present: true},
+		{Start: bs, Length: bs, Zero: true},
+		{Start: 2 * bs, Length: 2 * bs, Present: true},
+		{Start: 4 * bs, Length: 2 * bs, Zero: true},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Fatalf("Unexpected extents of the base: %+v", e)
+	}
+
+	f, err := NewFromSparseFileOptions(&df, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize: 4096,
+		Base:      base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first 2 blocks and the last 2 ones of the base are unchanged, then come a modified
+	// block, a block of zeroes, a block past the end of the base and a short hole
+	data = append(data, make([]byte, 2*bs-100)...)
+	rnd.Read(data[2*bs : 3*bs])
+	for i := 3 * bs; i < 4*bs; i++ {
+		data[i] = 0
+	}
+	rnd.Read(data[6*bs : 7*bs])
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = f.Extents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Extent{
+		{Start: 0, Length: bs, Depth: 1, Present: true},
+		{Start: bs, Length: bs, Depth: 1, Zero: true},
+		{Start: 2 * bs, Length: bs, Present: true},
+		{Start: 3 * bs, Length: bs, Present: true, Zero: true},
+		{Start: 4 * bs, Length: 2 * bs, Depth: 1, Zero: true},
+		{Start: 6 * bs, Length: bs, Present: true},
+		{Start: 7 * bs, Length: bs - 100, Zero: true},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Fatalf("Unexpected extents: %+v", e)
+	}
+}
@@ -0,0 +1,77 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// The ownership, the permission bits and the timestamps of the source of a file can be recorded in
+// the header with Options.FileAttrs and restored from FileAttrs(). They are kept in a metadata
+// record (see metadata.go): the mode, the uid and the gid as 32-bit values followed by the access
+// and the modification times as 64-bit nanoseconds since the epoch.
+
+const fileAttrsLen = 3*4 + 2*8
+
+// FileAttrs describes the metadata of a file, see GetFileAttrs(). Uid and Gid are -1 if unknown.
+type FileAttrs struct {
+	Mode       os.FileMode // permission bits, setuid, setgid and sticky
+	Uid, Gid   int
+	AccessTime time.Time
+	ModTime    time.Time
+}
+
+const fileAttrsModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func (a *FileAttrs) marshal() []byte {
+	buf := make([]byte, 0, fileAttrsLen)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(a.Mode&fileAttrsModeMask))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(int32(a.Uid)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(int32(a.Gid)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(a.AccessTime.UnixNano()))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(a.ModTime.UnixNano()))
+	return buf
+}
+
+func unmarshalFileAttrs(buf []byte) (*FileAttrs, error) {
+	if len(buf) != fileAttrsLen {
+		return nil, ErrInvalidFormat
+	}
+	return &FileAttrs{
+		Mode:       os.FileMode(binary.LittleEndian.Uint32(buf)) & fileAttrsModeMask,
+		Uid:        int(int32(binary.LittleEndian.Uint32(buf[4:]))),
+		Gid:        int(int32(binary.LittleEndian.Uint32(buf[8:]))),
+		AccessTime: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[12:]))),
+		ModTime:    time.Unix(0, int64(binary.LittleEndian.Uint64(buf[20:]))),
+	}, nil
+}
+
+// FileAttrs returns the file metadata recorded in the header, nil if there is none.
+func (f *compFile) FileAttrs() (*FileAttrs, error) {
+	f.Lock()
+	data := f.meta[metaFileAttrs]
+	f.Unlock()
+	if data == nil {
+		return nil, nil
+	}
+	return unmarshalFileAttrs(data)
+}
+
+// SetFileAttrs applies attrs to the named file. The ownership is changed first because that may
+// clear the setuid and setgid bits. Like SetXattrs() it carries on if a step fails (e.g. changing
+// the owner requires privileges) and returns the first error.
+func SetFileAttrs(name string, attrs *FileAttrs) error {
+	var first error
+	if attrs.Uid >= 0 || attrs.Gid >= 0 {
+		first = os.Chown(name, attrs.Uid, attrs.Gid)
+	}
+	err := os.Chmod(name, attrs.Mode&fileAttrsModeMask)
+	if err != nil && first == nil {
+		first = err
+	}
+	err = os.Chtimes(name, attrs.AccessTime, attrs.ModTime)
+	if err != nil && first == nil {
+		first = err
+	}
+	return first
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+import (
+	"os"
+)
+
+// GetFileAttrs returns the mode and the modification time of the named file, the ownership is
+// unknown and the access time is reported as the modification time on this platform.
+func GetFileAttrs(name string) (*FileAttrs, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAttrs{
+		Mode:       fi.Mode() & fileAttrsModeMask,
+		Uid:        -1,
+		Gid:        -1,
+		AccessTime: fi.ModTime(),
+		ModTime:    fi.ModTime(),
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// GetFileAttrs returns the ownership, the mode and the timestamps of the named file.
+func GetFileAttrs(name string) (*FileAttrs, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return &FileAttrs{
+		Mode:       fi.Mode() & fileAttrsModeMask,
+		Uid:        int(st.Uid),
+		Gid:        int(st.Gid),
+		AccessTime: time.Unix(st.Atim.Unix()),
+		ModTime:    fi.ModTime(),
+	}, nil
+}
@@ -0,0 +1,60 @@
+package spgz
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileAttrs(t *testing.T) {
+	attrs := &FileAttrs{
+		Mode:       0640 | os.ModeSetgid,
+		Uid:        1000,
+		Gid:        -1,
+		AccessTime: time.Unix(1600000000, 123),
+		ModTime:    time.Unix(1500000000, 456),
+	}
+
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{FileAttrs: attrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := f.FileAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil || res.Mode != attrs.Mode || res.Uid != attrs.Uid || res.Gid != attrs.Gid ||
+		!res.AccessTime.Equal(attrs.AccessTime) || !res.ModTime.Equal(attrs.ModTime) {
+		t.Fatalf("Unexpected attributes: %+v", res)
+	}
+
+	name := filepath.Join(t.TempDir(), "file")
+	err = os.WriteFile(name, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the mode and the times, the ownership can't be changed without privileges
+	err = SetFileAttrs(name, &FileAttrs{Mode: 0604, Uid: -1, Gid: -1, AccessTime: attrs.AccessTime, ModTime: attrs.ModTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetFileAttrs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode != 0604 || !got.ModTime.Equal(attrs.ModTime) {
+		t.Fatalf("Unexpected attributes: %+v", got)
+	}
+}
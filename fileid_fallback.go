@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+type fileID struct{}
+
+// identify returns false, files are not identified.
+func identify(f SparseFile) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"syscall"
+)
+
+type fileID struct {
+	dev, ino uint64
+}
+
+// identify returns the identity of the underlying file, false if it doesn't have one.
+func identify(f SparseFile) (fileID, bool) {
+	rc := rawConn(f)
+	if rc == nil {
+		return fileID{}, false
+	}
+	var st syscall.Stat_t
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.Fstat(int(fd), &st)
+	})
+	if err != nil || cerr != nil {
+		return fileID{}, false
+	}
+	return fileID{
+		dev: uint64(st.Dev),
+		ino: st.Ino,
+	}, true
+}
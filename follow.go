@@ -0,0 +1,62 @@
+package spgz
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Follow is like WriteTo but doesn't stop at the end of the file: it waits for another process
+// to append to the file and writes the new data as it appears, polling every interval, much like
+// tail -f. It returns when ctx is done or on error. The writer is expected to only append, data
+// that is modified behind the current offset is not written again.
+//
+// A final block that can't be decoded is assumed to be in the middle of being written and is
+// retried on the next poll.
+func (f *compFile) Follow(ctx context.Context, w io.Writer, interval time.Duration) (n int64, err error) {
+	retrying := false
+	for {
+		var written int64
+		written, err = f.WriteToContext(ctx, w)
+		n += written
+		if err != nil {
+			var ce *ErrCorruptBlock
+			if !errors.As(err, &ce) {
+				return
+			}
+			tail, terr := f.isTail(ce.Num)
+			if terr != nil {
+				return n, terr
+			}
+			if retrying && !tail {
+				// It's been written completely by now
+				return
+			}
+			retrying = true
+		} else {
+			retrying = false
+		}
+		if written == 0 || retrying {
+			if !sleepContext(ctx, interval) {
+				return n, ctx.Err()
+			}
+		}
+		err = f.Refresh()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isTail returns true if block num is stored in the last slot of the file.
+func (f *compFile) isTail(num int64) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return false, err
+	}
+	return f.blockOffset(f.slotOf(num)+1) >= o, nil
+}
@@ -0,0 +1,88 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Len()
+}
+
+func TestFollow(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "follow.spgz")
+	w, err := OpenFileSize(name, os.O_RDWR|os.O_CREATE, 0666, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	data := bytes.Repeat([]byte("follow me "), 5000)
+	_, err = w.Write(data[:10000])
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	done := make(chan error)
+	go func() {
+		_, err := r.Follow(ctx, &out, time.Millisecond)
+		done <- err
+	}()
+
+	for off := 10000; off < len(data); off += 7000 {
+		end := off + 7000
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err = w.Write(data[off:end])
+		if err == nil {
+			err = w.Sync()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for out.Len() < len(data) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	err = <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("Data mismatch, got %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,177 @@
+package spgz
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// Every block has a slot of BlockSize()+1 bytes and its stored form usually takes only a part of
+// it. The rest of the slot is the slack; normally it's a hole, so it takes no space, but it
+// remains allocated if punching the hole failed when the block was rewritten with a smaller size,
+// or the file was copied by a tool that doesn't preserve holes. Compact() releases it.
+//
+// The ideal size of a file is the header and the tables plus, for every block stored in its own
+// slot, the pages spanned by the stored form of the block. Finding the stored size of a
+// compressed block requires decompressing it, so measuring the file reads all of it.
+
+const allocPage = 4096
+
+// Fragmentation describes the space usage of a file as far as compaction is concerned, see
+// Fragmentation().
+type Fragmentation struct {
+	Allocated int64 // space allocated for the file, -1 if unknown
+	Ideal     int64 // space needed for the header and the stored blocks
+
+	Blocks     int64 // blocks stored in their own slot (blocks of zeroes are not stored)
+	ZeroBlocks int64 // blocks of zeroes, their slots are all slack
+	Stored     int64 // total stored size of the blocks
+
+	// Slack is the space in the slots that is not taken by the stored blocks, AllocatedSlack
+	// the part of it that is allocated (-1 if unknown) and SlackSlots the number of slots that
+	// have allocated slack.
+	Slack          int64
+	AllocatedSlack int64
+	SlackSlots     int64
+
+	// Fill counts the stored blocks by the part of the slot they take: Fill[0] those that take
+	// less than 10%, Fill[9] those that take 90% or more.
+	Fill [10]int64
+}
+
+// Percent returns the allocated space as a percentage of the ideal size, 0 if it's unknown.
+func (fr *Fragmentation) Percent() int {
+	if fr.Allocated < 0 || fr.Ideal <= 0 {
+		return 0
+	}
+	return int(fr.Allocated * 100 / fr.Ideal)
+}
+
+// Fragmentation measures the space usage of the file. It reads and decompresses all blocks.
+// Blocks that share a slot, are read from the base or the parent, or kept in a block store are
+// not counted, except for the references to the block store.
+func (f *compFile) Fragmentation() (*Fragmentation, error) {
+	f.Lock()
+	defer f.Unlock()
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.fragmentation()
+}
+
+// fragmentation measures the file and records its ideal size.
+func (f *compFile) fragmentation() (*Fragmentation, error) {
+	size, err := f.size()
+	if err != nil {
+		return nil, err
+	}
+	fileSize, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	fr := &Fragmentation{
+		Allocated:      allocatedSize(f.f),
+		Ideal:          roundUp(f.dataOffset, allocPage),
+		AllocatedSlack: -1,
+	}
+	ds, _ := f.f.(DataSeeker)
+	if ds != nil {
+		fr.AllocatedSlack = 0
+	}
+	b := &block{
+		f: f,
+	}
+	buf := make([]byte, f.blockSize+1)
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	for num := int64(0); num < blocks; num++ {
+		if !f.isPresent(num) || f.slotOf(num) != num {
+			continue
+		}
+		typ, hole, err := f.slotType(num, buf)
+		if err != nil {
+			return nil, err
+		}
+		var stored int64
+		switch {
+		case hole:
+			fr.ZeroBlocks++
+		case typ == blkCompressed:
+			err = b.load(num)
+			var ce *ErrCorruptBlock
+			if errors.As(err, &ce) {
+				// It can't be measured, count the whole slot
+				stored = f.blockSize + 1
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			stored = b.physSize
+		case typ == blkStored:
+			stored = 1 + sha256.Size
+		default:
+			stored = f.blockSize + 1
+		}
+
+		start := f.blockOffset(num)
+		dataEnd := start + stored
+		slotEnd := min(f.blockOffset(num+1), fileSize)
+		if stored > 0 {
+			fr.Blocks++
+			fr.Stored += stored
+			fr.Ideal += roundUp(dataEnd, allocPage) - start&^(allocPage-1)
+			fr.Fill[min(stored*10/(f.blockSize+1), 9)]++
+		}
+		if slotEnd > dataEnd {
+			fr.Slack += slotEnd - dataEnd
+			if ds != nil {
+				// Pages shared with the data or the next slot can't be released
+				n, err := allocatedRange(ds, roundUp(dataEnd, allocPage), slotEnd&^(allocPage-1))
+				if err != nil {
+					return nil, err
+				}
+				if n > 0 {
+					fr.AllocatedSlack += n
+					fr.SlackSlots++
+				}
+			}
+		}
+	}
+
+	f.lastIdeal = fr.Ideal
+	if !f.readOnly {
+		var data [8]byte
+		binary.LittleEndian.PutUint64(data[:], uint64(fr.Ideal))
+		f.setMeta(metaIdealSize, data[:])
+		err = f.writeMeta()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fr, nil
+}
+
+// allocatedRange returns how much of [start, end) is not a hole.
+func allocatedRange(ds DataSeeker, start, end int64) (n int64, err error) {
+	for start < end {
+		var data, hole int64
+		data, err = ds.SeekData(start)
+		if err != nil || data >= end {
+			return
+		}
+		hole, err = ds.SeekHole(data)
+		if err != nil {
+			return
+		}
+		hole = min(hole, end)
+		n += hole - data
+		start = hole
+	}
+	return
+}
+
+func roundUp(n, to int64) int64 {
+	return (n + to - 1) &^ (to - 1)
+}
@@ -0,0 +1,87 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFragmentation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fragmentation.spgz")
+	f, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	// Two compressible blocks, a block of zeroes and another compressible one
+	data := bytes.Repeat([]byte("fragmentation"), int(4*bs)/13)
+	clear(data[2*bs : 3*bs])
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := f.ReadBlockRaw(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Blocks != 3 || fr.ZeroBlocks != 1 || fr.Fill[0] != 3 {
+		t.Fatalf("Unexpected counts: %+v", fr)
+	}
+	if fr.Stored <= 0 || fr.Slack < 3*(bs+1)-fr.Stored {
+		t.Fatalf("Unexpected sizes: %+v", fr)
+	}
+	if fr.AllocatedSlack > 0 {
+		t.Fatalf("Slack is allocated: %+v", fr)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the slack of slot 0
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := f.blockOffset(0) + 1 + int64(len(raw))
+	_, err = file.WriteAt(bytes.Repeat([]byte{0xff}, int(f.blockOffset(1)-end)), end)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fr, err = f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.AllocatedSlack < 0 {
+		t.Skip("Holes are not reported")
+	}
+	if fr.SlackSlots != 1 || fr.AllocatedSlack < bs/2 {
+		t.Fatalf("Slack not reported: %+v", fr)
+	}
+	err = f.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err = f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.SlackSlots != 0 || fr.AllocatedSlack != 0 {
+		t.Fatalf("Slack not released: %+v", fr)
+	}
+}
@@ -0,0 +1,108 @@
+package spgz
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A gzipFile reads a plain gzip file sequentially, so that tools that extract spgz files can
+// handle .gz files the same way (see Sniff()). There is no random access.
+
+type gzipFile struct {
+	r        io.ReaderAt
+	physSize int64
+	z        *gzip.Reader
+	size     int64 // -1 until known
+	closer   io.Closer
+}
+
+// NewGzipReader returns a reader of the gzip stream of the given physical size stored in r.
+func NewGzipReader(r io.ReaderAt, physSize int64) (*gzipFile, error) {
+	z, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(r, 0, physSize)))
+	if err != nil {
+		if err == gzip.ErrHeader || err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidFormat
+		}
+		return nil, err
+	}
+	return &gzipFile{
+		r:        r,
+		physSize: physSize,
+		z:        z,
+		size:     -1,
+	}, nil
+}
+
+// OpenGzip opens the named gzip file for reading.
+func OpenGzip(name string) (*gzipFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f, err := NewGzipReader(file, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.closer = file
+	return f, nil
+}
+
+func (f *gzipFile) Read(buf []byte) (int, error) {
+	return f.z.Read(buf)
+}
+
+// WriteTo writes the rest of the uncompressed data to w.
+func (f *gzipFile) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, BUFSIZE)
+	var written int64
+	for {
+		n, err := f.z.Read(buf)
+		if n > 0 {
+			wn, werr := w.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Size returns the size of the uncompressed data. The size recorded in the gzip trailer is only
+// correct modulo 4GB, so the first call decompresses the whole file.
+func (f *gzipFile) Size() (int64, error) {
+	if f.size >= 0 {
+		return f.size, nil
+	}
+	z, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(f.r, 0, f.physSize)))
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(ioutil.Discard, z)
+	if err != nil {
+		return 0, err
+	}
+	f.size = size
+	return size, nil
+}
+
+func (f *gzipFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package spgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+)
+
+func TestGzipReader(t *testing.T) {
+	data := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data[:1024*1024])
+
+	// Two members, as produced by e.g. concatenating gzip files
+	var buf bytes.Buffer
+	for _, part := range [][]byte{data[:1024*1024+100], data[1024*1024+100:]} {
+		z := gzip.NewWriter(&buf)
+		z.Write(part)
+		z.Close()
+	}
+	r := bytes.NewReader(buf.Bytes())
+
+	f, err := NewGzipReader(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	var out bytes.Buffer
+	_, err = f.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("Data mismatch")
+	}
+
+	_, err = NewGzipReader(bytes.NewReader(data), int64(len(data)))
+	if err != ErrInvalidFormat {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package spgz
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A block index lists a weak rolling checksum and a strong (truncated SHA-256) checksum of every
+// block of the logical content, similar to a zsync control file. A client that has an older
+// version of the content computes the rolling checksum at every offset of its copy to find the
+// blocks it already has (wherever they moved to) and only downloads the rest, e.g. with HTTP range
+// requests from `spgz serve-http`. The last block is hashed padded with zeroes.
+//
+//  header: "SPGZIDX1", block size (u32), reserved (u32), size (u64)
+//  per block: weak checksum (u32), strong checksum (16 bytes)
+
+const (
+	indexMagic      = "SPGZIDX1"
+	indexStrongSize = 16
+
+	maxIndexRequest = 16 * 1024 * 1024
+)
+
+var (
+	ErrIndexMismatch = errors.New("Downloaded data does not match the index")
+)
+
+type indexHeader struct {
+	Magic     [8]byte
+	BlockSize uint32
+	Reserved  uint32
+	Size      uint64
+}
+
+// IndexEntry holds the checksums of a block.
+type IndexEntry struct {
+	Weak   uint32
+	Strong [indexStrongSize]byte
+}
+
+// Index is a parsed block index.
+type Index struct {
+	BlockSize int64
+	Size      int64
+	Blocks    []IndexEntry
+}
+
+// rollsum is the rsync rolling checksum.
+type rollsum struct {
+	a, b uint32
+	l    uint32
+}
+
+func (s *rollsum) init(data []byte) {
+	s.a, s.b = 0, 0
+	s.l = uint32(len(data))
+	for i, c := range data {
+		s.a += uint32(c)
+		s.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+func (s *rollsum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.l*uint32(out)
+}
+
+func (s *rollsum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+func strongSum(data []byte) (strong [indexStrongSize]byte) {
+	sum := sha256.Sum256(data)
+	copy(strong[:], sum[:])
+	return
+}
+
+// WriteIndex writes the index of the first size bytes of r to w.
+func WriteIndex(w io.Writer, r io.ReaderAt, size, blockSize int64) error {
+	if blockSize <= 0 || blockSize > maxDeltaBlockSize {
+		return ErrInvalidOptions
+	}
+	bw := bufio.NewWriter(w)
+	h := indexHeader{
+		BlockSize: uint32(blockSize),
+		Size:      uint64(size),
+	}
+	copy(h.Magic[:], indexMagic)
+	err := binary.Write(bw, binary.LittleEndian, &h)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, blockSize)
+	var s rollsum
+	for off := int64(0); off < size; off += blockSize {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && !(err == io.EOF && (n == len(buf) || off+int64(n) >= size)) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if remaining := size - off; int64(n) > remaining {
+			n = int(remaining)
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		s.init(buf)
+		e := IndexEntry{
+			Weak:   s.sum(),
+			Strong: strongSum(buf),
+		}
+		err = binary.Write(bw, binary.LittleEndian, &e)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadIndex parses an index written by WriteIndex.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	var h indexHeader
+	err := binary.Read(br, binary.LittleEndian, &h)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidFormat
+		}
+		return nil, err
+	}
+	if string(h.Magic[:]) != indexMagic || h.BlockSize == 0 || h.BlockSize > maxDeltaBlockSize || h.Size > 1<<62 {
+		return nil, ErrInvalidFormat
+	}
+	idx := &Index{
+		BlockSize: int64(h.BlockSize),
+		Size:      int64(h.Size),
+	}
+	blocks := (idx.Size + idx.BlockSize - 1) / idx.BlockSize
+	for i := int64(0); i < blocks; i++ {
+		var e IndexEntry
+		err = binary.Read(br, binary.LittleEndian, &e)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrInvalidFormat
+			}
+			return nil, err
+		}
+		idx.Blocks = append(idx.Blocks, e)
+	}
+	return idx, nil
+}
+
+// match finds the blocks of the index that are present anywhere in the first size bytes of r and
+// returns their offsets in r, -1 for the blocks that were not found.
+func (idx *Index) match(r io.ReaderAt, size int64) ([]int64, error) {
+	found := make([]int64, len(idx.Blocks))
+	weak := make(map[uint32][]int, len(idx.Blocks))
+	for i := range idx.Blocks {
+		found[i] = -1
+		weak[idx.Blocks[i].Weak] = append(weak[idx.Blocks[i].Weak], i)
+	}
+	bs := idx.BlockSize
+	if size < bs {
+		return found, nil
+	}
+
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, size), 1024*1024)
+	ring := make([]byte, bs)
+	window := make([]byte, bs)
+	var s rollsum
+	var off int64 // offset of the window
+	head := 0     // position of the oldest byte in the ring
+
+	fill := func() error {
+		_, err := io.ReadFull(br, ring)
+		head = 0
+		s.init(ring)
+		return err
+	}
+	err := fill()
+	if err != nil {
+		return nil, err
+	}
+	remaining := len(idx.Blocks)
+	for remaining > 0 {
+		matched := false
+		if candidates := weak[s.sum()]; candidates != nil {
+			copy(window, ring[head:])
+			copy(window[bs-int64(head):], ring[:head])
+			strong := strongSum(window)
+			for _, i := range candidates {
+				if found[i] < 0 && idx.Blocks[i].Strong == strong {
+					found[i] = off
+					remaining--
+					matched = true
+				}
+			}
+		}
+		if matched && off+2*bs <= size {
+			err = fill()
+			if err != nil {
+				return nil, err
+			}
+			off += bs
+			continue
+		}
+		if off+bs >= size {
+			break
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		s.roll(ring[head], c)
+		ring[head] = c
+		head++
+		if int64(head) == bs {
+			head = 0
+		}
+		off++
+	}
+	return found, nil
+}
+
+// SyncIndex writes the content described by the index to t. Blocks that can be found anywhere in
+// the first localSize bytes of local are copied from there, the rest is read from remote, joining
+// adjacent blocks into requests of up to 16MB. The Changed and BytesSent fields of the returned
+// stats count the blocks and the bytes read from remote.
+func SyncIndex(t Target, idx *Index, local io.ReaderAt, localSize int64, remote io.ReaderAt) (*DeltaStats, error) {
+	found, err := idx.match(local, localSize)
+	if err != nil {
+		return nil, err
+	}
+	bs := idx.BlockSize
+	stats := &DeltaStats{
+		Blocks: int64(len(idx.Blocks)),
+	}
+	buf := make([]byte, bs)
+	for i := 0; i < len(found); {
+		if found[i] >= 0 {
+			_, err := local.ReadAt(buf, found[i])
+			if err != nil && err != io.EOF {
+				return stats, err
+			}
+			_, err = t.WriteAt(buf[:idx.blockLen(i)], int64(i)*bs)
+			if err != nil {
+				return stats, err
+			}
+			i++
+			continue
+		}
+		// Download a run of missing blocks at once
+		j := i + 1
+		for j < len(found) && found[j] < 0 && int64(j-i)*bs < maxIndexRequest {
+			j++
+		}
+		start := int64(i) * bs
+		end := int64(j) * bs
+		if end > idx.Size {
+			end = idx.Size
+		}
+		data := make([]byte, end-start)
+		_, err := remote.ReadAt(data, start)
+		if err != nil && err != io.EOF {
+			return stats, err
+		}
+		for k := i; k < j; k++ {
+			block := data[int64(k-i)*bs:]
+			if int64(len(block)) > bs {
+				block = block[:bs]
+			}
+			copy(buf, block)
+			for l := len(block); l < len(buf); l++ {
+				buf[l] = 0
+			}
+			if strongSum(buf) != idx.Blocks[k].Strong {
+				return stats, ErrIndexMismatch
+			}
+		}
+		_, err = t.WriteAt(data, start)
+		if err != nil {
+			return stats, err
+		}
+		stats.Changed += int64(j - i)
+		stats.BytesSent += int64(len(data))
+		i = j
+	}
+	return stats, t.Truncate(idx.Size)
+}
+
+func (idx *Index) blockLen(i int) int64 {
+	if l := idx.Size - int64(i)*idx.BlockSize; l < idx.BlockSize {
+		return l
+	}
+	return idx.BlockSize
+}
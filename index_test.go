@@ -0,0 +1,75 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type countingReaderAt struct {
+	*bytes.Reader
+	reads, bytes int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	r.bytes += len(p)
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestSyncIndex(t *testing.T) {
+	const bs = 4096
+	old := make([]byte, 20*bs+500)
+	rand.Read(old)
+
+	// Insert some data so that the rest is shifted, modify a block and append some zeroes
+	updated := append(append([]byte(nil), old[:3*bs+10]...), []byte("some inserted data")...)
+	updated = append(updated, old[3*bs+10:]...)
+	for i := 10 * bs; i < 11*bs; i++ {
+		updated[i] ^= 0xff
+	}
+	updated = append(updated, make([]byte, 3*bs)...)
+
+	var idxBuf bytes.Buffer
+	err := WriteIndex(&idxBuf, bytes.NewReader(updated), int64(len(updated)), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ReadIndex(&idxBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sf memSparseFile
+	target, err := NewFromSparseFile(&sf, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &countingReaderAt{Reader: bytes.NewReader(updated)}
+	stats, err := SyncIndex(target, idx, bytes.NewReader(old), int64(len(old)), remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The block with the insertion, the modified block and the last 4 blocks (the end of the
+	// original data and the zeroes) are downloaded in 3 requests
+	if stats.Changed != 6 || remote.reads != 3 {
+		t.Fatalf("Unexpected stats: %+v, %d reads", stats, remote.reads)
+	}
+
+	buf := make([]byte, len(updated))
+	_, err = target.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, updated) {
+		t.Fatal("Content differs")
+	}
+	size, err := target.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(updated)) {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+}
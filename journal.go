@@ -0,0 +1,230 @@
+package spgz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// The journal is a single write-ahead record in the feature region. Before the slot of a block
+// is written, the new content of the beginning of the slot (the image), the length of the hole
+// to punch before writing it and, for the last slot, the new end of the file are written into the
+// record, protected by a digest, and synced. Then the slot is written, the file is synced again
+// and the record is cleared. If the file is opened with a valid record, the write is repeated,
+// so a torn slot is completed. A torn record has an invalid digest and is ignored, in which case
+// the slot has not been touched.
+//
+// Clearing the record is not synced right away. It becomes durable with the next record, or with
+// an explicit sync before a slot is modified outside of the journal, e.g. by PunchHole.
+//
+//  record: "SPGZJRNL", block number (u64), hole length (u64), end (u64), image length (u32),
+//          reserved (u32), SHA-256 of everything after the magic followed by the image
+
+const (
+	journalMagic = "SPGZJRNL"
+)
+
+var (
+	ErrRecoveryNeeded = errors.New("The file has an unfinished write, open it for writing to complete it")
+)
+
+type journalRecord struct {
+	Magic    [8]byte
+	Num      uint64
+	HoleLen  uint64
+	End      uint64
+	Len      uint32
+	Reserved uint32
+	Digest   [sha256.Size]byte
+}
+
+const (
+	journalRecordSize = 8 + 8 + 8 + 8 + 4 + 4 + sha256.Size
+)
+
+func (r *journalRecord) digest(image []byte) (sum [sha256.Size]byte) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, []uint64{r.Num, r.HoleLen, r.End})
+	binary.Write(h, binary.LittleEndian, []uint32{r.Len, r.Reserved})
+	h.Write(image)
+	copy(sum[:], h.Sum(nil))
+	return
+}
+
+// initJournal reserves the region for the journal record, which is also used as the scratch slot
+// of featShadow.
+func (f *compFile) initJournal(h *headerV2, feature uint32) {
+	f.journalOffset = int64(h.DataOffset)
+	h.Features |= feature
+	size := (journalRecordSize + f.blockSize + 1 + headerSize - 1) &^ (headerSize - 1)
+	h.DataOffset += uint64(size)
+
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(f.journalOffset))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(size))
+	f.setMeta(metaJournal, buf[:])
+}
+
+// writeImage replaces the beginning of the slot of the block with image after punching a hole of
+// holeLen bytes. Either of them may be empty.
+func (b *block) writeImage(image []byte, holeLen int64) error {
+	f := b.f
+	offset := f.blockOffset(b.num)
+	if f.features&(featJournal|featShadow) == 0 {
+		return f.applyImage(offset, image, holeLen, 0)
+	}
+
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	var end int64
+	if f.blockOffset(b.num+1) >= o {
+		// The last slot, the length of its data is determined by the end of the file
+		end = offset + holeLen
+		if l := offset + int64(len(image)); l > end {
+			end = l
+		}
+	}
+	r := journalRecord{
+		Num:     uint64(b.num),
+		HoleLen: uint64(holeLen),
+		End:     uint64(end),
+		Len:     uint32(len(image)),
+	}
+	copy(r.Magic[:], journalMagic)
+	r.Digest = r.digest(image)
+	if f.features&featShadow != 0 {
+		err = f.writeShadow(&r, image)
+	} else {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &r)
+		buf.Write(image)
+		_, err = f.f.WriteAt(buf.Bytes(), f.journalOffset)
+		if err == nil {
+			err = f.f.Sync()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.journalPending = false
+
+	err = f.applyImage(offset, image, holeLen, end)
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	return f.clearJournal()
+}
+
+func (f *compFile) applyImage(offset int64, image []byte, holeLen, end int64) error {
+	if holeLen > 0 {
+		err := f.punchHole(offset, holeLen)
+		if err != nil {
+			return err
+		}
+	}
+	if len(image) > 0 {
+		_, err := f.f.WriteAt(image, offset)
+		if err != nil {
+			return err
+		}
+	}
+	if end > 0 {
+		return f.f.Truncate(end)
+	}
+	return nil
+}
+
+func (f *compFile) clearJournal() error {
+	var magic [len(journalMagic)]byte
+	_, err := f.f.WriteAt(magic[:], f.journalOffset)
+	if err == nil {
+		f.journalPending = true
+	}
+	return err
+}
+
+// settleJournal makes sure a cleared record stays cleared before a slot is modified outside of
+// the journal.
+func (f *compFile) settleJournal() error {
+	if !f.journalPending {
+		return nil
+	}
+	err := f.f.Sync()
+	if err == nil {
+		f.journalPending = false
+	}
+	return err
+}
+
+func (f *compFile) truncateFile(size int64) error {
+	err := f.settleJournal()
+	if err != nil {
+		return err
+	}
+	return f.f.Truncate(size)
+}
+
+// recoverJournal completes a write that was interrupted by a crash.
+func (f *compFile) recoverJournal() error {
+	meta := f.meta[metaJournal]
+	if len(meta) != 16 {
+		return ErrInvalidFormat
+	}
+	f.journalOffset = int64(binary.LittleEndian.Uint64(meta))
+	size := int64(binary.LittleEndian.Uint64(meta[8:]))
+	if f.journalOffset < headerSize || size < journalRecordSize+f.blockSize+1 || f.journalOffset+size > f.dataOffset {
+		return ErrInvalidFormat
+	}
+
+	var r journalRecord
+	err := binary.Read(io.NewSectionReader(f.f, f.journalOffset, journalRecordSize), binary.LittleEndian, &r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Never written
+			return nil
+		}
+		return err
+	}
+	if string(r.Magic[:]) != journalMagic || int64(r.Len) > f.blockSize+1 || int64(r.HoleLen) > f.blockSize+1 {
+		return nil
+	}
+	image := make([]byte, r.Len)
+	_, err = f.f.ReadAt(image, f.journalOffset+journalRecordSize)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if r.digest(image) != r.Digest {
+		// Torn record, the slot has not been touched
+		return nil
+	}
+	if f.readOnly {
+		if f.features&featShadow != 0 && r.End == 0 {
+			f.shadow = &shadowSlot{
+				num:     int64(r.Num),
+				image:   image,
+				holeLen: int64(r.HoleLen),
+			}
+			return nil
+		}
+		return ErrRecoveryNeeded
+	}
+	err = f.applyImage(f.blockOffset(int64(r.Num)), image, int64(r.HoleLen), int64(r.End))
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if err == nil {
+		err = f.clearJournal()
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+var errCrash = errors.New("crash")
+
+// tearingFile writes only half of the data written at tearAt and fails.
+type tearingFile struct {
+	memSparseFile
+	tearAt int64
+}
+
+func (t *tearingFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == t.tearAt {
+		t.tearAt = -1
+		n, _ := t.memSparseFile.WriteAt(p[:len(p)/2], off)
+		return n, errCrash
+	}
+	return t.memSparseFile.WriteAt(p, off)
+}
+
+func TestJournal(t *testing.T) {
+	sf := &tearingFile{
+		tearAt: -1,
+	}
+	open := func(flag int) (*compFile, error) {
+		sf.Seek(0, os.SEEK_SET)
+		return NewFromSparseFileOptions(sf, flag, &Options{
+			BlockSize: 64 * 1024,
+			Journal:   true,
+		})
+	}
+	f, err := open(os.O_RDWR | os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 3*bs)
+	rnd.Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(f *compFile, expected []byte) {
+		buf := make([]byte, len(expected))
+		_, err := f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatal("Data differs")
+		}
+	}
+
+	// The slot write is torn, the record is complete
+	f, err = open(os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData := append([]byte(nil), data...)
+	rnd.Read(newData[bs : 2*bs])
+	_, err = f.WriteAt(newData[bs:2*bs], bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.tearAt = f.blockOffset(1)
+	err = f.Sync()
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = open(os.O_RDONLY)
+	if err != ErrRecoveryNeeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f, err = open(os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, newData)
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The record is torn, the slot is untouched
+	rnd.Read(data[bs : 2*bs])
+	_, err = f.WriteAt(data[bs:2*bs], bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.tearAt = f.journalOffset
+	err = f.Sync()
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f, err = open(os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, newData)
+}
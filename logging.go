@@ -0,0 +1,37 @@
+package spgz
+
+import (
+	"log/slog"
+)
+
+// SetLogger sets the logger that receives events which may be of interest to the operator: blocks
+// that don't compress and are stored raw (debug), failures to punch holes (warning) and corrupt
+// blocks (error). nil, the default, disables logging. See also Options.Logger.
+func (f *compFile) SetLogger(l *slog.Logger) {
+	f.Lock()
+	f.log = l
+	f.Unlock()
+}
+
+func (f *compFile) punchHole(offset, size int64) error {
+	err := f.settleJournal()
+	if err != nil {
+		return err
+	}
+	num := int64(-1)
+	if offset >= f.dataOffset {
+		num = (offset - f.dataOffset) / (f.blockSize + 1)
+	}
+	span := f.startSpan("punch", num)
+	err = f.f.PunchHole(offset, size)
+	span.End(err)
+	if err != nil {
+		if f.metrics != nil {
+			f.metrics.PunchHoleFailures.Add(1)
+		}
+		if f.log != nil {
+			f.log.Warn("spgz: could not punch hole", "file", f.name, "offset", offset, "size", size, "err", err)
+		}
+	}
+	return err
+}
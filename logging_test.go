@@ -0,0 +1,44 @@
+package spgz
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logBuf bytes.Buffer
+	f.SetLogger(slog.New(slog.NewTextHandler(&logBuf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	data := make([]byte, 2*f.BlockSize())
+	rand.New(rand.NewSource(1)).Read(data[:f.BlockSize()])
+	copy(data[f.BlockSize():], bytes.Repeat([]byte("log"), int(f.BlockSize())/3))
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logBuf.String(), "storing raw") {
+		t.Fatalf("Raw storage was not logged: %q", logBuf.String())
+	}
+
+	sf.data[f.blockOffset(1)+1] ^= 0xff
+	err = f.Verify()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(logBuf.String(), "corrupt block") || !strings.Contains(logBuf.String(), "block=1") {
+		t.Fatalf("Corrupt block was not logged: %q", logBuf.String())
+	}
+}
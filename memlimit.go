@@ -0,0 +1,72 @@
+package spgz
+
+// With Options.MemoryLimit the number of blocks a file keeps in memory is bounded: the current
+// block, the write-back cache (Options.WriteBack), the blocks WriteTo() loads ahead
+// (Options.PipelineDepth) and the blocks ReadFrom() has in flight when it compresses in parallel
+// (Options.CompressJobs). A block takes up to twice the block size (the data and the stored
+// image), so the limit is turned into a number of blocks. The write-back cache gets its share
+// first, then the pipeline and then the compression, all are reduced (down to being disabled)
+// rather than failing, only a limit that can't hold the current block is rejected. The blocks
+// loaded by concurrent ReadAt calls (Options.ConcurrentReads) are not counted.
+//
+// Compression normally has twice as many blocks in flight as there are workers, so that the
+// workers are kept busy while the finished blocks are being stored. With less room the number of
+// blocks in flight is reduced first, then the number of workers, as a worker without a block
+// of its own is of no use. The blocks in flight are the only ones ReadFrom() reads ahead, so
+// once they're all taken reading the source waits for the oldest one to be stored.
+
+// blockMemory returns the most memory a block takes.
+func (f *compFile) blockMemory() int64 {
+	return 2 * (f.blockSize + 1)
+}
+
+// fitMemory returns the write-back cache size, the pipeline depth, the number of compression
+// workers and the number of blocks they may have in flight reduced to fit into limit bytes. The
+// write-back cache needs a spare block and the pipeline one that's being loaded while the queue is
+// full.
+func (f *compFile) fitMemory(limit int64, writeBack, depth, jobs int) (int, int, int, int, error) {
+	avail := limit/f.blockMemory() - 1
+	if avail < 0 {
+		return 0, 0, 0, 0, ErrInvalidOptions
+	}
+	if writeBack > 0 {
+		if int64(writeBack)+1 > avail {
+			writeBack = int(avail) - 1
+		}
+		if writeBack > 0 {
+			avail -= int64(writeBack) + 1
+		} else {
+			writeBack = 0
+		}
+	}
+	if depth > 0 {
+		if int64(depth)+1 > avail {
+			depth = int(avail) - 1
+		}
+		if depth > 0 {
+			avail -= int64(depth) + 1
+		} else {
+			depth = 0
+		}
+	}
+	inFlight := compressInFlight(jobs)
+	if int64(inFlight) > avail {
+		inFlight = int(avail)
+	}
+	if jobs > inFlight {
+		jobs = inFlight
+	}
+	if jobs <= 1 {
+		jobs, inFlight = 0, 0
+	}
+	return writeBack, depth, jobs, inFlight, nil
+}
+
+// compressInFlight returns the number of blocks jobs compression workers have in flight without
+// a memory limit.
+func compressInFlight(jobs int) int {
+	if jobs <= 1 {
+		return 0
+	}
+	return 2 * jobs
+}
@@ -0,0 +1,99 @@
+package spgz
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for 4 blocks: the current one and the write-back cache with its spare block
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		WriteBack:     10,
+		PipelineDepth: 4,
+		MemoryLimit:   4 * 2 * 4097,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.writeBack == nil || f.writeBack.max != 2 || f.pipelineDepth != 0 {
+		t.Fatalf("Unexpected limits: %+v, %d", f.writeBack, f.pipelineDepth)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the write-back cache the pipeline gets the rest
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDONLY, &Options{
+		PipelineDepth: 4,
+		MemoryLimit:   4 * 2 * 4097,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.pipelineDepth != 2 {
+		t.Fatalf("Unexpected pipeline depth: %d", f.pipelineDepth)
+	}
+	f.Close()
+
+	// The compression gets what's left after the write-back cache, first fewer blocks in flight,
+	// then fewer workers
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		WriteBack:    2,
+		CompressJobs: 4,
+		MemoryLimit:  10 * 2 * 4097,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.compressJobs != 4 || f.compressInFlight != 6 {
+		t.Fatalf("Unexpected compression limits: %d, %d", f.compressJobs, f.compressInFlight)
+	}
+	f.Close()
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		WriteBack:    2,
+		CompressJobs: 4,
+		MemoryLimit:  7 * 2 * 4097,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.compressJobs != 3 || f.compressInFlight != 3 {
+		t.Fatalf("Unexpected compression limits: %d, %d", f.compressJobs, f.compressInFlight)
+	}
+	f.Close()
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		CompressJobs: 4,
+		MemoryLimit:  2 * 2 * 4097,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.compressJobs != 0 || f.compressInFlight != 0 {
+		t.Fatalf("Unexpected compression limits: %d, %d", f.compressJobs, f.compressInFlight)
+	}
+	f.Close()
+
+	sf.Seek(0, os.SEEK_SET)
+	_, err = NewFromSparseFileOptions(&sf, os.O_RDONLY, &Options{MemoryLimit: 4096})
+	if err != ErrInvalidOptions {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
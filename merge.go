@@ -0,0 +1,192 @@
+package spgz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNotOverlay = errors.New("The file is not an overlay")
+)
+
+// Commit writes the blocks stored in an overlay into its parent (which is opened for writing for
+// the duration of the call) and empties the overlay, so that it reads everything from the parent
+// again. Blocks of zeroes become holes in the parent and the space used by the overlay is released.
+func (f *compFile) Commit() error {
+	f.Lock()
+	defer f.Unlock()
+	path := f.Parent()
+	if path == "" {
+		return ErrNotOverlay
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+	size, err := f.size()
+	if err != nil {
+		return err
+	}
+
+	parent, err := OpenFile(f.resolvePath(path), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	b := &block{
+		f: f,
+	}
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	for num := int64(0); num < blocks; num++ {
+		if !f.isPresent(num) {
+			continue
+		}
+		err = b.load(num)
+		if err == nil {
+			_, err = parent.WriteAt(b.data, num*f.blockSize)
+		}
+		if err != nil {
+			parent.Close()
+			return err
+		}
+	}
+	err = parent.Truncate(size)
+	if err != nil {
+		parent.Close()
+		return err
+	}
+	err = parent.Close()
+	if err != nil {
+		return err
+	}
+
+	// Switch to the updated parent and drop all blocks
+	newBase, err := f.openParent(path)
+	if err != nil {
+		return err
+	}
+	f.closeBase()
+	f.base = newBase
+	f.ownBase = true
+	f.loaded = false
+
+	err = f.resetMap(size, func(num int64) bool {
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	end := f.blockOffset(f.mapBlocks)
+	if end > o {
+		end = o
+	}
+	if end > f.dataOffset {
+		err = f.punchHole(f.dataOffset, end-f.dataOffset)
+		if err != nil {
+			return err
+		}
+	}
+	if size/f.blockSize < f.mapBlocks {
+		// The last block is now absent, its stored (possibly compressed) length must be
+		// replaced with the logical one
+		return f.truncateFile(f.endOffset(size))
+	}
+	return nil
+}
+
+// MergeParent copies the blocks stored in the parent of an overlay into the overlay and makes the
+// overlay refer to the parent's parent instead, shortening the chain by one. If the parent is not
+// an overlay itself this is the same as Flatten().
+func (f *compFile) MergeParent() error {
+	parent, ok := f.base.(*compFile)
+	if f.Parent() == "" || !ok {
+		return ErrNotOverlay
+	}
+	if parent.Parent() == "" {
+		return f.Flatten()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for num := int64(0); num < f.mapBlocks; num++ {
+		if f.isPresent(num) || !parent.isPresent(num) {
+			continue
+		}
+		err := f.copyUp(num)
+		if err != nil {
+			return err
+		}
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+
+	// The path of the grandparent is relative to the parent
+	path := parent.resolvePath(parent.Parent())
+	if f.name != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+			if dir, err := filepath.Abs(filepath.Dir(f.name)); err == nil {
+				if rel, err := filepath.Rel(dir, abs); err == nil {
+					path = rel
+				}
+			}
+		}
+	}
+	f.setMeta(metaParentPath, []byte(path))
+
+	// Take over the grandparent which is already open
+	grandparent := parent.base
+	parent.ownBase = false
+	parent.Close()
+	f.base = grandparent
+	f.ownBase = true
+
+	oldMapBlocks := f.mapBlocks
+	oldPresent := f.present
+	return f.resetMap(parent.baseSize, func(num int64) bool {
+		if num >= oldMapBlocks {
+			return true
+		}
+		return oldPresent[num/8]&(1<<uint(num%8)) != 0
+	})
+}
+
+// resetMap sets a new base size and rebuilds the present block map (as far as the space reserved
+// for it allows) using present() for the entries. It updates the header.
+func (f *compFile) resetMap(baseSize int64, present func(num int64) bool) error {
+	capacity := (f.dataOffset - f.mapOffset) * 8
+	mapBlocks := (baseSize + f.blockSize - 1) / f.blockSize
+	if mapBlocks > capacity {
+		mapBlocks = capacity
+	}
+	l := len(f.present)
+	newPresent := make([]byte, (mapBlocks+7)/8)
+	for num := int64(0); num < mapBlocks; num++ {
+		if present(num) {
+			newPresent[num/8] |= 1 << uint(num%8)
+		}
+	}
+	if len(newPresent) > l {
+		l = len(newPresent)
+	}
+	buf := make([]byte, l)
+	copy(buf, newPresent)
+	_, err := f.f.WriteAt(buf, f.mapOffset)
+	if err != nil {
+		return err
+	}
+	f.present = newPresent
+	f.mapBlocks = mapBlocks
+	f.baseSize = baseSize
+
+	return f.updateHeaderV2(func(h *headerV2) {
+		h.MapBlocks = uint64(mapBlocks)
+		h.BaseSize = uint64(baseSize)
+	})
+}
@@ -0,0 +1,140 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeChain creates base <- o1 <- o2 where each file modifies a different block.
+func makeChain(t *testing.T, dir string) []byte {
+	base, err := OpenFileSize(filepath.Join(dir, "base"), os.O_RDWR|os.O_CREATE, 0666, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := base.BlockSize()
+	data := make([]byte, 4*bs+100)
+	for i := range data {
+		data[i] = 'b'
+	}
+	_, err = base.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+
+	for i, name := range []string{"o1", "o2"} {
+		parent := "base"
+		if i > 0 {
+			parent = "o1"
+		}
+		o, err := CreateOverlay(filepath.Join(dir, name), parent, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = o.WriteAt([]byte(name), int64(i+1)*bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(data[int64(i+1)*bs:], name)
+		err = o.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// o2 also zeroes the first block
+	o2, err := OpenFile(filepath.Join(dir, "o2"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o2.PunchHole(0, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < bs; i++ {
+		data[i] = 0
+	}
+	o2.Close()
+	return data
+}
+
+func checkContent(t *testing.T, name string, expected []byte) {
+	f, err := OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, len(expected)+10)
+	n, _ := f.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("%s: data differs", name)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expected := makeChain(t, dir)
+
+	o2, err := OpenFile(filepath.Join(dir, "o2"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num := int64(0); num < o2.mapBlocks; num++ {
+		if o2.isPresent(num) {
+			t.Fatalf("Block %d is present after commit", num)
+		}
+	}
+	err = o2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, filepath.Join(dir, "o1"), expected)
+	checkContent(t, filepath.Join(dir, "o2"), expected)
+
+	err = (&compFile{}).Commit()
+	if err != ErrNotOverlay {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestMergeParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expected := makeChain(t, dir)
+
+	o2, err := OpenFile(filepath.Join(dir, "o2"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o2.MergeParent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o2.Parent() != "base" {
+		t.Fatalf("Unexpected parent: %q", o2.Parent())
+	}
+	err = o2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "o1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, filepath.Join(dir, "o2"), expected)
+}
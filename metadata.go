@@ -0,0 +1,106 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// A version 2 header carries a list of metadata records after the fixed fields. Each record is
+// a 16-bit tag and a 16-bit length followed by the data, a zero tag ends the list.
+
+const (
+	metaOffset = 64
+)
+
+const (
+	_ uint16 = iota
+	metaBaseDigest
+	metaParentPath
+	metaDedupTable
+	metaSourcePath
+	metaJournal
+	metaCreator // see creator.go
+	metaCreated
+	metaHostname
+	metaComment
+	metaXattrs    // see xattr.go
+	metaFileAttrs // see fileattrs.go
+	metaScrub     // see scrub.go
+	metaIdealSize // see autocompact.go
+)
+
+var (
+	ErrMetadataTooLarge = errors.New("Metadata does not fit into the header")
+)
+
+func (f *compFile) setMeta(tag uint16, data []byte) {
+	if f.meta == nil {
+		f.meta = make(map[uint16][]byte)
+	}
+	f.meta[tag] = data
+}
+
+func (f *compFile) marshalMeta(buf []byte) error {
+	tags := make([]int, 0, len(f.meta))
+	for tag := range f.meta {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	pos := 0
+	for _, tag := range tags {
+		data := f.meta[uint16(tag)]
+		// leave room for the terminating tag
+		if pos+4+len(data)+2 > len(buf) {
+			return ErrMetadataTooLarge
+		}
+		binary.LittleEndian.PutUint16(buf[pos:], uint16(tag))
+		binary.LittleEndian.PutUint16(buf[pos+2:], uint16(len(data)))
+		copy(buf[pos+4:], data)
+		pos += 4 + len(data)
+	}
+	for i := pos; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+// writeMeta writes the metadata records of an existing file into its header page.
+func (f *compFile) writeMeta() error {
+	buf := make([]byte, headerSize-metaOffset)
+	err := f.marshalMeta(buf)
+	if err != nil {
+		return err
+	}
+	_, err = f.f.WriteAt(buf, metaOffset)
+	return err
+}
+
+func (f *compFile) unmarshalMeta(buf []byte) error {
+	meta, err := parseMeta(buf)
+	if err != nil {
+		return err
+	}
+	for tag, data := range meta {
+		f.setMeta(tag, data)
+	}
+	return nil
+}
+
+func parseMeta(buf []byte) (map[uint16][]byte, error) {
+	meta := make(map[uint16][]byte)
+	for pos := 0; pos+4 <= len(buf); {
+		tag := binary.LittleEndian.Uint16(buf[pos:])
+		if tag == 0 {
+			break
+		}
+		l := int(binary.LittleEndian.Uint16(buf[pos+2:]))
+		if pos+4+l > len(buf) {
+			return nil, ErrInvalidFormat
+		}
+		meta[tag] = append([]byte(nil), buf[pos+4:pos+4+l]...)
+		pos += 4 + l
+	}
+	return meta, nil
+}
@@ -0,0 +1,97 @@
+package spgz
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects counters across any number of files, see SetMetrics. It's an expvar.Var, so
+// it can be published with expvar.Publish() and scraped from /debug/vars (or converted by an
+// expvar exporter for Prometheus).
+type Metrics struct {
+	BlocksCompressed  expvar.Int // blocks stored compressed, in the file or a block store
+	BlocksRaw         expvar.Int // blocks stored uncompressed because they don't compress
+	BlocksHole        expvar.Int // all-zero blocks stored as holes
+	BlocksUnchanged   expvar.Int // blocks not written because their slot held the same data
+	BytesWritten      expvar.Int // bytes of block data written to the file or a block store
+	PunchHoleFailures expvar.Int
+	CompressTime      Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) String() string {
+	return fmt.Sprintf(`{"blocksCompressed": %s, "blocksRaw": %s, "blocksHole": %s, "blocksUnchanged": %s, "bytesWritten": %s, "punchHoleFailures": %s, "compressTime": %s}`,
+		m.BlocksCompressed.String(), m.BlocksRaw.String(), m.BlocksHole.String(), m.BlocksUnchanged.String(), m.BytesWritten.String(),
+		m.PunchHoleFailures.String(), m.CompressTime.String())
+}
+
+// histogramBounds are the upper bounds of the Histogram buckets, the last bucket is unbounded.
+var histogramBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram counts durations in buckets bounded by 100µs, 1ms, 10ms, 100ms and 1s.
+type Histogram struct {
+	buckets [len(histogramBounds) + 1]int64
+	count   int64
+	sum     int64 // nanoseconds
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Count returns the number of observations and their total duration.
+func (h *Histogram) Count() (int64, time.Duration) {
+	return atomic.LoadInt64(&h.count), time.Duration(atomic.LoadInt64(&h.sum))
+}
+
+// Buckets returns the number of observations per bucket, not cumulative.
+func (h *Histogram) Buckets() []int64 {
+	b := make([]int64, len(h.buckets))
+	for i := range b {
+		b[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	return b
+}
+
+func (h *Histogram) String() string {
+	var sb strings.Builder
+	count, sum := h.Count()
+	fmt.Fprintf(&sb, `{"count": %d, "sumSeconds": %g, "buckets": {`, count, sum.Seconds())
+	for i, n := range h.Buckets() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		if i < len(histogramBounds) {
+			fmt.Fprintf(&sb, `"%g": %d`, histogramBounds[i].Seconds(), n)
+		} else {
+			fmt.Fprintf(&sb, `"+Inf": %d`, n)
+		}
+	}
+	sb.WriteString("}}")
+	return sb.String()
+}
+
+// SetMetrics makes the file record its activity in m, nil disables it.
+func (f *compFile) SetMetrics(m *Metrics) {
+	f.Lock()
+	f.metrics = m
+	f.Unlock()
+}
@@ -0,0 +1,48 @@
+package spgz
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	f.SetMetrics(m)
+
+	bs := f.BlockSize()
+	data := make([]byte, 3*bs)
+	rand.New(rand.NewSource(1)).Read(data[:bs])
+	copy(data[bs:], bytes.Repeat([]byte("metrics"), int(bs)/7))
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.BlocksRaw.Value() != 1 || m.BlocksCompressed.Value() != 1 || m.BlocksHole.Value() != 1 {
+		t.Fatalf("Unexpected counters: %s", m)
+	}
+	if w := m.BytesWritten.Value(); w <= bs+1 || w >= 2*bs {
+		t.Fatalf("Unexpected bytes written: %d", w)
+	}
+	if count, _ := m.CompressTime.Count(); count != 2 {
+		t.Fatalf("Unexpected histogram count: %d", count)
+	}
+
+	var v map[string]interface{}
+	err = json.Unmarshal([]byte(m.String()), &v)
+	if err != nil {
+		t.Fatalf("Invalid JSON %q: %v", m.String(), err)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"os"
+	"syscall"
+)
+
+// With Options.Mmap a file opened read-only is mapped into memory and the blocks are
+// decompressed straight from the mapping instead of being read into a buffer first. The mapping
+// covers the file as it was when it was opened, the slots past it (e.g. appended by another
+// process since) and a final short slot are read with ReadAt. The file must not be truncated by
+// anyone while it's mapped, accessing the lost pages would crash the process. Files that are not
+// an *os.File (or can't be mapped for another reason) are read with ReadAt.
+
+// mmapFile returns a read-only mapping of the whole file or nil if it can't be mapped.
+func mmapFile(sf SparseFile) []byte {
+	file, ok := sf.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return nil
+	}
+	size, err := sf.Seek(0, os.SEEK_END)
+	if err != nil || size <= 0 || int64(int(size)) != size {
+		return nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func munmap(data []byte) {
+	syscall.Munmap(data)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+func mmapFile(sf SparseFile) []byte {
+	return nil
+}
+
+func munmap(data []byte) {
+}
@@ -0,0 +1,53 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mmap.spgz")
+	f, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 5*bs+100)
+	rand.New(rand.NewSource(1)).Read(data[:bs])
+	copy(data[2*bs:], bytes.Repeat([]byte("mmap"), int(bs)))
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileOptions(name, os.O_RDWR, 0, &Options{Mmap: true}); err != ErrInvalidOptions {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDONLY, 0, &Options{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && f.mapping == nil {
+		t.Fatal("The file is not mapped")
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
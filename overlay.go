@@ -0,0 +1,124 @@
+package spgz
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// An overlay is a file that refers to a parent spgz file by path, much like a qcow2 image with a
+// backing file. It uses the same present block map as a differential archive: blocks that have
+// not been written to the overlay are read from the parent, which is opened read-only along with
+// the overlay. The parent can itself be an overlay, forming a chain.
+
+// CreateOverlay creates a new overlay with the given parent. The overlay initially has the same
+// content as the parent. A relative parent path is relative to the directory of the overlay.
+func CreateOverlay(name, parent string, perm os.FileMode) (*compFile, error) {
+	return OpenFileOptions(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm, &Options{
+		Parent: parent,
+	})
+}
+
+// Parent returns the parent path of an overlay (as recorded in the file) or an empty string.
+func (f *compFile) Parent() string {
+	return string(f.meta[metaParentPath])
+}
+
+// resolvePath returns the location of a parent path recorded in the file.
+func (f *compFile) resolvePath(path string) string {
+	if !filepath.IsAbs(path) && f.name != "" {
+		path = filepath.Join(filepath.Dir(f.name), path)
+	}
+	return path
+}
+
+func (f *compFile) openParent(path string) (*compFile, error) {
+	parent, err := OpenFile(f.resolvePath(path), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open parent %s: %w", path, err)
+	}
+	return parent, nil
+}
+
+func (f *compFile) initParent(h *headerV2, path string) error {
+	parent, err := f.openParent(path)
+	if err != nil {
+		return err
+	}
+	f.ownBase = true
+	f.setMeta(metaParentPath, []byte(path))
+	return f.initBase(h, parent, false)
+}
+
+// endOffset returns the physical end of a file of the given size with an absent last block.
+// The length of such a block is determined by the end of the file.
+func (f *compFile) endOffset(size int64) int64 {
+	num := size / f.blockSize
+	o := f.blockOffset(num)
+	if l := size - num*f.blockSize; l > 0 {
+		o += l + 1
+	}
+	return o
+}
+
+// initOverlaySize sets the size of a new overlay to the size of the parent. The last block is
+// left in the parent like all the others.
+func (f *compFile) initOverlaySize() error {
+	return f.truncateFile(f.endOffset(f.baseSize))
+}
+
+func (f *compFile) closeBase() {
+	if f.ownBase {
+		if c, ok := f.base.(io.Closer); ok {
+			c.Close()
+		}
+		f.ownBase = false
+	}
+}
+
+// Flatten copies all blocks that are still read from the base (or parent) into the file and
+// removes the reference, making the file self-contained.
+func (f *compFile) Flatten() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.base == nil {
+		return nil
+	}
+	for num := int64(0); num < f.mapBlocks; num++ {
+		if f.isPresent(num) {
+			continue
+		}
+		err := f.copyUp(num)
+		if err != nil {
+			return err
+		}
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+
+	err = f.updateHeaderV2(func(h *headerV2) {
+		h.Features &^= featBase | featDiff | featCopyOnRead
+		h.MapOffset = 0
+		h.MapBlocks = 0
+		h.BaseSize = 0
+		delete(f.meta, metaBaseDigest)
+		delete(f.meta, metaParentPath)
+		delete(f.meta, metaSourcePath)
+	})
+	if err != nil {
+		return err
+	}
+	err = f.punchHole(f.mapOffset, int64(len(f.present)))
+	if err != nil {
+		return err
+	}
+
+	f.closeBase()
+	f.base = nil
+	f.mapBlocks = 0
+	f.present = nil
+	return nil
+}
@@ -0,0 +1,119 @@
+package spgz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base, err := OpenFileSize(filepath.Join(dir, "base"), os.O_RDWR|os.O_CREATE, 0666, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := base.BlockSize()
+	data := make([]byte, 3*bs+100)
+	for i := range data {
+		data[i] = 'b'
+	}
+	_, err = base.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = base.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o1, err := CreateOverlay(filepath.Join(dir, "o1"), "base", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := o1.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	_, err = o1.WriteAt([]byte("11"), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o2, err := CreateOverlay(filepath.Join(dir, "o2"), "o1", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o2.WriteAt([]byte("22"), 2*bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Extending the partial last block must keep its content
+	err = o2.Truncate(int64(len(data)) + 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]byte(nil), data...), make([]byte, 50)...)
+	copy(expected[bs:], "11")
+	copy(expected[2*bs:], "22")
+
+	check := func(f *compFile) {
+		buf := make([]byte, len(expected)+10)
+		n, _ := f.ReadAt(buf, 0)
+		if !bytes.Equal(buf[:n], expected) {
+			t.Fatal("Data differs")
+		}
+	}
+
+	o2, err = OpenFile(filepath.Join(dir, "o2"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o2.Parent() != "o1" {
+		t.Fatalf("Unexpected parent: %q", o2.Parent())
+	}
+	check(o2)
+
+	err = o2.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(o2)
+	err = o2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flattened file must not depend on the chain anymore
+	err = os.Remove(filepath.Join(dir, "o1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o2, err = OpenFile(filepath.Join(dir, "o2"), os.O_RDONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o2.Parent() != "" {
+		t.Fatalf("Parent after flatten: %q", o2.Parent())
+	}
+	check(o2)
+	o2.Close()
+}
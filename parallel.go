@@ -0,0 +1,145 @@
+package spgz
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// With Options.CompressJobs ReadFrom() reads whole blocks ahead and compresses them in that many
+// goroutines while the source is being read and the previous blocks are being written. The
+// blocks are still stored one by one in order by the goroutine that called ReadFrom(), the
+// workers only produce the images of the slots (see block.compress()), so everything else about
+// storing a block (base, dedup, journal, change tracking etc.) works as usual. At most twice as
+// many blocks as there are workers are in flight, fewer with Options.MemoryLimit (see
+// memlimit.go). Each one holds a buffer for the data and one for the image, which are reused, so
+// once they're all taken reading the source waits for the oldest block to be stored.
+//
+// The parallel path is taken from the first block boundary ReadFrom() reaches. Partial blocks at
+// the start and at the end are written the usual way, so that they're merged with the data that's
+// already there. Copy() uses ReadFrom() for the ranges of data when the destination has
+// CompressJobs set.
+
+type compressJob struct {
+	b    block
+	zero bool
+	err  error
+	done chan struct{}
+}
+
+func (j *compressJob) run() {
+	j.b.image, j.err = nil, nil
+	j.zero = IsBlockZero(j.b.data)
+	if !j.zero {
+		j.b.image, j.err = j.b.compress(j.b.rawBlock)
+		if j.err == nil && cap(j.b.image) <= cap(j.b.rawBlock) {
+			// Keep the buffer for the next block unless it has grown beyond what's accounted for
+			j.b.rawBlock = j.b.image
+		}
+	}
+	j.done <- struct{}{}
+}
+
+// readFromParallel reads and stores full blocks from rd starting at f.offset, which must be at a
+// block boundary. It returns the number of bytes stored and what was read after the last full
+// block.
+func (f *compFile) readFromParallel(ctx context.Context, rd io.Reader, p *progress) (n int64, tail []byte, err error) {
+	err = f.flushBlock()
+	if err != nil {
+		return
+	}
+	// The current block may be overwritten
+	f.loaded = false
+
+	work := make(chan *compressJob)
+	var wg sync.WaitGroup
+	for i := 0; i < f.compressJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				j.run()
+			}
+		}()
+	}
+	defer func() {
+		close(work)
+		wg.Wait()
+	}()
+
+	var queue, free []*compressJob
+	store := func() error {
+		j := queue[0]
+		queue = queue[1:]
+		free = append(free, j)
+		<-j.done
+		if j.err != nil {
+			return j.err
+		}
+		serr := j.b.storeBlock(false, j.zero)
+		if serr != nil {
+			return serr
+		}
+		n += int64(len(j.b.data))
+		p.add(int64(len(j.b.data)), j.b.physSize)
+		return nil
+	}
+
+	for {
+		err = ctx.Err()
+		if err != nil {
+			break
+		}
+		err = f.checkRange(f.offset, 1)
+		if err != nil {
+			break
+		}
+		var j *compressJob
+		if l := len(free); l > 0 {
+			j = free[l-1]
+			free = free[:l-1]
+		} else {
+			j = &compressJob{
+				done: make(chan struct{}, 1),
+			}
+			j.b.init(f)
+			j.b.dataBlock = make([]byte, f.blockSize)
+			j.b.rawBlock = make([]byte, 0, f.blockSize+1)
+		}
+		var r int
+		r, err = io.ReadFull(rd, j.b.dataBlock)
+		if r < len(j.b.dataBlock) {
+			tail = j.b.dataBlock[:r]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			break
+		}
+		j.b.num = f.offset / f.blockSize
+		j.b.data = j.b.dataBlock
+		j.b.dirty = true
+		f.offset += int64(r)
+		queue = append(queue, j)
+		work <- j
+		for len(queue) >= f.compressInFlight && err == nil {
+			err = store()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for len(queue) > 0 {
+		if err != nil {
+			// Only wait for the rest
+			<-queue[0].done
+			queue = queue[1:]
+			continue
+		}
+		err = store()
+	}
+	if err != nil {
+		tail = nil
+	}
+	return
+}
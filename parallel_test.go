@@ -0,0 +1,83 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCompressJobs(t *testing.T) {
+	const bs = 8192
+	src := make([]byte, 20*bs+1000)
+	rand.New(rand.NewSource(1)).Read(src[:5*bs])
+	// compressible and zero blocks
+	for i := 8 * bs; i < 12*bs; i++ {
+		src[i] = byte(i / 100)
+	}
+
+	write := func(jobs int, limit int64, data []byte) *memSparseFile {
+		var sf memSparseFile
+		f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+			BlockSize:    bs,
+			Reproducible: true,
+			CompressJobs: jobs,
+			MemoryLimit:  limit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := f.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("Unexpected n: %d", n)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sf
+	}
+
+	seq := write(0, 0, src)
+	par := write(4, 0, src)
+	if !bytes.Equal(seq.data, par.data) {
+		t.Fatal("Files differ")
+	}
+	// Room for 3 blocks in flight, so reading the source waits for them to be stored
+	if !bytes.Equal(seq.data, write(4, 4*2*(bs+1), src).data) {
+		t.Fatal("Files differ with a memory limit")
+	}
+
+	// Overwrite the middle, the partial blocks at both ends are merged with the existing data
+	par.Seek(0, os.SEEK_SET)
+	f, err := NewFromSparseFileOptions(par, os.O_RDWR, &Options{CompressJobs: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := bytes.Repeat([]byte{0xaa}, 7*bs+100)
+	_, err = f.Seek(2*bs-300, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ReadFrom(bytes.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(src[2*bs-300:], patch)
+	f.Seek(0, io.SeekStart)
+	res, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, src) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
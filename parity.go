@@ -0,0 +1,518 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Parity records allow repairing a limited amount of corruption in the file. The slots are
+// divided into groups of ParityGroup consecutive slots and for each group the parity file holds a
+// record with the CRC32 of every slot and ParityShards Reed-Solomon parity shards (see
+// reedsolomon.go) of slot size. Up to ParityShards damaged slots (or parity shards) per group can
+// be reconstructed by Repair().
+//
+// The parity is brought up to date when the file is synced or closed. Until then the groups that
+// have been written to are marked as dirty in memory, and the parity file header has a flag which
+// is set before the first such write. If the flag is found set when the file is opened (i.e. the
+// file was not closed properly), all of the parity is recomputed.
+//
+// Parity file layout: a header page (parityHeader), followed by the records.
+
+const (
+	parityMagic = "SPGZPAR1"
+
+	defParityGroup  = 16
+	defParityShards = 2
+)
+
+var (
+	ErrParityMismatch   = errors.New("The parity file does not belong to this file")
+	ErrParityRequired   = errors.New("Repair requires a parity file")
+	ErrChecksumMismatch = errors.New("Slot data does not match its checksum")
+	ErrUnrepairable     = errors.New("Too many damaged slots in a parity group")
+)
+
+type parityHeader struct {
+	Magic      [8]byte
+	Group      uint32
+	Shards     uint32
+	SlotSize   uint64
+	DataOffset uint64
+	PhysSize   uint64
+	Dirty      uint32
+	Reserved   uint32
+}
+
+type parity struct {
+	file  SparseFile
+	raw   SparseFile // the data file, writes to it don't mark anything dirty
+	h     parityHeader
+	codec *rsCodec
+	dirty map[int64]struct{}
+	all   bool
+}
+
+// parityTracker wraps the data file and marks the groups that are written to as dirty.
+type parityTracker struct {
+	SparseFile
+	f *compFile
+}
+
+func (t *parityTracker) WriteAt(buf []byte, offset int64) (int, error) {
+	err := t.f.parityDirty(offset, int64(len(buf)))
+	if err != nil {
+		return 0, err
+	}
+	return t.SparseFile.WriteAt(buf, offset)
+}
+
+func (t *parityTracker) Write(buf []byte) (int, error) {
+	offset, err := t.SparseFile.Seek(0, os.SEEK_CUR)
+	if err == nil {
+		err = t.f.parityDirty(offset, int64(len(buf)))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return t.SparseFile.Write(buf)
+}
+
+func (t *parityTracker) PunchHole(offset, size int64) error {
+	err := t.f.parityDirty(offset, size)
+	if err != nil {
+		return err
+	}
+	return t.SparseFile.PunchHole(offset, size)
+}
+
+func (t *parityTracker) Truncate(size int64) error {
+	// The groups affected by a change of the size are found by updateParity()
+	err := t.f.setParityDirty()
+	if err != nil {
+		return err
+	}
+	return t.SparseFile.Truncate(size)
+}
+
+func (p *parity) slotSize() int64 {
+	return int64(p.h.SlotSize)
+}
+
+func (p *parity) recordSize() int64 {
+	return int64(p.h.Group+p.h.Shards)*4 + int64(p.h.Shards)*p.slotSize()
+}
+
+func (p *parity) recordOffset(group int64) int64 {
+	return headerSize + group*p.recordSize()
+}
+
+func (p *parity) writeHeader() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &p.h)
+	_, err := p.file.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func (f *compFile) initParity(opts *Options) error {
+	p := &parity{
+		file:  opts.Parity,
+		raw:   f.f,
+		dirty: make(map[int64]struct{}),
+	}
+	buf := make([]byte, binary.Size(&p.h))
+	_, err := p.file.ReadAt(buf, 0)
+	if err == io.EOF {
+		if f.readOnly {
+			return ErrParityMismatch
+		}
+		group, shards := opts.ParityGroup, opts.ParityShards
+		if group <= 0 {
+			group = defParityGroup
+		}
+		if shards <= 0 {
+			shards = defParityShards
+		}
+		copy(p.h.Magic[:], parityMagic)
+		p.h.Group = uint32(group)
+		p.h.Shards = uint32(shards)
+		p.h.SlotSize = uint64(f.blockSize + 1)
+		p.h.DataOffset = uint64(f.dataOffset)
+		p.h.Dirty = 1
+	} else if err != nil {
+		return err
+	} else {
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &p.h)
+		if string(p.h.Magic[:]) != parityMagic {
+			return ErrInvalidFormat
+		}
+		if p.h.SlotSize != uint64(f.blockSize+1) || p.h.DataOffset != uint64(f.dataOffset) {
+			return ErrParityMismatch
+		}
+	}
+	p.codec, err = newRSCodec(int(p.h.Group), int(p.h.Shards))
+	if err != nil {
+		return err
+	}
+	f.parity = p
+	if f.readOnly {
+		return nil
+	}
+	physSize, err := p.raw.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if p.h.Dirty != 0 || int64(p.h.PhysSize) != physSize {
+		p.all = true
+		p.h.Dirty = 1
+		err = p.writeHeader()
+		if err == nil {
+			err = f.updateParity()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.f = &parityTracker{
+		SparseFile: f.f,
+		f:          f,
+	}
+	return nil
+}
+
+// parityDirty marks the groups covering the physical range as dirty.
+func (f *compFile) parityDirty(offset, size int64) error {
+	p := f.parity
+	end := offset + size
+	if end <= f.dataOffset {
+		return nil
+	}
+	if offset < f.dataOffset {
+		offset = f.dataOffset
+	}
+	slots := p.slotSize() * int64(p.h.Group)
+	for g := (offset - f.dataOffset) / slots; g <= (end-1-f.dataOffset)/slots; g++ {
+		p.dirty[g] = struct{}{}
+	}
+	return f.setParityDirty()
+}
+
+// setParityDirty sets the dirty flag in the parity file header before the first modification.
+func (f *compFile) setParityDirty() error {
+	p := f.parity
+	if p.h.Dirty != 0 {
+		return nil
+	}
+	p.h.Dirty = 1
+	err := p.writeHeader()
+	if err == nil {
+		err = p.file.Sync()
+	}
+	return err
+}
+
+// groups returns the number of groups covering a physical file size.
+func (p *parity) groups(physSize int64) int64 {
+	dataOffset := int64(p.h.DataOffset)
+	if physSize <= dataOffset {
+		return 0
+	}
+	slots := (physSize - dataOffset + p.slotSize() - 1) / p.slotSize()
+	return (slots + int64(p.h.Group) - 1) / int64(p.h.Group)
+}
+
+func (p *parity) newShards() [][]byte {
+	shards := make([][]byte, p.h.Group+p.h.Shards)
+	for i := range shards {
+		shards[i] = make([]byte, p.slotSize())
+	}
+	return shards
+}
+
+// readSlots reads the data slots of a group, the parts beyond the end of the file read as zeroes.
+func (p *parity) readSlots(group int64, shards [][]byte) error {
+	offset := int64(p.h.DataOffset) + group*int64(p.h.Group)*p.slotSize()
+	for _, shard := range shards[:p.h.Group] {
+		n, err := p.raw.ReadAt(shard, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := n; i < len(shard); i++ {
+			shard[i] = 0
+		}
+		offset += p.slotSize()
+	}
+	return nil
+}
+
+// readRecord reads the checksums and the parity shards of a group.
+func (p *parity) readRecord(group int64, crcs []uint32, shards [][]byte) error {
+	buf := make([]byte, len(crcs)*4)
+	offset := p.recordOffset(group)
+	_, err := p.file.ReadAt(buf, offset)
+	if err == nil {
+		for i := range crcs {
+			crcs[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		offset += int64(len(buf))
+		for _, shard := range shards[p.h.Group:] {
+			_, err = p.file.ReadAt(shard, offset)
+			if err != nil {
+				break
+			}
+			offset += p.slotSize()
+		}
+	}
+	if err == io.EOF {
+		err = ErrParityMismatch
+	}
+	return err
+}
+
+// writeRecord encodes the shards and writes the record of a group.
+func (p *parity) writeRecord(group int64, shards [][]byte) error {
+	p.codec.encode(shards)
+	buf := make([]byte, 0, p.recordSize())
+	for _, shard := range shards {
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(shard))
+	}
+	for _, shard := range shards[p.h.Group:] {
+		buf = append(buf, shard...)
+	}
+	_, err := p.file.WriteAt(buf, p.recordOffset(group))
+	return err
+}
+
+// updateParity recomputes the records of the dirty groups and clears the dirty flag.
+func (f *compFile) updateParity() error {
+	p := f.parity
+	if p.h.Dirty == 0 {
+		return nil
+	}
+	physSize, err := p.raw.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	groups := p.groups(physSize)
+	if physSize != int64(p.h.PhysSize) {
+		// The previous last group and everything after it (including the groups that were
+		// skipped over by extending the file) have changed
+		g := p.groups(int64(p.h.PhysSize))
+		if g > 0 {
+			g--
+		}
+		for ; g < groups; g++ {
+			p.dirty[g] = struct{}{}
+		}
+	}
+	shards := p.newShards()
+	update := func(g int64) error {
+		err := p.readSlots(g, shards)
+		if err != nil {
+			return err
+		}
+		return p.writeRecord(g, shards)
+	}
+	if p.all {
+		for g := int64(0); g < groups; g++ {
+			err = update(g)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		for g := range p.dirty {
+			if g < groups {
+				err = update(g)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	err = p.file.Truncate(p.recordOffset(groups))
+	if err != nil {
+		return err
+	}
+	err = p.file.Sync()
+	if err != nil {
+		return err
+	}
+	p.h.PhysSize = uint64(physSize)
+	p.h.Dirty = 0
+	err = p.writeHeader()
+	if err == nil {
+		err = p.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	p.all = false
+	clear(p.dirty)
+	return nil
+}
+
+// checkGroup reads a group and returns the indexes of the shards that don't match their
+// checksums. Data slots beyond the end of the file are not checked.
+func (p *parity) checkGroup(group, physSize int64, shards [][]byte, crcs []uint32) ([]int, error) {
+	err := p.readSlots(group, shards)
+	if err == nil {
+		err = p.readRecord(group, crcs, shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+	first := (int64(p.h.DataOffset) + group*int64(p.h.Group)*p.slotSize())
+	var bad []int
+	for i, shard := range shards {
+		if i < int(p.h.Group) && first+int64(i)*p.slotSize() >= physSize {
+			continue
+		}
+		if crc32.ChecksumIEEE(shard) != crcs[i] {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+func (f *compFile) slotError(slot int64, cause error) error {
+	return &ErrCorruptBlock{
+		Num:        slot,
+		PhysOffset: f.blockOffset(slot),
+		Cause:      cause,
+	}
+}
+
+// verifyParity checks all slots against the checksums in the parity records and returns the
+// first mismatch as an ErrCorruptBlock. The groups that have been modified since the last update
+// are skipped.
+func (f *compFile) verifyParity(ctx context.Context) error {
+	f.Lock()
+	p := f.parity
+	physSize, err := p.raw.Seek(0, os.SEEK_END)
+	current := p.h.Dirty == 0 && int64(p.h.PhysSize) == physSize
+	f.Unlock()
+	if err != nil || !current {
+		// Not up to date, either modified since or not brought up to date after a crash
+		return err
+	}
+	shards := p.newShards()
+	crcs := make([]uint32, len(shards))
+	for g := int64(0); g < p.groups(physSize); g++ {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		f.Lock()
+		bad, err := p.checkGroup(g, physSize, shards, crcs)
+		f.Unlock()
+		if err != nil {
+			return err
+		}
+		for _, i := range bad {
+			if i < int(p.h.Group) {
+				return f.slotError(g*int64(p.h.Group)+int64(i), ErrChecksumMismatch)
+			}
+			return fmt.Errorf("parity record %d: %w", g, ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// Repair brings the parity up to date, then checks every slot against its checksum and
+// reconstructs the damaged ones from the parity records. It returns the number of repaired slots.
+// If a group has more damaged slots than there are parity shards, the others are still repaired
+// and an ErrCorruptBlock wrapping ErrUnrepairable is returned for it.
+func (f *compFile) Repair() (int, error) {
+	if f.parity == nil {
+		return 0, ErrParityRequired
+	}
+	if f.readOnly {
+		return 0, os.ErrPermission
+	}
+	f.Lock()
+	defer f.Unlock()
+	err := f.flushBlock()
+	if err == nil {
+		err = f.syncFile()
+	}
+	if err != nil {
+		return 0, err
+	}
+	p := f.parity
+	physSize, err := p.raw.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	shards := p.newShards()
+	crcs := make([]uint32, len(shards))
+	present := make([]bool, len(shards))
+	repaired := 0
+	var unrepairable error
+	for g := int64(0); g < p.groups(physSize); g++ {
+		bad, err := p.checkGroup(g, physSize, shards, crcs)
+		if err != nil {
+			return repaired, err
+		}
+		if len(bad) == 0 {
+			continue
+		}
+		first := g * int64(p.h.Group)
+		if len(bad) > int(p.h.Shards) {
+			if unrepairable == nil {
+				unrepairable = f.slotError(first+int64(bad[0]), ErrUnrepairable)
+			}
+			continue
+		}
+		for i := range present {
+			present[i] = true
+		}
+		for _, i := range bad {
+			present[i] = false
+		}
+		err = p.codec.reconstruct(shards, present)
+		if err != nil {
+			return repaired, err
+		}
+		for _, i := range bad {
+			if i >= int(p.h.Group) {
+				continue
+			}
+			slot := first + int64(i)
+			offset := f.blockOffset(slot)
+			data := shards[i]
+			if l := physSize - offset; l < int64(len(data)) {
+				data = data[:l]
+			}
+			if f.log != nil {
+				f.log.Warn("spgz: repairing slot", "file", f.name, "slot", slot)
+			}
+			_, err = p.raw.WriteAt(data, offset)
+			if err != nil {
+				return repaired, err
+			}
+			if f.loaded && f.slotOf(f.block.num) == slot {
+				f.loaded = false
+			}
+			repaired++
+		}
+		// Rewrites damaged parity shards
+		err = p.writeRecord(g, shards)
+		if err != nil {
+			return repaired, err
+		}
+	}
+	err = p.raw.Sync()
+	if err == nil {
+		err = p.file.Sync()
+	}
+	if err != nil {
+		return repaired, err
+	}
+	return repaired, unrepairable
+}
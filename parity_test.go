@@ -0,0 +1,101 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestParity(t *testing.T) {
+	var sf, pf memSparseFile
+	opts := &Options{BlockSize: 4096, Parity: &pf, ParityGroup: 4, ParityShards: 2}
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 30*bs+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(slots ...int64) {
+		for _, slot := range slots {
+			sf.data[f.blockOffset(slot)+3] ^= 0xff
+		}
+	}
+	open := func() *compFile {
+		sf.Seek(0, os.SEEK_SET)
+		f, err := NewFromSparseFileOptions(&sf, os.O_RDWR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Two slots in the first group, one in the second one and the last (partial) slot
+	corrupt(0, 3, 5, 30)
+	f = open()
+	var ce *ErrCorruptBlock
+	if err := f.Verify(); !errors.As(err, &ce) || ce.Num != 0 || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Unexpected Verify() result: %v", err)
+	}
+	n, err := f.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("Unexpected number of repaired slots: %d", n)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data)+1)
+	r, _ := f.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:r], data) {
+		t.Fatal("Data mismatch after repair")
+	}
+
+	// Modifications are reflected in the parity once the file is synced
+	_, err = f.WriteAt([]byte("modified"), 10*bs+10)
+	if err == nil {
+		err = f.Truncate(20*bs + 5)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[10*bs+10:], "modified")
+	data = data[:20*bs+5]
+	corrupt(10, 20)
+	n, err = f.Repair()
+	if err != nil || n != 2 {
+		t.Fatalf("Repair after modification: %d, %v", n, err)
+	}
+	r, _ = f.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:r], data) {
+		t.Fatal("Data mismatch after modification")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too much damage in one group
+	corrupt(4, 5, 6)
+	f = open()
+	defer f.Close()
+	n, err = f.Repair()
+	if !errors.Is(err, ErrUnrepairable) || n != 0 {
+		t.Fatalf("Unexpected Repair() result: %d, %v", n, err)
+	}
+}
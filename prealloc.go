@@ -0,0 +1,60 @@
+package spgz
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// With Options.Preallocate the whole slot of a block is allocated when the block is first written
+// into it, before its data is written and the rest of the slot is released. The filesystem then
+// places the data of every slot at the start of an extent sized for the slot rather than wherever
+// the next free space is, so under random writes the data of neighbouring slots stays in order on
+// the disk and doesn't get split into small extents when it grows. A slot is written into for the
+// first time if it has no data, i.e. it's past the end of the file or a hole.
+//
+// Preallocation is an optimisation: if the underlying file doesn't support it, it's turned off,
+// and if it fails for another reason (e.g. the filesystem is full) the block is written anyway.
+
+// SlotAllocator is an underlying file that can allocate space for a range without changing its
+// size. sparseFile implements it on Linux.
+type SlotAllocator interface {
+	Allocate(offset, size int64) error
+}
+
+// preallocateSlot allocates the slot of block num if nothing has been written into it yet. It
+// returns true if it did, the rest of the slot then needs to be released after the data is
+// written even if it's past the end of the file (see trimSlot).
+func (f *compFile) preallocateSlot(num int64) bool {
+	a, ok := f.f.(SlotAllocator)
+	if !ok {
+		f.preallocate = false
+		return false
+	}
+	start, end := f.blockOffset(num), f.blockOffset(num+1)
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return false
+	}
+	if o > start {
+		ds, ok := f.f.(DataSeeker)
+		if !ok {
+			return false
+		}
+		data, err := ds.SeekData(start)
+		if err != nil || data < end {
+			return false
+		}
+	}
+	err = a.Allocate(start, end-start)
+	if err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOTSUP) {
+			f.preallocate = false
+		}
+		if f.log != nil {
+			f.log.Debug("spgz: could not preallocate slot", "file", f.name, "block", num, "err", err)
+		}
+		return false
+	}
+	return true
+}
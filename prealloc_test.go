@@ -0,0 +1,81 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, preallocate bool) (*compFile, []byte) {
+		name = filepath.Join(dir, name)
+		f, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := f.BlockSize()
+		err = f.Truncate(8 * bs)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = OpenFileOptions(name, os.O_RDWR, 0, &Options{Preallocate: preallocate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			f.Close()
+		})
+		expected := make([]byte, 10*bs)
+		// Holes inside the file and slots past its end, the last one is partial
+		for _, num := range []int64{5, 2, 9, 7, 2} {
+			data := bytes.Repeat([]byte{byte(num), 'p'}, int(bs/2))
+			if num == 9 {
+				data = data[:bs/3]
+				expected = expected[:9*bs+bs/3]
+			}
+			copy(expected[num*bs:], data)
+			_, err = f.WriteAt(data, num*bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = f.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f, expected
+	}
+
+	f, expected := write("prealloc.spgz", true)
+	if !f.preallocate {
+		t.Skip("Preallocation is not supported")
+	}
+	res, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, expected) {
+		t.Fatal("Data mismatch")
+	}
+	fr, err := f.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.AllocatedSlack > 0 {
+		t.Fatalf("Slack is allocated: %+v", fr)
+	}
+
+	// The parts of the slots that are not taken by the data are released, including the one past
+	// the end of the file
+	plain, _ := write("plain.spgz", false)
+	if a, p := allocatedSize(f.f), allocatedSize(plain.f); a > p {
+		t.Fatalf("More space is allocated: %d, %d", a, p)
+	}
+}
@@ -0,0 +1,60 @@
+package spgz
+
+// Progress describes the work done so far by a ReadFrom, WriteTo or Verify call. Bytes in and out
+// are compressed and uncompressed bytes respectively for WriteTo and Verify, and the other way
+// round for ReadFrom. Blocks that are holes or shared with other blocks take no compressed bytes.
+// The compressed size of loaded blocks is approximate.
+type Progress struct {
+	Blocks   int64
+	BytesIn  int64
+	BytesOut int64
+
+	// Ratio is the compressed size divided by the uncompressed size.
+	Ratio float64
+}
+
+// ProgressFunc is called after every block. For ReadFrom and WriteTo it's called with the file
+// locked, so it must not use the file.
+type ProgressFunc func(p Progress)
+
+// SetProgress sets the callback that reports the progress of ReadFrom, WriteTo and Verify, nil
+// removes it. With a callback ReadFrom stores each block as soon as it's complete.
+func (f *compFile) SetProgress(fn ProgressFunc) {
+	f.Lock()
+	f.progress = fn
+	f.Unlock()
+}
+
+type progress struct {
+	Progress
+	fn           ProgressFunc
+	compressedIn bool
+}
+
+// newProgress returns nil if there is no callback.
+func (f *compFile) newProgress(compressedIn bool) *progress {
+	if f.progress == nil {
+		return nil
+	}
+	return &progress{
+		fn:           f.progress,
+		compressedIn: compressedIn,
+	}
+}
+
+func (p *progress) add(in, out int64) {
+	if p == nil {
+		return
+	}
+	p.Blocks++
+	p.BytesIn += in
+	p.BytesOut += out
+	compressed, uncompressed := p.BytesOut, p.BytesIn
+	if p.compressedIn {
+		compressed, uncompressed = uncompressed, compressed
+	}
+	if uncompressed > 0 {
+		p.Ratio = float64(compressed) / float64(uncompressed)
+	}
+	p.fn(p.Progress)
+}
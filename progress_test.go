@@ -0,0 +1,68 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("progress"), int(3*f.BlockSize()+100)/8)
+	var last Progress
+	calls := 0
+	f.SetProgress(func(p Progress) {
+		calls++
+		last = p
+	})
+
+	_, err = f.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 || last.Blocks != 4 || last.BytesIn != int64(len(data)) {
+		t.Fatalf("ReadFrom: %d calls, %+v", calls, last)
+	}
+	if last.BytesOut == 0 || last.Ratio <= 0 || last.Ratio >= 0.5 {
+		t.Fatalf("ReadFrom: unexpected compressed size: %+v", last)
+	}
+	stored := last.BytesOut
+
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("Data differs")
+	}
+	if last.Blocks != 4 || last.BytesOut != int64(len(data)) || last.BytesIn == 0 || last.BytesIn > stored {
+		t.Fatalf("WriteTo: %+v", last)
+	}
+
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Blocks != 4 || last.BytesOut != int64(len(data)) {
+		t.Fatalf("Verify: %+v", last)
+	}
+
+	f.SetProgress(nil)
+	calls = 0
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Fatal("Callback was called after removal")
+	}
+}
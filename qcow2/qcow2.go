@@ -0,0 +1,307 @@
+// Package qcow2 reads qcow2 disk images (versions 2 and 3) without a backing file or encryption.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/dop251/spgz"
+)
+
+const (
+	magic = 0x514649fb // "QFI\xfb"
+
+	incompatDirty        = 1 << 0
+	incompatCorrupt      = 1 << 1
+	incompatCompressType = 1 << 3
+
+	l1OffsetMask = 0x00fffffffffffe00
+	l2OffsetMask = 0x00fffffffffffe00
+	l2Compressed = 1 << 62
+	l2Zero       = 1 << 0
+
+	// The limits qemu puts on the images it opens
+	maxSize   = 1 << 62
+	maxL1Size = 32 << 20 / 8 // entries
+)
+
+var (
+	ErrInvalidFormat       = errors.New("Not a qcow2 image")
+	ErrUnsupportedVersion  = errors.New("Unsupported qcow2 version")
+	ErrBackingFile         = errors.New("Images with a backing file are not supported")
+	ErrEncrypted           = errors.New("Encrypted images are not supported")
+	ErrUnsupportedFeatures = errors.New("Image uses unsupported qcow2 features")
+	ErrCorrupt             = errors.New("Image is marked corrupt")
+)
+
+type header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+type headerV3 struct {
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+type Image struct {
+	r           io.ReaderAt
+	clusterBits uint32
+	clusterSize int64
+	size        int64
+	l1          []uint64
+
+	// the most recently used L2 table
+	l2Offset uint64
+	l2       []uint64
+
+	compBuf []byte
+}
+
+func Open(r io.ReaderAt) (*Image, error) {
+	var h header
+	err := binary.Read(io.NewSectionReader(r, 0, 72), binary.BigEndian, &h)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidFormat
+		}
+		return nil, err
+	}
+	if h.Magic != magic {
+		return nil, ErrInvalidFormat
+	}
+	switch h.Version {
+	case 2:
+	case 3:
+		var h3 headerV3
+		err = binary.Read(io.NewSectionReader(r, 72, 32), binary.BigEndian, &h3)
+		if err != nil {
+			return nil, err
+		}
+		if h3.IncompatibleFeatures&incompatCorrupt != 0 {
+			return nil, ErrCorrupt
+		}
+		if h3.IncompatibleFeatures&^(incompatDirty|incompatCompressType) != 0 {
+			return nil, ErrUnsupportedFeatures
+		}
+		if h3.IncompatibleFeatures&incompatCompressType != 0 {
+			// Only deflate (compression type 0) is supported
+			var ct [1]byte
+			if h3.HeaderLength > 104 {
+				if _, err := r.ReadAt(ct[:], 104); err != nil {
+					return nil, err
+				}
+			}
+			if ct[0] != 0 {
+				return nil, ErrUnsupportedFeatures
+			}
+		}
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	if h.BackingFileOffset != 0 {
+		return nil, ErrBackingFile
+	}
+	if h.CryptMethod != 0 {
+		return nil, ErrEncrypted
+	}
+	// The header is checked before anything is allocated based on it, so that a damaged image
+	// can't make l1Entries overflow or be huge.
+	if h.ClusterBits < 9 || h.ClusterBits > 21 || h.Size > maxSize || h.L1Size > maxL1Size {
+		return nil, ErrInvalidFormat
+	}
+
+	img := &Image{
+		r:           r,
+		clusterBits: h.ClusterBits,
+		clusterSize: 1 << h.ClusterBits,
+		size:        int64(h.Size),
+	}
+
+	l1Entries := (img.size + img.clusterSize*img.l2Entries() - 1) / (img.clusterSize * img.l2Entries())
+	if int64(h.L1Size) < l1Entries {
+		return nil, ErrInvalidFormat
+	}
+	img.l1 = make([]uint64, l1Entries)
+	err = binary.Read(io.NewSectionReader(r, int64(h.L1TableOffset), l1Entries*8), binary.BigEndian, img.l1)
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+func (img *Image) l2Entries() int64 {
+	return img.clusterSize / 8
+}
+
+func (img *Image) loadL2(offset uint64) error {
+	if img.l2 != nil && img.l2Offset == offset {
+		return nil
+	}
+	if img.l2 == nil {
+		img.l2 = make([]uint64, img.l2Entries())
+	}
+	err := binary.Read(io.NewSectionReader(img.r, int64(offset), img.clusterSize), binary.BigEndian, img.l2)
+	if err != nil {
+		img.l2Offset = 0
+		return err
+	}
+	img.l2Offset = offset
+	return nil
+}
+
+// l2Entry returns the L2 entry for the given cluster or 0 if its L2 table is not allocated.
+func (img *Image) l2Entry(cluster int64) (uint64, error) {
+	l2Offset := img.l1[cluster/img.l2Entries()] & l1OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	err := img.loadL2(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return img.l2[cluster%img.l2Entries()], nil
+}
+
+// readCluster reads the cluster described by the L2 entry e into buf (which must be clusterSize long).
+// It returns false if the cluster reads as zeroes.
+func (img *Image) readCluster(e uint64, buf []byte) (bool, error) {
+	if e&l2Compressed != 0 {
+		x := 62 - (img.clusterBits - 8)
+		offset := int64(e & (1<<x - 1))
+		sectors := int64((e>>x)&(1<<(62-x)-1)) + 1
+		l := sectors*512 - offset&511
+		if int64(cap(img.compBuf)) < l {
+			img.compBuf = make([]byte, l)
+		}
+		comp := img.compBuf[:l]
+		n, err := img.r.ReadAt(comp, offset)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return false, err
+		}
+		z := flate.NewReader(bytes.NewReader(comp[:n]))
+		_, err = io.ReadFull(z, buf)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if e&l2Zero != 0 {
+		return false, nil
+	}
+	offset := int64(e & l2OffsetMask)
+	if offset == 0 {
+		return false, nil
+	}
+	n, err := img.r.ReadAt(buf, offset)
+	if err == io.EOF {
+		// The last cluster of the file may be short
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		err = nil
+	}
+	return true, err
+}
+
+func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	if remaining := img.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+	buf := make([]byte, img.clusterSize)
+	for len(p) > 0 {
+		cluster := off >> img.clusterBits
+		e, err1 := img.l2Entry(cluster)
+		if err1 != nil {
+			return n, err1
+		}
+		allocated, err1 := img.readCluster(e, buf)
+		if err1 != nil {
+			return n, err1
+		}
+		o := off - cluster<<img.clusterBits
+		var nn int
+		if allocated {
+			nn = copy(p, buf[o:])
+		} else {
+			nn = int(img.clusterSize - o)
+			if nn > len(p) {
+				nn = len(p)
+			}
+			for i := range p[:nn] {
+				p[i] = 0
+			}
+		}
+		n += nn
+		off += int64(nn)
+		p = p[nn:]
+	}
+	return
+}
+
+// CopyTo writes the content of the image to t in ascending order. Unallocated clusters and clusters
+// consisting entirely of zeroes are skipped, the target is then truncated to the virtual size.
+// Returns the number of bytes actually written.
+func (img *Image) CopyTo(t spgz.Target) (written int64, err error) {
+	buf := make([]byte, img.clusterSize)
+	clusters := (img.size + img.clusterSize - 1) >> img.clusterBits
+	for cluster := int64(0); cluster < clusters; cluster++ {
+		if cluster%img.l2Entries() == 0 && img.l1[cluster/img.l2Entries()]&l1OffsetMask == 0 {
+			// Skip the whole L2 table
+			cluster += img.l2Entries() - 1
+			continue
+		}
+		e, err := img.l2Entry(cluster)
+		if err != nil {
+			return written, err
+		}
+		allocated, err := img.readCluster(e, buf)
+		if err != nil {
+			return written, err
+		}
+		if !allocated {
+			continue
+		}
+		off := cluster << img.clusterBits
+		data := buf
+		if remaining := img.size - off; remaining < img.clusterSize {
+			data = buf[:remaining]
+		}
+		if spgz.IsBlockZero(data) {
+			continue
+		}
+		n, err := t.WriteAt(data, off)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, t.Truncate(img.size)
+}
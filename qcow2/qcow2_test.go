@@ -0,0 +1,174 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+type memTarget struct {
+	data   []byte
+	writes int
+}
+
+func (t *memTarget) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(t.data)) {
+		t.Truncate(end)
+	}
+	t.writes++
+	return copy(t.data[off:], p), nil
+}
+
+func (t *memTarget) Truncate(size int64) error {
+	d := make([]byte, size)
+	copy(d, t.data)
+	t.data = d
+	return nil
+}
+
+const (
+	testClusterBits = 16
+	testClusterSize = 1 << testClusterBits
+	testSize        = 5*testClusterSize + 1000
+)
+
+func fill(buf []byte, v byte) {
+	for i := range buf {
+		buf[i] = v + byte(i%7)
+	}
+}
+
+// makeImage builds an image with a data cluster, an unallocated cluster, a compressed cluster,
+// a zero cluster, an allocated cluster of zeroes and a short data cluster, in that order.
+func makeImage(t *testing.T) (image, expected []byte) {
+	image = make([]byte, 7*testClusterSize)
+	expected = make([]byte, testSize)
+
+	h := header{
+		Magic:         magic,
+		Version:       3,
+		ClusterBits:   testClusterBits,
+		Size:          testSize,
+		L1Size:        1,
+		L1TableOffset: 1 * testClusterSize,
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	binary.Write(&buf, binary.BigEndian, &headerV3{RefcountOrder: 4, HeaderLength: 104})
+	copy(image, buf.Bytes())
+
+	binary.BigEndian.PutUint64(image[1*testClusterSize:], 2*testClusterSize)
+	l2 := image[2*testClusterSize:]
+
+	fill(image[3*testClusterSize:4*testClusterSize], 1)
+	fill(expected[0:testClusterSize], 1)
+	binary.BigEndian.PutUint64(l2[0:], 3*testClusterSize)
+
+	fill(expected[2*testClusterSize:3*testClusterSize], 2)
+	buf.Reset()
+	z, _ := flate.NewWriter(&buf, flate.BestCompression)
+	z.Write(expected[2*testClusterSize : 3*testClusterSize])
+	z.Close()
+	compOffset := uint64(4*testClusterSize + 100)
+	copy(image[compOffset:], buf.Bytes())
+	x := uint(62 - (testClusterBits - 8))
+	sectors := (compOffset%512+uint64(buf.Len())+511)/512 - 1
+	binary.BigEndian.PutUint64(l2[16:], l2Compressed|sectors<<x|compOffset)
+
+	binary.BigEndian.PutUint64(l2[24:], l2Zero)
+
+	binary.BigEndian.PutUint64(l2[32:], 5*testClusterSize)
+
+	fill(image[6*testClusterSize:6*testClusterSize+1000], 3)
+	fill(expected[5*testClusterSize:], 3)
+	binary.BigEndian.PutUint64(l2[40:], 6*testClusterSize)
+
+	return image, expected
+}
+
+func TestCopyTo(t *testing.T) {
+	image, expected := makeImage(t)
+	img, err := Open(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != testSize {
+		t.Fatalf("Unexpected size: %d", img.Size())
+	}
+
+	var target memTarget
+	n, err := img.CopyTo(&target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.writes != 3 {
+		t.Fatalf("Unexpected number of writes: %d", target.writes)
+	}
+	if n != 2*testClusterSize+1000 {
+		t.Fatalf("Unexpected number of bytes written: %d", n)
+	}
+	if !bytes.Equal(target.data, expected) {
+		t.Fatal("Content differs")
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	image, expected := makeImage(t)
+	img, err := Open(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3*testClusterSize)
+	n, err := img.ReadAt(buf, testClusterSize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], expected[testClusterSize/2:testClusterSize/2+n]) {
+		t.Fatal("Content differs")
+	}
+
+	n, err = img.ReadAt(buf, testSize-10)
+	if n != 10 || err == nil {
+		t.Fatalf("Unexpected result at the end: %d, %v", n, err)
+	}
+}
+
+func TestOpenBackingFile(t *testing.T) {
+	image, _ := makeImage(t)
+	binary.BigEndian.PutUint64(image[8:], 512)
+	_, err := Open(bytes.NewReader(image))
+	if err != ErrBackingFile {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestOpenCorruptHeader(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		offset int
+		value  uint64
+		size   int // of the field, 4 or 8
+	}{
+		{"cluster bits too small", 20, 8, 4},
+		{"cluster bits too large", 20, 64, 4},
+		{"negative size", 24, 1 << 63, 8},
+		{"size too large", 24, 1<<62 + 1, 8},
+		{"L1 table too small", 36, 0, 4},
+		{"L1 table too large", 36, 1<<32 - 1, 4},
+		{"L1 table too small for the size", 24, 1 << 61, 8},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			image, _ := makeImage(t)
+			if c.size == 4 {
+				binary.BigEndian.PutUint32(image[c.offset:], uint32(c.value))
+			} else {
+				binary.BigEndian.PutUint64(image[c.offset:], c.value)
+			}
+			_, err := Open(bytes.NewReader(image))
+			if err != ErrInvalidFormat {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
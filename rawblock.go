@@ -0,0 +1,148 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Raw block access lets replication and repair tools move blocks between files in their stored
+// form, without decompressing and recompressing them.
+
+// BlockType is the form of a raw block.
+type BlockType int
+
+const (
+	// BlockZero is a block that reads as zeroes, it has no payload. Writing one makes the block
+	// a hole of the full block size.
+	BlockZero BlockType = iota
+	// BlockUncompressed has the data as the payload.
+	BlockUncompressed
+	// BlockCompressed has a single gzip member as the payload.
+	BlockCompressed
+)
+
+var (
+	ErrInvalidPayload = errors.New("Invalid raw block payload")
+)
+
+// rawUnsupported returns ErrUnsupportedFeatures if the content of a block can't be handled in its
+// stored form: blocks in a block store or read from a base are not stored in the slots, and
+// storing a deduplicated block requires its data.
+func (f *compFile) rawUnsupported(write bool) error {
+	if f.base != nil || f.blockStore != nil || write && f.features&featDedup != 0 {
+		return ErrUnsupportedFeatures
+	}
+	return nil
+}
+
+// ReadBlockRaw returns the stored form of block num. A short last block that consists of zeroes
+// is returned as BlockUncompressed. Returns io.EOF past the end of the file.
+func (f *compFile) ReadBlockRaw(num int64) ([]byte, BlockType, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.rawUnsupported(false)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = f.flushBlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	b := &block{
+		f: f,
+	}
+	err = b.load(num)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b.data) == 0 {
+		return nil, 0, io.EOF
+	}
+	switch b.rawBlock[0] {
+	case blkCompressed:
+		return append([]byte(nil), b.rawBlock[1:b.physSize]...), BlockCompressed, nil
+	case blkUncompressed:
+		if int64(len(b.data)) == f.blockSize && IsBlockZero(b.data) {
+			return nil, BlockZero, nil
+		}
+		return append([]byte(nil), b.data...), BlockUncompressed, nil
+	}
+	return nil, 0, b.corrupt(ErrInvalidFormat)
+}
+
+// WriteBlockRaw stores block num in the given form. The payload is checked for plausibility
+// (its size and, for BlockCompressed, the gzip header and the uncompressed size in the trailer)
+// but not decompressed. A block shorter than the block size is padded with zeroes unless it's
+// the last one, writing past the end of the file extends it with holes.
+func (f *compFile) WriteBlockRaw(num int64, typ BlockType, payload []byte) (err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err = f.rawUnsupported(true)
+	if err != nil {
+		return err
+	}
+	var image []byte
+	switch typ {
+	case BlockZero:
+		if len(payload) != 0 {
+			return ErrInvalidPayload
+		}
+	case BlockUncompressed:
+		if len(payload) == 0 || int64(len(payload)) > f.blockSize {
+			return ErrInvalidPayload
+		}
+		image = append([]byte{blkUncompressed}, payload...)
+	case BlockCompressed:
+		if len(payload) < 18 || int64(len(payload)) > f.blockSize || payload[0] != 0x1f ||
+			payload[1] != 0x8b || payload[2] != 8 {
+			return ErrInvalidPayload
+		}
+		if size := binary.LittleEndian.Uint32(payload[len(payload)-4:]); size == 0 || int64(size) > f.blockSize {
+			return ErrInvalidPayload
+		}
+		image = append([]byte{blkCompressed}, payload...)
+	default:
+		return ErrInvalidPayload
+	}
+
+	err = f.flushBlock()
+	if err != nil {
+		return err
+	}
+	if f.loaded && f.block.num == num {
+		f.loaded = false
+	}
+	f.snapshot.Store(nil)
+
+	b := &block{
+		f:   f,
+		num: num,
+	}
+	defer func() {
+		if err != nil {
+			err = b.wrapErr("store", err)
+		}
+	}()
+	err = f.markChanged(num, num+1)
+	if err != nil {
+		return err
+	}
+	curOffset := f.blockOffset(num) + int64(len(image))
+	if typ == BlockZero {
+		err = b.writeImage(nil, f.blockSize+1)
+		curOffset = f.blockOffset(num + 1)
+	} else {
+		err = b.writeImage(image, 0)
+	}
+	if err != nil {
+		return err
+	}
+	err = b.trimSlot(curOffset, false)
+	if err != nil {
+		return err
+	}
+	return f.autoSync()
+}
@@ -0,0 +1,82 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestRawBlocks(t *testing.T) {
+	var sf memSparseFile
+	src, err := NewFromSparseFile(&sf, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := src.BlockSize()
+	data := make([]byte, 4*bs+100)
+	for i := int64(0); i < bs; i++ {
+		data[i] = byte(i % 7)
+	}
+	rand.New(rand.NewSource(1)).Read(data[bs : 2*bs])
+	// block 2 is zero, block 3 is partially zero
+	data[3*bs+5] = 1
+	data[4*bs+99] = 2
+	_, err = src.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var df memSparseFile
+	dst, err := NewFromSparseFile(&df, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BlockType{BlockCompressed, BlockUncompressed, BlockZero, BlockCompressed, BlockUncompressed}
+	// In reverse order, so that the file is extended by the first write
+	for num := int64(4); num >= 0; num-- {
+		payload, typ, err := src.ReadBlockRaw(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != expected[num] {
+			t.Fatalf("Block %d: unexpected type %d", num, typ)
+		}
+		err = dst.WriteBlockRaw(num, typ, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = src.ReadBlockRaw(5)
+	if err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	size, err := dst.Size()
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("Size: %d, %v", size, err)
+	}
+	buf := make([]byte, len(data))
+	_, err = dst.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+
+	for _, c := range []struct {
+		typ     BlockType
+		payload []byte
+	}{
+		{BlockZero, []byte{0}},
+		{BlockUncompressed, make([]byte, bs+1)},
+		{BlockCompressed, []byte("not a gzip member, really")},
+		{BlockType(7), nil},
+	} {
+		if err := dst.WriteBlockRaw(0, c.typ, c.payload); err != ErrInvalidPayload {
+			t.Fatalf("Type %d: unexpected error %v", c.typ, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package spgz
+
+import (
+	"errors"
+)
+
+// A systematic Reed-Solomon code over GF(2^8), used for the parity records (see parity.go). The
+// encoding matrix is derived from a Vandermonde matrix so that any data shards out of the
+// data+parity shards are enough to reconstruct the rest.
+
+var (
+	errTooFewShards = errors.New("Not enough shards to reconstruct the data")
+	errSingular     = errors.New("Singular matrix")
+)
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// gfMulAdd adds c*src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	var t [256]byte
+	for i := range t {
+		t[i] = gfMul(c, byte(i))
+	}
+	for i, b := range src {
+		dst[i] ^= t[b]
+	}
+}
+
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && a[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errSingular
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		if k := a[c][c]; k != 1 {
+			k = gfInv(k)
+			for j := 0; j < n; j++ {
+				a[c][j] = gfMul(a[c][j], k)
+				inv[c][j] = gfMul(inv[c][j], k)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if k := a[r][c]; r != c && k != 0 {
+				for j := 0; j < n; j++ {
+					a[r][j] ^= gfMul(k, a[c][j])
+					inv[r][j] ^= gfMul(k, inv[c][j])
+				}
+			}
+		}
+	}
+	return inv, nil
+}
+
+type rsCodec struct {
+	data, parity int
+	// rows of the encoding matrix, the first data rows are the identity
+	enc [][]byte
+}
+
+// newRSCodec returns a codec for the given number of data and parity shards, data+parity must
+// not exceed 256.
+func newRSCodec(data, parity int) (*rsCodec, error) {
+	n := data + parity
+	if data <= 0 || parity <= 0 || n > 256 {
+		return nil, ErrInvalidOptions
+	}
+	v := make([][]byte, n)
+	for r := range v {
+		v[r] = make([]byte, data)
+		for c := range v[r] {
+			v[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfInvert(v[:data])
+	if err != nil {
+		return nil, err
+	}
+	enc := make([][]byte, n)
+	for r := range enc {
+		enc[r] = make([]byte, data)
+		for c := 0; c < data; c++ {
+			var s byte
+			for k := 0; k < data; k++ {
+				s ^= gfMul(v[r][k], top[k][c])
+			}
+			enc[r][c] = s
+		}
+	}
+	return &rsCodec{
+		data:   data,
+		parity: parity,
+		enc:    enc,
+	}, nil
+}
+
+// encode computes the parity shards (shards[data:]) from the data shards. All shards must have
+// the same length.
+func (c *rsCodec) encode(shards [][]byte) {
+	for p := c.data; p < c.data+c.parity; p++ {
+		out := shards[p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < c.data; d++ {
+			gfMulAdd(out, shards[d], c.enc[p][d])
+		}
+	}
+}
+
+// reconstruct recomputes the shards that are not present.
+func (c *rsCodec) reconstruct(shards [][]byte, present []bool) error {
+	rows := make([][]byte, 0, c.data)
+	idx := make([]int, 0, c.data)
+	for i, ok := range present {
+		if ok && len(idx) < c.data {
+			rows = append(rows, c.enc[i])
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < c.data {
+		return errTooFewShards
+	}
+	dec, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	for d := 0; d < c.data; d++ {
+		if present[d] {
+			continue
+		}
+		out := shards[d]
+		for i := range out {
+			out[i] = 0
+		}
+		for j, k := range idx {
+			gfMulAdd(out, shards[k], dec[d][j])
+		}
+	}
+	c.encode(shards)
+	return nil
+}
@@ -0,0 +1,70 @@
+package spgz
+
+import (
+	"io"
+)
+
+// Refresh discards the cached block and re-reads the header and the tables loaded from it, so
+// that changes made to the file by another process (or through another handle) become visible.
+// Pending changes are written first. The base or parent the file was opened with is kept; if the
+// file no longer refers to one (e.g. because it has been flattened), it's released. If Refresh
+// fails, the file should be closed.
+func (f *compFile) Refresh() error {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.discardCache()
+	if err != nil {
+		return err
+	}
+
+	var magic [len(headerMagicV2)]byte
+	_, err = f.f.ReadAt(magic[:], 0)
+	if err != nil {
+		if err == io.EOF {
+			return ErrInvalidFormat
+		}
+		return err
+	}
+	if string(magic[:]) != headerMagicV2 {
+		// The header of a v1 file only holds the block size, which can't change
+		return nil
+	}
+
+	base := f.base
+	f.features = 0
+	f.mapBlocks = 0
+	f.present = nil
+	err = f.readHeaderV2(&Options{
+		Base:  base,
+		Store: f.blockStore,
+	})
+	if err != nil {
+		return err
+	}
+	if f.features&featBase == 0 && base != nil {
+		f.closeBase()
+		f.base = nil
+	}
+	return nil
+}
+
+// DiscardCache drops the cached block, so that the next read loads it from the file again. A
+// modified block is written first. Unlike Refresh it doesn't re-read the header, which is enough
+// if another process only modifies blocks in place.
+func (f *compFile) DiscardCache() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.discardCache()
+}
+
+func (f *compFile) discardCache() error {
+	err := f.flushBlock()
+	if err != nil {
+		return err
+	}
+	f.block.init(f)
+	f.loaded = false
+	f.snapshot.Store(nil)
+	return nil
+}
@@ -0,0 +1,89 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefresh(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "refresh.spgz")
+	w, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize:      4096,
+		ChangeTracking: true,
+		MaxTrackedSize: 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, err = w.WriteAt([]byte("old"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 3)
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.WriteAt([]byte("new"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.WriteAt([]byte("tail"), 3*w.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The block is still cached
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "old" {
+		t.Fatalf("Unexpected data: %q", buf)
+	}
+
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "new" {
+		t.Fatalf("Unexpected data after refresh: %q", buf)
+	}
+	size, err := r.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3*w.BlockSize()+4 {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	if r.Generation() != gen+1 {
+		t.Fatalf("Unexpected generation: %d", r.Generation())
+	}
+	tail := make([]byte, 4)
+	_, err = r.ReadAt(tail, 3*w.BlockSize())
+	if err != nil || !bytes.Equal(tail, []byte("tail")) {
+		t.Fatalf("Unexpected tail: %q, %v", tail, err)
+	}
+}
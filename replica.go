@@ -0,0 +1,90 @@
+package spgz
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// RepairFrom rewrites the blocks that can't be read or decoded (see Verify) with their content
+// read from replica, which holds the same data uncompressed: another copy of the file opened with
+// OpenFile(), a Base made with NewHTTPBase() for a copy served over HTTP, or the original source.
+// It returns the numbers of the repaired blocks. The damage is detected by the checksums of the
+// compressed blocks, so damage to blocks that are stored uncompressed goes unnoticed. Blocks read
+// from the base are not checked. Like any other write, a repair counts as a change for change
+// tracking.
+func (f *compFile) RepairFrom(replica io.ReaderAt) ([]int64, error) {
+	if f.readOnly {
+		return nil, os.ErrPermission
+	}
+	f.Lock()
+	err := f.flushBlock()
+	var size int64
+	if err == nil {
+		size, err = f.size()
+	}
+	f.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var repaired []int64
+	b := &block{
+		f: f,
+	}
+	var buf []byte
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	for num := int64(0); num < blocks; num++ {
+		err = f.checkBlock(b, num)
+		var ce *ErrCorruptBlock
+		if err == nil || !errors.As(err, &ce) {
+			if err != nil {
+				return repaired, err
+			}
+			continue
+		}
+		offset := num * f.blockSize
+		l := f.blockSize
+		if offset+l > size {
+			l = size - offset
+		}
+		if buf == nil {
+			buf = make([]byte, f.blockSize)
+		}
+		n, err := replica.ReadAt(buf[:l], offset)
+		if int64(n) < l {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return repaired, err
+		}
+		err = f.rewriteBlock(num, buf[:l])
+		if err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, num)
+	}
+	return repaired, nil
+}
+
+// rewriteBlock stores data as block num without loading it first.
+func (f *compFile) rewriteBlock(num int64, data []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	if f.loaded && f.block.num == num {
+		f.loaded = false
+	}
+	if f.log != nil {
+		f.log.Warn("spgz: repairing block from replica", "file", f.name, "block", num)
+	}
+	b := &block{
+		f:     f,
+		num:   num,
+		data:  data,
+		dirty: true,
+	}
+	return b.store(false)
+}
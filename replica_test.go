@@ -0,0 +1,59 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRepairFrom(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5*f.BlockSize()+100)
+	for i := range buf {
+		buf[i] = byte(i % 13)
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := NewFromSparseFile(&memSparseFile{data: append([]byte(nil), sf.data...)}, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	sf.data[f.blockOffset(1)+1] ^= 0xff
+	sf.data[f.blockOffset(3)+1] ^= 0xff
+
+	_, err = f.RepairFrom(bytes.NewReader(buf[:2*f.BlockSize()]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	repaired, err := f.RepairFrom(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 1 || repaired[0] != 3 {
+		// Block 1 was repaired by the previous attempt
+		t.Fatalf("Unexpected repaired blocks: %v", repaired)
+	}
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, len(buf)+1)
+	n, err := f.ReadAt(res, 0)
+	if err != io.EOF || !bytes.Equal(res[:n], buf) {
+		t.Fatalf("Data mismatch: %d, %v", n, err)
+	}
+}
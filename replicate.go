@@ -0,0 +1,262 @@
+package spgz
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Replication keeps a standby copy of a file up to date by streaming the blocks that change, in
+// their stored form (see rawblock.go), to a target on the other end of a connection. It uses the
+// framing of the delta protocol (see delta.go):
+//
+//  source -> target: "SPGZREP1", block size (u64)
+//  target -> source: status
+//  source -> target: rounds of records of block number (u64), block type (u8), length (u32),
+//                    payload; each round is followed by a size record (its payload is the size
+//                    of the file, u64) and an end of round record
+//  target -> source: status after each round, once the changes have been synced
+//
+// The first round sends all blocks, the following ones the blocks reported by ChangedBlocks().
+// The stream ends when the source closes the connection.
+
+const (
+	replMagic = "SPGZREP1"
+	replSize  = ^uint64(0) - 1
+	replRound = ^uint64(0)
+
+	defReplicateInterval = time.Second
+)
+
+// ReplicateOptions control Replicate.
+type ReplicateOptions struct {
+	// Interval is the pause between rounds, 1 second if 0.
+	Interval time.Duration
+
+	// OnRound is called after every round has been acknowledged by the target. Blocks is the
+	// number of blocks in the file and Changed the number of blocks sent.
+	OnRound func(stats *DeltaStats)
+}
+
+// ReplicaTarget is the receiving end of replication, normally an spgz file.
+type ReplicaTarget interface {
+	BlockSize() int64
+	WriteBlockRaw(num int64, typ BlockType, payload []byte) error
+	Truncatable
+	Sync() error
+}
+
+type replHeader struct {
+	Magic     [8]byte
+	BlockSize uint64
+}
+
+// Replicate sends the content of the file to the target on the other end of conn (see
+// ReceiveReplication) and then, every Interval, the blocks that have changed since the previous
+// round, until ctx is done. A final round is sent then and ctx.Err() is returned. The file must
+// have change tracking enabled and Replicate ends a generation every round (see Snapshot()), so
+// the file must not be written to by other processes at the same time. Files that need a base or a
+// block store can't be replicated.
+func (f *compFile) Replicate(ctx context.Context, conn io.ReadWriter, opts *ReplicateOptions) error {
+	if !f.ChangeTracking() {
+		return ErrChangeTrackingDisabled
+	}
+	if opts == nil {
+		opts = &ReplicateOptions{}
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defReplicateInterval
+	}
+	w := bufio.NewWriter(conn)
+	h := replHeader{
+		BlockSize: uint64(f.BlockSize()),
+	}
+	copy(h.Magic[:], replMagic)
+	err := binary.Write(w, binary.LittleEndian, &h)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = readDeltaStatus(conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	gen, err := f.Snapshot()
+	if err != nil {
+		return err
+	}
+	var changed []int64
+	full := true
+	for {
+		stats, err := f.sendRound(w, changed, full)
+		if err == nil {
+			err = readDeltaStatus(conn)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.OnRound != nil {
+			opts.OnRound(stats)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A final round is sent when the context is done
+		sleepContext(ctx, interval)
+
+		next, err := f.Snapshot()
+		if err != nil {
+			return err
+		}
+		changed, err = f.ChangedBlocks(gen)
+		if err != nil {
+			return err
+		}
+		gen = next
+		full = false
+	}
+}
+
+// sendRound sends the given blocks (or all of them if full is set) followed by the size and the
+// end of round record.
+func (f *compFile) sendRound(w *bufio.Writer, blocks []int64, full bool) (*DeltaStats, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	stats := &DeltaStats{
+		Blocks: (size + f.blockSize - 1) / f.blockSize,
+	}
+	send := func(num int64) error {
+		payload, typ, err := f.ReadBlockRaw(num)
+		if err == io.EOF {
+			// The file has been truncated since
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.LittleEndian, &deltaRecord{
+			Num:    uint64(num),
+			Type:   byte(typ),
+			Length: uint32(len(payload)),
+		})
+		if err == nil {
+			_, err = w.Write(payload)
+		}
+		stats.Changed++
+		stats.BytesSent += int64(len(payload))
+		return err
+	}
+	if full {
+		for num := int64(0); num < stats.Blocks; num++ {
+			err = send(num)
+			if err != nil {
+				return stats, err
+			}
+		}
+	} else {
+		for _, num := range blocks {
+			err = send(num)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+	err = binary.Write(w, binary.LittleEndian, &deltaRecord{Num: replSize, Length: 8})
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, uint64(size))
+	}
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, &deltaRecord{Num: replRound})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	return stats, err
+}
+
+// ReceiveReplication applies the rounds sent by Replicate on the other end of conn to the target
+// returned by open, which is called with the block size of the source. It returns nil when the
+// source closes the connection between rounds. Errors are also reported to the source.
+func ReceiveReplication(conn io.ReadWriter, open func(blockSize int64) (ReplicaTarget, error)) error {
+	r := bufio.NewReader(conn)
+	var h replHeader
+	err := binary.Read(r, binary.LittleEndian, &h)
+	if err != nil {
+		return err
+	}
+	if string(h.Magic[:]) != replMagic || h.BlockSize == 0 || h.BlockSize > maxDeltaBlockSize {
+		return ErrDeltaProtocol
+	}
+	blockSize := int64(h.BlockSize)
+	t, err := open(blockSize)
+	if err == nil && t.BlockSize() != blockSize {
+		err = fmt.Errorf("Block size mismatch: %d, the source has %d", t.BlockSize(), blockSize)
+	}
+	if err != nil {
+		reportDeltaError(conn, err)
+		return err
+	}
+	_, err = conn.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, blockSize)
+	for {
+		var rec deltaRecord
+		err = binary.Read(r, binary.LittleEndian, &rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch rec.Num {
+		case replRound:
+			err = t.Sync()
+			if err == nil {
+				_, err = conn.Write([]byte{0})
+				if err != nil {
+					return err
+				}
+			}
+		case replSize:
+			var size uint64
+			if rec.Length != 8 {
+				return ErrDeltaProtocol
+			}
+			err = binary.Read(r, binary.LittleEndian, &size)
+			if err != nil {
+				return err
+			}
+			err = t.Truncate(int64(size))
+		default:
+			if int64(rec.Length) > blockSize {
+				return ErrDeltaProtocol
+			}
+			_, err = io.ReadFull(r, payload[:rec.Length])
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			err = t.WriteBlockRaw(int64(rec.Num), BlockType(rec.Type), payload[:rec.Length])
+		}
+		if err != nil {
+			if !errors.Is(err, ErrDeltaProtocol) {
+				reportDeltaError(conn, err)
+			}
+			return err
+		}
+	}
+}
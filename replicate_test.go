@@ -0,0 +1,130 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplicate(t *testing.T) {
+	var sf, df memSparseFile
+	src, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{ChangeTracking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewFromSparseFile(&df, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := src.BlockSize()
+
+	data := make([]byte, 5*bs+123)
+	rand.Read(data)
+	_, err = src.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- ReceiveReplication(c2, func(blockSize int64) (ReplicaTarget, error) {
+			return dst, nil
+		})
+		c2.Close()
+	}()
+
+	rounds := make(chan *DeltaStats, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	replErr := make(chan error, 1)
+	go func() {
+		replErr <- src.Replicate(ctx, c1, &ReplicateOptions{
+			Interval: 10 * time.Millisecond,
+			OnRound: func(stats *DeltaStats) {
+				rounds <- stats
+			},
+		})
+		c1.Close()
+	}()
+
+	stats := <-rounds
+	if stats.Blocks != 6 || stats.Changed != 6 {
+		t.Fatalf("First round: %+v", stats)
+	}
+
+	// Modify a block and shrink the file, then wait for a round that picks it up
+	_, err = src.WriteAt([]byte("changed"), 2*bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[2*bs+10:], "changed")
+	err = src.Truncate(4*bs + 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:4*bs+5]
+	for {
+		stats = <-rounds
+		if stats.Changed > 0 {
+			break
+		}
+	}
+	if stats.Blocks != 5 || stats.Changed > 3 {
+		t.Fatalf("Second round: %+v", stats)
+	}
+
+	cancel()
+	err = <-replErr
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	err = <-recvErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := dst.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Size: %d", size)
+	}
+	buf := make([]byte, len(data))
+	_, err = dst.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+func TestReplicateBlockSizeMismatch(t *testing.T) {
+	var sf, df memSparseFile
+	src, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{ChangeTracking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewFromSparseFileSize(&df, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	go func() {
+		ReceiveReplication(c2, func(blockSize int64) (ReplicaTarget, error) {
+			return dst, nil
+		})
+		c2.Close()
+	}()
+	err = src.Replicate(context.Background(), c1, nil)
+	c1.Close()
+	if _, ok := err.(*DeltaError); !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// SampleReport is the result of VerifySample. The same seed selects the same blocks, so a check
+// can be repeated or extended.
+type SampleReport struct {
+	Seed       int64
+	Size       int64   // logical size of the file
+	SourceSize int64   // size of the source
+	Blocks     []int64 // the blocks that were compared, in ascending order
+	Mismatches []int64 // the blocks whose content differs from the source
+}
+
+// OK returns true if the sizes and all the compared blocks match.
+func (r *SampleReport) OK() bool {
+	return r.Size == r.SourceSize && len(r.Mismatches) == 0
+}
+
+// VerifySample compares n randomly chosen blocks (all of them if there are no more than n) with
+// the same ranges of src, which is srcSize bytes long. It gives a statistical confidence that the
+// file is a faithful copy of its source when there isn't enough time to compare them in full. The
+// blocks are chosen with a generator seeded with seed. Blocks beyond the end of the shorter of the
+// two are not compared, a difference in size is reported in any case. An error is returned if
+// either of them can't be read.
+func (f *compFile) VerifySample(src io.ReaderAt, srcSize int64, n int, seed int64) (*SampleReport, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	r := &SampleReport{
+		Seed:       seed,
+		Size:       size,
+		SourceSize: srcSize,
+	}
+	if srcSize < size {
+		size = srcSize
+	}
+	r.Blocks = sampleBlocks((size+f.blockSize-1)/f.blockSize, n, seed)
+
+	buf := make([]byte, f.blockSize)
+	srcBuf := make([]byte, f.blockSize)
+	for _, num := range r.Blocks {
+		offset := num * f.blockSize
+		l := f.blockSize
+		if offset+l > size {
+			l = size - offset
+		}
+		_, err = f.ReadAt(buf[:l], offset)
+		if err == nil {
+			_, err = src.ReadAt(srcBuf[:l], offset)
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !bytes.Equal(buf[:l], srcBuf[:l]) {
+			r.Mismatches = append(r.Mismatches, num)
+		}
+	}
+	return r, nil
+}
+
+// sampleBlocks returns n numbers of blocks out of blocks (all of them if there are no more than
+// n) chosen with a generator seeded with seed, in ascending order.
+func sampleBlocks(blocks int64, n int, seed int64) []int64 {
+	var chosen []int64
+	if int64(n) >= blocks {
+		for num := int64(0); num < blocks; num++ {
+			chosen = append(chosen, num)
+		}
+		return chosen
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	set := make(map[int64]bool, n)
+	for len(set) < n {
+		set[rnd.Int63n(blocks)] = true
+	}
+	for num := range set {
+		chosen = append(chosen, num)
+	}
+	sort.Slice(chosen, func(i, j int) bool {
+		return chosen[i] < chosen[j]
+	})
+	return chosen
+}
@@ -0,0 +1,58 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestVerifySample(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := make([]byte, 100*f.BlockSize()+10)
+	for i := range src {
+		src[i] = byte(i % 251)
+	}
+	_, err = f.WriteAt(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := f.VerifySample(bytes.NewReader(src), int64(len(src)), 10, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || len(r.Blocks) != 10 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+	r1, err := f.VerifySample(bytes.NewReader(src), int64(len(src)), 10, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range r.Blocks {
+		if r.Blocks[i] != r1.Blocks[i] {
+			t.Fatalf("Different blocks for the same seed: %v, %v", r.Blocks, r1.Blocks)
+		}
+	}
+
+	// Comparing all blocks finds a single changed byte
+	src[50*f.BlockSize()+7]++
+	r, err = f.VerifySample(bytes.NewReader(src), int64(len(src)), 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || len(r.Blocks) != 101 || len(r.Mismatches) != 1 || r.Mismatches[0] != 50 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+
+	r, err = f.VerifySample(bytes.NewReader(src[:len(src)-1]), int64(len(src)-1), 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || r.SourceSize != r.Size-1 || len(r.Mismatches) != 1 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+}
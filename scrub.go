@@ -0,0 +1,171 @@
+package spgz
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// ScrubOptions control a background scrub, see StartScrub.
+type ScrubOptions struct {
+	// Rate limits the scrub to this many bytes (of uncompressed data) per second. 0 means no limit.
+	Rate int64
+
+	// Interval is the pause between passes over the file. 0 means a single pass.
+	Interval time.Duration
+
+	// OnError is called for every block that can't be read or decoded, the scrub carries on.
+	// With Jobs it's not called concurrently but the blocks may be reported out of order.
+	OnError func(err error)
+
+	// Jobs is the number of blocks decoded at the same time, see VerifyParallel. 0 means 1.
+	Jobs int
+
+	// Record stores the result of every completed pass in the header (see LastScrub), so that
+	// files which haven't been checked recently can be found. The file must be writable.
+	Record bool
+}
+
+// ScrubResult is the result of a completed scrub pass, see LastScrub. It's kept in a metadata
+// record (see metadata.go): the time in nanoseconds since the epoch, the number of blocks checked
+// and the number of errors as 64-bit values.
+type ScrubResult struct {
+	Time   time.Time // when the pass completed
+	Blocks int64     // blocks checked
+	Errors int64     // blocks that could not be read or decoded
+}
+
+func (r *ScrubResult) marshal() []byte {
+	buf := make([]byte, 0, 24)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Time.UnixNano()))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Blocks))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Errors))
+	return buf
+}
+
+// LastScrub returns the result of the last scrub pass recorded in the header, nil if there is
+// none.
+func (f *compFile) LastScrub() *ScrubResult {
+	f.Lock()
+	data := f.meta[metaScrub]
+	f.Unlock()
+	if len(data) != 24 {
+		return nil
+	}
+	return &ScrubResult{
+		Time:   time.Unix(0, int64(binary.LittleEndian.Uint64(data))),
+		Blocks: int64(binary.LittleEndian.Uint64(data[8:])),
+		Errors: int64(binary.LittleEndian.Uint64(data[16:])),
+	}
+}
+
+// Scrubber is a running scrub.
+type Scrubber struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// StartScrub starts a goroutine which reads and decodes the blocks stored in the file (like
+// Verify) at a limited rate, so that corruption is found while there is still time to do
+// something about it. Unlike Verify it doesn't store modified blocks first, it checks the blocks
+// as they are in the file.
+func (f *compFile) StartScrub(opts ScrubOptions) *Scrubber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scrubber{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		for {
+			s.err = f.scrub(ctx, &opts)
+			if s.err != nil || opts.Interval <= 0 || !sleepContext(ctx, opts.Interval) {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Stop stops the scrub and waits for the goroutine to exit.
+func (s *Scrubber) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+// Wait waits for a single pass scrub to finish. It returns an error that prevented the scrub
+// from carrying on, e.g. a failure to determine the size of the file, or context.Canceled if it
+// has been stopped. Errors in blocks are reported to OnError.
+func (s *Scrubber) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (f *compFile) scrub(ctx context.Context, opts *ScrubOptions) error {
+	if opts.Record && f.readOnly {
+		return os.ErrPermission
+	}
+	f.Lock()
+	size, err := f.size()
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var res ScrubResult
+	var pace func(num int64) error
+	if opts.Rate > 0 {
+		pace = func(num int64) error {
+			due := start.Add(time.Duration(float64(num*f.blockSize) / float64(opts.Rate) * float64(time.Second)))
+			if !sleepContext(ctx, time.Until(due)) {
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	err = f.checkBlocks(ctx, blocks, opts.Jobs, pace, func(b *block, num int64, err error) {
+		res.Blocks++
+		if err != nil {
+			res.Errors++
+			if opts.OnError != nil {
+				opts.OnError(err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if opts.Record {
+		res.Time = time.Now()
+		return f.recordScrub(&res)
+	}
+	return nil
+}
+
+func (f *compFile) recordScrub(res *ScrubResult) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	f.setMeta(metaScrub, res.marshal())
+	return f.writeMeta()
+}
+
+// sleepContext sleeps for d, it returns false if the context is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
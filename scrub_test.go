@@ -0,0 +1,87 @@
+package spgz
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4*f.BlockSize())
+	for i := range buf {
+		buf[i] = byte(i % 13)
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.data[f.blockOffset(1)+1] ^= 0xff
+	sf.data[f.blockOffset(3)+1] ^= 0xff
+
+	var mu sync.Mutex
+	var corrupt []int64
+	s := f.StartScrub(ScrubOptions{
+		OnError: func(err error) {
+			var ce *ErrCorruptBlock
+			if !errors.As(err, &ce) {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			mu.Lock()
+			corrupt = append(corrupt, ce.Num)
+			mu.Unlock()
+		},
+	})
+	err = s.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 2 || corrupt[0] != 1 || corrupt[1] != 3 {
+		t.Fatalf("Unexpected corrupt blocks: %v", corrupt)
+	}
+
+	// The result of a pass is recorded in the header
+	if f.LastScrub() != nil {
+		t.Fatal("Unexpected scrub result")
+	}
+	err = f.StartScrub(ScrubOptions{Record: true}).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewFromSparseFile(&memSparseFile{data: sf.data}, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := r.LastScrub()
+	if res == nil || res.Blocks != 4 || res.Errors != 2 || time.Since(res.Time) > time.Minute {
+		t.Fatalf("Unexpected scrub result: %+v", res)
+	}
+	err = r.StartScrub(ScrubOptions{Record: true}).Wait()
+	if err != os.ErrPermission {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r.Close()
+
+	// A slow repeated scrub can be stopped
+	s = f.StartScrub(ScrubOptions{
+		Rate:     f.BlockSize(),
+		Interval: time.Hour,
+	})
+	time.Sleep(10 * time.Millisecond)
+	s.Stop()
+	if err := s.Wait(); err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
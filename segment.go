@@ -0,0 +1,442 @@
+package spgz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A segmented file stores the physical data of a file in several files of a fixed size, for
+// filesystems with a small maximum file size (e.g. FAT) or to spread a large archive over
+// several transfer media. The segments are named <name>.000, <name>.001 and so on. All segments
+// except the last one have the segment size, so for an existing file it's determined by the size
+// of the first segment.
+
+const (
+	defSegmentSize = 4*1024*1024*1024 - 4096 // fits FAT32
+)
+
+var (
+	ErrMissingSegment = errors.New("A segment of the file is missing")
+)
+
+type segmentedFile struct {
+	name     string
+	flag     int
+	perm     os.FileMode
+	size     int64 // of a segment
+	segments []*sparseFile
+	offset   int64
+
+	// see erasure.go
+	ec *segmentErasure
+}
+
+// SegmentOptions control the layout of a new segmented file. For an existing file the values it
+// was created with are used.
+type SegmentOptions struct {
+	// Size is the size of a segment, just under 4GB if 0.
+	Size int64
+
+	// Parity enables erasure coding across the segments, see erasure.go: for every Stripe
+	// consecutive segments (4 if 0) Parity parity segments are kept, so that any Parity of them can
+	// be lost and rebuilt by RepairSegments().
+	Parity int
+	Stripe int
+}
+
+func segmentName(name string, i int) string {
+	return fmt.Sprintf("%s.%03d", name, i)
+}
+
+// IsSegmented returns true if name refers to a segmented file, i.e. if the first segment (or the
+// erasure coding manifest) exists.
+func IsSegmented(name string) bool {
+	return exists(segmentName(name, 0)) || exists(manifestName(name))
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// OpenSegmented opens (or, depending on flag, creates) the segmented file with the given name.
+// segmentSize is only used if it can't be determined from the existing segments, 0 selects
+// just under 4GB. The result can be passed to NewFromSparseFile() and friends, or use
+// Options.SegmentSize with OpenFileOptions().
+func OpenSegmented(name string, flag int, perm os.FileMode, segmentSize int64) (*segmentedFile, error) {
+	return OpenSegmentedOptions(name, flag, perm, &SegmentOptions{Size: segmentSize})
+}
+
+// OpenSegmentedOptions is like OpenSegmented but allows enabling erasure coding for a new file.
+func OpenSegmentedOptions(name string, flag int, perm os.FileMode, opts *SegmentOptions) (*segmentedFile, error) {
+	if opts == nil {
+		opts = &SegmentOptions{}
+	}
+	segmentSize := opts.Size
+	if segmentSize <= 0 {
+		segmentSize = defSegmentSize
+	}
+	f := &segmentedFile{
+		name: name,
+		flag: flag &^ (os.O_TRUNC | os.O_EXCL),
+		perm: perm,
+		size: segmentSize,
+	}
+	m, err := readManifest(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if m != nil {
+		f.size = int64(m.SegmentSize)
+	}
+	first, err := os.OpenFile(segmentName(name, 0), flag&^os.O_TRUNC, perm)
+	if err != nil {
+		if m != nil && errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("%w: %s, use RepairSegments()", ErrMissingSegment, segmentName(name, 0))
+		}
+		return nil, err
+	}
+	f.segments = append(f.segments, NewSparseFile(first))
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(segmentName(name, i), f.flag&^os.O_CREATE, perm)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			f.Close()
+			return nil, err
+		}
+		f.segments = append(f.segments, NewSparseFile(file))
+	}
+	if n := len(f.segments); exists(segmentName(name, n+1)) || m != nil && n < m.segments() {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrMissingSegment, segmentName(name, n))
+	}
+	if m != nil || opts.Parity > 0 && f.flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err = f.initErasure(m, opts)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if flag&os.O_TRUNC != 0 {
+		err = f.Truncate(0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if len(f.segments) > 1 {
+		f.size, err = first.Seek(0, os.SEEK_END)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		for i, s := range f.segments[:len(f.segments)-1] {
+			size, err := s.Seek(0, os.SEEK_END)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			if size != f.size || f.size == 0 {
+				f.Close()
+				return nil, fmt.Errorf("%w: %s has size %d", ErrMissingSegment, segmentName(name, i), size)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Segments returns the number of segment files.
+func (f *segmentedFile) Segments() int {
+	return len(f.segments)
+}
+
+// SegmentSize returns the size of a segment.
+func (f *segmentedFile) SegmentSize() int64 {
+	return f.size
+}
+
+func (f *segmentedFile) Size() (int64, error) {
+	last := len(f.segments) - 1
+	size, err := f.segments[last].Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	return int64(last)*f.size + size, nil
+}
+
+// grow creates the segments up to and including i.
+func (f *segmentedFile) grow(i int) error {
+	for len(f.segments) <= i {
+		last := f.segments[len(f.segments)-1]
+		size, err := last.Seek(0, os.SEEK_END)
+		if err == nil {
+			err = f.markDirty(len(f.segments)-1, size, f.size-size)
+		}
+		if err == nil {
+			err = last.Truncate(f.size)
+		}
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(segmentName(f.name, len(f.segments)), f.flag|os.O_CREATE, f.perm)
+		if err != nil {
+			return err
+		}
+		f.segments = append(f.segments, NewSparseFile(file))
+	}
+	return nil
+}
+
+func (f *segmentedFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	for n < len(buf) {
+		i := int(offset / f.size)
+		if i >= len(f.segments) {
+			return n, io.EOF
+		}
+		o := offset % f.size
+		chunk := buf[n:]
+		if l := f.size - o; int64(len(chunk)) > l {
+			chunk = chunk[:l]
+		}
+		var r int
+		r, err = f.segments[i].ReadAt(chunk, o)
+		n += r
+		offset += int64(r)
+		if err != nil {
+			if err != io.EOF || i == len(f.segments)-1 {
+				return
+			}
+			// Only the last segment can be shorter
+			return n, fmt.Errorf("%w: %s is too short", ErrMissingSegment, segmentName(f.name, i))
+		}
+	}
+	return n, nil
+}
+
+func (f *segmentedFile) WriteAt(buf []byte, offset int64) (n int, err error) {
+	for n < len(buf) {
+		i := int(offset / f.size)
+		err = f.grow(i)
+		if err != nil {
+			return
+		}
+		o := offset % f.size
+		chunk := buf[n:]
+		if l := f.size - o; int64(len(chunk)) > l {
+			chunk = chunk[:l]
+		}
+		err = f.markDirty(i, o, int64(len(chunk)))
+		if err != nil {
+			return
+		}
+		var w int
+		w, err = f.segments[i].WriteAt(chunk, o)
+		n += w
+		offset += int64(w)
+		if err != nil {
+			return
+		}
+	}
+	return n, nil
+}
+
+func (f *segmentedFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *segmentedFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *segmentedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+		f.offset = offset
+	case os.SEEK_CUR:
+		f.offset += offset
+	case os.SEEK_END:
+		size, err := f.Size()
+		if err != nil {
+			return f.offset, err
+		}
+		f.offset = size + offset
+	default:
+		return f.offset, os.ErrInvalid
+	}
+	return f.offset, nil
+}
+
+// Truncate removes the segments that are no longer needed.
+func (f *segmentedFile) Truncate(size int64) error {
+	i := int(size / f.size)
+	if size > 0 && size%f.size == 0 {
+		// Keep the last segment full rather than adding an empty one
+		i--
+	}
+	if i >= len(f.segments) {
+		err := f.grow(i)
+		if err != nil {
+			return err
+		}
+	}
+	for len(f.segments)-1 > i {
+		last := len(f.segments) - 1
+		// The data disappears from the parity
+		err := f.markDirty(last, 0, f.size)
+		if err != nil {
+			return err
+		}
+		f.segments[last].Close()
+		err = os.Remove(segmentName(f.name, last))
+		if err != nil {
+			return err
+		}
+		f.segments = f.segments[:last]
+	}
+	size -= int64(i) * f.size
+	old, err := f.segments[i].Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if old > size {
+		err = f.markDirty(i, size, old-size)
+	} else {
+		err = f.markDirty(i, old, size-old)
+	}
+	if err != nil {
+		return err
+	}
+	return f.segments[i].Truncate(size)
+}
+
+// PunchHole punches the range in each of the segments it covers. The range is clipped to the
+// end of the file.
+func (f *segmentedFile) PunchHole(offset, size int64) error {
+	end, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if offset+size > end {
+		size = end - offset
+	}
+	for size > 0 {
+		i := int(offset / f.size)
+		o := offset % f.size
+		l := f.size - o
+		if l > size {
+			l = size
+		}
+		err := f.markDirty(i, o, l)
+		if err != nil {
+			return err
+		}
+		err = f.segments[i].PunchHole(o, l)
+		if err != nil {
+			return err
+		}
+		offset += l
+		size -= l
+	}
+	return nil
+}
+
+// Sync syncs the segments, then brings the parity segments up to date (if any).
+func (f *segmentedFile) Sync() error {
+	for _, s := range f.segments {
+		err := s.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return f.updateErasure()
+}
+
+func (f *segmentedFile) Close() error {
+	err := f.updateErasure()
+	for _, s := range f.segments {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Split converts the file with the given name into a segmented file and removes it.
+func Split(name string, segmentSize int64) error {
+	return SplitOptions(name, &SegmentOptions{Size: segmentSize})
+}
+
+// SplitOptions is like Split but allows enabling erasure coding.
+func SplitOptions(name string, opts *SegmentOptions) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := OpenSegmentedOptions(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, fi.Mode().Perm(), opts)
+	if err != nil {
+		return err
+	}
+	_, err = Copy(dst, NewSparseFile(src))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Join converts the segmented file with the given name into a single file and removes the
+// segments (and the parity segments, if any).
+func Join(name string) error {
+	fi, err := os.Stat(segmentName(name, 0))
+	if err != nil {
+		return err
+	}
+	src, err := OpenSegmented(name, os.O_RDONLY, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	dst := NewSparseWriter(NewSparseFileWithFallback(file))
+	_, err = Copy(dst, src)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < src.Segments(); i++ {
+		err = os.Remove(segmentName(name, i))
+		if err != nil {
+			return err
+		}
+	}
+	return removeErasure(name)
+}
@@ -0,0 +1,163 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmented(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{BlockSize: 4096, SegmentSize: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(name) || !exists(segmentName(name, 5)) || exists(segmentName(name, 6)) {
+		t.Fatal("Unexpected segments")
+	}
+
+	// The segments are detected and the segment size is taken from the first one
+	f, err = OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := f.f.(*segmentedFile).SegmentSize(); s != 10000 {
+		t.Fatalf("Unexpected segment size: %d", s)
+	}
+	buf := make([]byte, len(data)+1)
+	n, _ := f.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Truncate(4096)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(segmentName(name, 1)) {
+		t.Fatal("The segments beyond the end were not removed")
+	}
+
+	err = Join(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(name) || IsSegmented(name) {
+		t.Fatal("Join did not replace the segments")
+	}
+	err = Split(name, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(name) || !exists(segmentName(name, 1)) {
+		t.Fatal("Split did not replace the file")
+	}
+	f, err = OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, _ = f.ReadAt(buf, 0)
+	if !bytes.Equal(buf[:n], data[:4096]) {
+		t.Fatal("Data mismatch after split")
+	}
+}
+
+func TestSegmentErasure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.spgz")
+	opts := &Options{BlockSize: 4096, SegmentSize: 10000, SegmentParity: 2, SegmentStripe: 3}
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6 data segments, 2 stripes
+	if !exists(paritySegmentName(name, 3)) || exists(paritySegmentName(name, 4)) {
+		t.Fatal("Unexpected parity segments")
+	}
+
+	check := func() {
+		f, err := OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		buf := make([]byte, len(data)+1)
+		n, _ := f.ReadAt(buf, 0)
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatal("Data mismatch")
+		}
+	}
+
+	// A data and a parity segment of the first stripe, the last segment
+	os.Remove(segmentName(name, 0))
+	os.Remove(paritySegmentName(name, 1))
+	os.Remove(segmentName(name, 5))
+	_, err = OpenFile(name, os.O_RDONLY, 0)
+	if !errors.Is(err, ErrMissingSegment) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	repaired, err := RepairSegments(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 3 {
+		t.Fatalf("Unexpected repaired segments: %v", repaired)
+	}
+	check()
+
+	// Modify and truncate, the parity follows
+	f, err = OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("modified"), 25000)
+	if err == nil {
+		err = f.Truncate(30000)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[25000:], "modified")
+	data = data[:30000]
+	os.Remove(segmentName(name, 1))
+	os.Remove(segmentName(name, 2))
+	_, err = RepairSegments(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	os.Remove(segmentName(name, 0))
+	os.Remove(segmentName(name, 1))
+	os.Remove(segmentName(name, 2))
+	_, err = RepairSegments(name)
+	if !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
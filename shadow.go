@@ -0,0 +1,46 @@
+package spgz
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// With featShadow the journal region is a scratch slot. The new image of a slot is written there
+// and synced first, then the record header, which works as the pointer to the scratch slot, is
+// written and synced. Only then is the block's own slot overwritten. Until the header is complete
+// the slot holds the previous version, after that the scratch slot holds the new one. A reader
+// that opens the file read-only while the pointer is set reads the block from the scratch slot,
+// a writer copies it into the block's slot. The exception is the last slot of the file: if the
+// update changes the end of the file, a read-only open returns ErrRecoveryNeeded.
+
+type shadowSlot struct {
+	num     int64
+	image   []byte
+	holeLen int64
+}
+
+// read returns the content of the slot as if the update had been applied to it.
+func (s *shadowSlot) read(buf []byte) (int, error) {
+	n := copy(buf, s.image)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func (f *compFile) writeShadow(r *journalRecord, image []byte) error {
+	_, err := f.f.WriteAt(image, f.journalOffset+journalRecordSize)
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, r)
+	_, err = f.f.WriteAt(buf.Bytes(), f.journalOffset)
+	if err == nil {
+		err = f.f.Sync()
+	}
+	return err
+}
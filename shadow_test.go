@@ -0,0 +1,103 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestAtomicReplace(t *testing.T) {
+	sf := &tearingFile{
+		tearAt: -1,
+	}
+	open := func(flag int) *compFile {
+		sf.Seek(0, os.SEEK_SET)
+		f, err := NewFromSparseFileOptions(sf, flag, &Options{
+			BlockSize:     64 * 1024,
+			AtomicReplace: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	check := func(f *compFile, expected []byte) {
+		buf := make([]byte, len(expected))
+		_, err := f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatal("Data differs")
+		}
+	}
+
+	_, err := NewFromSparseFileOptions(&memSparseFile{}, os.O_RDWR|os.O_CREATE, &Options{
+		Journal:       true,
+		AtomicReplace: true,
+	})
+	if err != ErrInvalidOptions {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f := open(os.O_RDWR | os.O_CREATE)
+	bs := f.BlockSize()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 3*bs)
+	rnd.Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash while writing the scratch slot: the old version survives
+	f = open(os.O_RDWR)
+	newData := append([]byte(nil), data...)
+	rnd.Read(newData[bs : 2*bs])
+	_, err = f.WriteAt(newData[bs:2*bs], bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.tearAt = f.journalOffset + journalRecordSize
+	err = f.Sync()
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check(open(os.O_RDONLY), data)
+
+	// Crash while writing the block's slot: the new version is read from the scratch slot
+	f = open(os.O_RDWR)
+	_, err = f.WriteAt(newData[bs:2*bs], bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.tearAt = f.blockOffset(1)
+	err = f.Sync()
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r := open(os.O_RDONLY)
+	check(r, newData)
+	err = r.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f = open(os.O_RDWR)
+	check(f, newData)
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = open(os.O_RDONLY)
+	if r.shadow != nil {
+		t.Fatal("The pointer has not been cleared")
+	}
+	check(r, newData)
+}
@@ -0,0 +1,309 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+)
+
+// A sharded file spreads the physical data of a file across several backing files (typically on
+// different disks) in stripes of a fixed size, so that reading or writing a large archive uses the
+// bandwidth of all of them. It's a SparseFile, so it can be used with NewFromSparseFileOptions().
+// The placement is not recorded anywhere, the same shards in the same order with the same options
+// have to be used every time the file is opened.
+
+type ShardPlacement int
+
+const (
+	// ShardRoundRobin assigns the stripes to the shards in turn. The shards are stored densely.
+	ShardRoundRobin ShardPlacement = iota
+	// ShardHash assigns each stripe to a shard based on a hash of its number, which avoids a
+	// regular access pattern hitting the same shard. Each shard keeps the stripes at their
+	// original offsets and is sparse.
+	ShardHash
+)
+
+const (
+	defStripeSize = 1024 * 1024
+)
+
+var (
+	ErrNoShards = errors.New("At least one shard is required")
+)
+
+type ShardOptions struct {
+	// StripeSize is the size of a contiguous range stored in one shard, 1MB if 0. It should be a
+	// multiple of the block size.
+	StripeSize int64
+	Placement  ShardPlacement
+}
+
+type shardedFile struct {
+	shards    []SparseFile
+	stripe    int64
+	placement ShardPlacement
+	offset    int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// NewSharded creates a sharded file on top of the given files. Closing it closes them.
+func NewSharded(shards []SparseFile, opts *ShardOptions) (*shardedFile, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	f := &shardedFile{
+		shards: shards,
+		stripe: defStripeSize,
+	}
+	if opts != nil {
+		if opts.StripeSize > 0 {
+			f.stripe = opts.StripeSize
+		}
+		f.placement = opts.Placement
+	}
+	size, err := f.physSize()
+	if err != nil {
+		return nil, err
+	}
+	f.size = size
+	return f, nil
+}
+
+// OpenSharded opens (or, depending on flag, creates) the backing files and returns a sharded file
+// on top of them.
+func OpenSharded(names []string, flag int, perm os.FileMode, opts *ShardOptions) (*shardedFile, error) {
+	shards := make([]SparseFile, 0, len(names))
+	for _, name := range names {
+		file, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			for _, s := range shards {
+				s.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, NewSparseFile(file))
+	}
+	f, err := NewSharded(shards, opts)
+	if err != nil {
+		for _, s := range shards {
+			s.Close()
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// locate returns the shard and the offset in it for the given offset, and the number of bytes
+// until the end of the stripe.
+func (f *shardedFile) locate(offset int64) (shard int, o int64, l int64) {
+	stripe := offset / f.stripe
+	rem := offset % f.stripe
+	n := int64(len(f.shards))
+	switch f.placement {
+	case ShardHash:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(stripe))
+		h := fnv.New32a()
+		h.Write(buf[:])
+		shard = int(h.Sum32() % uint32(n))
+		o = offset
+	default:
+		shard = int(stripe % n)
+		o = stripe/n*f.stripe + rem
+	}
+	return shard, o, f.stripe - rem
+}
+
+// shardSize returns the size shard i has to have for the file to be size bytes long.
+func (f *shardedFile) shardSize(i int, size int64) int64 {
+	if f.placement == ShardHash {
+		return size
+	}
+	n := int64(len(f.shards))
+	stripes := size / f.stripe
+	s := stripes / n * f.stripe
+	if j := stripes % n; int64(i) < j {
+		s += f.stripe
+	} else if int64(i) == j {
+		s += size % f.stripe
+	}
+	return s
+}
+
+func (f *shardedFile) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size, nil
+}
+
+// physSize determines the size from the sizes of the shards.
+func (f *shardedFile) physSize() (int64, error) {
+	var size int64
+	n := int64(len(f.shards))
+	for i, s := range f.shards {
+		ss, err := s.Seek(0, os.SEEK_END)
+		if err != nil {
+			return 0, err
+		}
+		if ss == 0 {
+			continue
+		}
+		if f.placement != ShardHash {
+			// The logical end of the last stripe in the shard
+			k := (ss - 1) / f.stripe
+			ss = (k*n+int64(i))*f.stripe + ss - k*f.stripe
+		}
+		if ss > size {
+			size = ss
+		}
+	}
+	return size, nil
+}
+
+func (f *shardedFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	if offset >= size {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > size-offset {
+		buf = buf[:size-offset]
+		defer func() {
+			if err == nil {
+				err = io.EOF
+			}
+		}()
+	}
+	for n < len(buf) {
+		i, o, l := f.locate(offset)
+		chunk := buf[n:]
+		if int64(len(chunk)) > l {
+			chunk = chunk[:l]
+		}
+		r, err := f.shards[i].ReadAt(chunk, o)
+		if err != nil {
+			if err != io.EOF {
+				return n + r, err
+			}
+			// A shard that does not extend to the end of the file
+			for j := r; j < len(chunk); j++ {
+				chunk[j] = 0
+			}
+		}
+		n += len(chunk)
+		offset += int64(len(chunk))
+	}
+	return n, nil
+}
+
+func (f *shardedFile) WriteAt(buf []byte, offset int64) (n int, err error) {
+	for n < len(buf) {
+		i, o, l := f.locate(offset)
+		chunk := buf[n:]
+		if int64(len(chunk)) > l {
+			chunk = chunk[:l]
+		}
+		var w int
+		w, err = f.shards[i].WriteAt(chunk, o)
+		n += w
+		offset += int64(w)
+		if err != nil {
+			break
+		}
+	}
+	f.mu.Lock()
+	if offset > f.size {
+		f.size = offset
+	}
+	f.mu.Unlock()
+	return
+}
+
+func (f *shardedFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *shardedFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *shardedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+		f.offset = offset
+	case os.SEEK_CUR:
+		f.offset += offset
+	case os.SEEK_END:
+		size, err := f.Size()
+		if err != nil {
+			return f.offset, err
+		}
+		f.offset = size + offset
+	default:
+		return f.offset, os.ErrInvalid
+	}
+	return f.offset, nil
+}
+
+func (f *shardedFile) Truncate(size int64) error {
+	for i, s := range f.shards {
+		err := s.Truncate(f.shardSize(i, size))
+		if err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.size = size
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *shardedFile) PunchHole(offset, size int64) error {
+	for size > 0 {
+		i, o, l := f.locate(offset)
+		if l > size {
+			l = size
+		}
+		err := f.shards[i].PunchHole(o, l)
+		if err != nil {
+			return err
+		}
+		offset += l
+		size -= l
+	}
+	return nil
+}
+
+func (f *shardedFile) Sync() error {
+	for _, s := range f.shards {
+		err := s.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *shardedFile) Close() error {
+	var err error
+	for _, s := range f.shards {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSharded(t *testing.T) {
+	for _, placement := range []ShardPlacement{ShardRoundRobin, ShardHash} {
+		var files [3]memSparseFile
+		shards := []SparseFile{&files[0], &files[1], &files[2]}
+		opts := &ShardOptions{StripeSize: 64 * 1024, Placement: placement}
+		sf, err := NewSharded(shards, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFromSparseFileSize(sf, os.O_RDWR|os.O_CREATE, 64*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 1000000)
+		rand.New(rand.NewSource(1)).Read(data)
+		_, err = f.WriteAt(data, 0)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if placement == ShardRoundRobin {
+			for i := range files {
+				if l := len(files[i].data); l < 300000 || l > 400000 {
+					t.Fatalf("Uneven placement: shard %d has %d bytes", i, l)
+				}
+			}
+		}
+
+		// The size is determined from the shards
+		sf, err = NewSharded(shards, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err = NewFromSparseFile(sf, os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data)+1)
+		n, _ := f.ReadAt(buf, 0)
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatalf("Data mismatch (placement %d)", placement)
+		}
+		err = f.Truncate(300000)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sf, err = NewSharded(shards, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err = NewFromSparseFile(sf, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ = f.ReadAt(buf, 0)
+		if !bytes.Equal(buf[:n], data[:300000]) {
+			t.Fatalf("Data mismatch after truncate (placement %d)", placement)
+		}
+		f.Close()
+	}
+}
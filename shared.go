@@ -0,0 +1,211 @@
+package spgz
+
+import (
+	"io"
+	"os"
+)
+
+// Shared is a file that is used through any number of handles, each with its own offset and its
+// own cached block, so that clients reading different parts of the file don't keep evicting each
+// other's block. The handles are serialised by the file's lock. Writes go through the file's
+// block as usual; the blocks cached by the handles are discarded when the file is modified
+// through any of them. With Options.BlockCache the handles share the blocks they load through
+// it, see BlockCache.
+type Shared struct {
+	f       *compFile
+	version uint64 // incremented on every modification, protected by f's lock
+}
+
+// OpenShared opens a file for use through handles, see Shared.
+func OpenShared(name string, flag int, perm os.FileMode, opts *Options) (*Shared, error) {
+	f, err := OpenFileOptions(name, flag, perm, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.BlockCache != nil {
+		if id, ok := identify(f.f); ok {
+			f.cache = opts.BlockCache
+			f.cached = f.cache.register(id)
+		}
+	}
+	return &Shared{
+		f: f,
+	}, nil
+}
+
+// modified is called when the file is modified through a handle. The file must be locked.
+func (s *Shared) modified() {
+	s.version++
+	s.f.invalidateCache()
+}
+
+// NewHandle returns a new handle positioned at the start of the file.
+func (s *Shared) NewHandle() *handle {
+	h := &handle{
+		s: s,
+	}
+	h.block.init(s.f)
+	return h
+}
+
+// Close closes the file. The handles must not be used afterwards.
+func (s *Shared) Close() error {
+	err := s.f.Close()
+	s.f.Lock()
+	if cf := s.f.cached; cf != nil {
+		s.f.cached = nil
+		s.f.cache.release(cf)
+	}
+	s.f.Unlock()
+	return err
+}
+
+type handle struct {
+	s       *Shared
+	block   block
+	loaded  bool
+	version uint64
+	offset  int64
+}
+
+// blockAt returns the block containing offset. The file must be locked.
+func (h *handle) blockAt(offset int64) (*block, error) {
+	f := h.s.f
+	num := offset / f.blockSize
+	if f.loaded && f.block.num == num {
+		// It may have been modified
+		return &f.block, nil
+	}
+	if h.loaded && h.block.num == num && h.version == h.s.version {
+		return &h.block, nil
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	h.version = h.s.version
+	c, cf := f.cache, f.cached
+	var gen uint64
+	if cf != nil {
+		if data := c.get(cf, num); data != nil {
+			// Handles don't modify their block, the data can be used as it is. The block's own
+			// buffers are left alone for the next load.
+			h.block.num = num
+			h.block.data = data
+			h.loaded = true
+			return &h.block, nil
+		}
+		gen = c.generation(cf)
+	}
+	err = h.block.load(num)
+	h.loaded = err == nil || err == io.EOF
+	if cf != nil && err == nil {
+		c.put(cf, gen, num, h.block.data)
+	}
+	return &h.block, err
+}
+
+func (h *handle) ReadAt(buf []byte, offset int64) (n int, err error) {
+	f := h.s.f
+	f.Lock()
+	defer f.Unlock()
+	for n < len(buf) {
+		var b *block
+		b, err = h.blockAt(offset)
+		if err != nil {
+			return
+		}
+		o := offset - b.num*f.blockSize
+		if o >= int64(len(b.data)) {
+			// Past the end of the last block
+			err = io.EOF
+			return
+		}
+		n1 := copy(buf[n:], b.data[o:])
+		n += n1
+		offset += int64(n1)
+	}
+	return
+}
+
+func (h *handle) Read(buf []byte) (n int, err error) {
+	n, err = h.ReadAt(buf, h.offset)
+	h.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (h *handle) WriteAt(buf []byte, offset int64) (n int, err error) {
+	f := h.s.f
+	f.Lock()
+	n, err = f.write(buf, offset)
+	h.s.modified()
+	f.Unlock()
+	return
+}
+
+func (h *handle) Write(buf []byte) (n int, err error) {
+	n, err = h.WriteAt(buf, h.offset)
+	h.offset += int64(n)
+	return
+}
+
+func (h *handle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+		h.offset = offset
+		return h.offset, nil
+	case os.SEEK_CUR:
+		h.offset += offset
+		return h.offset, nil
+	case os.SEEK_END:
+		size, err := h.s.f.Size()
+		if err != nil {
+			return h.offset, err
+		}
+		h.offset = size + offset
+		return h.offset, nil
+	}
+	return h.offset, os.ErrInvalid
+}
+
+func (h *handle) PunchHole(offset, size int64) error {
+	defer h.modified()
+	return h.s.f.PunchHole(offset, size)
+}
+
+func (h *handle) Truncate(size int64) error {
+	defer h.modified()
+	return h.s.f.Truncate(size)
+}
+
+func (h *handle) modified() {
+	h.s.f.Lock()
+	h.s.modified()
+	h.s.f.Unlock()
+}
+
+func (h *handle) Size() (int64, error) {
+	return h.s.f.Size()
+}
+
+func (h *handle) BlockSize() int64 {
+	return h.s.f.BlockSize()
+}
+
+func (h *handle) Sync() error {
+	return h.s.f.Sync()
+}
+
+// Close releases the handle's block, the file stays open.
+func (h *handle) Close() error {
+	h.s.f.Lock()
+	h.block = block{
+		f: h.s.f,
+	}
+	h.loaded = false
+	h.s.f.Unlock()
+	return nil
+}
@@ -0,0 +1,240 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestShared(t *testing.T) {
+	s, err := OpenShared(filepath.Join(t.TempDir(), "shared.spgz"), os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	h1 := s.NewHandle()
+	h2 := s.NewHandle()
+	bs := h1.BlockSize()
+	_, err = h1.Write(bytes.Repeat([]byte("a"), int(2*bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3)
+	_, err = h2.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// h2 has block 0 cached now
+	_, err = h1.WriteAt([]byte("bbb"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h1.WriteAt([]byte("c"), 2*bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h2.ReadAt(buf, 0)
+	if err != nil || string(buf) != "bbb" {
+		t.Fatalf("Unexpected data: %q, %v", buf, err)
+	}
+	_, err = h2.ReadAt(buf, 2*bs+8)
+	if err != nil || string(buf) != "\x00\x00c" {
+		t.Fatalf("Unexpected data: %q, %v", buf, err)
+	}
+
+	err = h1.Truncate(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h2.ReadAt(buf, bs-1)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+
+	// Independent offsets
+	_, err = h2.Seek(10, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h1.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := h2.Read(buf)
+	if err != nil || n != 3 || string(buf) != "aaa" {
+		t.Fatalf("Unexpected read: %q, %v", buf, err)
+	}
+	n, err = h1.Read(buf)
+	if err != nil || n != 3 || string(buf) != "bbb" {
+		t.Fatalf("Unexpected read: %q, %v", buf, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := s.NewHandle()
+			defer h.Close()
+			data, err := io.ReadAll(h)
+			if err != nil || len(data) != int(bs) {
+				t.Errorf("Unexpected result: %d, %v", len(data), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSharedBlockCache(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cached.spgz")
+	c := NewBlockCache(2 * 4095)
+	s1, err := OpenShared(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize:  4096,
+		BlockCache: c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	w := s1.NewHandle()
+	bs := w.BlockSize()
+	data := make([]byte, 4*bs)
+	for i := range data {
+		data[i] = byte(i / 100)
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := OpenShared(name, os.O_RDONLY, 0, &Options{BlockCache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	read := func(h io.ReaderAt, num int64) {
+		t.Helper()
+		buf := make([]byte, bs)
+		_, err := h.ReadAt(buf, num*bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[num*bs:(num+1)*bs]) {
+			t.Fatalf("Block %d: data mismatch", num)
+		}
+	}
+	stats := func(hits, misses int64) {
+		t.Helper()
+		if h, m := c.Stats(); h != hits || m != misses {
+			t.Fatalf("Unexpected stats: %d hits, %d misses", h, m)
+		}
+	}
+
+	// The block loaded through one file is used by the other one
+	h1, h2 := s1.NewHandle(), s2.NewHandle()
+	read(h1, 0)
+	stats(0, 1)
+	read(h2, 0)
+	stats(1, 1)
+	read(s2.NewHandle(), 0)
+	stats(2, 1)
+
+	// Modifications invalidate the cached blocks
+	_, err = w.WriteAt([]byte("modified"), bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[bs+10:], "modified")
+	// Block 1 is stored, so that it's read from the file
+	_, err = w.WriteAt(data[3*bs:3*bs+1], 3*bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(s1.NewHandle(), 1)
+	stats(2, 2)
+	read(h1, 0)
+	stats(2, 3)
+
+	// The least recently used block is evicted
+	read(s1.NewHandle(), 2)
+	read(s1.NewHandle(), 0)
+	read(s1.NewHandle(), 1)
+	stats(3, 5)
+}
+
+func TestSharedBlockCacheStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cached.spgz")
+	c := NewBlockCache(1 << 20)
+	s1, err := OpenShared(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize:  4096,
+		BlockCache: c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := s1.NewHandle()
+	bs := w.BlockSize()
+	_, err = w.Write(bytes.Repeat([]byte("("), int(bs)))
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := OpenShared(name, os.O_RDONLY, 0, &Options{BlockCache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(want string) {
+		t.Helper()
+		buf := make([]byte, 8)
+		_, err := s2.NewHandle().ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != want {
+			t.Fatalf("Unexpected data: %q", buf)
+		}
+	}
+
+	// The modification is not stored yet, the other file loads and caches the old block
+	_, err = w.WriteAt(bytes.Repeat([]byte(")"), int(bs)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read("((((((((")
+	err = w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read("))))))))")
+
+	// The blocks are dropped with the last file
+	err = s1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.files) != 1 || c.lru.Len() == 0 {
+		t.Fatal("The blocks were dropped while the file is open")
+	}
+	err = s2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.files) != 0 || c.lru.Len() != 0 || c.size != 0 {
+		t.Fatalf("%d files, %d blocks left in the cache", len(c.files), c.lru.Len())
+	}
+}
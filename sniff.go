@@ -0,0 +1,134 @@
+package spgz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Format is the type of a file as determined by Sniff.
+type Format int
+
+const (
+	FormatUnknown  Format = iota // anything else, e.g. raw data
+	FormatSPGZ                   // a regular spgz file, see OpenFile()
+	FormatChunked                // a chunked archive, see OpenChunked()
+	FormatVarBlock               // a variable-block archive, see OpenVarFile()
+	FormatGzip                   // a plain gzip stream
+	FormatBGZF                   // a blocked gzip file, see OpenBGZF()
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatSPGZ:
+		return "spgz"
+	case FormatChunked:
+		return "spgz-chunked"
+	case FormatVarBlock:
+		return "spgz-varblock"
+	case FormatGzip:
+		return "gzip"
+	case FormatBGZF:
+		return "bgzf"
+	}
+	return "unknown"
+}
+
+var featureNames = []struct {
+	feat uint32
+	name string
+}{
+	{featChangeTracking, "change-tracking"},
+	{featBase, "base"},
+	{featDiff, "diff"},
+	{featDedup, "dedup"},
+	{featStore, "store"},
+	{featCopyOnRead, "copy-on-read"},
+	{featJournal, "journal"},
+	{featShadow, "shadow"},
+	{featExactBlockSize, "exact-block-size"},
+}
+
+func featureList(features uint32) []string {
+	var list []string
+	for _, fn := range featureNames {
+		if features&fn.feat != 0 {
+			list = append(list, fn.name)
+		}
+	}
+	return list
+}
+
+// Info is the result of Sniff. For FormatSPGZ the Header fields and Features are filled in.
+type Info struct {
+	Format Format
+	Header
+
+	// Features lists the features of a version 2 file, e.g. "dedup"
+	Features []string
+}
+
+// Sniff determines the format of the data by looking at its beginning, without the side effects
+// of opening it (e.g. opening a base or recovering a journal), so that tools can decide how to
+// handle an input. Data that is not recognised is FormatUnknown, an error is only returned if it
+// can't be read or an spgz header is malformed.
+func Sniff(r io.ReaderAt) (*Info, error) {
+	page := make([]byte, headerSize)
+	n, err := r.ReadAt(page, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	page = page[:n]
+	info := &Info{}
+	if len(page) < 8 {
+		if len(page) >= 3 && page[0] == 0x1f && page[1] == 0x8b && page[2] == 8 {
+			info.Format = FormatGzip
+		}
+		return info, nil
+	}
+	switch string(page[:8]) {
+	case headerMagic:
+		if len(page) < len(headerMagic)+4 {
+			return nil, ErrInvalidFormat
+		}
+		info.Format = FormatSPGZ
+		info.FormatVersion = 1
+		info.BlockSize = int64(binary.LittleEndian.Uint32(page[8:])) * 4096
+		if len(page) > metaOffset {
+			meta, err := parseMeta(page[metaOffset:])
+			if err != nil {
+				return nil, err
+			}
+			info.setCreator(meta)
+		}
+	case headerMagicV2:
+		if len(page) < headerSize {
+			return nil, ErrInvalidFormat
+		}
+		var h headerV2
+		binary.Read(bytes.NewReader(page), binary.LittleEndian, &h)
+		info.Format = FormatSPGZ
+		info.FormatVersion = 2
+		info.BlockSize = int64(h.BlockSize) * 4096
+		if h.Features&featExactBlockSize != 0 {
+			info.BlockSize = int64(h.ExactBlockSize)
+		}
+		info.Features = featureList(h.Features)
+		meta, err := parseMeta(page[metaOffset:])
+		if err != nil {
+			return nil, err
+		}
+		info.setCreator(meta)
+	case chunkedMagic:
+		info.Format = FormatChunked
+	case varMagic:
+		info.Format = FormatVarBlock
+	default:
+		if bgzfBlockSize(page) > 0 {
+			info.Format = FormatBGZF
+		} else if page[0] == 0x1f && page[1] == 0x8b && page[2] == 8 {
+			info.Format = FormatGzip
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,53 @@
+package spgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{Dedup: true, Comment: "sniffed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("data"))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Sniff(&sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatSPGZ || info.FormatVersion != 2 || info.BlockSize != defBlockSize+1 ||
+		len(info.Features) != 1 || info.Features[0] != "dedup" || info.Comment != "sniffed" {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write([]byte("data"))
+	z.Close()
+	for _, c := range []struct {
+		data   []byte
+		format Format
+	}{
+		{buf.Bytes(), FormatGzip},
+		{[]byte("raw data"), FormatUnknown},
+		{nil, FormatUnknown},
+		{[]byte(chunkedMagic), FormatChunked},
+	} {
+		info, err := Sniff(bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Format != c.format {
+			t.Fatalf("%q: unexpected format %s", c.data, info.Format)
+		}
+	}
+}
@@ -3,14 +3,18 @@
 package spgz
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"syscall"
-	"errors"
 )
 
 const (
 	FALLOC_FL_KEEP_SIZE  = 0x01 /* default is extend size */
 	FALLOC_FL_PUNCH_HOLE = 0x02 /* de-allocates range */
+
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
 )
 
 var (
@@ -29,11 +33,46 @@ func NewSparseFile(f *os.File) *sparseFile {
 
 func (f *sparseFile) PunchHole(offset, size int64) error {
 	err := syscall.Fallocate(int(f.File.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, size)
+	if err == nil {
+		return nil
+	}
 
-	if err == syscall.ENOTSUP {
-		err = ErrPunchHoleNotSupported
+	err = os.NewSyscallError("fallocate", err)
+	if errors.Is(err, syscall.ENOTSUP) {
+		// Keep the original error so that errors.Is() works for both
+		return fmt.Errorf("%w: %w", ErrPunchHoleNotSupported, err)
 	}
 
 	return err
 }
 
+// Allocate implements SlotAllocator.
+func (f *sparseFile) Allocate(offset, size int64) error {
+	return os.NewSyscallError("fallocate", syscall.Fallocate(int(f.File.Fd()), FALLOC_FL_KEEP_SIZE, offset, size))
+}
+
+// Datasync syncs the data of the file and the metadata needed to read it, see fdatasync(2).
+func (f *sparseFile) Datasync() error {
+	return os.NewSyscallError("fdatasync", syscall.Fdatasync(int(f.File.Fd())))
+}
+
+// SeekData implements DataSeeker. If the filesystem doesn't support SEEK_DATA the whole file is data.
+func (f *sparseFile) SeekData(offset int64) (int64, error) {
+	o, err := f.File.Seek(offset, SEEK_DATA)
+	if errors.Is(err, syscall.ENXIO) {
+		return f.File.Seek(0, os.SEEK_END)
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return offset, nil
+	}
+	return o, err
+}
+
+// SeekHole implements DataSeeker.
+func (f *sparseFile) SeekHole(offset int64) (int64, error) {
+	o, err := f.File.Seek(offset, SEEK_HOLE)
+	if errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.EINVAL) {
+		return f.File.Seek(0, os.SEEK_END)
+	}
+	return o, err
+}
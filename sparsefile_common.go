@@ -1,6 +1,7 @@
 package spgz
 
 import (
+	"errors"
 	"io"
 	"os"
 )
@@ -13,6 +14,14 @@ type Truncatable interface {
 	Truncate(size int64) error
 }
 
+// Target is a destination that is written at arbitrary offsets and then truncated to its final
+// size, e.g. by Materialize() and the importers in the qcow2 and sparsetar packages. Ranges that
+// are never written must read as zeroes, which is the case for a newly created spgz file.
+type Target interface {
+	io.WriterAt
+	Truncatable
+}
+
 type SparseFile interface {
 	io.ReadWriteSeeker
 	io.ReaderAt
@@ -24,6 +33,16 @@ type SparseFile interface {
 	Sync() error
 }
 
+// HolePuncher is a destination that can skip ranges of zeroes instead of writing them. If the
+// io.Writer passed to WriteTo() or Copy() implements it, blocks that consist entirely of zeroes are not
+// written, the position is advanced instead and the skipped range is punched (or the file is
+// extended) as necessary. SparseWriter implements it.
+type HolePuncher interface {
+	io.Seeker
+	Truncatable
+	PunchHole(offset, size int64) error
+}
+
 type SparseWriter struct {
 	SparseFile
 }
@@ -47,56 +66,61 @@ func NewSparseWriter(f SparseFile) *SparseWriter {
 
 func (w *SparseWriter) Write(p []byte) (int, error) {
 	if IsBlockZero(p) {
-		offset, err := w.SparseFile.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			return 0, err
-		}
-		end, err := w.Seek(0, os.SEEK_END)
+		err := skipZeroes(w, int64(len(p)))
 		if err != nil {
 			return 0, err
 		}
-		l := int64(len(p))
-		if offset < end {
-			if offset + l < end {
-				err = w.PunchHole(offset, int64(len(p)))
-				if err != nil {
-					return 0, err
-				}
-			} else {
-				err = w.Truncate(offset)
-				if err != nil {
-					return 0, err
-				}
-				end = offset
+		return len(p), nil
+	} else {
+		return w.SparseFile.Write(p)
+	}
+}
+
+// skipZeroes advances the position of w by l bytes making sure the skipped range reads as zeroes.
+func skipZeroes(w HolePuncher, l int64) error {
+	offset, err := w.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	end, err := w.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if offset < end {
+		if offset + l < end {
+			err = w.PunchHole(offset, l)
+			if err != nil {
+				return err
 			}
-		}
-		offset += l
-		_, err = w.Seek(offset, os.SEEK_SET)
-		if err != nil {
-			return 0, err
-		}
-		if end < offset {
+		} else {
 			err = w.Truncate(offset)
 			if err != nil {
-				return 0, err
+				return err
 			}
+			end = offset
 		}
-		return len(p), nil
-	} else {
-		return w.SparseFile.Write(p)
 	}
+	offset += l
+	_, err = w.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	if end < offset {
+		err = w.Truncate(offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (f *SparseFileWithFallback) PunchHole(offset, size int64) error {
 	if !f.fallback {
 		err := f.SparseFile.PunchHole(offset, size)
-		if err != nil {
-			if err == ErrPunchHoleNotSupported {
-				f.fallback = true
-			} else {
-				return err
-			}
+		if !errors.Is(err, ErrPunchHoleNotSupported) {
+			return err
 		}
+		f.fallback = true
 	}
 
 	var buf [BUFSIZE]byte
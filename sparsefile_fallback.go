@@ -22,3 +22,13 @@ func NewSparseFile(f *os.File) *sparseFile {
 		File: f,
 	}
 }
+
+// SeekData implements DataSeeker, the whole file is data.
+func (f *sparseFile) SeekData(offset int64) (int64, error) {
+	return offset, nil
+}
+
+// SeekHole implements DataSeeker, the only hole is at the end of the file.
+func (f *sparseFile) SeekHole(offset int64) (int64, error) {
+	return f.File.Seek(0, os.SEEK_END)
+}
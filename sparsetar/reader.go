@@ -0,0 +1,511 @@
+// Package sparsetar reads and writes tar entries of sparse files (in the GNU and the PAX sparse
+// formats) together with their sparse maps, which archive/tar does not expose: it fills the holes
+// with zeroes.
+package sparsetar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/spgz"
+)
+
+const blockSize = 512
+
+var (
+	ErrHeader    = errors.New("Invalid tar header")
+	ErrSparseMap = errors.New("Invalid sparse map")
+)
+
+// Fragment is a range of a sparse file that contains data. Everything outside of the fragments is
+// a hole.
+type Fragment struct {
+	Offset, Length int64
+}
+
+type Reader struct {
+	r io.Reader
+
+	hdr  *tar.Header
+	frag []Fragment
+
+	// the data of the current entry not read yet and the padding after it
+	remaining int64
+	pad       int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next advances to the next entry and returns its header. For a sparse file the header describes
+// a regular file of the logical size, see Map() for the data ranges. Returns io.EOF at the end of
+// the archive.
+func (tr *Reader) Next() (*tar.Header, error) {
+	err := tr.skip(tr.remaining + tr.pad)
+	if err != nil {
+		return nil, err
+	}
+	tr.hdr, tr.frag, tr.remaining, tr.pad = nil, nil, 0, 0
+
+	var (
+		longName, longLink string
+		pax                []paxRecord
+		block              [blockSize]byte
+	)
+	for {
+		err = tr.readHeader(block[:])
+		if err != nil {
+			return nil, err
+		}
+		size, err := parseNumeric(block[124:136])
+		if err != nil || size < 0 {
+			return nil, ErrHeader
+		}
+		switch typ := block[156]; typ {
+		case tar.TypeGNULongName, tar.TypeGNULongLink, tar.TypeXHeader, tar.TypeXGlobalHeader:
+			data, err := tr.readData(size)
+			if err != nil {
+				return nil, err
+			}
+			switch typ {
+			case tar.TypeGNULongName:
+				longName = cString(data)
+			case tar.TypeGNULongLink:
+				longLink = cString(data)
+			case tar.TypeXHeader:
+				pax, err = parsePAX(data)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		hdr := parseHeader(block[:])
+		hdr.Size = size
+		if longName != "" {
+			hdr.Name = longName
+		}
+		if longLink != "" {
+			hdr.Linkname = longLink
+		}
+		tr.hdr = hdr
+		tr.remaining = size
+		if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeDir {
+			// Historically the size field of these is ignored
+			tr.remaining = 0
+		}
+		tr.pad = -tr.remaining & (blockSize - 1)
+		if hdr.Typeflag == tar.TypeGNUSparse {
+			err = tr.readGNUSparse(block[:])
+		} else {
+			err = tr.applyPAX(pax)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return hdr, nil
+	}
+}
+
+// Map returns the data ranges of the current entry in ascending order. For an entry that is not
+// sparse it's a single range covering the whole file (unless it's empty).
+func (tr *Reader) Map() []Fragment {
+	return tr.frag
+}
+
+// CopyTo writes the data ranges of the current entry to t, then truncates t to the size of the
+// file, so the holes are never written. Chunks of the data consisting entirely of zeroes are
+// skipped as well. Returns the number of bytes actually written.
+func (tr *Reader) CopyTo(t spgz.Target) (written int64, err error) {
+	if tr.hdr == nil {
+		return 0, io.EOF
+	}
+	buf := make([]byte, 64*1024)
+	for _, f := range tr.frag {
+		for off := int64(0); off < f.Length; {
+			chunk := buf
+			if l := f.Length - off; l < int64(len(chunk)) {
+				chunk = chunk[:l]
+			}
+			_, err = io.ReadFull(tr.r, chunk)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+			tr.remaining -= int64(len(chunk))
+			if spgz.IsBlockZero(chunk) {
+				off += int64(len(chunk))
+				continue
+			}
+			var n int
+			n, err = t.WriteAt(chunk, f.Offset+off)
+			written += int64(n)
+			if err != nil {
+				return
+			}
+			off += int64(len(chunk))
+		}
+	}
+	tr.frag = nil
+	return written, t.Truncate(tr.hdr.Size)
+}
+
+func (tr *Reader) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if s, ok := tr.r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, tr.r, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readHeader reads the next header block, returns io.EOF at the end-of-archive marker (or the
+// physical end).
+func (tr *Reader) readHeader(block []byte) error {
+	_, err := io.ReadFull(tr.r, block)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrHeader
+		}
+		return err
+	}
+	if spgz.IsBlockZero(block) {
+		return io.EOF
+	}
+	if !checksumOK(block) {
+		return ErrHeader
+	}
+	return nil
+}
+
+// readData reads the (padded) data of a meta entry.
+func (tr *Reader) readData(size int64) ([]byte, error) {
+	if size > 1024*1024 {
+		return nil, ErrHeader
+	}
+	data := make([]byte, (size+blockSize-1)&^(blockSize-1))
+	_, err := io.ReadFull(tr.r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+func (tr *Reader) readGNUSparse(block []byte) error {
+	var frag []Fragment
+	parse := func(entries []byte) error {
+		for ; len(entries) >= 24; entries = entries[24:] {
+			if entries[0] == 0 {
+				break
+			}
+			off, err1 := parseNumeric(entries[:12])
+			l, err2 := parseNumeric(entries[12:24])
+			if err1 != nil || err2 != nil {
+				return ErrSparseMap
+			}
+			frag = append(frag, Fragment{Offset: off, Length: l})
+		}
+		return nil
+	}
+	err := parse(block[386:482])
+	if err != nil {
+		return err
+	}
+	for ext := block[482] != 0; ext; {
+		var b [blockSize]byte
+		_, err = io.ReadFull(tr.r, b[:])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		err = parse(b[:504])
+		if err != nil {
+			return err
+		}
+		ext = b[504] != 0
+	}
+	size, err := parseNumeric(block[483:495])
+	if err != nil {
+		return ErrSparseMap
+	}
+	tr.hdr.Typeflag = tar.TypeReg
+	return tr.setMap(frag, size)
+}
+
+type paxRecord struct {
+	key, value string
+}
+
+func parsePAX(data []byte) ([]paxRecord, error) {
+	var recs []paxRecord
+	for len(data) > 0 {
+		// "%d %s=%s\n"
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, ErrHeader
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp || n > len(data) || data[n-1] != '\n' {
+			return nil, ErrHeader
+		}
+		rec := string(data[sp+1 : n-1])
+		eq := strings.IndexByte(rec, '=')
+		if eq < 0 {
+			return nil, ErrHeader
+		}
+		recs = append(recs, paxRecord{rec[:eq], rec[eq+1:]})
+		data = data[n:]
+	}
+	return recs, nil
+}
+
+func (tr *Reader) applyPAX(pax []paxRecord) error {
+	if len(pax) == 0 {
+		return tr.setMap(nil, -1)
+	}
+	hdr := tr.hdr
+	hdr.PAXRecords = make(map[string]string, len(pax))
+	var (
+		major, minor string
+		sparseMap    []string
+		realSize     int64 = -1
+	)
+	for _, rec := range pax {
+		var err error
+		switch rec.key {
+		case "path":
+			hdr.Name = rec.value
+		case "linkpath":
+			hdr.Linkname = rec.value
+		case "uname":
+			hdr.Uname = rec.value
+		case "gname":
+			hdr.Gname = rec.value
+		case "uid":
+			hdr.Uid, err = strconv.Atoi(rec.value)
+		case "gid":
+			hdr.Gid, err = strconv.Atoi(rec.value)
+		case "size":
+			hdr.Size, err = strconv.ParseInt(rec.value, 10, 64)
+			tr.remaining = hdr.Size
+			tr.pad = -tr.remaining & (blockSize - 1)
+		case "mtime":
+			hdr.ModTime, err = parsePAXTime(rec.value)
+		case "GNU.sparse.name":
+			hdr.Name = rec.value
+		case "GNU.sparse.major":
+			major = rec.value
+		case "GNU.sparse.minor":
+			minor = rec.value
+		case "GNU.sparse.size", "GNU.sparse.realsize":
+			realSize, err = strconv.ParseInt(rec.value, 10, 64)
+		case "GNU.sparse.map":
+			// 0.1
+			sparseMap = strings.Split(rec.value, ",")
+		case "GNU.sparse.offset", "GNU.sparse.numbytes":
+			// 0.0, the records are repeated for each fragment
+			sparseMap = append(sparseMap, rec.value)
+		}
+		if err != nil {
+			return ErrHeader
+		}
+		hdr.PAXRecords[rec.key] = rec.value
+	}
+	if realSize < 0 {
+		return tr.setMap(nil, -1)
+	}
+	if major == "1" && minor == "0" {
+		// The map is at the beginning of the data
+		var err error
+		sparseMap, err = tr.readSparseMap()
+		if err != nil {
+			return err
+		}
+	}
+	if len(sparseMap)%2 != 0 {
+		return ErrSparseMap
+	}
+	frag := make([]Fragment, 0, len(sparseMap)/2)
+	for i := 0; i < len(sparseMap); i += 2 {
+		off, err1 := strconv.ParseInt(sparseMap[i], 10, 64)
+		l, err2 := strconv.ParseInt(sparseMap[i+1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return ErrSparseMap
+		}
+		frag = append(frag, Fragment{Offset: off, Length: l})
+	}
+	return tr.setMap(frag, realSize)
+}
+
+// readSparseMap reads the map of the 1.0 format: the number of fragments followed by the offset
+// and the length of each one, all newline-terminated, padded to a block.
+func (tr *Reader) readSparseMap() ([]string, error) {
+	var (
+		data  []byte
+		lines []string
+		n     = -1
+	)
+	for n < 0 || len(lines) < 1+2*n {
+		if tr.remaining < blockSize {
+			return nil, ErrSparseMap
+		}
+		b, err := tr.readData(blockSize)
+		if err != nil {
+			return nil, err
+		}
+		tr.remaining -= blockSize
+		data = append(data, b...)
+		lines = strings.Split(string(data), "\n")
+		lines = lines[:len(lines)-1]
+		if n < 0 && len(lines) > 0 {
+			n, err = strconv.Atoi(lines[0])
+			if err != nil || n < 0 || int64(n) > tr.hdr.Size {
+				return nil, ErrSparseMap
+			}
+		}
+	}
+	return lines[1 : 1+2*n], nil
+}
+
+// setMap validates the map and sets the logical size, size < 0 means the entry is not sparse.
+func (tr *Reader) setMap(frag []Fragment, size int64) error {
+	if size < 0 {
+		if tr.hdr.Typeflag == tar.TypeReg || tr.hdr.Typeflag == tar.TypeRegA {
+			tr.hdr.Typeflag = tar.TypeReg
+			if tr.remaining > 0 {
+				tr.frag = []Fragment{{0, tr.remaining}}
+			}
+		}
+		return nil
+	}
+	var pos, total int64
+	for _, f := range frag {
+		if f.Offset < pos || f.Length < 0 || f.Offset+f.Length > size {
+			return ErrSparseMap
+		}
+		if f.Length > 0 {
+			tr.frag = append(tr.frag, f)
+		}
+		pos = f.Offset + f.Length
+		total += f.Length
+	}
+	if total != tr.remaining {
+		return ErrSparseMap
+	}
+	tr.hdr.Size = size
+	return nil
+}
+
+func parseHeader(b []byte) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag: b[156],
+		Name:     cString(b[0:100]),
+		Linkname: cString(b[157:257]),
+	}
+	mode, _ := parseNumeric(b[100:108])
+	uid, _ := parseNumeric(b[108:116])
+	gid, _ := parseNumeric(b[116:124])
+	mtime, _ := parseNumeric(b[136:148])
+	hdr.Mode = mode
+	hdr.Uid = int(uid)
+	hdr.Gid = int(gid)
+	hdr.ModTime = time.Unix(mtime, 0)
+	switch string(b[257:265]) {
+	case "ustar\x0000":
+		hdr.Uname = cString(b[265:297])
+		hdr.Gname = cString(b[297:329])
+		if prefix := cString(b[345:500]); prefix != "" {
+			hdr.Name = prefix + "/" + hdr.Name
+		}
+	case "ustar  \x00":
+		// GNU, there is no prefix
+		hdr.Uname = cString(b[265:297])
+		hdr.Gname = cString(b[297:329])
+	}
+	return hdr
+}
+
+func parsePAXTime(s string) (time.Time, error) {
+	sec, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		sec, frac = s[:i], s[i+1:]
+	}
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsecs int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		nsecs, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(secs, nsecs), nil
+}
+
+// parseNumeric parses an octal field, or a base-256 one if the high bit of the first byte is set.
+func parseNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		var v int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if v>>55 != 0 {
+				return 0, ErrHeader
+			}
+			v = v<<8 | int64(c)
+		}
+		return v, nil
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func checksumOK(b []byte) bool {
+	want, err := parseNumeric(b[148:156])
+	if err != nil {
+		return false
+	}
+	var unsigned, signed int64
+	for i, c := range b {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		unsigned += int64(c)
+		signed += int64(int8(c))
+	}
+	return want == unsigned || want == signed
+}
@@ -0,0 +1,149 @@
+package sparsetar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type memTarget struct {
+	data   []byte
+	writes int
+}
+
+func (t *memTarget) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(t.data)) {
+		t.Truncate(end)
+	}
+	t.writes++
+	return copy(t.data[off:], p), nil
+}
+
+func (t *memTarget) Truncate(size int64) error {
+	d := make([]byte, size)
+	copy(d, t.data)
+	t.data = d
+	return nil
+}
+
+// header builds a header block, fill can set additional fields before the checksum is computed.
+func header(name string, typ byte, size int64, fill func(b []byte)) []byte {
+	b := make([]byte, blockSize)
+	copy(b, name)
+	copy(b[100:], "0000644\x00")
+	copy(b[124:], fmt.Sprintf("%011o\x00", size))
+	copy(b[136:], "00000000000\x00")
+	b[156] = typ
+	copy(b[257:], "ustar  \x00")
+	if fill != nil {
+		fill(b)
+	}
+	copy(b[148:], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+func padded(data []byte) []byte {
+	return append(data, make([]byte, -len(data)&(blockSize-1))...)
+}
+
+func paxData(recs ...string) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(recs); i += 2 {
+		rec := " " + recs[i] + "=" + recs[i+1] + "\n"
+		// The length includes its own digits
+		n := len(rec) + len(fmt.Sprint(len(rec)))
+		n = len(rec) + len(fmt.Sprint(n))
+		fmt.Fprintf(&buf, "%d%s", n, rec)
+	}
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	const size = 100000
+	frag := []Fragment{{1024, 1500}, {70000, 512}}
+	expected := make([]byte, size)
+	var data []byte
+	for i, f := range frag {
+		for j := f.Offset; j < f.Offset+f.Length; j++ {
+			expected[j] = byte(i + 1 + int(j%7))
+		}
+		data = append(data, expected[f.Offset:f.Offset+f.Length]...)
+	}
+
+	var archive bytes.Buffer
+	// GNU format
+	archive.Write(header("gnu", tar.TypeGNUSparse, int64(len(data)), func(b []byte) {
+		for i, f := range frag {
+			copy(b[386+i*24:], fmt.Sprintf("%011o\x00%011o\x00", f.Offset, f.Length))
+		}
+		copy(b[483:], fmt.Sprintf("%011o\x00", size))
+	}))
+	archive.Write(padded(append([]byte(nil), data...)))
+	// PAX 0.1
+	pax := paxData("GNU.sparse.size", fmt.Sprint(size), "GNU.sparse.map",
+		fmt.Sprintf("%d,%d,%d,%d", frag[0].Offset, frag[0].Length, frag[1].Offset, frag[1].Length),
+		"GNU.sparse.name", "pax01")
+	archive.Write(header("PaxHeaders/x", tar.TypeXHeader, int64(len(pax)), nil))
+	archive.Write(padded(pax))
+	archive.Write(header("GNUSparseFile.0/pax01", tar.TypeReg, int64(len(data)), nil))
+	archive.Write(padded(append([]byte(nil), data...)))
+	// PAX 1.0
+	pax = paxData("GNU.sparse.major", "1", "GNU.sparse.minor", "0", "GNU.sparse.name", "pax10",
+		"GNU.sparse.realsize", fmt.Sprint(size))
+	sparseMap := padded([]byte(fmt.Sprintf("2\n%d\n%d\n%d\n%d\n", frag[0].Offset, frag[0].Length, frag[1].Offset, frag[1].Length)))
+	archive.Write(header("PaxHeaders/x", tar.TypeXHeader, int64(len(pax)), nil))
+	archive.Write(padded(pax))
+	archive.Write(header("GNUSparseFile.0/pax10", tar.TypeReg, int64(len(sparseMap)+len(data)), nil))
+	archive.Write(sparseMap)
+	archive.Write(padded(append([]byte(nil), data...)))
+	// Not sparse
+	archive.Write(header("plain", tar.TypeReg, 3, nil))
+	archive.Write(padded([]byte("abc")))
+	archive.Write(make([]byte, 2*blockSize))
+
+	r := NewReader(&archive)
+	for _, name := range []string{"gnu", "pax01", "pax10"} {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != name || hdr.Size != size || hdr.Typeflag != tar.TypeReg {
+			t.Fatalf("Unexpected header: %+v", hdr)
+		}
+		if !reflect.DeepEqual(r.Map(), frag) {
+			t.Fatalf("%s: unexpected map: %v", name, r.Map())
+		}
+		var target memTarget
+		written, err := r.CopyTo(&target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != int64(len(data)) || target.writes != len(frag) {
+			t.Fatalf("%s: %d bytes in %d writes", name, written, target.writes)
+		}
+		if !bytes.Equal(target.data, expected) {
+			t.Fatalf("%s: data mismatch", name)
+		}
+	}
+
+	// Skipping the data
+	hdr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "plain" || !reflect.DeepEqual(r.Map(), []Fragment{{0, 3}}) {
+		t.Fatalf("Unexpected entry: %+v, %v", hdr, r.Map())
+	}
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package sparsetar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dop251/spgz"
+)
+
+var (
+	ErrWriteAfterClose = errors.New("Write after Close")
+)
+
+// Writer writes sparse files as tar entries in the GNU format, which GNU tar, bsdtar and
+// archive/tar all understand.
+type Writer struct {
+	w      io.Writer
+	closed bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// DataMap returns the data ranges of the first size bytes of ds.
+func DataMap(ds spgz.DataSeeker, size int64) ([]Fragment, error) {
+	var frag []Fragment
+	for offset := int64(0); offset < size; {
+		data, err := ds.SeekData(offset)
+		if err != nil {
+			return nil, err
+		}
+		if data >= size {
+			break
+		}
+		hole, err := ds.SeekHole(data)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		frag = append(frag, Fragment{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	return frag, nil
+}
+
+// WriteSparse writes an entry for a regular file of hdr.Size bytes, of which only the ranges in
+// frag (which must be in ascending order and not overlap, they are extended to multiples of 512
+// bytes) are read from r and stored. The name, the mode, the owner and the modification time are
+// taken from hdr.
+func (tw *Writer) WriteSparse(hdr *tar.Header, r io.ReaderAt, frag []Fragment) error {
+	if tw.closed {
+		return ErrWriteAfterClose
+	}
+	frag, err := alignMap(frag, hdr.Size)
+	if err != nil {
+		return err
+	}
+	var pos, data int64
+	for _, f := range frag {
+		pos = f.Offset + f.Length
+		data += f.Length
+	}
+	if len(frag) == 0 || pos < hdr.Size {
+		// Like GNU tar, mark the size with an empty fragment at the end
+		frag = append(frag, Fragment{Offset: hdr.Size})
+	}
+
+	if len(hdr.Name) > 100 {
+		err = tw.writeLongName(hdr.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var b [blockSize]byte
+	copy(b[0:100], hdr.Name)
+	formatNumeric(b[100:108], hdr.Mode&07777)
+	formatNumeric(b[108:116], int64(hdr.Uid))
+	formatNumeric(b[116:124], int64(hdr.Gid))
+	formatNumeric(b[124:136], data)
+	formatNumeric(b[136:148], hdr.ModTime.Unix())
+	b[156] = tar.TypeGNUSparse
+	copy(b[257:265], "ustar  \x00")
+	copy(b[265:297], hdr.Uname)
+	copy(b[297:329], hdr.Gname)
+	formatNumeric(b[483:495], hdr.Size)
+	rest := formatSparse(b[386:482], frag)
+	if len(rest) > 0 {
+		b[482] = 1
+	}
+	err = tw.writeHeader(b[:])
+	if err != nil {
+		return err
+	}
+	for len(rest) > 0 {
+		var ext [blockSize]byte
+		rest = formatSparse(ext[:504], rest)
+		if len(rest) > 0 {
+			ext[504] = 1
+		}
+		_, err = tw.w.Write(ext[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	for _, f := range frag {
+		for off := int64(0); off < f.Length; {
+			chunk := buf
+			if l := f.Length - off; l < int64(len(chunk)) {
+				chunk = chunk[:l]
+			}
+			n, err := r.ReadAt(chunk, f.Offset+off)
+			if n < len(chunk) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			_, err = tw.w.Write(chunk)
+			if err != nil {
+				return err
+			}
+			off += int64(len(chunk))
+		}
+	}
+	var pad [blockSize]byte
+	_, err = tw.w.Write(pad[:-data&(blockSize-1)])
+	return err
+}
+
+// Close writes the end-of-archive marker. The underlying writer is not closed.
+func (tw *Writer) Close() error {
+	if tw.closed {
+		return nil
+	}
+	tw.closed = true
+	_, err := tw.w.Write(make([]byte, 2*blockSize))
+	return err
+}
+
+func (tw *Writer) writeLongName(name string) error {
+	var b [blockSize]byte
+	copy(b[0:100], "././@LongLink")
+	formatNumeric(b[100:108], 0644)
+	formatNumeric(b[124:136], int64(len(name)+1))
+	b[156] = tar.TypeGNULongName
+	copy(b[257:265], "ustar  \x00")
+	err := tw.writeHeader(b[:])
+	if err != nil {
+		return err
+	}
+	data := make([]byte, (len(name)+blockSize)&^(blockSize-1))
+	copy(data, name)
+	_, err = tw.w.Write(data)
+	return err
+}
+
+func (tw *Writer) writeHeader(b []byte) error {
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	_, err := tw.w.Write(b)
+	return err
+}
+
+// alignMap validates the map and extends the fragments to block boundaries (merging the ones that
+// then touch), GNU tar misplaces the data of fragments that are not aligned.
+func alignMap(frag []Fragment, size int64) ([]Fragment, error) {
+	var (
+		aligned []Fragment
+		pos     int64
+	)
+	for _, f := range frag {
+		if f.Offset < pos || f.Length < 0 || f.Offset+f.Length > size {
+			return nil, ErrSparseMap
+		}
+		pos = f.Offset + f.Length
+		if f.Length == 0 {
+			continue
+		}
+		start := f.Offset &^ (blockSize - 1)
+		end := (pos + blockSize - 1) &^ (blockSize - 1)
+		if end > size {
+			end = size
+		}
+		if n := len(aligned); n > 0 && aligned[n-1].Offset+aligned[n-1].Length >= start {
+			aligned[n-1].Length = end - aligned[n-1].Offset
+		} else {
+			aligned = append(aligned, Fragment{Offset: start, Length: end - start})
+		}
+	}
+	return aligned, nil
+}
+
+// formatSparse fills the sparse entries area b with as many fragments as fit, returns the rest.
+func formatSparse(b []byte, frag []Fragment) []Fragment {
+	for len(b) >= 24 && len(frag) > 0 {
+		formatNumeric(b[:12], frag[0].Offset)
+		formatNumeric(b[12:24], frag[0].Length)
+		b = b[24:]
+		frag = frag[1:]
+	}
+	return frag
+}
+
+// formatNumeric formats v as a NUL-terminated octal number if it fits into b, in base-256
+// otherwise.
+func formatNumeric(b []byte, v int64) {
+	if v < 1<<(3*uint(len(b)-1)) {
+		copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, v))
+		return
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= 0x80
+}
@@ -0,0 +1,100 @@
+package sparsetar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dop251/spgz"
+)
+
+func TestWriter(t *testing.T) {
+	f, err := spgz.OpenFile(filepath.Join(t.TempDir(), "test.spgz"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs := f.BlockSize()
+	expected := make([]byte, 10*bs+100)
+	for i := 2 * bs; i < 3*bs+10; i++ {
+		expected[i] = byte(i%251 + 1)
+	}
+	for i := 7 * bs; i < 8*bs; i++ {
+		expected[i] = byte(i%13 + 1)
+	}
+	_, err = f.WriteAt(expected, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(expected))
+
+	frag, err := DataMap(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frag, []Fragment{{2 * bs, 2 * bs}, {7 * bs, bs}}) {
+		t.Fatalf("Unexpected map: %v", frag)
+	}
+
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	names := []string{"image", strings.Repeat("long/", 30) + "image", "empty"}
+	mtime := time.Unix(1500000000, 0)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0640, Size: size, ModTime: mtime}
+		if name == "empty" {
+			err = w.WriteSparse(hdr, f, nil)
+		} else {
+			err = w.WriteSparse(hdr, f, frag)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archive/tar fills the holes
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for _, name := range names {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != name || hdr.Size != size || hdr.Mode != 0640 || !hdr.ModTime.Equal(mtime) {
+			t.Fatalf("Unexpected header: %+v", hdr)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := expected
+		if name == "empty" {
+			want = make([]byte, size)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("%s: data mismatch", name)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	r := NewReader(&archive)
+	hdr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aligned, _ := alignMap(frag, size)
+	if hdr.Size != size || !reflect.DeepEqual(r.Map(), aligned) || aligned[0].Offset%blockSize != 0 {
+		t.Fatalf("Unexpected entry: %+v, %v", hdr, r.Map())
+	}
+}
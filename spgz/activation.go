@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Socket activation: when started by systemd for a .socket unit, the socket is passed as file
+// descriptor 3 and LISTEN_PID and LISTEN_FDS are set. With Accept=no (the default) it's a
+// listening socket, with Accept=yes a connection for every instance of the service.
+
+const listenFdsStart = 3
+
+// activationSocket returns the socket passed by systemd, nil if the process was not socket
+// activated. The variables are removed so that child processes don't pick the socket up.
+func activationSocket() (*os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds == 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds != 1 {
+		return nil, errors.New("Exactly one socket must be passed by systemd")
+	}
+	syscall.CloseOnExec(listenFdsStart)
+	return os.NewFile(listenFdsStart, "LISTEN_FD_3"), nil
+}
+
+// listenTCP returns the listening socket passed by systemd or, if there is none, listens on addr.
+func listenTCP(addr string) (net.Listener, error) {
+	f, err := activationSocket()
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return net.Listen("tcp", addr)
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// acceptOne returns a single connection for the servers that handle one client: the connection
+// passed by systemd (Accept=yes), the first one accepted on the socket passed by systemd or on
+// addr. It returns nil if the process was not socket activated and addr is empty.
+func acceptOne(addr string) (net.Conn, error) {
+	f, err := activationSocket()
+	if err != nil {
+		return nil, err
+	}
+	var l net.Listener
+	if f != nil {
+		defer f.Close()
+		// FileListener doesn't check that the socket is listening
+		accepting, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return nil, err
+		}
+		if accepting == 0 {
+			return net.FileConn(f)
+		}
+		l, err = net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if addr == "" {
+			return nil, nil
+		}
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer l.Close()
+	return l.Accept()
+}
+
+// serverConn returns the connection of a server that handles one client (see acceptOne), or
+// stdin/stdout. A socket is closed on SIGINT or SIGTERM so that the server stops, the returned
+// function reports whether that has happened.
+func serverConn(addr string) (io.ReadWriter, func() bool) {
+	c, err := acceptOne(addr)
+	if err != nil {
+		log.Fatalf("Could not accept a connection: %v", err)
+	}
+	if c == nil {
+		return stdio{Reader: os.Stdin, Writer: os.Stdout}, func() bool { return false }
+	}
+	var terminated int32
+	onTerminate(func(sig os.Signal) {
+		log.Infof("%v, stopping", sig)
+		atomic.StoreInt32(&terminated, 1)
+		c.Close()
+	})
+	return c, func() bool {
+		return atomic.LoadInt32(&terminated) != 0
+	}
+}
+
+// onTerminate calls fn once SIGINT or SIGTERM is received.
+func onTerminate(fn func(sig os.Signal)) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		fn(<-c)
+	}()
+}
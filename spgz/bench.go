@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+// benchReader produces size bytes of synthetic data: each MB is in turn zeroes, random (i.e.
+// incompressible) data and text-like data (twice), which roughly resembles a disk image.
+type benchReader struct {
+	rnd  *rand.Rand
+	size int64
+	pos  int64
+	buf  []byte
+}
+
+func newBenchReader(size int64) *benchReader {
+	return &benchReader{
+		rnd:  rand.New(rand.NewSource(1)),
+		size: size,
+		buf:  make([]byte, 1024*1024),
+	}
+}
+
+func (r *benchReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	chunk := int64(len(r.buf))
+	o := r.pos % chunk
+	if o == 0 {
+		switch (r.pos / chunk) % 4 {
+		case 0:
+			for i := range r.buf {
+				r.buf[i] = 0
+			}
+		case 1:
+			r.rnd.Read(r.buf)
+		default:
+			for i := range r.buf {
+				r.buf[i] = "etaoin shrdlu\n"[r.rnd.Intn(14)]
+			}
+		}
+	}
+	rest := r.buf[o:]
+	if l := r.size - r.pos; int64(len(rest)) > l {
+		rest = rest[:l]
+	}
+	n := copy(p, rest)
+	r.pos += int64(n)
+	return n, nil
+}
+
+func mbPerSec(n int64, d time.Duration) float64 {
+	return float64(n) / (1024 * 1024) / d.Seconds()
+}
+
+func benchBlockSize(dir string, blockSize, size int64) {
+	tmp, err := ioutil.TempFile(dir, "spgz-bench-")
+	if err != nil {
+		log.Fatalf("Could not create file: %v", err)
+	}
+	name := tmp.Name()
+	tmp.Close()
+	defer os.Remove(name)
+
+	f, err := spgz.OpenFileOptions(name, os.O_RDWR, 0666, &spgz.Options{BlockSize: blockSize})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	start := time.Now()
+	_, err = f.ReadFrom(newBenchReader(size))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		log.Fatalf("Compression failed: %v", err)
+	}
+	compress := time.Since(start)
+	fi, err := f.Stat()
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		log.Fatalf("Compression failed: %v", err)
+	}
+
+	f, err = spgz.OpenFile(name, os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+	start = time.Now()
+	_, err = f.WriteTo(ioutil.Discard)
+	if err != nil {
+		log.Fatalf("Decompression failed: %v", err)
+	}
+	decompress := time.Since(start)
+
+	fmt.Printf("Block size %d: compress %.1f MB/s, decompress %.1f MB/s", fi.BlockSize, mbPerSec(size, compress), mbPerSec(size, decompress))
+	if fi.Allocated >= 0 {
+		fmt.Printf(", ratio %.3f", float64(fi.Allocated)/float64(size))
+	}
+	fmt.Println()
+}
+
+func benchZero(size int64) {
+	buf := make([]byte, 1024*1024)
+	start := time.Now()
+	for n := int64(0); n < size; n += int64(len(buf)) {
+		if !spgz.IsBlockZero(buf) {
+			log.Fatal("Zero detection failed")
+		}
+	}
+	fmt.Printf("Zero detection: %.1f MB/s\n", mbPerSec(size, time.Since(start)))
+}
+
+func benchPunchHole(dir string) {
+	const holes = 256
+	const holeSize = 64 * 1024
+	tmp, err := ioutil.TempFile(dir, "spgz-bench-")
+	if err != nil {
+		log.Fatalf("Could not create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = io.CopyN(tmp, newBenchReader(holes*holeSize), holes*holeSize)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		log.Fatalf("Could not write file: %v", err)
+	}
+	sf := spgz.NewSparseFile(tmp)
+	start := time.Now()
+	for i := int64(0); i < holes; i++ {
+		err = sf.PunchHole(i*holeSize, holeSize)
+		if err != nil {
+			fmt.Printf("Punch hole: %v\n", err)
+			return
+		}
+	}
+	fmt.Printf("Punch hole: %v per call\n", time.Since(start)/holes)
+}
+
+func cmdBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	blockSizes := fs.String("block-size", "", "Comma-separated list of block sizes to test (the default block size if empty)")
+	size := fs.Int64("size", 256*1024*1024, "Amount of synthetic data")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *size <= 0 {
+		usage()
+	}
+	dir := fs.Arg(0)
+
+	sizes := []int64{0}
+	if *blockSizes != "" {
+		sizes = nil
+		for _, s := range strings.Split(*blockSizes, ",") {
+			bs, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil || bs < 4096 {
+				log.Fatalf("Invalid block size: %s", s)
+			}
+			sizes = append(sizes, bs)
+		}
+	}
+	// Blocks are always compressed with gzip, so the block size is the only thing to choose
+	for _, bs := range sizes {
+		benchBlockSize(dir, bs, *size)
+	}
+	benchZero(*size)
+	benchPunchHole(dir)
+}
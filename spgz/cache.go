@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdCache(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666, &spgz.Options{
+		Source: fs.Arg(1),
+	})
+	if err != nil {
+		log.Fatalf("Could not create file: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdCat(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	offset := fs.Int64("offset", 0, "Offset in the uncompressed data")
+	length := fs.Int64("length", -1, "Number of bytes to extract (up to the end if negative)")
+	base := fs.String("base", "", "Base file of a differential archive")
+	storeDir := fs.String("store", "", "Block store directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *offset < 0 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base:  openBase(*base),
+		Store: openStore(*storeDir),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteRange(os.Stdout, *offset, *length)
+	if err != nil {
+		log.Fatalf("Extraction failed: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdChangedBlocks(args []string) {
+	fs := flag.NewFlagSet("changed-blocks", flag.ExitOnError)
+	since := fs.Uint("since", 0, "Report changes made after this generation ended")
+	snapshot := fs.Bool("snapshot", false, "End the current generation and print its number")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	mode := os.O_RDONLY
+	if *snapshot {
+		mode = os.O_RDWR
+	}
+	f, err := spgz.OpenFile(fs.Arg(0), mode, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+
+	changed, err := f.ChangedBlocks(uint32(*since))
+	if err != nil {
+		log.Fatalf("Could not get changed blocks: %v", err)
+	}
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get file size: %v", err)
+	}
+
+	// Print the changes as offset and length pairs, merging adjacent blocks
+	bs := f.BlockSize()
+	for i := 0; i < len(changed); {
+		j := i + 1
+		for j < len(changed) && changed[j] == changed[j-1]+1 {
+			j++
+		}
+		start := changed[i] * bs
+		end := (changed[j-1] + 1) * bs
+		if end > size {
+			end = size
+		}
+		if end > start {
+			fmt.Printf("%d %d\n", start, end-start)
+		}
+		i = j
+	}
+
+	if *snapshot {
+		gen, err := f.Snapshot()
+		if err != nil {
+			log.Fatalf("Snapshot failed: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Generation: %d\n", gen)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
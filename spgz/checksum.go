@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdChecksum(args []string) {
+	fs := flag.NewFlagSet("checksum", flag.ExitOnError)
+	chunkSize := fs.Int64("chunk-size", 1024*1024, "Size of the chunks that are checksummed individually")
+	name := fs.String("name", "", "File name in the manifest (the name of the compressed file without the extension if empty)")
+	check := fs.String("check", "", "Instead of writing a manifest, check the file or device given as the argument against this one")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	if *check != "" {
+		manifest, err := os.Open(*check)
+		if err != nil {
+			log.Fatalf("Could not open manifest: %v", err)
+		}
+		defer manifest.Close()
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Could not open file: %v", err)
+		}
+		defer f.Close()
+		bad, err := spgz.VerifyChecksums(f, manifest)
+		if err != nil {
+			log.Fatalf("Check failed: %v", err)
+		}
+		for _, off := range bad {
+			log.Warnf("Chunk at offset %d does not match", off)
+		}
+		if len(bad) > 0 {
+			log.Fatalf("%d chunks do not match", len(bad))
+		}
+		return
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+	}
+	err = spgz.WriteChecksums(os.Stdout, f, size, *chunkSize, *name)
+	if err != nil {
+		log.Fatalf("Could not write checksums: %v", err)
+	}
+}
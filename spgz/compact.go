@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+// compactCopy rewrites the file into a new one which then replaces it. The blocks are
+// recompressed and the header is written anew, so files that use any features are rejected.
+func compactCopy(name string) (before, after int64) {
+	f, err := spgz.OpenFile(name, os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Could not get file info: %v", err)
+	}
+	for _, feat := range fi.Features {
+		if feat != "exact-block-size" {
+			log.Fatalf("The file uses features (%v) that are not preserved by copying, compact it in place", fi.Features)
+		}
+	}
+	h := f.Header()
+
+	tmpName := name + ".compact"
+	dst, err := spgz.OpenFileOptions(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666, &spgz.Options{
+		BlockSize: f.BlockSize() + 1,
+		Creator:   h.Creator,
+		Comment:   h.Comment,
+	})
+	if err != nil {
+		log.Fatalf("Could not create file: %v", err)
+	}
+	_, err = f.WriteTo(dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	var dfi *spgz.FileInfo
+	if err == nil {
+		dfi, err = dst.Stat()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		log.Fatalf("Copy failed: %v", err)
+	}
+	if fi.Allocated < 0 {
+		return fi.FileSize, dfi.FileSize
+	}
+	return fi.Allocated, dfi.Allocated
+}
+
+// compactInPlace compacts the file, if threshold is set only when the allocated space exceeds that
+// percentage of the ideal size.
+func compactInPlace(name string, threshold int) (before, after int64) {
+	f, err := spgz.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	if threshold > 0 {
+		fr, err := f.Fragmentation()
+		if err != nil {
+			log.Fatalf("Could not measure the file: %v", err)
+		}
+		if fr.Percent() <= threshold {
+			log.Infof("Allocated %d%% of the ideal size, not compacting", fr.Percent())
+			err = f.Close()
+			if err != nil {
+				log.Fatalf("Close failed: %v", err)
+			}
+			return fr.Allocated, fr.Allocated
+		}
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = f.Compact()
+	}
+	if err != nil {
+		log.Fatalf("Compact failed: %v", err)
+	}
+	err = f.Sync()
+	var afi *spgz.FileInfo
+	if err == nil {
+		afi, err = f.Stat()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("Compact failed: %v", err)
+	}
+	if fi.Allocated < 0 {
+		return fi.FileSize, afi.FileSize
+	}
+	return fi.Allocated, afi.Allocated
+}
+
+func cmdCompact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	copyMode := fs.Bool("copy", false, "Rewrite the file into a new one (which needs free space for it) instead of compacting it in place")
+	threshold := fs.Int("threshold", 0, "Only compact if the allocated space exceeds this percentage of the ideal size (e.g. 150)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *copyMode && *threshold > 0 {
+		usage()
+	}
+
+	var before, after int64
+	if *copyMode {
+		before, after = compactCopy(fs.Arg(0))
+	} else {
+		before, after = compactInPlace(fs.Arg(0), *threshold)
+	}
+	log.Infof("Reclaimed %d bytes (%d -> %d)", before-after, before, after)
+}
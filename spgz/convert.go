@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdConvert(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	blockSize := fs.Int64("block-size", 0, "Block size (a multiple of 4096, the default if 0)")
+	comment := fs.String("comment", "", "Comment to record in the header")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *blockSize%4096 != 0 {
+		usage()
+	}
+
+	log.Warnf("Converting %s in place, it will be lost if the conversion is interrupted", fs.Arg(0))
+	err := spgz.ConvertInPlace(fs.Arg(0), &spgz.Options{
+		BlockSize: *blockSize,
+		Comment:   *comment,
+	})
+	if err != nil {
+		log.Fatalf("Conversion failed: %v", err)
+	}
+}
+
+func cmdExpand(args []string) {
+	fs := flag.NewFlagSet("expand", flag.ExitOnError)
+	base := fs.String("base", "", "Base file of a differential archive")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	log.Warnf("Expanding %s in place, it will be lost if the expansion is interrupted", fs.Arg(0))
+	err := spgz.ExpandInPlace(fs.Arg(0), &spgz.Options{
+		Base: openBase(*base),
+	})
+	if err != nil {
+		log.Fatalf("Expansion failed: %v", err)
+	}
+}
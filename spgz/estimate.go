@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdEstimate(args []string) {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	blocks := fs.Int("blocks", 1000, "Number of randomly chosen blocks to compress, 0 to compress all of them")
+	seed := fs.Int64("seed", 0, "Seed for choosing the blocks (a random one if 0)")
+	blockSize := fs.Int64("block-size", 0, "Block size (a multiple of 4096, the default if 0)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	src, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Could not open source: %v", err)
+	}
+	defer src.Close()
+	// Seek rather than Stat, so that block devices work
+	size, err := src.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatalf("Could not determine the source size: %v", err)
+	}
+
+	e, err := spgz.EstimateSize(src, size, &spgz.EstimateOptions{
+		BlockSize: *blockSize,
+		Blocks:    *blocks,
+		Seed:      *seed,
+	})
+	if err != nil {
+		log.Fatalf("Estimate failed: %v", err)
+	}
+	fmt.Printf("Size:              %d\n", e.Size)
+	fmt.Printf("Blocks compressed: %d of %d", e.Sampled, e.Blocks)
+	if e.Sampled < e.Blocks {
+		fmt.Printf(" (seed %d)", *seed)
+	}
+	fmt.Printf("\n")
+	fmt.Printf("  zeroes:          %d\n", e.ZeroBlocks)
+	fmt.Printf("  raw:             %d\n", e.RawBlocks)
+	if e.Margin > 0 {
+		fmt.Printf("Allocated:         %d ± %d\n", e.Allocated, e.Margin)
+	} else {
+		fmt.Printf("Allocated:         %d\n", e.Allocated)
+	}
+	fmt.Printf("Ratio:             %.3f\n", e.Ratio())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+	"github.com/dop251/spgz/sparsetar"
+)
+
+func cmdExportTar(args []string) {
+	fs := flag.NewFlagSet("export-tar", flag.ExitOnError)
+	entry := fs.String("name", "", "Name of the entry (the name of the compressed file without the extension if empty)")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get file size: %v", err)
+	}
+	frag, err := sparsetar.DataMap(f, size)
+	if err != nil {
+		log.Fatalf("Could not read the block map: %v", err)
+	}
+
+	hdr := &tar.Header{
+		Name: *entry,
+		Mode: 0644,
+		Size: size,
+	}
+	if hdr.Name == "" {
+		hdr.Name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+	}
+	if fi, err := os.Stat(fs.Arg(0)); err == nil {
+		hdr.ModTime = fi.ModTime()
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if fs.Arg(1) != "-" {
+		out, err = os.OpenFile(fs.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err != nil {
+			log.Fatalf("Could not open output file: %v", err)
+		}
+	}
+
+	w := sparsetar.NewWriter(out)
+	err = w.WriteSparse(hdr, f, frag)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	err = out.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+	"github.com/dop251/spgz/vhd"
+)
+
+func cmdExportVHD(args []string) {
+	fs := flag.NewFlagSet("export-vhd", flag.ExitOnError)
+	format := fs.String("format", "vhd", "Output format (vhd or vhdx)")
+	fixed := fs.Bool("fixed", false, "Create a fixed size image")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	var write func(spgz.Target, io.ReaderAt, int64, bool) error
+	switch *format {
+	case "vhd":
+		write = vhd.WriteVHD
+	case "vhdx":
+		write = vhd.WriteVHDX
+	default:
+		log.Fatalf("Unknown format: %s", *format)
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get file size: %v", err)
+	}
+
+	out, err := os.OpenFile(fs.Arg(1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		log.Fatalf("Could not open output file: %v", err)
+	}
+
+	err = write(out, f, size, !*fixed)
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	err = out.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdFragmentation(args []string) {
+	fs := flag.NewFlagSet("fragmentation", flag.ExitOnError)
+	base := fs.String("base", "", "Base file of a differential archive")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base: openBase(*base),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	fr, err := f.Fragmentation()
+	if err != nil {
+		log.Fatalf("Could not measure the file: %v", err)
+	}
+	if fr.Allocated >= 0 {
+		fmt.Printf("Allocated:         %d (%d%% of the ideal size)\n", fr.Allocated, fr.Percent())
+	}
+	fmt.Printf("Ideal size:        %d\n", fr.Ideal)
+	fmt.Printf("Stored blocks:     %d (%d bytes)\n", fr.Blocks, fr.Stored)
+	fmt.Printf("Zero blocks:       %d\n", fr.ZeroBlocks)
+	fmt.Printf("Slack:             %d\n", fr.Slack)
+	if fr.AllocatedSlack >= 0 {
+		fmt.Printf("Allocated slack:   %d in %d slots (released by compact)\n", fr.AllocatedSlack, fr.SlackSlots)
+	}
+	fmt.Printf("Slot fill:\n")
+	for i, n := range fr.Fill {
+		fmt.Printf("  %3d-%3d%%:        %d\n", i*10, (i+1)*10, n)
+	}
+}
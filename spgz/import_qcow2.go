@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+	"github.com/dop251/spgz/qcow2"
+)
+
+func cmdImportQcow2(args []string) {
+	fs := flag.NewFlagSet("import-qcow2", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	in, err := os.Open(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Could not open source image ('%s'): %v", fs.Arg(1), err)
+	}
+	defer in.Close()
+
+	img, err := qcow2.Open(in)
+	if err != nil {
+		log.Fatalf("Could not read source image: %v", err)
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+
+	_, err = img.CopyTo(f)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+	"github.com/dop251/spgz/sparsetar"
+)
+
+func cmdImportTar(args []string) {
+	fs := flag.NewFlagSet("import-tar", flag.ExitOnError)
+	entry := fs.String("name", "", "Name of the entry to import (the first regular file if empty)")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(1) != "-" {
+		file, err := os.Open(fs.Arg(1))
+		if err != nil {
+			log.Fatalf("Could not open tar file ('%s'): %v", fs.Arg(1), err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	r := sparsetar.NewReader(in)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			log.Fatalf("No matching entry found")
+		}
+		if err != nil {
+			log.Fatalf("Could not read tar file: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && (*entry == "" || hdr.Name == *entry) {
+			break
+		}
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+
+	_, err = r.CopyTo(f)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
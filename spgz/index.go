@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	blockSize := fs.Int64("block-size", 64*1024, "Block size")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Could not create index file: %v", err)
+	}
+	err = spgz.WriteIndex(out, f, size, *blockSize)
+	if err != nil {
+		log.Fatalf("Could not write index: %v", err)
+	}
+	err = out.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
+
+func openIndex(name string) (io.ReadCloser, error) {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		resp, err := http.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", name, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(name)
+}
+
+func cmdFetch(args []string) {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 4 {
+		usage()
+	}
+
+	r, err := openIndex(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Could not open index: %v", err)
+	}
+	idx, err := spgz.ReadIndex(r)
+	r.Close()
+	if err != nil {
+		log.Fatalf("Could not read index: %v", err)
+	}
+
+	remote, err := spgz.NewHTTPBase(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Could not open %s: %v", fs.Arg(1), err)
+	}
+
+	old, err := spgz.OpenFile(fs.Arg(2), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer old.Close()
+	oldSize, err := old.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(3), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Fatalf("Could not create file: %v", err)
+	}
+	stats, err := spgz.SyncIndex(f, idx, old, oldSize, remote)
+	if err != nil {
+		log.Fatalf("Fetch failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+	log.Infof("Downloaded %d of %d blocks (%d bytes)", stats.Changed, stats.Blocks, stats.BytesSent)
+}
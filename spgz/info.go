@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	base := fs.String("base", "", "Base file of a differential archive")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base: openBase(*base),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	s, err := f.Stats()
+	if err != nil {
+		log.Fatalf("Could not get stats: %v", err)
+	}
+	fmt.Printf("Size:              %d\n", s.Size)
+	fmt.Printf("Block size:        %d\n", f.BlockSize())
+	fmt.Printf("File size:         %d\n", s.FileSize)
+	if s.Allocated >= 0 {
+		fmt.Printf("Allocated:         %d\n", s.Allocated)
+		fmt.Printf("Ratio:             %.3f\n", s.Ratio)
+	}
+	fmt.Printf("Blocks:            %d\n", s.Blocks)
+	fmt.Printf("  compressed:      %d\n", s.CompressedBlocks)
+	fmt.Printf("  raw:             %d\n", s.RawBlocks)
+	fmt.Printf("  holes:           %d\n", s.HoleBlocks)
+	if s.StoredBlocks > 0 {
+		fmt.Printf("  in block store:  %d\n", s.StoredBlocks)
+	}
+	if s.BaseBlocks > 0 {
+		fmt.Printf("  from base:       %d\n", s.BaseBlocks)
+	}
+	if s.SharedBlocks > 0 {
+		fmt.Printf("  deduplicated:    %d\n", s.SharedBlocks)
+	}
+	if f.ChangeTracking() {
+		fmt.Printf("Generation:        %d\n", f.Generation())
+	}
+	if p := f.Parent(); p != "" {
+		fmt.Printf("Parent:            %s\n", p)
+	}
+	h := f.Header()
+	fmt.Printf("Format version:    %d\n", h.FormatVersion)
+	if h.Creator != "" {
+		fmt.Printf("Created by:        %s\n", h.Creator)
+	}
+	if !h.Created.IsZero() {
+		fmt.Printf("Created at:        %s\n", h.Created.Format(time.RFC3339))
+	}
+	if h.Hostname != "" {
+		fmt.Printf("Created on host:   %s\n", h.Hostname)
+	}
+	if h.Comment != "" {
+		fmt.Printf("Comment:           %s\n", h.Comment)
+	}
+	if r := f.LastScrub(); r != nil {
+		fmt.Printf("Last scrub:        %s, %d blocks, %d errors\n", r.Time.Format(time.RFC3339), r.Blocks, r.Errors)
+	}
+}
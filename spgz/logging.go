@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// setupLogging consumes the logging options at the start of args (they go before the command or
+// the other options) and configures the logger accordingly. It returns the remaining arguments.
+//
+//	-v                  log debug messages
+//	-q                  only log errors
+//	--log-format <fmt>  "text" (the default) or "json", one object per line
+func setupLogging(args []string) []string {
+	level := log.InfoLevel
+	format := "text"
+	for len(args) > 0 {
+		arg := args[0]
+		if !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+		switch name {
+		case "v":
+			level = log.DebugLevel
+		case "q":
+			level = log.ErrorLevel
+		case "log-format":
+			if !hasValue {
+				if len(args) < 2 {
+					usage()
+				}
+				args = args[1:]
+				value = args[0]
+			}
+			format = value
+		default:
+			// Not a logging option
+			name = ""
+		}
+		if name == "" {
+			break
+		}
+		args = args[1:]
+	}
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown log format: %s\n\n", format)
+		usage()
+	}
+	log.SetLevel(level)
+	log.SetOutput(os.Stderr)
+	return args
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/dop251/spgz"
+	"github.com/dop251/spgz/ublk"
 	"github.com/dop251/buse"
 )
 
@@ -21,8 +28,45 @@ const (
 )
 
 func usage() {
-	s := "Compress:\n    %[1]s -c <compressed_file> <source>\n\nExtract:\n    %[1]s -x <compressed_file> [--no-sparse] <target>\n\n"+
-		"Get original size:\n    %[1]s -s <compressed_file>\n\nConnect to a local nbd device:\n    %[1]s -b <compressed_file> /dev/nbd...\n"
+	s := "Compress:\n    %[1]s -c <compressed_file> [--track-changes] [--dedup] [--journal] [--store <dir>] [--comment <text>] [--reproducible] [--jobs <n>] [--memory-limit <bytes>] [--raw-backoff <n>] [--no-atomic] [--preserve] [--xattrs] [--acls] [--selinux] [--base <base_file>|--chunked] <source>\n\nExtract:\n    %[1]s -x <compressed_file> [--no-sparse] [--follow] [--gzip] [--raw] [--preserve] [--xattrs] [--acls] [--selinux] [--base <base_file>] [--store <dir>] <target>\n\n"+
+		"Compress or extract depending on whether the input is compressed (takes the options of -c and -x):\n    %[1]s auto [options] <input> <output>\n\n"+
+		"Get original size:\n    %[1]s -s <compressed_file> [--gzip] [--raw] [--store <dir>]\n\nConnect to a local nbd device:\n    %[1]s -b <compressed_file> [--replicate <remote>] [--preallocate] [--skip-unchanged] /dev/nbd...\n\n"+
+		"Attach as a ublk block device:\n    %[1]s -u <compressed_file> [--replicate <remote>] [--preallocate] [--skip-unchanged]\n\n"+
+		"Serve the content over HTTP:\n    %[1]s serve-http [-listen <addr>] <compressed_file>\n\n"+
+		"Import a qcow2 image:\n    %[1]s import-qcow2 <compressed_file> <image.qcow2>\n\n"+
+		"Import a regular or sparse (GNU or PAX format) file from a tar archive:\n    %[1]s import-tar [-name <entry>] <compressed_file> <tar_file|->\n\n"+
+		"Export as a VHD or VHDX image:\n    %[1]s export-vhd [-format vhd|vhdx] [-fixed] <compressed_file> <output>\n\n"+
+		"Export as a sparse file in a tar archive (GNU format):\n    %[1]s export-tar [-name <entry>] <compressed_file> <output|->\n\n"+
+		"List blocks changed since a generation (and optionally start a new one):\n    %[1]s changed-blocks [-since <generation>] [-snapshot] <compressed_file>\n\n"+
+		"Create a full copy of a differential archive:\n    %[1]s materialize <compressed_file> <base_file> <output_file>\n\n"+
+		"Create an overlay (writes go to the overlay, unwritten blocks are read from the parent):\n    %[1]s overlay <overlay_file> <parent_file>\n\n"+
+		"Copy all blocks from the parent or base into the file and remove the reference:\n    %[1]s flatten [-base <base_file>] <compressed_file>\n\n"+
+		"Write an overlay into its parent (or merge the parent into the overlay):\n    %[1]s commit [-merge-parent] <overlay_file>\n\n"+
+		"Transfer the blocks that differ to a remote archive (over ssh or TCP):\n    %[1]s sync <compressed_file> [user@]host:path|tcp://host:port\n\n"+
+		"Receive a sync (on stdin/stdout or a single TCP connection):\n    %[1]s sync-server [-listen <addr>] <compressed_file>\n\n"+
+		"Keep a standby copy of a device attached with -b or -u (--replicate [user@]host:path|tcp://host:port):\n    %[1]s replicate-server [-listen <addr>] <compressed_file>\n\n"+
+		"Keep a compressed file in sync with a source that is being modified, recompressing the changed blocks:\n    %[1]s watch [-interval <duration>] <source> <compressed_file>\n\n"+
+		"Create a copy-on-read cache of a file, block device or http(s) URL:\n    %[1]s cache <compressed_file> <source>\n\n"+
+		"Write a block index for clients of serve-http:\n    %[1]s index [-block-size <size>] <compressed_file> <index_file>\n\n"+
+		"Download an updated image using an older local copy and an index:\n    %[1]s fetch <index_file|url> <url> <old_compressed_file> <new_compressed_file>\n\n"+
+		"Show the space usage:\n    %[1]s info [-base <base_file>] <compressed_file>\n\n"+
+		"Write a range of the uncompressed data to stdout:\n    %[1]s cat [-offset <offset>] [-length <length>] [-base <base_file>] [-store <dir>] <compressed_file>\n\n"+
+		"Show which ranges contain data and which read as zeroes (like qemu-img map):\n    %[1]s map [-output human|json] [-base <base_file>] [-store <dir>] <compressed_file>\n\n"+
+		"Write SHA-256 checksums of the content in a format sha256sum -c understands (or check a file against them):\n    %[1]s checksum [-chunk-size <size>] [-name <name>] <compressed_file>\n    %[1]s checksum -check <manifest> <file|device>\n\n"+
+		"Split a file into segments (<file>.000, <file>.001, ...), which are opened transparently:\n    %[1]s split [-size <size>] [-parity <n> [-stripe <n>]] <compressed_file>\n\n"+
+		"Join the segments back into a single file:\n    %[1]s join <compressed_file>\n\n"+
+		"Rebuild lost segments of a file split with -parity:\n    %[1]s repair-segments <compressed_file>\n\n"+
+		"Predict the size of the compressed file of a source without writing it (from a sample of blocks, or all with -blocks 0):\n    %[1]s estimate [-blocks <n>] [-seed <seed>] [-block-size <size>] <source>\n\n"+
+		"Show how much space the slots waste and how much of it compact would release:\n    %[1]s fragmentation [-base <base_file>] <compressed_file>\n\n"+
+		"Release space that doesn't hold data (or, with -copy, rewrite the file):\n    %[1]s compact [-copy|-threshold <percent>] <compressed_file>\n\n"+
+		"Punch holes over the ranges of zeroes in a regular file:\n    %[1]s sparsify [-block-size <size>] <file>\n\n"+
+		"Compress a raw file in place, without the space for a copy (not crash safe):\n    %[1]s convert [-block-size <size>] [-comment <text>] <file>\n\n"+
+		"Decompress a file in place into its raw content (not crash safe):\n    %[1]s expand [-base <base_file>] <compressed_file>\n\n"+
+		"Check that all blocks can be read and decoded, recording the time and the result in the header:\n    %[1]s scrub [-rate <bytes_per_second>] [-jobs <n>] [-no-record] <compressed_file>\n\n"+
+		"Compare a random sample of blocks with the source (repeatable with the seed it prints):\n    %[1]s verify-sample [-blocks <n>] [-seed <seed>] [-base <base_file>] <compressed_file> <source>\n\n"+
+		"Rewrite the blocks that can't be decoded with their content from a copy:\n    %[1]s repair -replica <compressed_file|raw_file|url> <compressed_file>\n\n"+
+		"Measure compression and decompression throughput, zero detection speed and punch hole latency in a directory:\n    %[1]s bench [-block-size <size>[,<size>...]] [-size <size>] <dir>\n\n"+
+		"Logging options, before the command or the other options:\n    -v (debug messages) | -q (errors only), --log-format text|json\n"
 
 	fmt.Fprintf(os.Stderr, s, os.Args[0])
 	os.Exit(1)
@@ -52,28 +96,126 @@ func failOptions() {
 	usage()
 }
 
+var commands = map[string]func(args []string){
+	"serve-http":       cmdServeHTTP,
+	"import-qcow2":     cmdImportQcow2,
+	"import-tar":       cmdImportTar,
+	"export-vhd":       cmdExportVHD,
+	"export-tar":       cmdExportTar,
+	"changed-blocks":   cmdChangedBlocks,
+	"materialize":      cmdMaterialize,
+	"overlay":          cmdOverlay,
+	"flatten":          cmdFlatten,
+	"commit":           cmdCommit,
+	"sync":             cmdSync,
+	"sync-server":      cmdSyncServer,
+	"replicate-server": cmdReplicateServer,
+	"watch":            cmdWatch,
+	"cache":            cmdCache,
+	"index":            cmdIndex,
+	"fetch":            cmdFetch,
+	"info":             cmdInfo,
+	"cat":              cmdCat,
+	"map":              cmdMap,
+	"checksum":         cmdChecksum,
+	"split":            cmdSplit,
+	"join":             cmdJoin,
+	"repair-segments":  cmdRepairSegments,
+	"bench":            cmdBench,
+	"compact":          cmdCompact,
+	"fragmentation":    cmdFragmentation,
+	"estimate":         cmdEstimate,
+	"sparsify":         cmdSparsify,
+	"convert":          cmdConvert,
+	"expand":           cmdExpand,
+	"scrub":            cmdScrub,
+	"verify-sample":    cmdVerifySample,
+	"repair":           cmdRepair,
+}
+
 func main() {
+	args := setupLogging(os.Args[1:])
+	if len(args) > 0 {
+		if cmd := commands[args[0]]; cmd != nil {
+			cmd(args[1:])
+			return
+		}
+	}
+
 	var buse = flag.String("b", "", "Connect to a local nbd device")
+	var ublk = flag.String("u", "", "Attach as a ublk block device")
+	var replicate = flag.String("replicate", "", "Stream the changes to the device to a replicate-server (requires --track-changes)")
+	var preallocate = flag.Bool("preallocate", false, "Allocate the whole slot of a block of the device when it's first written, to keep the file in fewer extents")
+	var skipUnchanged = flag.Bool("skip-unchanged", false, "Read a block's slot before storing it and don't write it if it holds the same data")
 	var create = flag.String("c", "", "Create compressed file")
 	var extract = flag.String("x", "", "Extract compressed file")
 	var size = flag.String("s", "", "Get original size in bytes")
 	var noSparse = flag.Bool("no-sparse", false, "Disable sparse file")
-	var debug = flag.Bool("debug", false, "Enable debug logging")
+	var debug = flag.Bool("debug", false, "Enable debug logging (same as -v)")
+	var trackChanges = flag.Bool("track-changes", false, "Enable changed-block tracking in the created file")
+	var baseName = flag.String("base", "", "Base of a differential archive")
+	var dedup = flag.Bool("dedup", false, "Store identical blocks only once in the created file")
+	var journal = flag.Bool("journal", false, "Protect block writes to the created file against crashes")
+	var storeDir = flag.String("store", "", "Keep the blocks in a content-addressable store in this directory")
+	var chunked = flag.Bool("chunked", false, "Create an append-only archive with content-defined chunks")
+	var follow = flag.Bool("follow", false, "Keep extracting data appended to the compressed file until interrupted")
+	var comment = flag.String("comment", "", "A comment to record in the header of the created file")
+	var preserve = flag.Bool("preserve", false, "Record (or restore) the owner, the mode and the timestamps of the source")
+	var xattrs = flag.Bool("xattrs", false, "Record (or restore) the extended attributes of the source")
+	var acls = flag.Bool("acls", false, "Record (or restore) the POSIX ACLs of the source")
+	var selinux = flag.Bool("selinux", false, "Record (or restore) the SELinux context of the source")
+	var gz = flag.Bool("gzip", false, "Accept a plain gzip or BGZF file when extracting or getting the size")
+	var raw = flag.Bool("raw", false, "Accept a file that is not compressed at all when extracting (it is copied verbatim, with a warning) or getting the size")
+	var reproducible = flag.Bool("reproducible", false, "Leave the creation time and host out of the created file so that it only depends on the data")
+	var jobs = flag.Int("jobs", runtime.NumCPU(), "Number of blocks to compress in parallel when creating a file")
+	var memoryLimit = flag.Int64("memory-limit", 0, "Most memory in bytes the blocks of the created file may take, fewer blocks are compressed in parallel to fit (0 for no limit)")
+	var rawBackoff = flag.Int("raw-backoff", 0, "After this many blocks in a row that don't compress, only compress the blocks whose sample does (0 to always compress); with --reproducible the blocks are then compressed one at a time")
+	var noAtomic = flag.Bool("no-atomic", false, "Create the compressed file in place rather than under a temporary name that it gets once it's complete")
 
 
-	flag.Parse()
+	auto := len(args) > 0 && args[0] == "auto"
+	if auto {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	name := flag.Arg(0)
 
+	if auto {
+		if flag.NArg() != 2 || *create != "" || *extract != "" || *size != "" || *buse != "" || *ublk != "" {
+			usage()
+		}
+		if isArchive(flag.Arg(0), *gz) {
+			*extract = flag.Arg(0)
+			name = flag.Arg(1)
+		} else {
+			*create = flag.Arg(1)
+		}
+	}
+
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	var xattrClasses int
+	if *xattrs {
+		xattrClasses |= spgz.XattrsUser
+	}
+	if *acls {
+		xattrClasses |= spgz.XattrsACL
+	}
+	if *selinux {
+		xattrClasses |= spgz.XattrsSELinux
+	}
+
 	if *extract != "" {
 		if *create != "" || *size != "" {
 			failOptions()
 		}
-		f, err := spgz.OpenFile(*extract, os.O_RDONLY, 0666)
+		f, err := openArchive(*extract, &spgz.Options{
+			Base:  openBase(*baseName),
+			Store: openStore(*storeDir),
+		}, *gz, *raw)
 		if err != nil {
 			log.Fatalf("Could not open compressed file: %v", err)
 		}
@@ -121,7 +263,7 @@ func main() {
 			if ftype == _FTYPE_FILE {
 				err = out.Truncate(0)
 				if err != nil {
-					log.Printf("Truncate() failed: %v", err)
+					log.Warnf("Truncate() failed: %v", err)
 				}
 			}
 			if *noSparse || ftype != _FTYPE_FILE {
@@ -133,43 +275,176 @@ func main() {
 
 		defer w.Close()
 
-		_, err = io.Copy(w, f)
+		if *follow {
+			fl, ok := f.(interface {
+				Follow(context.Context, io.Writer, time.Duration) (int64, error)
+			})
+			if !ok {
+				log.Fatal("--follow is not supported for this archive")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			_, err = fl.Follow(ctx, w, time.Second)
+			stop()
+			if errors.Is(err, context.Canceled) {
+				err = nil
+			}
+		} else {
+			_, err = io.Copy(w, f)
+		}
 		if err != nil {
 			log.Fatalf("Copy failed: %v", err)
 		}
+		// Before the extended attributes, changing the owner may remove some of them
+		if *preserve && ftype == _FTYPE_FILE && name != "-" {
+			restoreFileAttrs(f, name)
+		}
+		if xattrClasses != 0 && ftype == _FTYPE_FILE && name != "-" {
+			restoreXattrs(f, name, xattrClasses)
+		}
 	} else if *create != "" {
 		if *size != "" {
 			failOptions()
 		}
 
 		var in io.Reader
+		var inSize int64 = -1
 		if name != "-" {
 			f, err := os.Open(name)
 			if err != nil {
 				log.Fatalf("Could not open source file ('%s'): %v", name, err)
 			}
 			in = f
+			if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+				inSize = fi.Size()
+				// Holes in the source are skipped using SEEK_DATA rather than read
+				in = spgz.NewSparseFile(f)
+			}
 		} else {
 			in = os.Stdin
 		}
 
-		f, err := spgz.OpenFile(*create, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		var attrs map[string][]byte
+		if xattrClasses != 0 && name != "-" {
+			all, err := spgz.GetXattrs(name)
+			if err != nil {
+				log.Fatalf("Could not read extended attributes: %v", err)
+			}
+			attrs = spgz.FilterXattrs(all, xattrClasses)
+		}
+		var fileAttrs *spgz.FileAttrs
+		if *preserve && name != "-" {
+			var err error
+			fileAttrs, err = spgz.GetFileAttrs(name)
+			if err != nil {
+				log.Fatalf("Could not read file attributes: %v", err)
+			}
+		}
+
+		// Unless --no-atomic is given, the file is created without a name (where the filesystem
+		// supports it) or under a temporary name in the same directory, so that an incomplete
+		// file is never mistaken for a complete one
+		target := *create
+		var unnamed *os.File
+		if !*noAtomic {
+			if _, err := os.Lstat(target); err == nil {
+				log.Fatalf("Could not open file: %v", &os.PathError{Op: "open", Path: target, Err: os.ErrExist})
+			}
+			if !*chunked {
+				file, err := spgz.CreateUnnamed(filepath.Dir(target), 0666)
+				if err == nil {
+					unnamed = file
+				} else if err != spgz.ErrTmpFileNotSupported {
+					log.Fatalf("Could not open file: %v", err)
+				}
+			}
+			if unnamed == nil {
+				*create = filepath.Join(filepath.Dir(target), fmt.Sprintf(".%s.%d.tmp", filepath.Base(target), os.Getpid()))
+			}
+		}
+		fail := func(format string, args ...interface{}) {
+			if !*noAtomic && unnamed == nil {
+				os.Remove(*create)
+			}
+			log.Fatalf(format, args...)
+		}
+
+		var f io.WriteCloser
+		var err error
+		opts := &spgz.Options{
+			ChangeTracking: *trackChanges,
+			Dedup:          *dedup,
+			Journal:        *journal,
+			Base:           openBase(*baseName),
+			Store:          openStore(*storeDir),
+			Comment:        *comment,
+			Xattrs:         attrs,
+			FileAttrs:      fileAttrs,
+			Reproducible:   *reproducible,
+			CompressJobs:   *jobs,
+			MemoryLimit:    *memoryLimit,
+			RawBackoff:     *rawBackoff,
+		}
+		if *chunked {
+			f, err = spgz.CreateChunked(*create, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666, nil)
+		} else if unnamed != nil {
+			f, err = spgz.NewFromFileOptions(unnamed, os.O_RDWR, opts)
+		} else {
+			f, err = spgz.OpenFileOptions(*create, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666, opts)
+		}
 		if err != nil {
 			log.Fatalf("Could not open file: %v", err)
 		}
 
-		_, err = io.Copy(f, in)
+		if inSize >= 0 {
+			if t, ok := f.(spgz.Truncatable); ok {
+				err = t.Truncate(inSize)
+				if err != nil {
+					fail("Truncate failed: %v", err)
+				}
+			}
+			_, err = spgz.Copy(f, in)
+		} else {
+			_, err = io.Copy(f, in)
+		}
 		if err != nil {
-			log.Fatalf("Copy failed: %v", err)
+			fail("Copy failed: %v", err)
+		}
+		if s, ok := f.(interface{ Sync() error }); ok && !*noAtomic {
+			err = s.Sync()
+			if err != nil {
+				fail("Sync failed: %v", err)
+			}
+		}
+		if unnamed != nil {
+			// The file descriptor is needed for the link, nothing is written on Close after Sync
+			err = spgz.LinkUnnamed(unnamed, target)
+			if err != nil {
+				fail("Could not link the file: %v", err)
+			}
 		}
 		err = f.Close()
 		if err != nil {
-			log.Fatalf("Close failed: %v", err)
+			fail("Close failed: %v", err)
+		}
+		if !*noAtomic && unnamed == nil {
+			// Unlike a rename, a link doesn't replace a file created in the meantime
+			err = os.Link(*create, target)
+			if err != nil && !errors.Is(err, os.ErrExist) {
+				err = os.Rename(*create, target)
+			}
+			if err != nil {
+				fail("Could not rename the file: %v", err)
+			}
+			os.Remove(*create)
 		}
 	} else if *buse != "" {
-		doBuse(*buse, name)
+		doBuse(*buse, name, *replicate, &spgz.Options{Preallocate: *preallocate, SkipUnchanged: *skipUnchanged})
+	} else if *ublk != "" {
+		doUblk(*ublk, *replicate, &spgz.Options{Preallocate: *preallocate, SkipUnchanged: *skipUnchanged})
 	} else if *size != "" {
-		f, err := spgz.OpenFile(*size, os.O_RDONLY, 0666)
+		f, err := openArchive(*size, &spgz.Options{
+			Store: openStore(*storeDir),
+		}, *gz, *raw)
 		if err != nil {
 			log.Fatalf("Could not open file: %v", err)
 		}
@@ -183,8 +458,167 @@ func main() {
 	}
 }
 
-func doBuse(file, dev string) {
-	f, err := spgz.OpenFile(file, os.O_RDWR, 0666)
+// isArchive returns true if the file (or the segmented file) with the given name is compressed,
+// i.e. if auto mode should extract it rather than compress it.
+func isArchive(name string, gz bool) bool {
+	if name == "-" {
+		log.Fatalf("The input of auto mode must be a file")
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && spgz.IsSegmented(name) {
+			return true
+		}
+		log.Fatalf("Could not open input file: %v", err)
+	}
+	defer file.Close()
+	info, err := spgz.Sniff(file)
+	if err != nil {
+		log.Fatalf("Could not read input file: %v", err)
+	}
+	switch info.Format {
+	case spgz.FormatUnknown:
+		return false
+	case spgz.FormatGzip, spgz.FormatBGZF:
+		return gz
+	}
+	return true
+}
+
+// openBase opens the base of a differential archive, returns nil if name is empty.
+func openBase(name string) spgz.Base {
+	if name == "" {
+		return nil
+	}
+	f, err := spgz.OpenFile(name, os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open base file: %v", err)
+	}
+	return f
+}
+
+type archive interface {
+	io.Reader
+	Size() (int64, error)
+	Close() error
+}
+
+// openArchive opens either a chunked archive or a regular one for reading. If gz is set a plain
+// gzip file is accepted as well, if raw is set an uncompressed file is read as is.
+func openArchive(name string, opts *spgz.Options, gz, raw bool) (archive, error) {
+	cf, err := spgz.OpenChunked(name)
+	if err == nil {
+		return cf, nil
+	}
+	if !errors.Is(err, spgz.ErrInvalidFormat) && !(errors.Is(err, os.ErrNotExist) && spgz.IsSegmented(name)) {
+		return nil, err
+	}
+	f, err := spgz.OpenFileOptions(name, os.O_RDONLY, 0666, opts)
+	if err != nil {
+		if (gz || raw) && errors.Is(err, spgz.ErrInvalidFormat) {
+			if uf, uerr := openUncompressed(name, gz, raw); uerr == nil {
+				return uf, nil
+			}
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+type rawFile struct {
+	*os.File
+}
+
+func (f rawFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// openUncompressed opens a file that is not an spgz archive: a gzip or BGZF file (if gz is set) or
+// anything else that isn't a known compressed format (if raw is set).
+func openUncompressed(name string, gz, raw bool) (archive, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := spgz.Sniff(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	switch {
+	case info.Format == spgz.FormatGzip && gz:
+		file.Close()
+		return spgz.OpenGzip(name)
+	case info.Format == spgz.FormatBGZF && gz:
+		file.Close()
+		return spgz.OpenBGZF(name)
+	case info.Format == spgz.FormatUnknown && raw:
+		log.Warnf("%s is not compressed, copying it verbatim", name)
+		return rawFile{file}, nil
+	}
+	file.Close()
+	return nil, spgz.ErrInvalidFormat
+}
+
+// restoreXattrs sets the extended attributes recorded in the archive on the extracted file.
+func restoreXattrs(f archive, name string, classes int) {
+	x, ok := f.(interface {
+		Xattrs() (map[string][]byte, error)
+	})
+	if !ok {
+		log.Warnf("The archive does not support extended attributes")
+		return
+	}
+	attrs, err := x.Xattrs()
+	if err != nil {
+		log.Fatalf("Could not read extended attributes: %v", err)
+	}
+	err = spgz.SetXattrs(name, spgz.FilterXattrs(attrs, classes))
+	if err != nil {
+		// E.g. SELinux contexts may not be settable without privileges
+		log.Warnf("Could not restore all extended attributes: %v", err)
+	}
+}
+
+// restoreFileAttrs sets the owner, the mode and the timestamps recorded in the archive on the
+// extracted file.
+func restoreFileAttrs(f archive, name string) {
+	x, ok := f.(interface {
+		FileAttrs() (*spgz.FileAttrs, error)
+	})
+	if !ok {
+		log.Warnf("The archive does not support file attributes")
+		return
+	}
+	attrs, err := x.FileAttrs()
+	if err != nil {
+		log.Fatalf("Could not read file attributes: %v", err)
+	}
+	if attrs == nil {
+		log.Warnf("No file attributes were recorded in the archive")
+		return
+	}
+	err = spgz.SetFileAttrs(name, attrs)
+	if err != nil {
+		// The owner can't be changed without privileges
+		log.Warnf("Could not restore all file attributes: %v", err)
+	}
+}
+
+// openStore returns the block store in the directory, nil if dir is empty.
+func openStore(dir string) spgz.BlockStore {
+	if dir == "" {
+		return nil
+	}
+	return spgz.NewDirStore(dir)
+}
+
+func doBuse(file, dev, replicate string, opts *spgz.Options) {
+	f, err := spgz.OpenFileOptions(file, os.O_RDWR, 0666, opts)
 	if err != nil {
 		log.Fatalf("Could not open file: %v", err)
 	}
@@ -196,17 +630,57 @@ func doBuse(file, dev string) {
 	if err != nil {
 		log.Fatalf("Could not create a device: %v", err)
 	}
+	if replicate != "" {
+		defer startReplication(f, replicate)()
+	}
+
+	runDevice(device)
+}
+
+func doUblk(file, replicate string, opts *spgz.Options) {
+	f, err := spgz.OpenFileOptions(file, os.O_RDWR, 0666, opts)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+	device, err := ublk.NewDevice(size, f)
+	if err != nil {
+		log.Fatalf("Could not create a device: %v", err)
+	}
+	log.Infof("Attached as %s", device.Path())
+	if replicate != "" {
+		stop := startReplication(f, replicate)
+		runDevice(device)
+		stop()
+	} else {
+		runDevice(device)
+	}
+
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
+
+type blockDevice interface {
+	Run() error
+	Disconnect()
+}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+func runDevice(device blockDevice) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	disc := make(chan error, 1)
 	go func() {
 		disc <- device.Run()
 	}()
 	select {
-	case <-sig:
-		// Received SIGTERM, cleanup
-		log.Infoln("SIGINT, disconnecting...")
+	case s := <-sig:
+		// Received SIGINT or SIGTERM, cleanup
+		log.Infof("%v, disconnecting...", s)
 		device.Disconnect()
 		err := <-disc
 		if err != nil {
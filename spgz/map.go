@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+// mapEntry is an entry of the output of qemu-img map --output=json. Since the blocks are
+// compressed there is no offset. Holes are not present unless they hide the data of a base.
+type mapEntry struct {
+	Start   int64 `json:"start"`
+	Length  int64 `json:"length"`
+	Depth   int   `json:"depth"`
+	Present bool  `json:"present"`
+	Zero    bool  `json:"zero"`
+	Data    bool  `json:"data"`
+}
+
+func cmdMap(args []string) {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	output := fs.String("output", "human", "Output format (human or json, as with qemu-img map)")
+	base := fs.String("base", "", "Base file of a differential archive")
+	storeDir := fs.String("store", "", "Block store directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *output != "human" && *output != "json" {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base:  openBase(*base),
+		Store: openStore(*storeDir),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	extents, err := f.Extents()
+	if err != nil {
+		log.Fatalf("Could not read the block map: %v", err)
+	}
+	names := []string{fs.Arg(0)}
+	if *base != "" {
+		names = append(names, *base)
+	} else if p := f.Parent(); p != "" {
+		names = append(names, p)
+	}
+	writeMap(os.Stdout, mapEntries(extents), *output == "json", names)
+}
+
+func mapEntries(extents []spgz.Extent) []mapEntry {
+	entries := make([]mapEntry, 0, len(extents))
+	for _, e := range extents {
+		entries = append(entries, mapEntry{
+			Start:   e.Start,
+			Length:  e.Length,
+			Depth:   e.Depth,
+			Present: e.Present,
+			Zero:    e.Zero,
+			Data:    !e.Zero,
+		})
+	}
+	return entries
+}
+
+// writeMap writes the entries as qemu-img map does. names are the names of the files in the chain
+// of bases, as far as they are known.
+func writeMap(w io.Writer, entries []mapEntry, asJSON bool, names []string) {
+	if asJSON {
+		fmt.Fprint(w, "[")
+		for i, e := range entries {
+			if i > 0 {
+				fmt.Fprint(w, ",\n")
+			}
+			b, _ := json.Marshal(&e)
+			fmt.Fprintf(w, "%s", b)
+		}
+		fmt.Fprint(w, "]\n")
+		return
+	}
+	fmt.Fprintf(w, "%-16s%-16s%s\n", "Offset", "Length", "File")
+	for _, e := range entries {
+		if e.Data {
+			name := fmt.Sprintf("(base at depth %d)", e.Depth)
+			if e.Depth < len(names) {
+				name = names[e.Depth]
+			}
+			fmt.Fprintf(w, "%-#16x%-#16x%s\n", e.Start, e.Length, name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dop251/spgz"
+)
+
+func TestMapJSON(t *testing.T) {
+	dir := t.TempDir()
+	base, err := spgz.OpenFileOptions(filepath.Join(dir, "base"), os.O_RDWR|os.O_CREATE, 0666, &spgz.Options{
+		BlockSize: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	bs := base.BlockSize()
+	// Data and a hole in the base, the archive replaces the data and adds data and a hole
+	data := make([]byte, 4*bs)
+	rand.New(rand.NewSource(1)).Read(data[:bs])
+	_, err = base.WriteAt(data[:2*bs], 0)
+	if err == nil {
+		err = base.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := spgz.OpenFileOptions(filepath.Join(dir, "diff"), os.O_RDWR|os.O_CREATE, 0666, &spgz.Options{
+		BlockSize: 4096,
+		Base:      base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rand.New(rand.NewSource(2)).Read(data[2*bs : 3*bs])
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := f.Extents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeMap(&buf, mapEntries(extents), true, nil)
+	expected := fmt.Sprintf(`[{"start":0,"length":%[1]d,"depth":1,"present":true,"zero":false,"data":true},
+{"start":%[1]d,"length":%[1]d,"depth":1,"present":false,"zero":true,"data":false},
+{"start":%[2]d,"length":%[1]d,"depth":0,"present":true,"zero":false,"data":true},
+{"start":%[3]d,"length":%[1]d,"depth":0,"present":false,"zero":true,"data":false}]
+`, bs, 2*bs, 3*bs)
+	if buf.String() != expected {
+		t.Fatalf("Unexpected output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdMaterialize(args []string) {
+	fs := flag.NewFlagSet("materialize", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base: openBase(fs.Arg(1)),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	out, err := spgz.OpenFileSize(fs.Arg(2), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666, f.BlockSize()+1)
+	if err != nil {
+		log.Fatalf("Could not open output file: %v", err)
+	}
+	err = f.Materialize(out)
+	if err != nil {
+		log.Fatalf("Materialize failed: %v", err)
+	}
+	err = out.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
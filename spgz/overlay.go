@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdOverlay(args []string) {
+	fs := flag.NewFlagSet("overlay", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	f, err := spgz.CreateOverlay(fs.Arg(0), fs.Arg(1), 0666)
+	if err != nil {
+		log.Fatalf("Could not create overlay: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
+
+func cmdFlatten(args []string) {
+	fs := flag.NewFlagSet("flatten", flag.ExitOnError)
+	baseName := fs.String("base", "", "Base of a differential archive")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDWR, 0666, &spgz.Options{
+		Base: openBase(*baseName),
+	})
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	err = f.Flatten()
+	if err != nil {
+		log.Fatalf("Flatten failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
+
+func cmdCommit(args []string) {
+	fs := flag.NewFlagSet("commit", flag.ExitOnError)
+	mergeParent := fs.Bool("merge-parent", false, "Merge the parent into the overlay instead")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDWR, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	if *mergeParent {
+		err = f.MergeParent()
+	} else {
+		err = f.Commit()
+	}
+	if err != nil {
+		log.Fatalf("Commit failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+// openReplica opens a copy of the content: an http(s) URL (e.g. of serve-http), a compressed
+// file or anything else, which is read as is.
+func openReplica(name string) io.ReaderAt {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		b, err := spgz.NewHTTPBase(name)
+		if err != nil {
+			log.Fatalf("Could not open replica: %v", err)
+		}
+		return b
+	}
+	if isArchive(name, false) {
+		f, err := spgz.OpenFile(name, os.O_RDONLY, 0666)
+		if err != nil {
+			log.Fatalf("Could not open replica: %v", err)
+		}
+		return f
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("Could not open replica: %v", err)
+	}
+	return f
+}
+
+func cmdRepair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	replica := fs.String("replica", "", "A copy of the content to take the damaged blocks from: another compressed file, a raw file or device, or an http(s) URL")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *replica == "" {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDWR, 0666)
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	repaired, err := f.RepairFrom(openReplica(*replica))
+	for _, num := range repaired {
+		log.Infof("Repaired block %d", num)
+	}
+	if err != nil {
+		log.Fatalf("Repair failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+	fmt.Printf("Repaired %d blocks\n", len(repaired))
+}
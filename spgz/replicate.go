@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+type replicator interface {
+	ChangeTracking() bool
+	Replicate(ctx context.Context, conn io.ReadWriter, opts *spgz.ReplicateOptions) error
+}
+
+// startReplication connects to a replicate-server and streams the changes of f to it until the
+// returned function is called, which sends the last changes and closes the connection.
+func startReplication(f replicator, remote string) func() {
+	if !f.ChangeTracking() {
+		log.Fatalf("Replication requires a file created with --track-changes")
+	}
+	conn, closeConn, err := dialRemote(remote, "replicate-server")
+	if err != nil {
+		log.Fatalf("Could not connect: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Replicate(ctx, conn, &spgz.ReplicateOptions{
+			OnRound: func(stats *spgz.DeltaStats) {
+				if stats.Changed > 0 {
+					log.Debugf("Replicated %d of %d blocks (%d bytes)", stats.Changed, stats.Blocks, stats.BytesSent)
+				}
+			},
+		})
+	}()
+	return func() {
+		cancel()
+		err := <-done
+		if err != nil && err != context.Canceled {
+			log.Errorf("Replication failed: %v", err)
+		}
+		err = closeConn()
+		if err != nil {
+			log.Warnf("Close failed: %v", err)
+		}
+	}
+}
+
+func cmdReplicateServer(args []string) {
+	fs := flag.NewFlagSet("replicate-server", flag.ExitOnError)
+	listen := fs.String("listen", "", "Accept a single connection on this address (or the socket passed by systemd) instead of using stdin/stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	name := fs.Arg(0)
+
+	conn, terminated := serverConn(*listen)
+
+	var f io.Closer
+	err := spgz.ReceiveReplication(conn, func(blockSize int64) (spgz.ReplicaTarget, error) {
+		if _, err := os.Stat(name); err == nil {
+			t, err := spgz.OpenFile(name, os.O_RDWR, 0666)
+			if err == nil {
+				f = t
+			}
+			return t, err
+		}
+		t, err := spgz.OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &spgz.Options{
+			BlockSize: blockSize + 1,
+		})
+		if err == nil {
+			f = t
+		}
+		return t, err
+	})
+	// The changes up to the last complete round have been synced, stopping is clean
+	if err != nil && !terminated() {
+		if f != nil {
+			f.Close()
+		}
+		log.Fatalf("Replication failed: %v", err)
+	}
+	if f != nil {
+		err = f.Close()
+		if err != nil {
+			log.Fatalf("Close failed: %v", err)
+		}
+	}
+}
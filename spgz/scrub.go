@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdScrub(args []string) {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	rate := fs.Int64("rate", 0, "Limit the scrub to this many bytes (of uncompressed data) per second, 0 means no limit")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of blocks to decode in parallel")
+	noRecord := fs.Bool("no-record", false, "Don't record the result in the header (the file is opened read-only)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	flags := os.O_RDWR
+	if *noRecord {
+		flags = os.O_RDONLY
+	}
+	f, err := spgz.OpenFile(fs.Arg(0), flags, 0666)
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+
+	var failed int
+	err = f.StartScrub(spgz.ScrubOptions{
+		Rate:   *rate,
+		Jobs:   *jobs,
+		Record: !*noRecord,
+		OnError: func(err error) {
+			log.Warnf("%v", err)
+			failed++
+		},
+	}).Wait()
+	if err != nil {
+		log.Fatalf("Scrub failed: %v", err)
+	}
+	if res := f.LastScrub(); res != nil && !*noRecord {
+		fmt.Printf("Checked %d blocks at %s, %d errors\n", res.Blocks, res.Time.Format(time.RFC3339), res.Errors)
+	}
+	if failed > 0 {
+		f.Close()
+		log.Fatalf("%d blocks could not be read", failed)
+	}
+}
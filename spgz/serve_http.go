@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdServeHTTP(args []string) {
+	fs := flag.NewFlagSet("serve-http", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to listen on (unless a socket is passed by systemd)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	name := fs.Arg(0)
+
+	f, err := spgz.OpenFile(name, os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		log.Fatalf("Could not stat file: %v", err)
+	}
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Prevent ServeContent from sniffing the content type
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// ServeContent takes care of Range, If-Range and conditional requests. Each request gets its
+		// own SectionReader so that concurrent clients do not share the file offset.
+		http.ServeContent(w, r, base, info.ModTime(), io.NewSectionReader(f, 0, size))
+	})
+
+	l, err := listenTCP(*listen)
+	if err != nil {
+		log.Fatalf("Could not listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler: handler,
+	}
+	stopped := make(chan struct{})
+	onTerminate(func(sig os.Signal) {
+		log.Infof("%v, finishing the requests in progress", sig)
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			log.Warnf("Shutdown failed: %v", err)
+		}
+		close(stopped)
+	})
+
+	log.Infof("Serving %s (%d bytes) on %s", name, size, l.Addr())
+	err = srv.Serve(l)
+	if err != http.ErrServerClosed {
+		log.Fatalf("Server failed: %v", err)
+	}
+	<-stopped
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdSparsify(args []string) {
+	fs := flag.NewFlagSet("sparsify", flag.ExitOnError)
+	blockSize := fs.Int64("block-size", 4096, "Granularity of the holes (should be a multiple of the filesystem block size)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *blockSize <= 0 {
+		usage()
+	}
+
+	file, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer file.Close()
+	sf := spgz.NewSparseFile(file)
+	size, err := sf.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+
+	chunk := (1024*1024 + *blockSize - 1) / *blockSize * *blockSize
+	buf := make([]byte, chunk)
+	var punched, zeroStart int64
+	zeroes := int64(0)
+	punch := func() {
+		if zeroes > 0 {
+			err := sf.PunchHole(zeroStart, zeroes)
+			if err != nil {
+				log.Fatalf("Could not punch hole: %v", err)
+			}
+			punched += zeroes
+			zeroes = 0
+		}
+	}
+	for offset := int64(0); offset < size; {
+		// Only the ranges of data are read, the holes are already there
+		data, err := sf.SeekData(offset)
+		if err != nil {
+			log.Fatalf("Seek failed: %v", err)
+		}
+		if data >= size {
+			break
+		}
+		hole, err := sf.SeekHole(data)
+		if err != nil {
+			log.Fatalf("Seek failed: %v", err)
+		}
+		punch()
+		for offset = data - data%*blockSize; offset < hole; {
+			b := buf
+			if l := hole - offset; int64(len(b)) > l {
+				b = b[:l]
+			}
+			n, err := sf.ReadAt(b, offset)
+			if err != nil && err != io.EOF {
+				log.Fatalf("Read failed: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+			for i := int64(0); i < int64(n); i += *blockSize {
+				blk := b[i:n]
+				if int64(len(blk)) > *blockSize {
+					blk = blk[:*blockSize]
+				}
+				if int64(len(blk)) == *blockSize && spgz.IsBlockZero(blk) {
+					if zeroes == 0 {
+						zeroStart = offset + i
+					}
+					zeroes += *blockSize
+				} else {
+					punch()
+				}
+			}
+			offset += int64(n)
+		}
+		if offset < hole {
+			break
+		}
+	}
+	punch()
+	err = file.Sync()
+	if err != nil {
+		log.Fatalf("Sync failed: %v", err)
+	}
+	log.Infof("Punched %d bytes", punched)
+}
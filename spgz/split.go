@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdSplit(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	size := fs.Int64("size", 4*1024*1024*1024-4096, "Segment size")
+	parity := fs.Int("parity", 0, "Number of parity segments per stripe (enables erasure coding)")
+	stripe := fs.Int("stripe", 4, "Number of data segments per stripe")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *size <= 0 || *parity < 0 || *stripe <= 0 {
+		usage()
+	}
+
+	err := spgz.SplitOptions(fs.Arg(0), &spgz.SegmentOptions{
+		Size:   *size,
+		Parity: *parity,
+		Stripe: *stripe,
+	})
+	if err != nil {
+		log.Fatalf("Split failed: %v", err)
+	}
+}
+
+func cmdJoin(args []string) {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	err := spgz.Join(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Join failed: %v", err)
+	}
+}
+
+func cmdRepairSegments(args []string) {
+	fs := flag.NewFlagSet("repair-segments", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	repaired, err := spgz.RepairSegments(fs.Arg(0))
+	for _, name := range repaired {
+		log.Infof("Rebuilt %s", name)
+	}
+	if err != nil {
+		log.Fatalf("Repair failed: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+// dialRemote connects to a server command (sync-server or replicate-server). The remote is either
+// tcp://host:port or [user@]host:path, in which case the server is started over ssh.
+func dialRemote(remote, server string) (io.ReadWriter, func() error, error) {
+	if strings.HasPrefix(remote, "tcp://") {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(remote, "tcp://"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.Close, nil
+	}
+	i := strings.IndexByte(remote, ':')
+	if i <= 0 {
+		usage()
+	}
+	// ssh passes the command to the remote shell
+	cmd := exec.Command("ssh", "--", remote[:i], "spgz", server, shellQuote(remote[i+1:]))
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdio{Reader: r, Writer: w}, func() error {
+		w.Close()
+		return cmd.Wait()
+	}, nil
+}
+
+// shellQuote returns s quoted for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func cmdSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDONLY, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("Could not get size: %v", err)
+	}
+
+	conn, closeConn, err := dialRemote(fs.Arg(1), "sync-server")
+	if err != nil {
+		log.Fatalf("Could not connect: %v", err)
+	}
+	stats, err := spgz.SendDelta(conn, f, size, f.BlockSize())
+	if err != nil {
+		log.Fatalf("Sync failed: %v", err)
+	}
+	err = closeConn()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+	log.Infof("Transferred %d of %d blocks (%d bytes)", stats.Changed, stats.Blocks, stats.BytesSent)
+}
+
+func cmdSyncServer(args []string) {
+	fs := flag.NewFlagSet("sync-server", flag.ExitOnError)
+	listen := fs.String("listen", "", "Accept a single connection on this address (or the socket passed by systemd) instead of using stdin/stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	f, err := spgz.OpenFile(fs.Arg(0), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+
+	conn, terminated := serverConn(*listen)
+	err = spgz.ReceiveDelta(conn, f)
+	if err != nil {
+		f.Close()
+		if terminated() {
+			log.Fatal("Sync interrupted")
+		}
+		log.Fatalf("Sync failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdVerifySample(args []string) {
+	fs := flag.NewFlagSet("verify-sample", flag.ExitOnError)
+	blocks := fs.Int("blocks", 1000, "Number of randomly chosen blocks to compare")
+	seed := fs.Int64("seed", 0, "Seed for choosing the blocks, to repeat an earlier check (a random one if 0)")
+	base := fs.String("base", "", "Base file of a differential archive")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	f, err := spgz.OpenFileOptions(fs.Arg(0), os.O_RDONLY, 0666, &spgz.Options{
+		Base: openBase(*base),
+	})
+	if err != nil {
+		log.Fatalf("Could not open compressed file: %v", err)
+	}
+	defer f.Close()
+	src, err := os.Open(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Could not open source: %v", err)
+	}
+	defer src.Close()
+	// Seek rather than Stat, so that block devices work
+	srcSize, err := src.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatalf("Could not determine the source size: %v", err)
+	}
+
+	r, err := f.VerifySample(src, srcSize, *blocks, *seed)
+	if err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+	fmt.Printf("Seed:              %d\n", r.Seed)
+	fmt.Printf("Blocks compared:   %d of %d\n", len(r.Blocks), (r.Size+f.BlockSize()-1)/f.BlockSize())
+	fmt.Printf("Mismatches:        %d\n", len(r.Mismatches))
+	for _, num := range r.Mismatches {
+		log.Warnf("Block %d (offset %d) does not match", num, num*f.BlockSize())
+	}
+	if r.Size != r.SourceSize {
+		log.Warnf("The size of the source (%d) differs from the size of the file (%d)", r.SourceSize, r.Size)
+	}
+	if !r.OK() {
+		f.Close()
+		src.Close()
+		os.Exit(1)
+	}
+}
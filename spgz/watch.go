@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dop251/spgz"
+)
+
+func cmdWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := fs.Duration("interval", 0, "How often to check the size and the modification time of the source (default 1s)")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	src, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Could not open source: %v", err)
+	}
+	defer src.Close()
+
+	f, err := spgz.OpenFile(fs.Arg(1), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		log.Fatalf("Could not open file: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = f.Watch(ctx, src, &spgz.WatchOptions{
+		Interval: *interval,
+		OnUpdate: func(stats *spgz.WatchStats) {
+			log.Infof("Updated %d of %d blocks, size %d", stats.Changed, stats.Blocks, stats.Size)
+		},
+	})
+	stop()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		f.Close()
+		log.Fatalf("Watch failed: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package spgz
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileInfo describes a file, see Stat().
+type FileInfo struct {
+	Size      int64 // logical size
+	FileSize  int64 // apparent size of the compressed file
+	Allocated int64 // space allocated for the compressed file, -1 if unknown
+	BlockSize int64
+
+	// ModTime is the modification time of the compressed file, zero if it's not known (e.g. it's
+	// not an *os.File).
+	ModTime time.Time
+
+	Codec         string // the compression of the blocks, always "gzip"
+	FormatVersion int    // 1 or 2
+
+	// Features lists the features of a version 2 file, as in Info
+	Features []string
+}
+
+// Stats describes the space usage of a file, see Stats().
+type Stats struct {
+	Size      int64 // logical size
+	FileSize  int64 // apparent size of the compressed file
+	Allocated int64 // space allocated for the compressed file, -1 if unknown
+
+	Blocks           int64
+	HoleBlocks       int64 // all-zero blocks, stored as holes
+	RawBlocks        int64 // stored uncompressed
+	CompressedBlocks int64
+	StoredBlocks     int64 // kept in a block store
+	BaseBlocks       int64 // read from the base or the parent
+	SharedBlocks     int64 // sharing the slot of an identical block, see dedup.go
+
+	// Ratio is Allocated divided by Size, 0 if Allocated is unknown or Size is 0.
+	Ratio float64
+}
+
+// Stat returns the sizes, the modification time and the format of the file. Unlike Stats() it
+// doesn't read the blocks.
+func (f *compFile) Stat() (*FileInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	fi := &FileInfo{
+		BlockSize:     f.blockSize,
+		Codec:         "gzip",
+		FormatVersion: f.version,
+		Features:      featureList(f.features),
+	}
+	fi.Size, err = f.size()
+	if err != nil {
+		return nil, err
+	}
+	fi.FileSize, err = f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	fi.Allocated = allocatedSize(f.f)
+	if sf, ok := f.f.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		st, err := sf.Stat()
+		if err != nil {
+			return nil, err
+		}
+		fi.ModTime = st.ModTime()
+	}
+	return fi, nil
+}
+
+// Stats returns the space usage of the file. It reads the type of every block and, for
+// uncompressed ones, the whole block to find out if it's a hole.
+func (f *compFile) Stats() (*Stats, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{}
+	s.Size, err = f.size()
+	if err != nil {
+		return nil, err
+	}
+	s.FileSize, err = f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	s.Allocated = allocatedSize(f.f)
+	if s.Allocated >= 0 && s.Size > 0 {
+		s.Ratio = float64(s.Allocated) / float64(s.Size)
+	}
+
+	s.Blocks = (s.Size + f.blockSize - 1) / f.blockSize
+	buf := make([]byte, f.blockSize+1)
+	for num := int64(0); num < s.Blocks; num++ {
+		if !f.isPresent(num) {
+			s.BaseBlocks++
+			continue
+		}
+		if _, isLink := f.links[num]; isLink {
+			s.SharedBlocks++
+			continue
+		}
+		typ, hole, err := f.slotType(num, buf)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case hole:
+			s.HoleBlocks++
+		case typ == blkUncompressed:
+			s.RawBlocks++
+		case typ == blkCompressed:
+			s.CompressedBlocks++
+		default:
+			s.StoredBlocks++
+		}
+	}
+	return s, nil
+}
+
+// slotType returns the type of the slot of block num (which must be present) and whether it's a
+// hole. buf must be at least BlockSize()+1 bytes long, it's used to read uncompressed slots.
+func (f *compFile) slotType(num int64, buf []byte) (typ byte, hole bool, err error) {
+	n, err := f.f.ReadAt(buf[:1], f.blockOffset(num))
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if n == 0 {
+		return blkUncompressed, true, nil
+	}
+	switch buf[0] {
+	case blkUncompressed:
+		n, err = f.f.ReadAt(buf[:f.blockSize+1], f.blockOffset(num))
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		return blkUncompressed, IsBlockZero(buf[1:n]), nil
+	case blkCompressed, blkStored:
+		return buf[0], false, nil
+	}
+	b := &block{
+		f:   f,
+		num: num,
+	}
+	return 0, false, b.wrapErr("load", b.corrupt(ErrInvalidFormat))
+}
@@ -0,0 +1,70 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	f, err := OpenFileSize(filepath.Join(t.TempDir(), "stats.spgz"), os.O_RDWR|os.O_CREATE, 0666, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	bs := f.BlockSize()
+	data := make([]byte, 4*bs+100)
+	rand.New(rand.NewSource(1)).Read(data[:bs])
+	copy(data[2*bs:], bytes.Repeat([]byte("stats"), int(bs)/5))
+	data[len(data)-1] = 1
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := f.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != int64(len(data)) || s.Blocks != 5 {
+		t.Fatalf("Unexpected size: %+v", s)
+	}
+	// The last block is short and doesn't compress well enough
+	if s.RawBlocks != 2 || s.CompressedBlocks != 1 || s.HoleBlocks != 2 {
+		t.Fatalf("Unexpected block counts: %+v", s)
+	}
+	if s.Allocated <= bs || s.Allocated >= int64(len(data)) || s.Ratio <= 0 || s.Ratio >= 1 {
+		t.Fatalf("Unexpected allocation: %+v", s)
+	}
+}
+
+func TestStat(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "stat.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{ChangeTracking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt([]byte("data"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size != 1004 || fi.FileSize != st.Size() || fi.BlockSize != f.BlockSize() || !fi.ModTime.Equal(st.ModTime()) {
+		t.Fatalf("Unexpected info: %+v", fi)
+	}
+	if fi.Codec != "gzip" || fi.FormatVersion != 2 || len(fi.Features) != 1 || fi.Features[0] != "change-tracking" {
+		t.Fatalf("Unexpected format: %+v", fi)
+	}
+}
@@ -0,0 +1,89 @@
+package spgz
+
+import (
+	"io"
+)
+
+// Tuning of the streaming paths. ReadFrom() normally fills a block with as many reads from the
+// source as it takes and WriteTo() writes a block (or the rest of it) at a time. With
+// Options.ReadChunkSize and WriteChunkSize the sizes of the reads and writes are set explicitly,
+// e.g. to match the preferred I/O size of the storage. With Options.PipelineDepth WriteTo()
+// decompresses the next blocks in the background, so that decompression and writing overlap.
+
+// sizedReader makes reads of at most size bytes from r.
+type sizedReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c *sizedReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.r.Read(p)
+}
+
+type prefetched struct {
+	b   *block
+	err error
+}
+
+// prefetcher loads the blocks from the current offset to the end of the file in the background,
+// up to depth of them ahead of the consumer. It must only be used while the file is locked, so
+// that the blocks don't change, and closed before the lock is released.
+type prefetcher struct {
+	queue chan chan prefetched
+	stop  chan struct{}
+}
+
+func (f *compFile) startPrefetch(depth int) (*prefetcher, error) {
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.size()
+	if err != nil {
+		return nil, err
+	}
+	p := &prefetcher{
+		queue: make(chan chan prefetched, depth),
+		stop:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.queue)
+		for num := f.offset / f.blockSize; num*f.blockSize < size; num++ {
+			ch := make(chan prefetched, 1)
+			select {
+			case p.queue <- ch:
+			case <-p.stop:
+				return
+			}
+			go func(num int64) {
+				b := &block{
+					f: f,
+				}
+				err := b.load(num)
+				ch <- prefetched{b, err}
+			}(num)
+		}
+	}()
+	return p, nil
+}
+
+// next returns the next block or io.EOF after the last one.
+func (p *prefetcher) next() (*block, error) {
+	ch, ok := <-p.queue
+	if !ok {
+		return nil, io.EOF
+	}
+	r := <-ch
+	return r.b, r.err
+}
+
+// close stops loading and waits for the blocks that are being loaded.
+func (p *prefetcher) close() {
+	close(p.stop)
+	for ch := range p.queue {
+		<-ch
+	}
+}
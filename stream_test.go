@@ -0,0 +1,129 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type sizeRecorder struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (r *sizeRecorder) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.Buffer.Read(p)
+}
+
+func (r *sizeRecorder) Write(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.Buffer.Write(p)
+}
+
+func TestChunkSizes(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{
+		BlockSize:      64 * 1024,
+		ReadChunkSize:  1000,
+		WriteChunkSize: 10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*f.BlockSize()+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	src := &sizeRecorder{}
+	src.Write(data)
+	_, err = f.ReadFrom(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range src.sizes[1:] {
+		if s > 1000 {
+			t.Fatalf("Read of %d bytes", s)
+		}
+	}
+
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &sizeRecorder{}
+	_, err = f.WriteTo(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range dst.sizes {
+		if s != 10000 && i != len(dst.sizes)-1 {
+			t.Fatalf("Write of %d bytes", s)
+		}
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Fatal("Data mismatch")
+	}
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n--; w.n < 0 {
+		return 0, errors.New("failed")
+	}
+	return len(p), nil
+}
+
+func TestPipeline(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "pipeline.spgz")
+	f, err := OpenFileSize(name, os.O_RDWR|os.O_CREATE, 0666, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := bytes.Repeat([]byte("pipeline"), int(10*bs+100)/8)
+	rand.New(rand.NewSource(1)).Read(data[3*bs : 4*bs])
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDONLY, 0, &Options{
+		PipelineDepth: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Seek(100, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)-100) || !bytes.Equal(buf.Bytes(), data[100:]) {
+		t.Fatal("Data mismatch")
+	}
+
+	// The prefetching stops if the destination fails
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteTo(&failingWriter{n: 2})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,91 @@
+package spgz
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ErrTornTail = errors.New("The final block is damaged, use Options.RepairTail to remove it")
+)
+
+// checkTail is called when a file is opened for writing. The final block is the one that is most
+// likely to be damaged by a crash because it's the one that is appended to, so it's decoded
+// upfront. If it can't be decoded, either ErrTornTail is returned (wrapping the reason) or, with
+// repair, the block is removed so that the file ends at the last good block boundary. Blocks
+// that share its slot through deduplication become zero blocks.
+func (f *compFile) checkTail(repair bool) error {
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if o <= f.dataOffset {
+		return nil
+	}
+	num := (o - f.dataOffset) / (f.blockSize + 1)
+	if !f.isPresent(num) {
+		return nil
+	}
+	b := &block{
+		f: f,
+	}
+	err = b.load(num)
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	var ce *ErrCorruptBlock
+	if !errors.As(err, &ce) && !errors.Is(err, ErrInvalidFormat) {
+		return err
+	}
+	if !repair {
+		return fmt.Errorf("%w: %w", ErrTornTail, err)
+	}
+	if f.log != nil {
+		f.log.Warn("spgz: removing damaged final block", "file", f.name, "block", num, "err", err)
+	}
+	if _, isLink := f.links[num]; isLink {
+		err = f.release(num)
+	} else {
+		err = f.dropDamaged(num)
+	}
+	if err != nil {
+		return err
+	}
+	err = f.markChanged(num, num+1)
+	if err != nil {
+		return err
+	}
+	return f.truncateFile(f.blockOffset(num))
+}
+
+// dropDamaged removes the damaged block num from the dedup table. Nothing can be recovered from
+// its slot, so rather than moving the data (see release()) the blocks that share the slot are
+// unlinked. Their own slots are holes, so they become zero blocks.
+func (f *compFile) dropDamaged(num int64) error {
+	digest, exists := f.digests[num]
+	if !exists {
+		return nil
+	}
+	refs := f.refs[num]
+	if len(refs) > 0 && f.log != nil {
+		f.log.Warn("spgz: zeroing blocks that share the slot of the damaged block", "file", f.name, "block", num, "blocks", refs)
+	}
+	for _, r := range refs {
+		delete(f.digests, r)
+		delete(f.links, r)
+		err := f.writeDedupEntry(r, [sha256.Size]byte{}, -1)
+		if err == nil {
+			err = f.markChanged(r, r+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	delete(f.refs, num)
+	delete(f.owners, digest)
+	delete(f.digests, num)
+	return f.writeDedupEntry(num, [sha256.Size]byte{}, -1)
+}
@@ -0,0 +1,178 @@
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTornTail(t *testing.T) {
+	var sf memSparseFile
+	open := func(flag int, repair bool) (*compFile, error) {
+		sf.Seek(0, os.SEEK_SET)
+		return NewFromSparseFileOptions(&sf, flag, &Options{
+			BlockSize:  64 * 1024,
+			RepairTail: repair,
+		})
+	}
+	f, err := open(os.O_RDWR|os.O_CREATE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := bytes.Repeat([]byte("compressible "), int(3*bs/13))
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of appending the last block
+	sf.data = sf.data[:len(sf.data)-16]
+
+	_, err = open(os.O_RDWR, false)
+	if !errors.Is(err, ErrTornTail) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var logBuf bytes.Buffer
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+		RepairTail: true,
+		Logger:     slog.New(slog.NewTextHandler(&logBuf, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logBuf.String(), "removing damaged final block") || !strings.Contains(logBuf.String(), "block=2") {
+		t.Fatalf("The repair was not logged: %q", logBuf.String())
+	}
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2*bs {
+		t.Fatalf("Unexpected size: %d", size)
+	}
+	buf := make([]byte, size)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[:size]) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only opens are not checked
+	f, err = open(os.O_RDONLY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestTornTailDedup(t *testing.T) {
+	var sf memSparseFile
+	open := func(flag int) (*compFile, error) {
+		sf.Seek(0, os.SEEK_SET)
+		return NewFromSparseFileOptions(&sf, flag, &Options{
+			BlockSize:  64 * 1024,
+			Dedup:      true,
+			RepairTail: true,
+		})
+	}
+	f, err := open(os.O_RDWR | os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := bytes.Repeat([]byte("compressible "), int(bs/13)+1)[:bs]
+	// Block 1 shares the slot of block 5, which is the final one
+	_, err = f.WriteAt(data, 5*bs)
+	if err == nil {
+		_, err = f.WriteAt(data, bs)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared, _ := f.DedupStats(); shared != 1 {
+		t.Fatalf("Unexpected number of shared blocks: %d", shared)
+	}
+
+	// Damage the type byte of the final slot
+	sf.data[f.blockOffset(5)] = 0xff
+
+	for i := 0; i < 2; i++ {
+		f, err = open(os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := f.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 5*bs {
+			t.Fatalf("Unexpected size: %d", size)
+		}
+		buf := make([]byte, size)
+		_, err = f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsBlockZero(buf) {
+			t.Fatal("The blocks that shared the damaged slot are not zeroed")
+		}
+		if shared, distinct := f.DedupStats(); shared != 0 || distinct != 0 {
+			t.Fatalf("Unexpected dedup stats: %d, %d", shared, distinct)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The slot can be used again
+	f, err = open(os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(data, 2*bs)
+	if err == nil {
+		_, err = f.WriteAt(data, 3*bs)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared, _ := f.DedupStats(); shared != 1 {
+		t.Fatalf("Unexpected number of shared blocks after the repair: %d", shared)
+	}
+	f, err = open(os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*bs)
+	_, err = f.ReadAt(buf, 2*bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:bs], data) || !bytes.Equal(buf[bs:], data) {
+		t.Fatal("Data mismatch")
+	}
+	f.Close()
+}
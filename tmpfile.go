@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// O_TMPFILE as defined on most architectures (__O_TMPFILE | O_DIRECTORY)
+	O_TMPFILE = 0x410000
+
+	AT_FDCWD          = -100
+	AT_SYMLINK_FOLLOW = 0x400
+)
+
+var (
+	ErrTmpFileNotSupported = errors.New("This filesystem does not support unnamed temporary files")
+)
+
+// CreateUnnamed creates a file in dir that has no name (using O_TMPFILE) until LinkUnnamed() gives
+// it one, so that nothing is left behind if the process dies before. Returns
+// ErrTmpFileNotSupported if the kernel or the filesystem doesn't support it.
+func CreateUnnamed(dir string, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(dir, os.O_RDWR|O_TMPFILE, perm)
+	if err != nil {
+		// Kernels without O_TMPFILE see an attempt to open a directory for writing
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EISDIR) {
+			return nil, ErrTmpFileNotSupported
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// LinkUnnamed links a file created by CreateUnnamed() into the directory tree under name. It
+// fails if name exists.
+func LinkUnnamed(f *os.File, name string) error {
+	oldpath, err := syscall.BytePtrFromString(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		return err
+	}
+	newpath, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	atFdcwd := AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(atFdcwd), uintptr(unsafe.Pointer(oldpath)),
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(newpath)), AT_SYMLINK_FOLLOW, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "link", Old: f.Name(), New: name, Err: errno}
+	}
+	return nil
+}
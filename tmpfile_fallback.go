@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrTmpFileNotSupported = errors.New("Unnamed temporary files are not supported on this platform")
+)
+
+func CreateUnnamed(dir string, perm os.FileMode) (*os.File, error) {
+	return nil, ErrTmpFileNotSupported
+}
+
+func LinkUnnamed(f *os.File, name string) error {
+	return ErrTmpFileNotSupported
+}
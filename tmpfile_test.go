@@ -0,0 +1,53 @@
+package spgz
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateUnnamed(t *testing.T) {
+	dir := t.TempDir()
+	file, err := CreateUnnamed(dir, 0666)
+	if err == ErrTmpFileNotSupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFromFile(file, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("unnamed"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("Unexpected directory entries: %v", entries)
+	}
+
+	name := filepath.Join(dir, "named.spgz")
+	err = LinkUnnamed(file, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LinkUnnamed(file, name); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f1, err := OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	data, err := io.ReadAll(f1)
+	if err != nil || string(data) != "unnamed" {
+		t.Fatalf("Unexpected data: %q, %v", data, err)
+	}
+}
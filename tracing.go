@@ -0,0 +1,44 @@
+package spgz
+
+import (
+	"io"
+)
+
+// Tracer receives spans for block operations, see SetTracer. The operations are "load", "store",
+// "compress" and "punch". num is the block number, or -1 if a hole is punched outside the blocks.
+// An adapter for OpenTelemetry only needs to start a span with a block number attribute and
+// record the error when it ends.
+type Tracer interface {
+	Start(op string, num int64) Span
+}
+
+// Span is an operation in progress. End is called with the error the operation failed with or nil.
+type Span interface {
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(error) {}
+
+// SetTracer makes the file report spans to t, nil disables tracing.
+func (f *compFile) SetTracer(t Tracer) {
+	f.Lock()
+	f.tracer = t
+	f.Unlock()
+}
+
+func (f *compFile) startSpan(op string, num int64) Span {
+	if f.tracer == nil {
+		return nopSpan{}
+	}
+	return f.tracer.Start(op, num)
+}
+
+// endLoadSpan ends the span of a load which returns io.EOF for blocks beyond the end of the file.
+func endLoadSpan(span Span, err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	span.End(err)
+}
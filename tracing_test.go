@@ -0,0 +1,53 @@
+package spgz
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+type testTracer struct {
+	spans []string
+}
+
+type testSpan struct {
+	t    *testTracer
+	name string
+}
+
+func (t *testTracer) Start(op string, num int64) Span {
+	return &testSpan{
+		t:    t,
+		name: fmt.Sprintf("%s %d", op, num),
+	}
+}
+
+func (s *testSpan) End(err error) {
+	if err != nil {
+		s.name += " " + err.Error()
+	}
+	s.t.spans = append(s.t.spans, s.name)
+}
+
+func TestTracer(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracer testTracer
+	f.SetTracer(&tracer)
+
+	_, err = f.WriteAt([]byte("trace"), f.BlockSize()+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"load 1", "compress 1", "store 1"}
+	if fmt.Sprint(tracer.spans) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected spans: %v", tracer.spans)
+	}
+}
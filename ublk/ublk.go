@@ -0,0 +1,483 @@
+//go:build linux
+// +build linux
+
+// Package ublk exposes a random access backend (such as an spgz file) as a local block device
+// using the Linux userspace block driver (ublk, kernel 6.0+, requires the ublk_drv module).
+package ublk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	ctrlDevice = "/dev/ublk-control"
+
+	cmdAddDev    = 0x04
+	cmdDelDev    = 0x05
+	cmdStartDev  = 0x06
+	cmdStopDev   = 0x07
+	cmdSetParams = 0x08
+
+	ioFetchReq          = 0x20
+	ioCommitAndFetchReq = 0x21
+
+	ioOpRead        = 0
+	ioOpWrite       = 1
+	ioOpFlush       = 2
+	ioOpDiscard     = 3
+	ioOpWriteSame   = 4
+	ioOpWriteZeroes = 5
+
+	attrVolatileCache = 1 << 2
+
+	paramTypeBasic   = 1 << 0
+	paramTypeDiscard = 1 << 1
+
+	ctrlCmdSize = 32
+	ioCmdSize   = 16
+	ioDescSize  = 24
+	devInfoSize = 64
+	paramsSize  = 64
+
+	queueDepth = 64
+	maxIOBuf   = 512 * 1024
+
+	wakeTag = ^uint64(0)
+)
+
+var (
+	ErrNotAvailable = errors.New("ublk is not available (is the ublk_drv module loaded?)")
+)
+
+// Backend is the storage behind a Device. If it also implements PunchHole(offset, size int64) error,
+// discard and write-zeroes requests are passed to it, otherwise discards are ignored and zeroes are written.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+type holePuncher interface {
+	PunchHole(offset, size int64) error
+}
+
+type Device struct {
+	size    int64
+	backend Backend
+
+	ctrlMu  sync.Mutex
+	ctrl    *ring
+	ctrlFd  int
+	ctrlBuf []byte
+	legacy  bool
+
+	id     uint32
+	charFd int
+	q      *ring
+	descs  []byte
+	bufs   []byte
+	zeroes []byte
+
+	// The queue goroutine keeps a read of wakeFd queued, see wake
+	wakeFd  int
+	wakeBuf [8]byte
+
+	stopping int32
+	done     chan struct{}
+	err      error
+}
+
+func iowr(nr, size uint32) uint32 {
+	return 3<<30 | size<<16 | 'u'<<8 | nr
+}
+
+// NewDevice creates a ublk device of the given size (rounded down to 512 bytes) backed by backend.
+// The device node appears once Run is called.
+func NewDevice(size int64, backend Backend) (*Device, error) {
+	ctrlFd, err := syscall.Open(ctrlDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil, ErrNotAvailable
+		}
+		return nil, err
+	}
+
+	d := &Device{
+		size:    size &^ 511,
+		backend: backend,
+		ctrlFd:  ctrlFd,
+		ctrlBuf: make([]byte, devInfoSize+paramsSize),
+		charFd:  -1,
+		wakeFd:  -1,
+		done:    make(chan struct{}),
+	}
+
+	d.ctrl, err = newRing(4, ioringSetupSQE128)
+	if err != nil {
+		syscall.Close(ctrlFd)
+		return nil, err
+	}
+
+	err = d.addDev()
+	if err == syscall.EINVAL {
+		// Kernels before 6.4 only understand the plain opcodes
+		d.legacy = true
+		err = d.addDev()
+	}
+	if err != nil {
+		d.closeCtrl()
+		return nil, err
+	}
+
+	err = d.setParams()
+	if err == nil {
+		err = d.openQueue()
+	}
+	if err != nil {
+		d.ctrlCmd(cmdDelDev, 0, nil)
+		d.closeQueue()
+		d.closeCtrl()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Path returns the path of the block device node.
+func (d *Device) Path() string {
+	return fmt.Sprintf("/dev/ublkb%d", d.id)
+}
+
+// encodeCtrlCmd fills in struct ublksrv_ctrl_cmd.
+func encodeCtrlCmd(cmd []byte, id uint32, data uint64, buf []byte) {
+	binary.LittleEndian.PutUint32(cmd[0:], id)
+	binary.LittleEndian.PutUint16(cmd[4:], 0xffff) // queue_id, none
+	if buf != nil {
+		binary.LittleEndian.PutUint16(cmd[6:], uint16(len(buf)))
+		binary.LittleEndian.PutUint64(cmd[8:], uint64(uintptr(unsafe.Pointer(&buf[0]))))
+	}
+	binary.LittleEndian.PutUint64(cmd[16:], data)
+}
+
+// encodeIOCmd fills in struct ublksrv_io_cmd for the first (and only) queue.
+func encodeIOCmd(cmd []byte, tag uint16, result int32, buf []byte) {
+	binary.LittleEndian.PutUint16(cmd[2:], tag)
+	binary.LittleEndian.PutUint32(cmd[4:], uint32(result))
+	binary.LittleEndian.PutUint64(cmd[8:], uint64(uintptr(unsafe.Pointer(&buf[0]))))
+}
+
+// encodeParams fills in struct ublk_params for a device of size bytes.
+func encodeParams(p []byte, size int64) {
+	for i := range p {
+		p[i] = 0
+	}
+	binary.LittleEndian.PutUint32(p[0:], paramsSize)
+	binary.LittleEndian.PutUint32(p[4:], paramTypeBasic|paramTypeDiscard)
+
+	basic := p[8:40]
+	binary.LittleEndian.PutUint32(basic[0:], attrVolatileCache)
+	basic[4] = 9  // logical_bs_shift
+	basic[5] = 12 // physical_bs_shift
+	basic[6] = 12 // io_opt_shift
+	basic[7] = 9  // io_min_shift
+	binary.LittleEndian.PutUint32(basic[8:], maxIOBuf>>9)
+	binary.LittleEndian.PutUint64(basic[16:], uint64(size>>9))
+
+	discard := p[40:60]
+	binary.LittleEndian.PutUint32(discard[4:], 4096)
+	binary.LittleEndian.PutUint32(discard[8:], ^uint32(0)>>9)
+	binary.LittleEndian.PutUint32(discard[12:], ^uint32(0)>>9)
+	binary.LittleEndian.PutUint16(discard[16:], 1)
+}
+
+func (d *Device) ctrlCmd(op uint32, data uint64, buf []byte) error {
+	var cmd [ctrlCmdSize]byte
+	encodeCtrlCmd(cmd[:], d.id, data, buf)
+
+	if !d.legacy {
+		op = iowr(op, ctrlCmdSize)
+	}
+
+	d.ctrlMu.Lock()
+	defer d.ctrlMu.Unlock()
+	if !d.ctrl.uringCmd(d.ctrlFd, op, cmd[:], 0) {
+		return syscall.EBUSY
+	}
+	err := d.ctrl.enter(1)
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return err
+	}
+	_, res, ok := d.ctrl.reap()
+	if !ok {
+		return syscall.EIO
+	}
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+func (d *Device) addDev() error {
+	info := d.ctrlBuf[:devInfoSize]
+	for i := range info {
+		info[i] = 0
+	}
+	binary.LittleEndian.PutUint16(info[0:], 1)          // nr_hw_queues
+	binary.LittleEndian.PutUint16(info[2:], queueDepth) // queue_depth
+	binary.LittleEndian.PutUint32(info[8:], maxIOBuf)   // max_io_buf_bytes
+	binary.LittleEndian.PutUint32(info[12:], ^uint32(0))
+	d.id = ^uint32(0)
+
+	err := d.ctrlCmd(cmdAddDev, 0, info)
+	if err != nil {
+		return err
+	}
+	d.id = binary.LittleEndian.Uint32(info[12:])
+	return nil
+}
+
+func (d *Device) setParams() error {
+	p := d.ctrlBuf[devInfoSize:]
+	encodeParams(p, d.size)
+	return d.ctrlCmd(cmdSetParams, 0, p)
+}
+
+func (d *Device) openQueue() error {
+	name := fmt.Sprintf("/dev/ublkc%d", d.id)
+	var err error
+	// The character device is created asynchronously by udev
+	for i := 0; i < 50; i++ {
+		d.charFd, err = syscall.Open(name, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if err != syscall.ENOENT {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		d.charFd = -1
+		return err
+	}
+
+	pageSize := os.Getpagesize()
+	descSize := (queueDepth*ioDescSize + pageSize - 1) / pageSize * pageSize
+	d.descs, err = syscall.Mmap(d.charFd, 0, descSize, syscall.PROT_READ, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+
+	// Buffers are handed to the kernel by address, so they must live outside of the Go heap
+	d.bufs, err = syscall.Mmap(-1, 0, queueDepth*maxIOBuf, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return errno
+	}
+	d.wakeFd = int(fd)
+
+	d.q, err = newRing(queueDepth*2, 0)
+	return err
+}
+
+func (d *Device) closeQueue() {
+	if d.q != nil {
+		d.q.close()
+		d.q = nil
+	}
+	if d.bufs != nil {
+		syscall.Munmap(d.bufs)
+		d.bufs = nil
+	}
+	if d.descs != nil {
+		syscall.Munmap(d.descs)
+		d.descs = nil
+	}
+	if d.charFd != -1 {
+		syscall.Close(d.charFd)
+		d.charFd = -1
+	}
+	if d.wakeFd != -1 {
+		syscall.Close(d.wakeFd)
+		d.wakeFd = -1
+	}
+}
+
+func (d *Device) closeCtrl() {
+	d.ctrl.close()
+	syscall.Close(d.ctrlFd)
+}
+
+func (d *Device) buf(tag uint16) []byte {
+	return d.bufs[int(tag)*maxIOBuf : int(tag+1)*maxIOBuf]
+}
+
+func (d *Device) ioCmd(op uint32, tag uint16, result int32) bool {
+	var cmd [ioCmdSize]byte
+	encodeIOCmd(cmd[:], tag, result, d.buf(tag))
+	if !d.legacy {
+		op = iowr(op, ioCmdSize)
+	}
+	return d.q.uringCmd(d.charFd, op, cmd[:], uint64(tag))
+}
+
+// serve runs the queue. It must stay on one OS thread, because the driver binds the queue
+// to the task that issued the first FETCH_REQ.
+func (d *Device) serve(ready chan<- error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(d.done)
+
+	for tag := uint16(0); tag < queueDepth; tag++ {
+		d.ioCmd(ioFetchReq, tag, 0)
+	}
+	d.q.read(d.wakeFd, d.wakeBuf[:], wakeTag)
+	err := d.q.enter(0)
+	ready <- err
+	if err != nil {
+		return
+	}
+
+	active := queueDepth
+	for active > 0 {
+		err = d.q.enter(1)
+		if err != nil {
+			d.err = err
+			return
+		}
+		for {
+			userData, res, ok := d.q.reap()
+			if !ok {
+				break
+			}
+			if userData == wakeTag {
+				if atomic.LoadInt32(&d.stopping) != 0 {
+					return
+				}
+				d.q.read(d.wakeFd, d.wakeBuf[:], wakeTag)
+				continue
+			}
+			if res == -int32(syscall.ENODEV) {
+				// UBLK_IO_RES_ABORT, the device is going away
+				active--
+				continue
+			}
+			if res < 0 {
+				d.err = syscall.Errno(-res)
+				return
+			}
+			tag := uint16(userData)
+			d.ioCmd(ioCommitAndFetchReq, tag, d.handle(tag))
+		}
+	}
+}
+
+func (d *Device) handle(tag uint16) int32 {
+	desc := d.descs[int(tag)*ioDescSize:]
+	op := binary.LittleEndian.Uint32(desc[0:]) & 0xff
+	n := int64(binary.LittleEndian.Uint32(desc[4:])) << 9
+	off := int64(binary.LittleEndian.Uint64(desc[8:])) << 9
+
+	var err error
+	switch op {
+	case ioOpRead:
+		buf := d.buf(tag)[:n]
+		var r int
+		r, err = d.backend.ReadAt(buf, off)
+		if err == io.EOF {
+			for i := r; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			err = nil
+		}
+	case ioOpWrite:
+		_, err = d.backend.WriteAt(d.buf(tag)[:n], off)
+	case ioOpFlush:
+		err = d.backend.Sync()
+	case ioOpDiscard, ioOpWriteZeroes:
+		if p, ok := d.backend.(holePuncher); ok {
+			err = p.PunchHole(off, n)
+		} else if op == ioOpWriteZeroes {
+			err = d.writeZeroes(off, n)
+		}
+		n = 0
+	default:
+		return -int32(syscall.EOPNOTSUPP)
+	}
+	if err != nil {
+		return -int32(syscall.EIO)
+	}
+	if op == ioOpFlush {
+		return 0
+	}
+	return int32(n)
+}
+
+func (d *Device) writeZeroes(off, n int64) error {
+	if d.zeroes == nil {
+		d.zeroes = make([]byte, maxIOBuf)
+	}
+	for n > 0 {
+		l := n
+		if l > maxIOBuf {
+			l = maxIOBuf
+		}
+		_, err := d.backend.WriteAt(d.zeroes[:l], off)
+		if err != nil {
+			return err
+		}
+		off += l
+		n -= l
+	}
+	return nil
+}
+
+// Run starts the device and serves requests until Disconnect is called.
+// The device is removed before Run returns.
+func (d *Device) Run() error {
+	ready := make(chan error, 1)
+	go d.serve(ready)
+	err := <-ready
+	if err == nil {
+		err = d.ctrlCmd(cmdStartDev, uint64(os.Getpid()), nil)
+		if err != nil {
+			d.wake()
+		}
+	}
+	<-d.done
+	if err == nil {
+		err = d.err
+	}
+
+	d.closeQueue()
+	d.ctrlCmd(cmdDelDev, 0, nil)
+	d.closeCtrl()
+	return err
+}
+
+// wake makes the queue goroutine return. Only that goroutine submits to the queue ring, so it's
+// woken through the eventfd it's reading.
+func (d *Device) wake() {
+	atomic.StoreInt32(&d.stopping, 1)
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	syscall.Write(d.wakeFd, one[:])
+}
+
+// Disconnect stops the device, causing Run to return.
+func (d *Device) Disconnect() {
+	d.ctrlCmd(cmdStopDev, 0, nil)
+	d.wake()
+}
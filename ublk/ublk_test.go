@@ -0,0 +1,211 @@
+//go:build linux
+// +build linux
+
+package ublk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testRing(t *testing.T, entries, flags uint32) *ring {
+	r, err := newRing(entries, flags)
+	if err != nil {
+		if err == syscall.ENOSYS || err == syscall.EPERM {
+			t.Skipf("io_uring is not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+	t.Cleanup(r.close)
+	return r
+}
+
+func TestRing(t *testing.T) {
+	r := testRing(t, 4, 0)
+	for i := uint64(0); i < 4; i++ {
+		if !r.nop(i) {
+			t.Fatalf("Could not queue entry %d", i)
+		}
+	}
+	if r.nop(4) {
+		t.Fatal("Queued more entries than the ring has")
+	}
+	err := r.enter(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 4; i++ {
+		userData, res, ok := r.reap()
+		if !ok || userData != i || res != 0 {
+			t.Fatalf("Unexpected completion: %d, %d, %v", userData, res, ok)
+		}
+	}
+	if _, _, ok := r.reap(); ok {
+		t.Fatal("Unexpected completion")
+	}
+	if !r.nop(5) {
+		t.Fatal("The submitted entries were not released")
+	}
+}
+
+func TestRingUringCmd(t *testing.T) {
+	r := testRing(t, 4, ioringSetupSQE128)
+	if r.sqeSize != 128 {
+		t.Fatalf("Unexpected SQE size: %d", r.sqeSize)
+	}
+	cmd := bytes.Repeat([]byte{0xaa}, ctrlCmdSize)
+	if !r.uringCmd(7, 0x12345678, cmd, 42) {
+		t.Fatal("Could not queue")
+	}
+	sqe := r.sqes[:r.sqeSize]
+	if sqe[0] != ioringOpUringCmd || binary.LittleEndian.Uint32(sqe[4:]) != 7 ||
+		binary.LittleEndian.Uint32(sqe[8:]) != 0x12345678 || binary.LittleEndian.Uint64(sqe[32:]) != 42 {
+		t.Fatalf("Unexpected SQE: %x", sqe[:48])
+	}
+	if !bytes.Equal(sqe[48:48+ctrlCmdSize], cmd) || !bytes.Equal(sqe[48+ctrlCmdSize:], make([]byte, r.sqeSize-48-ctrlCmdSize)) {
+		t.Fatalf("Unexpected command payload: %x", sqe[48:])
+	}
+}
+
+// TestRingWake checks the mechanism Device.wake relies on: a read of an eventfd queued by the
+// goroutine that waits for completions is completed by a write from another one.
+func TestRingWake(t *testing.T) {
+	r := testRing(t, 4, 0)
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer syscall.Close(int(fd))
+	var buf [8]byte
+	r.read(int(fd), buf[:], wakeTag)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		var one [8]byte
+		binary.LittleEndian.PutUint64(one[:], 1)
+		syscall.Write(int(fd), one[:])
+	}()
+	err := r.enter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userData, res, ok := r.reap()
+	if !ok || userData != wakeTag || res != 8 || binary.LittleEndian.Uint64(buf[:]) != 1 {
+		t.Fatalf("Unexpected completion: %d, %d, %v", userData, res, ok)
+	}
+}
+
+func TestIowr(t *testing.T) {
+	// UBLK_U_CMD_ADD_DEV and UBLK_U_IO_FETCH_REQ from linux/ublk_cmd.h
+	if op := iowr(cmdAddDev, ctrlCmdSize); op != 0xc0207504 {
+		t.Fatalf("Unexpected ADD_DEV: %x", op)
+	}
+	if op := iowr(ioFetchReq, ioCmdSize); op != 0xc0107520 {
+		t.Fatalf("Unexpected FETCH_REQ: %x", op)
+	}
+}
+
+func TestEncodeCmd(t *testing.T) {
+	buf := make([]byte, 100)
+	var cmd [ctrlCmdSize]byte
+	encodeCtrlCmd(cmd[:], 3, 0x1122334455667788, buf)
+	if binary.LittleEndian.Uint32(cmd[0:]) != 3 || binary.LittleEndian.Uint16(cmd[4:]) != 0xffff ||
+		binary.LittleEndian.Uint16(cmd[6:]) != 100 || binary.LittleEndian.Uint64(cmd[16:]) != 0x1122334455667788 {
+		t.Fatalf("Unexpected control command: %x", cmd)
+	}
+	if addr := binary.LittleEndian.Uint64(cmd[8:]); addr == 0 {
+		t.Fatal("The buffer address is not set")
+	}
+
+	var io [ioCmdSize]byte
+	encodeIOCmd(io[:], 9, -5, buf)
+	if binary.LittleEndian.Uint16(io[0:]) != 0 || binary.LittleEndian.Uint16(io[2:]) != 9 ||
+		int32(binary.LittleEndian.Uint32(io[4:])) != -5 || binary.LittleEndian.Uint64(io[8:]) != binary.LittleEndian.Uint64(cmd[8:]) {
+		t.Fatalf("Unexpected I/O command: %x", io)
+	}
+}
+
+func TestEncodeParams(t *testing.T) {
+	p := bytes.Repeat([]byte{0xff}, paramsSize)
+	encodeParams(p, 1<<30)
+	if binary.LittleEndian.Uint32(p[0:]) != paramsSize || binary.LittleEndian.Uint32(p[4:]) != paramTypeBasic|paramTypeDiscard {
+		t.Fatalf("Unexpected header: %x", p[:8])
+	}
+	basic := p[8:40]
+	if basic[4] != 9 || binary.LittleEndian.Uint32(basic[8:]) != maxIOBuf>>9 || binary.LittleEndian.Uint64(basic[16:]) != 1<<21 {
+		t.Fatalf("Unexpected basic parameters: %x", basic)
+	}
+	if binary.LittleEndian.Uint32(p[44:]) != 4096 || binary.LittleEndian.Uint16(p[56:]) != 1 {
+		t.Fatalf("Unexpected discard parameters: %x", p[40:60])
+	}
+	if !bytes.Equal(p[60:], make([]byte, paramsSize-60)) {
+		t.Fatal("The rest of the parameters is not cleared")
+	}
+}
+
+type memBackend struct {
+	data []byte
+}
+
+func (b *memBackend) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, b.data[off:]), nil
+}
+
+func (b *memBackend) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b.data[off:], p), nil
+}
+
+func (b *memBackend) Sync() error {
+	return nil
+}
+
+func TestDevice(t *testing.T) {
+	backend := &memBackend{
+		data: make([]byte, 1<<20),
+	}
+	d, err := NewDevice(int64(len(backend.data)), backend)
+	if err != nil {
+		if errors.Is(err, ErrNotAvailable) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			t.Skipf("ublk is not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Run()
+	}()
+
+	var f *os.File
+	for i := 0; i < 50; i++ {
+		f, err = os.OpenFile(d.Path(), os.O_RDWR, 0)
+		if !os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		d.Disconnect()
+		<-errc
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("ublk"), 1024)
+	_, err = f.WriteAt(data, 8192)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	d.Disconnect()
+	if rerr := <-errc; err == nil {
+		err = rerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backend.data[8192:8192+len(data)], data) {
+		t.Fatal("The data did not reach the backend")
+	}
+}
@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+package ublk
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIoUringSetup = 425
+	sysIoUringEnter = 426
+
+	ioringSetupSQE128 = 1 << 10
+
+	ioringFeatSingleMmap = 1 << 0
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringEnterGetEvents = 1 << 0
+
+	ioringOpNop      = 0
+	ioringOpRead     = 22
+	ioringOpUringCmd = 46
+
+	cqeSize = 16
+)
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// ring is a minimal io_uring instance, just enough to issue IORING_OP_URING_CMD. It must only be
+// used by one goroutine at a time: the control ring is serialised by Device.ctrlMu and the queue
+// ring is only used by the goroutine that serves the queue (other goroutines wake it through an
+// eventfd, see Device.wake).
+type ring struct {
+	fd int
+
+	sqRing, cqRing, sqes []byte
+	sqeSize              int
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []byte
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []byte
+}
+
+func newRing(entries uint32, flags uint32) (*ring, error) {
+	var p uringParams
+	p.flags = flags
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	r := &ring{
+		fd:      int(fd),
+		sqeSize: 64,
+	}
+	if flags&ioringSetupSQE128 != 0 {
+		r.sqeSize = 128
+	}
+
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*cqeSize)
+	if p.features&ioringFeatSingleMmap != 0 && cqSize > sqSize {
+		sqSize = cqSize
+	}
+
+	var err error
+	r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, sqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	if p.features&ioringFeatSingleMmap != 0 {
+		r.cqRing = r.sqRing
+	} else {
+		r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, cqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	r.sqes, err = syscall.Mmap(r.fd, ioringOffSqes, int(p.sqEntries)*r.sqeSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = r.sqRing[p.sqOff.array : p.sqOff.array+p.sqEntries*4]
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = r.cqRing[p.cqOff.cqes : p.cqOff.cqes+p.cqEntries*cqeSize]
+
+	return r, nil
+}
+
+// queue puts a zeroed SQE filled in by fill onto the submission queue. It does not call into the kernel.
+func (r *ring) queue(fill func(sqe []byte)) bool {
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead) > *r.sqMask {
+		return false
+	}
+	idx := tail & *r.sqMask
+	sqe := r.sqes[int(idx)*r.sqeSize : int(idx+1)*r.sqeSize]
+	for i := range sqe {
+		sqe[i] = 0
+	}
+	fill(sqe)
+	binary.LittleEndian.PutUint32(r.sqArray[idx*4:], idx)
+	atomic.StoreUint32(r.sqTail, tail+1)
+	return true
+}
+
+// uringCmd queues an IORING_OP_URING_CMD with the given command payload.
+func (r *ring) uringCmd(fd int, op uint32, cmd []byte, userData uint64) bool {
+	return r.queue(func(sqe []byte) {
+		sqe[0] = ioringOpUringCmd
+		binary.LittleEndian.PutUint32(sqe[4:], uint32(fd))
+		binary.LittleEndian.PutUint32(sqe[8:], op)
+		binary.LittleEndian.PutUint64(sqe[32:], userData)
+		copy(sqe[48:], cmd)
+	})
+}
+
+func (r *ring) nop(userData uint64) bool {
+	return r.queue(func(sqe []byte) {
+		sqe[0] = ioringOpNop
+		binary.LittleEndian.PutUint64(sqe[32:], userData)
+	})
+}
+
+// read queues an IORING_OP_READ of fd into buf, which must stay in place until it completes.
+func (r *ring) read(fd int, buf []byte, userData uint64) bool {
+	return r.queue(func(sqe []byte) {
+		sqe[0] = ioringOpRead
+		binary.LittleEndian.PutUint32(sqe[4:], uint32(fd))
+		binary.LittleEndian.PutUint64(sqe[16:], uint64(uintptr(unsafe.Pointer(&buf[0]))))
+		binary.LittleEndian.PutUint32(sqe[24:], uint32(len(buf)))
+		binary.LittleEndian.PutUint64(sqe[32:], userData)
+	})
+}
+
+// enter submits all queued SQEs and waits for at least minComplete completions.
+func (r *ring) enter(minComplete uint32) error {
+	toSubmit := *r.sqTail - atomic.LoadUint32(r.sqHead)
+	var flags uintptr
+	if minComplete > 0 {
+		flags = ioringEnterGetEvents
+	}
+	for {
+		_, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// reap returns the next completion, if there is one.
+func (r *ring) reap() (userData uint64, res int32, ok bool) {
+	head := *r.cqHead
+	if head == atomic.LoadUint32(r.cqTail) {
+		return
+	}
+	cqe := r.cqes[(head&*r.cqMask)*cqeSize:]
+	userData = binary.LittleEndian.Uint64(cqe)
+	res = int32(binary.LittleEndian.Uint32(cqe[8:]))
+	atomic.StoreUint32(r.cqHead, head+1)
+	return userData, res, true
+}
+
+func (r *ring) close() {
+	if r.sqes != nil {
+		syscall.Munmap(r.sqes)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+	syscall.Close(r.fd)
+}
@@ -0,0 +1,59 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+)
+
+// With Options.SkipUnchanged a block that is stored with the same bytes its slot already holds is
+// not written at all: neither the data nor the rest of the slot is touched, so rewriting a mostly
+// unchanged image (e.g. refreshing a backup) costs reads and compression rather than writes. The
+// slot is read and compared before every store into the block's own slot, which is cheap past the
+// end of the file and for holes, but is an extra read otherwise. Writes that don't change the
+// data of a block that isn't modified yet don't mark it modified in the first place.
+//
+// Only the stored bytes (or the hole of a block of zeroes) are compared, the rest of the slot is
+// assumed to be released by the store that wrote them, except for the last slot which has to end
+// where the data does. The change tracking generation of the block is updated regardless, and a
+// store made by Truncate still truncates the file after the slot.
+
+// keepSlot returns true if the slot of the block holds image (or, if image is nil, holeLen bytes
+// of zeroes) and ends where it does, so that storing the block can be skipped.
+func (b *block) keepSlot(image []byte, holeLen int64) (bool, error) {
+	f := b.f
+	if !f.skipUnchanged || !f.isPresent(b.num) {
+		return false, nil
+	}
+	l := max(int64(len(image)), holeLen)
+	start := f.blockOffset(b.num)
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return false, err
+	}
+	if o < start+l || o > start+l && o < f.blockOffset(b.num+1) {
+		// Not written yet or the last slot, which would have to be truncated
+		return false, nil
+	}
+	if int64(cap(f.compareBuf)) < l {
+		f.compareBuf = make([]byte, f.blockSize+1)
+	}
+	buf := f.compareBuf[:l]
+	_, err = f.f.ReadAt(buf, start)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(buf[:len(image)], image) || !IsBlockZero(buf[len(image):]) {
+		return false, nil
+	}
+	if m := f.metrics; m != nil {
+		m.BlocksUnchanged.Add(1)
+	}
+	return true, nil
+}
+
+// sameData returns true if writing buf at offset o into the block doesn't change its data. The
+// part of buf past the end of the data is ignored, the caller checks that the data is not extended.
+func (b *block) sameData(o int64, buf []byte) bool {
+	n := min(int64(len(buf)), int64(len(b.data))-o)
+	return bytes.Equal(b.data[o:o+n], buf[:n])
+}
@@ -0,0 +1,177 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type writeCountingFile struct {
+	memSparseFile
+	writes, punches int
+}
+
+func (s *writeCountingFile) WriteAt(p []byte, off int64) (int, error) {
+	s.writes++
+	return s.memSparseFile.WriteAt(p, off)
+}
+
+func (s *writeCountingFile) PunchHole(offset, size int64) error {
+	s.punches++
+	return s.memSparseFile.PunchHole(offset, size)
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	var sf writeCountingFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{BlockSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	// Compressible, random and zero blocks, the last one is partial
+	src := make([]byte, 9*bs+1000)
+	for i := int64(0); i < 3*bs; i++ {
+		src[i] = byte(i / 100)
+	}
+	rand.New(rand.NewSource(1)).Read(src[4*bs : 6*bs])
+	copy(src[7*bs:], bytes.Repeat([]byte("unchanged"), int(bs)))
+	_, err = f.ReadFrom(bytes.NewReader(src))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := bytes.Clone(sf.data)
+
+	for _, jobs := range []int{0, 4} {
+		sf.Seek(0, io.SeekStart)
+		f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{
+			SkipUnchanged: true,
+			CompressJobs:  jobs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMetrics()
+		f.SetMetrics(m)
+		sf.writes, sf.punches = 0, 0
+		_, err = f.ReadFrom(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(src[2*bs+100:5*bs], 2*bs+100)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf.writes != 0 || sf.punches != 0 {
+			t.Fatalf("%d jobs: unexpected writes: %d, %d", jobs, sf.writes, sf.punches)
+		}
+		if m.BlocksUnchanged.Value() != 10 {
+			t.Fatalf("%d jobs: unexpected number of unchanged blocks: %d", jobs, m.BlocksUnchanged.Value())
+		}
+		if !bytes.Equal(sf.data, stored) {
+			t.Fatalf("%d jobs: file modified", jobs)
+		}
+	}
+
+	// A changed block is stored as usual
+	sf.Seek(0, io.SeekStart)
+	f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("changed"), 7*bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(src[7*bs+10:], "changed")
+	_, err = f.WriteAt(src[:2*bs], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.writes == 0 {
+		t.Fatal("The changed block was not written")
+	}
+	f.Seek(0, io.SeekStart)
+	res, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, src) {
+		t.Fatal("Data mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipUnchangedTruncate(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{BlockSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	// Compressible, zero and random blocks, the random ones are stored raw
+	src := make([]byte, 7*bs+1000)
+	for i := int64(0); i < 2*bs; i++ {
+		src[i] = byte(i / 100)
+	}
+	rand.New(rand.NewSource(1)).Read(src[3*bs : 6*bs])
+	copy(src[6*bs:], bytes.Repeat([]byte("truncate"), int(bs)))
+	_, err = f.ReadFrom(bytes.NewReader(src))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Into a raw block, its shortened image is a prefix of the slot, and into a hole
+	for _, size := range []int64{5*bs + 1000, 2*bs + 100} {
+		sf.Seek(0, io.SeekStart)
+		f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{SkipUnchanged: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Truncate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			s, err := f.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != size {
+				t.Fatalf("Size after truncating to %d: %d", size, s)
+			}
+			f.Seek(0, io.SeekStart)
+			res, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res, src[:size]) {
+				t.Fatalf("Data mismatch after truncating to %d", size)
+			}
+			err = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				sf.Seek(0, io.SeekStart)
+				f, err = NewFromSparseFileOptions(&sf, os.O_RDWR, &Options{SkipUnchanged: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
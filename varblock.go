@@ -0,0 +1,544 @@
+package spgz
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A variable-block archive is an alternative to the block format for mixed workloads. The data
+// is divided into regions, each with its own block size, so that regions that are written to at
+// random can use small blocks (less data to recompress per write) while the rest uses large ones
+// (better compression). A modified block is appended to the end of the file rather than written
+// in place and the index in the footer maps the blocks to their data. The space taken by previous
+// versions of the blocks is not reused.
+//
+// Layout: a 16 byte header, the gzip compressed blocks and, every time the file is synced, the
+// region table, the block index (one varEntry per stored block) and a trailer pointing to them.
+// The trailer at the end of the file is the current one, so changes made after the last Sync()
+// or Close() are lost if the file is not closed properly.
+
+const (
+	varMagic        = "SPGZVAR1"
+	varTrailerMagic = "SPGZVARI"
+	varHeaderSize   = 16
+	varTrailerSize  = 48
+
+	defVarBlockSize = 1024 * 1024
+	minVarBlockSize = 512
+	maxVarBlockSize = 1 << 30
+)
+
+// VarRegion sets the block size of a range of the data. Blocks are aligned to the start of
+// the region and the last one may be shorter.
+type VarRegion struct {
+	Offset, Length int64
+	BlockSize      int64
+}
+
+// VarOptions control the creation of variable-block archives. They are ignored when an existing
+// archive is opened.
+type VarOptions struct {
+	// BlockSize is the block size outside of the regions, between 512 bytes and 1GB. Defaults
+	// to 1MB.
+	BlockSize int64
+
+	// Regions that use a different block size. They must not overlap.
+	Regions []VarRegion
+}
+
+type varHeader struct {
+	Magic    [8]byte
+	Reserved uint64
+}
+
+type varRegionEntry struct {
+	Offset, Length, BlockSize uint64
+}
+
+// varEntry describes a stored block. Blocks without an entry are all zeroes. Length can be less
+// than the block size for the block at the end of the data.
+type varEntry struct {
+	Offset     uint64
+	PhysOffset uint64
+	Length     uint32
+	PhysLength uint32
+}
+
+type varTrailer struct {
+	IndexOffset uint64
+	Size        uint64
+	BlockSize   uint64
+	Blocks      uint64
+	Regions     uint32
+	Reserved    uint32
+	Magic       [8]byte
+}
+
+type varFile struct {
+	sync.Mutex
+	f        SparseFile
+	readOnly bool
+
+	blockSize int64
+	regions   []VarRegion
+	index     map[int64]varEntry // by the offset of the block
+	size      int64
+	end       int64 // where the next block is appended
+	modified  bool  // the index needs to be written
+
+	// The current block
+	start  int64
+	data   []byte
+	loaded bool
+	dirty  bool
+
+	physData []byte
+	comp     bytes.Buffer
+	z        *gzip.Writer
+	zr       *gzip.Reader
+}
+
+// NewVarFile opens the variable-block archive stored in file, creating a new one if the file is
+// empty and flag allows writing.
+func NewVarFile(file SparseFile, flag int, opts *VarOptions) (*varFile, error) {
+	f := &varFile{
+		f:        file,
+		readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		index:    make(map[int64]varEntry),
+	}
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 && !f.readOnly {
+		err = f.create(opts)
+	} else {
+		err = f.open(size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenVarFile opens or creates a variable-block archive with the given name, see NewVarFile().
+func OpenVarFile(name string, flag int, perm os.FileMode, opts *VarOptions) (*varFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewVarFile(NewSparseFile(file), flag, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func validVarBlockSize(bs int64) bool {
+	return bs >= minVarBlockSize && bs <= maxVarBlockSize
+}
+
+// setRegions sorts the regions and checks that they are valid.
+func (f *varFile) setRegions(regions []VarRegion) error {
+	f.regions = append([]VarRegion(nil), regions...)
+	sort.Slice(f.regions, func(i, j int) bool {
+		return f.regions[i].Offset < f.regions[j].Offset
+	})
+	var end int64
+	for _, r := range f.regions {
+		if r.Offset < end || r.Length <= 0 || !validVarBlockSize(r.BlockSize) {
+			return ErrInvalidOptions
+		}
+		end = r.Offset + r.Length
+	}
+	return nil
+}
+
+func (f *varFile) create(opts *VarOptions) error {
+	if opts == nil {
+		opts = &VarOptions{}
+	}
+	f.blockSize = opts.BlockSize
+	if f.blockSize == 0 {
+		f.blockSize = defVarBlockSize
+	}
+	if !validVarBlockSize(f.blockSize) {
+		return ErrInvalidOptions
+	}
+	err := f.setRegions(opts.Regions)
+	if err != nil {
+		return err
+	}
+	var h varHeader
+	copy(h.Magic[:], varMagic)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &h)
+	_, err = f.f.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		return err
+	}
+	f.end = varHeaderSize
+	// Write an empty index so that the archive is valid from the start
+	f.modified = true
+	return f.writeIndex()
+}
+
+func (f *varFile) open(size int64) error {
+	if size < varHeaderSize+varTrailerSize {
+		return ErrInvalidFormat
+	}
+	var h varHeader
+	err := binary.Read(io.NewSectionReader(f.f, 0, varHeaderSize), binary.LittleEndian, &h)
+	if err != nil {
+		return err
+	}
+	if string(h.Magic[:]) != varMagic {
+		return ErrInvalidFormat
+	}
+	var t varTrailer
+	err = binary.Read(io.NewSectionReader(f.f, size-varTrailerSize, varTrailerSize), binary.LittleEndian, &t)
+	if err != nil {
+		return err
+	}
+	regionSize := uint64(binary.Size(varRegionEntry{}))
+	entrySize := uint64(binary.Size(varEntry{}))
+	if string(t.Magic[:]) != varTrailerMagic || t.IndexOffset < varHeaderSize ||
+		uint64(t.Regions) > uint64(size)/regionSize || t.Blocks > uint64(size)/entrySize ||
+		t.IndexOffset+uint64(t.Regions)*regionSize+t.Blocks*entrySize != uint64(size-varTrailerSize) ||
+		!validVarBlockSize(int64(t.BlockSize)) {
+		return ErrInvalidFormat
+	}
+	f.blockSize = int64(t.BlockSize)
+	f.size = int64(t.Size)
+	f.end = size
+
+	ir := bufio.NewReader(io.NewSectionReader(f.f, int64(t.IndexOffset), size-varTrailerSize-int64(t.IndexOffset)))
+	regions := make([]VarRegion, t.Regions)
+	for i := range regions {
+		var r varRegionEntry
+		err = binary.Read(ir, binary.LittleEndian, &r)
+		if err != nil {
+			return err
+		}
+		regions[i] = VarRegion{
+			Offset:    int64(r.Offset),
+			Length:    int64(r.Length),
+			BlockSize: int64(r.BlockSize),
+		}
+	}
+	if f.setRegions(regions) != nil {
+		return ErrInvalidFormat
+	}
+	for i := uint64(0); i < t.Blocks; i++ {
+		var e varEntry
+		err = binary.Read(ir, binary.LittleEndian, &e)
+		if err != nil {
+			return err
+		}
+		start, length := f.blockAt(int64(e.Offset))
+		if start != int64(e.Offset) || int64(e.Length) > length || int64(e.Offset+uint64(e.Length)) > f.size ||
+			e.PhysOffset < varHeaderSize || e.PhysOffset+uint64(e.PhysLength) > t.IndexOffset {
+			return ErrInvalidFormat
+		}
+		f.index[start] = e
+	}
+	return nil
+}
+
+// blockAt returns the offset and the length of the block that contains offset.
+func (f *varFile) blockAt(offset int64) (start, length int64) {
+	i := sort.Search(len(f.regions), func(i int) bool {
+		return f.regions[i].Offset+f.regions[i].Length > offset
+	})
+	if i < len(f.regions) && f.regions[i].Offset <= offset {
+		r := &f.regions[i]
+		start = r.Offset + (offset-r.Offset)/r.BlockSize*r.BlockSize
+		length = r.BlockSize
+		if end := r.Offset + r.Length; start+length > end {
+			length = end - start
+		}
+		return
+	}
+	// In the gap before region i
+	var gap int64
+	if i > 0 {
+		gap = f.regions[i-1].Offset + f.regions[i-1].Length
+	}
+	start = gap + (offset-gap)/f.blockSize*f.blockSize
+	length = f.blockSize
+	if i < len(f.regions) && start+length > f.regions[i].Offset {
+		length = f.regions[i].Offset - start
+	}
+	return
+}
+
+// load makes the block that contains offset the current one.
+func (f *varFile) load(offset int64) error {
+	start, length := f.blockAt(offset)
+	if f.loaded && f.start == start {
+		return nil
+	}
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	f.loaded = false
+	if int64(cap(f.data)) < length {
+		f.data = make([]byte, length)
+	}
+	f.data = f.data[:length]
+	n := 0
+	if e, exists := f.index[start]; exists {
+		if cap(f.physData) < int(e.PhysLength) {
+			f.physData = make([]byte, e.PhysLength)
+		}
+		f.physData = f.physData[:e.PhysLength]
+		_, err = f.f.ReadAt(f.physData, int64(e.PhysOffset))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if f.zr == nil {
+			f.zr, err = gzip.NewReader(bytes.NewReader(f.physData))
+		} else {
+			err = f.zr.Reset(bytes.NewReader(f.physData))
+		}
+		if err == nil {
+			n, err = io.ReadFull(f.zr, f.data[:e.Length])
+		}
+		if err != nil {
+			return ErrInvalidFormat
+		}
+	}
+	for i := n; i < len(f.data); i++ {
+		f.data[i] = 0
+	}
+	f.start = start
+	f.loaded = true
+	return nil
+}
+
+// flush stores the current block if it has been modified.
+func (f *varFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	data := f.data
+	if l := f.size - f.start; int64(len(data)) > l {
+		data = data[:l]
+	}
+	f.modified = true
+	if IsBlockZero(data) {
+		delete(f.index, f.start)
+		f.dirty = false
+		return nil
+	}
+	f.comp.Reset()
+	if f.z == nil {
+		f.z = newGzipWriter(&f.comp)
+	} else {
+		f.z.Reset(&f.comp)
+	}
+	f.z.Write(data)
+	err := f.z.Close()
+	if err != nil {
+		return err
+	}
+	_, err = f.f.WriteAt(f.comp.Bytes(), f.end)
+	if err != nil {
+		return err
+	}
+	f.index[f.start] = varEntry{
+		Offset:     uint64(f.start),
+		PhysOffset: uint64(f.end),
+		Length:     uint32(len(data)),
+		PhysLength: uint32(f.comp.Len()),
+	}
+	f.end += int64(f.comp.Len())
+	f.dirty = false
+	return nil
+}
+
+// writeIndex appends the region table, the index and the trailer.
+func (f *varFile) writeIndex() error {
+	if !f.modified {
+		return nil
+	}
+	starts := make([]int64, 0, len(f.index))
+	for start := range f.index {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	var buf bytes.Buffer
+	for _, r := range f.regions {
+		binary.Write(&buf, binary.LittleEndian, &varRegionEntry{
+			Offset:    uint64(r.Offset),
+			Length:    uint64(r.Length),
+			BlockSize: uint64(r.BlockSize),
+		})
+	}
+	for _, start := range starts {
+		e := f.index[start]
+		binary.Write(&buf, binary.LittleEndian, &e)
+	}
+	t := varTrailer{
+		IndexOffset: uint64(f.end),
+		Size:        uint64(f.size),
+		BlockSize:   uint64(f.blockSize),
+		Blocks:      uint64(len(starts)),
+		Regions:     uint32(len(f.regions)),
+	}
+	copy(t.Magic[:], varTrailerMagic)
+	binary.Write(&buf, binary.LittleEndian, &t)
+	_, err := f.f.WriteAt(buf.Bytes(), f.end)
+	if err != nil {
+		return err
+	}
+	f.end += int64(buf.Len())
+	f.modified = false
+	return nil
+}
+
+// Size returns the size of the data.
+func (f *varFile) Size() (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.size, nil
+}
+
+// BlockSizeAt returns the offset and the size of the block that contains offset.
+func (f *varFile) BlockSizeAt(offset int64) (start, length int64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.blockAt(offset)
+}
+
+func (f *varFile) ReadAt(buf []byte, offset int64) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	for n < len(buf) {
+		if offset >= f.size {
+			return n, io.EOF
+		}
+		err = f.load(offset)
+		if err != nil {
+			return
+		}
+		data := f.data
+		if l := f.size - f.start; int64(len(data)) > l {
+			data = data[:l]
+		}
+		c := copy(buf[n:], data[offset-f.start:])
+		n += c
+		offset += int64(c)
+	}
+	return
+}
+
+func (f *varFile) WriteAt(buf []byte, offset int64) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.readOnly {
+		return 0, os.ErrPermission
+	}
+	for n < len(buf) {
+		err = f.load(offset)
+		if err != nil {
+			return
+		}
+		c := copy(f.data[offset-f.start:], buf[n:])
+		f.dirty = true
+		n += c
+		offset += int64(c)
+		if offset > f.size {
+			f.size = offset
+			f.modified = true
+		}
+	}
+	return
+}
+
+// Truncate changes the size of the data. Blocks that are no longer needed are removed from the
+// index.
+func (f *varFile) Truncate(size int64) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.readOnly {
+		return os.ErrPermission
+	}
+	if size < f.size {
+		start, _ := f.blockAt(size)
+		if e, exists := f.index[start]; exists && int64(e.Offset)+int64(e.Length) > size {
+			// The block is cut, the rest of it must read as zeroes if the file is extended again
+			err := f.load(start)
+			if err != nil {
+				return err
+			}
+			f.dirty = true
+		}
+		for s := range f.index {
+			if s >= size {
+				delete(f.index, s)
+			}
+		}
+		if f.loaded && f.start >= size {
+			f.loaded = false
+			f.dirty = false
+		}
+	}
+	if f.loaded {
+		// Zero the part of the current block that is beyond the new size
+		if o := size - f.start; o < int64(len(f.data)) && o >= 0 {
+			for i := o; i < int64(len(f.data)); i++ {
+				f.data[i] = 0
+			}
+		}
+	}
+	f.size = size
+	f.modified = true
+	return nil
+}
+
+// Sync stores the current block, writes the index and syncs the underlying file.
+func (f *varFile) Sync() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.sync()
+}
+
+func (f *varFile) sync() error {
+	if f.readOnly {
+		return nil
+	}
+	err := f.flush()
+	if err == nil {
+		err = f.writeIndex()
+	}
+	if err == nil {
+		err = f.f.Sync()
+	}
+	return err
+}
+
+// Close syncs the file (if it's writable) and closes the underlying file.
+func (f *varFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	err := f.sync()
+	cerr := f.f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestVarFile(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewVarFile(&sf, os.O_RDWR|os.O_CREATE, &VarOptions{
+		BlockSize: 64 * 1024,
+		Regions: []VarRegion{
+			{Offset: 100 * 1024, Length: 40 * 1024, BlockSize: 4096},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ offset, start, length int64 }{
+		{0, 0, 64 * 1024},
+		{70 * 1024, 64 * 1024, 36 * 1024},
+		{100*1024 + 5000, 100*1024 + 4096, 4096},
+		{139 * 1024, 136 * 1024, 4096},
+		{140 * 1024, 140 * 1024, 64 * 1024},
+	} {
+		start, length := f.BlockSizeAt(c.offset)
+		if start != c.start || length != c.length {
+			t.Fatalf("Block at %d: %d, %d", c.offset, start, length)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	data := bytes.Repeat([]byte("variable blocks "), 300*1024/16)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random writes
+	for i := 0; i < 100; i++ {
+		o := rnd.Int63n(int64(len(data)) - 100)
+		rnd.Read(data[o : o+100])
+		_, err = f.WriteAt(data[o:o+100], o)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zeroes past the end
+	_, err = f.WriteAt([]byte{1}, 400*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, make([]byte, 400*1024-len(data))...)
+	data = append(data, 1)
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(f *varFile, expected []byte) {
+		size, _ := f.Size()
+		if size != int64(len(expected)) {
+			t.Fatalf("Unexpected size: %d", size)
+		}
+		buf := make([]byte, len(expected))
+		_, err := f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatal("Data mismatch")
+		}
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewVarFile(&sf, os.O_RDWR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, data)
+	if start, length := f.BlockSizeAt(101 * 1024); start != 100*1024 || length != 4096 {
+		t.Fatal("Regions are not preserved")
+	}
+
+	// Shrink and extend again, the cut off data must read as zeroes
+	err = f.Truncate(110 * 1024)
+	if err == nil {
+		err = f.Truncate(200 * 1024)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data[:110*1024], make([]byte, 90*1024)...)
+	check(f, data)
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewVarFile(&sf, os.O_RDONLY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, data)
+	_, err = f.WriteAt([]byte{1}, 0)
+	if err != os.ErrPermission {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestVarFileInvalidRegions(t *testing.T) {
+	var sf memSparseFile
+	_, err := NewVarFile(&sf, os.O_RDWR|os.O_CREATE, &VarOptions{
+		Regions: []VarRegion{
+			{Offset: 0, Length: 8192, BlockSize: 4096},
+			{Offset: 4096, Length: 8192, BlockSize: 4096},
+		},
+	})
+	if err != ErrInvalidOptions {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package spgz
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Verify reads and decodes every block stored in the file and returns the first error, see
+// ErrCorruptBlock. Blocks that are read from a base are not checked. If the file has parity
+// records, the slots are also checked against their checksums, see Repair().
+func (f *compFile) Verify() error {
+	return f.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify but stops with ctx.Err() if the context is done. The file is only
+// locked while a block is being read, so it can be used concurrently.
+func (f *compFile) VerifyContext(ctx context.Context) error {
+	f.Lock()
+	err := f.flushBlock()
+	var size int64
+	if err == nil {
+		size, err = f.size()
+	}
+	p := f.newProgress(true)
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b := &block{
+		f: f,
+	}
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	for num := int64(0); num < blocks; num++ {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = f.checkBlock(b, num)
+		if err != nil {
+			return err
+		}
+		p.add(b.physSize, int64(len(b.data)))
+	}
+	if f.parity != nil {
+		return f.verifyParity(ctx)
+	}
+	return nil
+}
+
+// checkBlock loads block num into b unless it's read from the base.
+func (f *compFile) checkBlock(b *block, num int64) error {
+	var err error
+	f.Lock()
+	if f.isPresent(num) {
+		err = b.load(num)
+	} else {
+		b.physSize, b.data = 0, nil
+	}
+	f.Unlock()
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// VerifyReport is the combined result of VerifyParallel.
+type VerifyReport struct {
+	Blocks int64 // blocks checked, including those read from the base
+
+	// Errors has an error for every block that could not be read or decoded, in the order of the
+	// blocks, followed by the parity error if any.
+	Errors []error
+}
+
+// VerifyParallel is like VerifyContext but decodes up to jobs blocks at the same time and
+// carries on after errors in blocks, which are collected in the report. The slots are read under
+// the lock and decoded without it (see checkBlockParallel), so it scales with the number of cores
+// as long as the storage keeps up. The returned error is one that prevented the verification
+// from completing, e.g. ctx.Err().
+func (f *compFile) VerifyParallel(ctx context.Context, jobs int) (*VerifyReport, error) {
+	f.Lock()
+	err := f.flushBlock()
+	var size int64
+	if err == nil {
+		size, err = f.size()
+	}
+	p := f.newProgress(true)
+	f.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	type blockErr struct {
+		num int64
+		err error
+	}
+	var bad []blockErr
+	r := &VerifyReport{}
+	blocks := (size + f.blockSize - 1) / f.blockSize
+	err = f.checkBlocks(ctx, blocks, jobs, nil, func(b *block, num int64, err error) {
+		r.Blocks++
+		if err != nil {
+			bad = append(bad, blockErr{num, err})
+		} else {
+			p.add(b.physSize, int64(len(b.data)))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(bad, func(i, j int) bool {
+		return bad[i].num < bad[j].num
+	})
+	for _, e := range bad {
+		r.Errors = append(r.Errors, e.err)
+	}
+	if f.parity != nil {
+		err = f.verifyParity(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			r.Errors = append(r.Errors, err)
+		}
+	}
+	return r, nil
+}
+
+// checkBlocks checks blocks [0, blocks) in jobs goroutines (at least one). pace, if not nil, is
+// called before a block is handed out and stops the check if it returns an error. done is called
+// for every checked block, never concurrently.
+func (f *compFile) checkBlocks(ctx context.Context, blocks int64, jobs int, pace func(num int64) error, done func(b *block, num int64, err error)) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	nums := make(chan int64)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := &block{
+				f: f,
+			}
+			for num := range nums {
+				err := f.checkBlockParallel(b, num)
+				mu.Lock()
+				done(b, num, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	for num := int64(0); num < blocks; num++ {
+		err = ctx.Err()
+		if err == nil && pace != nil {
+			err = pace(num)
+		}
+		if err != nil {
+			break
+		}
+		nums <- num
+	}
+	close(nums)
+	wg.Wait()
+	return err
+}
+
+// checkBlockParallel is like checkBlock but only holds the lock while the slot is read. A
+// compressed block is decompressed without it, so that several blocks can be decoded at the same
+// time. The data of the block is not padded (see padShort).
+func (f *compFile) checkBlockParallel(b *block, num int64) (err error) {
+	f.Lock()
+	if !f.isPresent(num) {
+		f.Unlock()
+		b.physSize, b.data = 0, nil
+		return nil
+	}
+	b.num = num
+	b.physSize = 0
+	if b.dataBlock == nil {
+		b.dataBlock = make([]byte, f.blockSize)
+	}
+	n, err := b.readSlot(num)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	if err != nil || b.rawBlock[0] != blkCompressed {
+		// Nothing to decompress
+		if err == nil {
+			b.rawBlock = b.rawBlock[:n]
+			switch b.rawBlock[0] {
+			case blkUncompressed:
+				b.data = b.rawBlock[1:]
+				b.physSize = int64(n)
+			case blkStored:
+				err = b.loadStored()
+			default:
+				err = b.corrupt(ErrInvalidFormat)
+			}
+		}
+		f.Unlock()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			err = b.wrapErr("load", err)
+		}
+		return err
+	}
+	f.Unlock()
+
+	err = b.inflate(b.rawBlock[1:n])
+	if err != nil {
+		f.Lock()
+		err = b.wrapErr("load", b.corrupt(err))
+		f.Unlock()
+		return err
+	}
+	b.physSize++
+	return nil
+}
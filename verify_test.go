@@ -0,0 +1,103 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3*f.BlockSize()+10)
+	for i := range buf {
+		buf[i] = byte(i % 7)
+	}
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = f.VerifyContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.WriteToContext(ctx, &bytes.Buffer{})
+	if err != context.Canceled || n != 0 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+
+	sf.data[f.blockOffset(2)+1] ^= 0xff
+	err = f.Verify()
+	var ce *ErrCorruptBlock
+	if !errors.As(err, &ce) || ce.Num != 2 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestVerifyParallel(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFileSize(&sf, os.O_RDWR|os.O_CREATE, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16*f.BlockSize()+10)
+	for i := range buf {
+		buf[i] = byte(i % 7)
+	}
+	// a hole
+	copy(buf[4*f.BlockSize():], bytes.Repeat([]byte{0}, int(f.BlockSize())))
+	_, err = f.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := f.VerifyParallel(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Blocks != 17 || len(r.Errors) != 0 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+
+	sf.data[f.blockOffset(11)+1] ^= 0xff
+	sf.data[f.blockOffset(2)+1] ^= 0xff
+	r, err = f.VerifyParallel(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 2 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+	for i, num := range []int64{2, 11} {
+		var ce *ErrCorruptBlock
+		if !errors.As(r.Errors[i], &ce) || ce.Num != num {
+			t.Fatalf("Unexpected error: %v", r.Errors[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = f.VerifyParallel(ctx, 4)
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
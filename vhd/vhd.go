@@ -0,0 +1,260 @@
+// Package vhd exports disk images as VHD (fixed or dynamic) or VHDX (fixed or dynamic) files.
+//
+// Source data is read through an io.ReaderAt, blocks consisting entirely of zeroes are left
+// unallocated in dynamic images and are not written in fixed ones, so the output file stays sparse.
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/dop251/spgz"
+)
+
+const (
+	sectorSize = 512
+
+	vhdBlockSize = 2 * 1024 * 1024
+
+	vhdDiskTypeFixed   = 2
+	vhdDiskTypeDynamic = 3
+)
+
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueId           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueId    [16]byte
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8 * 24]byte
+	Reserved2         [256]byte
+}
+
+func checksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// geometry calculates the CHS geometry as described in the VHD specification.
+func geometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / sectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var spt, h, cth int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cth = totalSectors / spt
+	} else {
+		spt = 17
+		cth = totalSectors / spt
+		h = (cth + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cth >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cth = totalSectors / spt
+		}
+		if cth >= h*1024 {
+			spt = 63
+			h = 16
+			cth = totalSectors / spt
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(spt)
+}
+
+func newFooter(size int64, diskType uint32) (*vhdFooter, error) {
+	f := &vhdFooter{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        ^uint64(0),
+		TimeStamp:         uint32(time.Since(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+	}
+	copy(f.Cookie[:], "conectix")
+	copy(f.CreatorApplication[:], "spgz")
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.Cylinders, f.Heads, f.SectorsPerTrack = geometry(size)
+	if _, err := rand.Read(f.UniqueId[:]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func marshal(v interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	return buf.Bytes()
+}
+
+func (f *vhdFooter) bytes() []byte {
+	f.Checksum = 0
+	f.Checksum = checksum(marshal(f))
+	return marshal(f)
+}
+
+// forEachBlock calls fn for every blockSize long block of the source (which is size bytes long)
+// that is not entirely zero. The last block is padded with zeroes.
+func forEachBlock(r io.ReaderAt, size int64, blockSize int64, fn func(num int64, data []byte) error) error {
+	buf := make([]byte, blockSize)
+	for off := int64(0); off < size; off += blockSize {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && !(err == io.EOF && int64(n) >= size-off) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		if spgz.IsBlockZero(buf) {
+			continue
+		}
+		err = fn(off/blockSize, buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteVHD writes size bytes from r as a VHD image. The virtual size is rounded up to a whole sector.
+func WriteVHD(t spgz.Target, r io.ReaderAt, size int64, dynamic bool) error {
+	if dynamic {
+		return writeDynamicVHD(t, r, size)
+	}
+	srcSize := size
+	size = (size + sectorSize - 1) &^ (sectorSize - 1)
+
+	footer, err := newFooter(size, vhdDiskTypeFixed)
+	if err != nil {
+		return err
+	}
+	err = forEachBlock(r, srcSize, vhdBlockSize, func(num int64, data []byte) error {
+		off := num * vhdBlockSize
+		if remaining := size - off; remaining < int64(len(data)) {
+			data = data[:remaining]
+		}
+		_, err := t.WriteAt(data, off)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = t.Truncate(size)
+	if err != nil {
+		return err
+	}
+	_, err = t.WriteAt(footer.bytes(), size)
+	return err
+}
+
+func writeDynamicVHD(t spgz.Target, r io.ReaderAt, srcSize int64) error {
+	size := (srcSize + sectorSize - 1) &^ (sectorSize - 1)
+	footer, err := newFooter(size, vhdDiskTypeDynamic)
+	if err != nil {
+		return err
+	}
+	footer.DataOffset = sectorSize
+
+	entries := (size + vhdBlockSize - 1) / vhdBlockSize
+	const batOffset = 3 * sectorSize
+	batSize := (entries*4 + sectorSize - 1) &^ (sectorSize - 1)
+
+	dh := &vhdDynamicHeader{
+		DataOffset:      ^uint64(0),
+		TableOffset:     batOffset,
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       vhdBlockSize,
+	}
+	copy(dh.Cookie[:], "cxsparse")
+	dh.Checksum = checksum(marshal(dh))
+
+	// Unallocated entries are 0xffffffff
+	bat := make([]byte, batSize)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+
+	// Each block is preceded by a sector bitmap, 512 bytes for 2MB blocks.
+	const bitmapSize = vhdBlockSize / sectorSize / 8
+	bitmap := make([]byte, bitmapSize)
+	for i := range bitmap {
+		bitmap[i] = 0xff
+	}
+
+	pos := int64(batOffset) + batSize
+	err = forEachBlock(r, srcSize, vhdBlockSize, func(num int64, data []byte) error {
+		binary.BigEndian.PutUint32(bat[num*4:], uint32(pos/sectorSize))
+		if _, err := t.WriteAt(bitmap, pos); err != nil {
+			return err
+		}
+		if _, err := t.WriteAt(data, pos+bitmapSize); err != nil {
+			return err
+		}
+		pos += bitmapSize + vhdBlockSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fb := footer.bytes()
+	if _, err = t.WriteAt(fb, 0); err != nil {
+		return err
+	}
+	if _, err = t.WriteAt(marshal(dh), sectorSize); err != nil {
+		return err
+	}
+	if _, err = t.WriteAt(bat, batOffset); err != nil {
+		return err
+	}
+	if _, err = t.WriteAt(fb, pos); err != nil {
+		return err
+	}
+	return t.Truncate(pos + sectorSize)
+}
@@ -0,0 +1,175 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+type memTarget struct {
+	data []byte
+}
+
+func (t *memTarget) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(t.data)) {
+		t.Truncate(end)
+	}
+	return copy(t.data[off:], p), nil
+}
+
+func (t *memTarget) Truncate(size int64) error {
+	d := make([]byte, size)
+	copy(d, t.data)
+	t.data = d
+	return nil
+}
+
+// makeSource returns a source of 3 blocks and a short tail where only the first and the last
+// blocks contain data.
+func makeSource() []byte {
+	src := make([]byte, 3*vhdBlockSize+1000)
+	for i := 0; i < 1000; i++ {
+		src[i] = byte(i)
+		src[len(src)-1-i] = byte(i) | 1
+	}
+	return src
+}
+
+func checkFooter(t *testing.T, b []byte, size int64, diskType uint32) {
+	var f vhdFooter
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Cookie[:]) != "conectix" {
+		t.Fatalf("Unexpected cookie: %q", f.Cookie)
+	}
+	if f.CurrentSize != uint64(size) || f.DiskType != diskType {
+		t.Fatalf("Unexpected footer: size %d, type %d", f.CurrentSize, f.DiskType)
+	}
+	sum := f.Checksum
+	f.Checksum = 0
+	if checksum(marshal(&f)) != sum {
+		t.Fatal("Footer checksum mismatch")
+	}
+}
+
+func TestFixedVHD(t *testing.T) {
+	src := makeSource()
+	var tgt memTarget
+	err := WriteVHD(&tgt, bytes.NewReader(src), int64(len(src)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(src)+sectorSize-1) &^ (sectorSize - 1)
+	if int64(len(tgt.data)) != size+sectorSize {
+		t.Fatalf("Unexpected file size: %d", len(tgt.data))
+	}
+	if !bytes.Equal(tgt.data[:len(src)], src) || !bytes.Equal(tgt.data[len(src):size], make([]byte, size-int64(len(src)))) {
+		t.Fatal("Data differs")
+	}
+	checkFooter(t, tgt.data[size:], size, vhdDiskTypeFixed)
+}
+
+func TestDynamicVHD(t *testing.T) {
+	src := makeSource()
+	var tgt memTarget
+	err := WriteVHD(&tgt, bytes.NewReader(src), int64(len(src)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(src)+sectorSize-1) &^ (sectorSize - 1)
+	checkFooter(t, tgt.data, size, vhdDiskTypeDynamic)
+	checkFooter(t, tgt.data[len(tgt.data)-sectorSize:], size, vhdDiskTypeDynamic)
+
+	var dh vhdDynamicHeader
+	err = binary.Read(bytes.NewReader(tgt.data[sectorSize:]), binary.BigEndian, &dh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dh.Cookie[:]) != "cxsparse" || dh.MaxTableEntries != 4 {
+		t.Fatalf("Unexpected dynamic header: %q, %d", dh.Cookie, dh.MaxTableEntries)
+	}
+
+	padded := make([]byte, 4*vhdBlockSize)
+	copy(padded, src)
+	allocated := 0
+	for i := int64(0); i < int64(dh.MaxTableEntries); i++ {
+		e := binary.BigEndian.Uint32(tgt.data[int64(dh.TableOffset)+i*4:])
+		block := padded[i*vhdBlockSize : (i+1)*vhdBlockSize]
+		if e == 0xffffffff {
+			if !bytes.Equal(block, make([]byte, vhdBlockSize)) {
+				t.Fatalf("Block %d is not allocated", i)
+			}
+			continue
+		}
+		allocated++
+		off := int64(e)*sectorSize + vhdBlockSize/sectorSize/8
+		if !bytes.Equal(tgt.data[off:off+vhdBlockSize], block) {
+			t.Fatalf("Block %d differs", i)
+		}
+	}
+	if allocated != 2 {
+		t.Fatalf("Unexpected number of allocated blocks: %d", allocated)
+	}
+}
+
+func testVHDX(t *testing.T, dynamic bool) {
+	src := makeSource()
+	var tgt memTarget
+	err := WriteVHDX(&tgt, bytes.NewReader(src), int64(len(src)), dynamic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tgt.data[:8]) != "vhdxfile" {
+		t.Fatal("Missing file type identifier")
+	}
+	for _, off := range []int{vhdxHeader1Offset, vhdxHeader2Offset} {
+		h := append([]byte(nil), tgt.data[off:off+4096]...)
+		if string(h[:4]) != "head" {
+			t.Fatalf("Missing header at %d", off)
+		}
+		sum := binary.LittleEndian.Uint32(h[4:])
+		binary.LittleEndian.PutUint32(h[4:], 0)
+		if crc32.Checksum(h, crc32c) != sum {
+			t.Fatalf("Header checksum mismatch at %d", off)
+		}
+	}
+	if string(tgt.data[vhdxRegion1Offset:vhdxRegion1Offset+4]) != "regi" {
+		t.Fatal("Missing region table")
+	}
+	if string(tgt.data[vhdxMetaOffset:vhdxMetaOffset+8]) != "metadata" {
+		t.Fatal("Missing metadata")
+	}
+
+	padded := make([]byte, 4*vhdxBlockSize)
+	copy(padded, src)
+	allocated := 0
+	for i := int64(0); i < 4; i++ {
+		e := binary.LittleEndian.Uint64(tgt.data[vhdxBATOffset+i*8:])
+		block := padded[i*vhdxBlockSize : (i+1)*vhdxBlockSize]
+		if e&7 != vhdxPayloadBlockFullyPresent {
+			if !dynamic || !bytes.Equal(block, make([]byte, vhdxBlockSize)) {
+				t.Fatalf("Block %d is not present", i)
+			}
+			continue
+		}
+		allocated++
+		off := int64(e>>20) * mb
+		if !bytes.Equal(tgt.data[off:off+vhdxBlockSize], block) {
+			t.Fatalf("Block %d differs", i)
+		}
+	}
+	if dynamic && allocated != 2 {
+		t.Fatalf("Unexpected number of allocated blocks: %d", allocated)
+	}
+}
+
+func TestDynamicVHDX(t *testing.T) {
+	testVHDX(t, true)
+}
+
+func TestFixedVHDX(t *testing.T) {
+	testVHDX(t, false)
+}
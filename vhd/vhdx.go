@@ -0,0 +1,226 @@
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/dop251/spgz"
+)
+
+const (
+	mb = 1024 * 1024
+
+	vhdxBlockSize = 2 * mb
+
+	vhdxHeader1Offset = 64 * 1024
+	vhdxHeader2Offset = 128 * 1024
+	vhdxRegion1Offset = 192 * 1024
+	vhdxRegion2Offset = 256 * 1024
+	vhdxLogOffset     = 1 * mb
+	vhdxLogLength     = 1 * mb
+	vhdxMetaOffset    = 2 * mb
+	vhdxMetaLength    = 1 * mb
+	vhdxBATOffset     = 3 * mb
+
+	vhdxPayloadBlockFullyPresent = 6
+
+	vhdxMetaIsVirtualDisk = 1 << 1
+	vhdxMetaIsRequired    = 1 << 2
+)
+
+var (
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	guidBATRegion          = guid(0x2DC27766, 0xF623, 0x4200, 0x9D64115E9BFD4A08)
+	guidMetadataRegion     = guid(0x8B7CA206, 0x4790, 0x4B9A, 0xB8FE575F050F886E)
+	guidFileParameters     = guid(0xCAA16737, 0xFA36, 0x4D43, 0xB3B633F0AA44E76B)
+	guidVirtualDiskSize    = guid(0x2FA54224, 0xCD1B, 0x4876, 0xB2115DBED83BF4B8)
+	guidVirtualDiskID      = guid(0xBECA12AB, 0xB2E6, 0x4523, 0x93EFC309E000C746)
+	guidLogicalSectorSize  = guid(0x8141BF1D, 0xA96F, 0x4709, 0xBA47F233A8FAAB5F)
+	guidPhysicalSectorSize = guid(0xCDA348C7, 0x445D, 0x4471, 0x9CC9E9885251C556)
+)
+
+// guid returns the on-disk (mixed endian) representation of a GUID.
+func guid(d1 uint32, d2, d3 uint16, d4 uint64) (g [16]byte) {
+	binary.LittleEndian.PutUint32(g[0:], d1)
+	binary.LittleEndian.PutUint16(g[4:], d2)
+	binary.LittleEndian.PutUint16(g[6:], d3)
+	binary.BigEndian.PutUint64(g[8:], d4)
+	return
+}
+
+func randomGUID() (g [16]byte, err error) {
+	_, err = rand.Read(g[:])
+	return
+}
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGuid  [16]byte
+	DataWriteGuid  [16]byte
+	LogGuid        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionEntry struct {
+	Guid       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetaEntry struct {
+	ItemId   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// withCRC returns v marshalled into a buffer of the given size with the CRC-32C of the buffer
+// stored at offset 4.
+func withCRC(size int, v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, item := range v {
+		binary.Write(&buf, binary.LittleEndian, item)
+	}
+	b := make([]byte, size)
+	copy(b, buf.Bytes())
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+	return b
+}
+
+func vhdxMetadata(size int64, diskID [16]byte) []byte {
+	var items bytes.Buffer
+	var entries []vhdxMetaEntry
+	add := func(id [16]byte, flags uint32, v interface{}) {
+		entries = append(entries, vhdxMetaEntry{
+			ItemId: id,
+			Offset: uint32(64*1024 + items.Len()),
+			Length: uint32(binary.Size(v)),
+			Flags:  flags,
+		})
+		binary.Write(&items, binary.LittleEndian, v)
+	}
+	add(guidFileParameters, vhdxMetaIsRequired, [2]uint32{vhdxBlockSize, 0})
+	add(guidVirtualDiskSize, vhdxMetaIsVirtualDisk|vhdxMetaIsRequired, uint64(size))
+	add(guidVirtualDiskID, vhdxMetaIsVirtualDisk|vhdxMetaIsRequired, diskID)
+	add(guidLogicalSectorSize, vhdxMetaIsVirtualDisk|vhdxMetaIsRequired, uint32(sectorSize))
+	add(guidPhysicalSectorSize, vhdxMetaIsVirtualDisk|vhdxMetaIsRequired, uint32(4096))
+
+	var buf bytes.Buffer
+	buf.WriteString("metadata")
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{0, uint16(len(entries))})
+	buf.Write(make([]byte, 20))
+	binary.Write(&buf, binary.LittleEndian, entries)
+
+	meta := make([]byte, 64*1024+items.Len())
+	copy(meta, buf.Bytes())
+	copy(meta[64*1024:], items.Bytes())
+	return meta
+}
+
+// WriteVHDX writes size bytes from r as a VHDX image with 2MB blocks. The virtual size is rounded up
+// to a whole sector. Dynamic images only allocate blocks that contain data, fixed images allocate
+// all blocks but still only write the non-zero ones.
+func WriteVHDX(t spgz.Target, r io.ReaderAt, size int64, dynamic bool) error {
+	srcSize := size
+	size = (size + sectorSize - 1) &^ (sectorSize - 1)
+
+	diskID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	fileWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	dataWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+
+	// One sector bitmap entry follows every chunkRatio payload entries
+	const chunkRatio = (1 << 23) * sectorSize / vhdxBlockSize
+	payloadBlocks := (size + vhdxBlockSize - 1) / vhdxBlockSize
+	batEntries := payloadBlocks + (payloadBlocks-1)/chunkRatio
+	batLength := (batEntries*8 + mb - 1) &^ (mb - 1)
+	bat := make([]byte, batLength)
+	batEntry := func(num int64) []byte {
+		return bat[(num+num/chunkRatio)*8:]
+	}
+
+	pos := int64(vhdxBATOffset) + batLength
+	if dynamic {
+		err = forEachBlock(r, srcSize, vhdxBlockSize, func(num int64, data []byte) error {
+			binary.LittleEndian.PutUint64(batEntry(num), uint64(pos/mb)<<20|vhdxPayloadBlockFullyPresent)
+			_, err := t.WriteAt(data, pos)
+			pos += vhdxBlockSize
+			return err
+		})
+	} else {
+		dataOffset := pos
+		for num := int64(0); num < payloadBlocks; num++ {
+			binary.LittleEndian.PutUint64(batEntry(num), uint64(pos/mb)<<20|vhdxPayloadBlockFullyPresent)
+			pos += vhdxBlockSize
+		}
+		err = forEachBlock(r, srcSize, vhdxBlockSize, func(num int64, data []byte) error {
+			_, err := t.WriteAt(data, dataOffset+num*vhdxBlockSize)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	ident := make([]byte, 64*1024)
+	copy(ident, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("spgz")) {
+		binary.LittleEndian.PutUint16(ident[8+i*2:], c)
+	}
+	if _, err = t.WriteAt(ident, 0); err != nil {
+		return err
+	}
+
+	for i, off := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		h := vhdxHeader{
+			SequenceNumber: uint64(i),
+			FileWriteGuid:  fileWrite,
+			DataWriteGuid:  dataWrite,
+			Version:        1,
+			LogLength:      vhdxLogLength,
+			LogOffset:      vhdxLogOffset,
+		}
+		copy(h.Signature[:], "head")
+		if _, err = t.WriteAt(withCRC(4096, &h), off); err != nil {
+			return err
+		}
+	}
+
+	regions := withCRC(64*1024, []byte("regi"), [3]uint32{0, 2, 0}, []vhdxRegionEntry{
+		{Guid: guidBATRegion, FileOffset: vhdxBATOffset, Length: uint32(batLength), Required: 1},
+		{Guid: guidMetadataRegion, FileOffset: vhdxMetaOffset, Length: vhdxMetaLength, Required: 1},
+	})
+	for _, off := range []int64{vhdxRegion1Offset, vhdxRegion2Offset} {
+		if _, err = t.WriteAt(regions, off); err != nil {
+			return err
+		}
+	}
+
+	if _, err = t.WriteAt(vhdxMetadata(size, diskID), vhdxMetaOffset); err != nil {
+		return err
+	}
+	if _, err = t.WriteAt(bat, vhdxBATOffset); err != nil {
+		return err
+	}
+	return t.Truncate(pos)
+}
@@ -0,0 +1,174 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+)
+
+// Watch keeps the file in sync with a source that is being modified: after an initial pass it
+// waits for the source to change (using inotify where available, otherwise by checking its size
+// and modification time every interval), reads it again and writes the blocks that differ from
+// the previous pass. A digest of every block is kept in memory, so only the touched blocks are
+// recompressed, but the whole source is read on every change.
+//
+// The initial pass compares the source with the content of the file, so watching a source that
+// has already been compressed into the file only writes what has changed since.
+
+const defWatchInterval = time.Second
+
+// WatchOptions control Watch.
+type WatchOptions struct {
+	// Interval is how often the size and the modification time of the source are checked, 1
+	// second if 0. With change notifications they're checked in addition to waiting for them.
+	Interval time.Duration
+
+	// OnUpdate is called after every pass that has modified the file.
+	OnUpdate func(stats *WatchStats)
+}
+
+// WatchStats describe a pass of Watch.
+type WatchStats struct {
+	Size    int64 // size of the source
+	Blocks  int64 // number of blocks in the source
+	Changed int64 // number of blocks that were written
+}
+
+type changeWatcher interface {
+	// wait returns true if the source has been modified within timeout.
+	wait(ctx context.Context, timeout time.Duration) (bool, error)
+	close() error
+}
+
+// Watch updates the file from src until ctx is done (then ctx.Err() is returned) or an error
+// occurs. The file is synced after every pass that has modified it.
+func (f *compFile) Watch(ctx context.Context, src *os.File, opts *WatchOptions) error {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defWatchInterval
+	}
+	w, err := newChangeWatcher(src.Name())
+	if err != nil {
+		// Fall back to polling
+		w = nil
+	}
+	if w != nil {
+		defer w.close()
+	}
+
+	var sums [][sha256.Size]byte
+	var last os.FileInfo
+	first := true
+	for {
+		// Taken before reading, so that a change made during the pass is picked up by the next one
+		info, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if first || !sameFileState(info, last) {
+			stats, modified, err := f.watchPass(src, info.Size(), &sums, first)
+			if err != nil {
+				return err
+			}
+			if modified && opts.OnUpdate != nil {
+				opts.OnUpdate(stats)
+			}
+			first = false
+			last = info
+		}
+
+		modified := false
+		if w != nil {
+			modified, err = w.wait(ctx, interval)
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+		} else {
+			sleepContext(ctx, interval)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if modified {
+			// Make sure the pass runs even if the modification time hasn't changed
+			last = nil
+		}
+	}
+}
+
+func sameFileState(a, b os.FileInfo) bool {
+	return b != nil && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// watchPass reads size bytes from src and writes the blocks whose digest differs from sums,
+// updating it. If compare is set, blocks that are already in the file are not written. It returns
+// true if the file has been modified.
+func (f *compFile) watchPass(src io.ReaderAt, size int64, sums *[][sha256.Size]byte, compare bool) (stats *WatchStats, modified bool, err error) {
+	bs := f.blockSize
+	stats = &WatchStats{
+		Size:   size,
+		Blocks: (size + bs - 1) / bs,
+	}
+	buf := make([]byte, bs)
+	var cur []byte
+	if compare {
+		cur = make([]byte, bs)
+	}
+	for num := int64(0); num < stats.Blocks; num++ {
+		off := num * bs
+		data := buf[:min(bs, size-off)]
+		var n int
+		n, err = src.ReadAt(data, off)
+		if err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+		// The source has shrunk since, the next pass takes care of it
+		clear(data[n:])
+
+		sum := sha256.Sum256(data)
+		if num < int64(len(*sums)) {
+			if (*sums)[num] == sum {
+				continue
+			}
+			(*sums)[num] = sum
+		} else {
+			*sums = append(*sums, sum)
+		}
+		if compare {
+			n, err := f.ReadAt(cur[:len(data)], off)
+			if (err == nil || err == io.EOF) && n == len(data) && bytes.Equal(cur[:n], data) {
+				continue
+			}
+		}
+		_, err = f.WriteAt(data, off)
+		if err != nil {
+			return
+		}
+		stats.Changed++
+	}
+	*sums = (*sums)[:stats.Blocks]
+
+	var fsize int64
+	fsize, err = f.Size()
+	if err != nil {
+		return
+	}
+	modified = stats.Changed > 0 || fsize != size
+	if fsize != size {
+		err = f.Truncate(size)
+		if err != nil {
+			return
+		}
+	}
+	if modified {
+		err = f.Sync()
+	}
+	return
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+// newChangeWatcher returns nil, the source is polled.
+func newChangeWatcher(name string) (changeWatcher, error) {
+	return nil, nil
+}
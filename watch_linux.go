@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+type inotifyWatcher struct {
+	f *os.File
+}
+
+func newChangeWatcher(name string) (changeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	_, err = syscall.InotifyAddWatch(fd, name, syscall.IN_MODIFY|syscall.IN_ATTRIB|syscall.IN_CLOSE_WRITE)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	// The descriptor is non-blocking, so the file is added to the poller and read deadlines work
+	return &inotifyWatcher{
+		f: os.NewFile(uintptr(fd), "inotify"),
+	}, nil
+}
+
+func (w *inotifyWatcher) wait(ctx context.Context, timeout time.Duration) (bool, error) {
+	err := w.f.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return false, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		w.f.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	// Only whether there have been events matters, not what they were
+	var buf [4096]byte
+	n, err := w.f.Read(buf[:])
+	if err != nil {
+		if os.IsTimeout(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (w *inotifyWatcher) close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,98 @@
+package spgz
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	var sf memSparseFile
+	f, err := NewFromSparseFile(&sf, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+
+	data := make([]byte, 4*bs+100)
+	rand.Read(data)
+	// The archive already has the first two blocks
+	_, err = f.WriteAt(data[:2*bs], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "source")
+	err = os.WriteFile(name, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	updates := make(chan *WatchStats, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Watch(ctx, src, &WatchOptions{
+			Interval: 10 * time.Millisecond,
+			OnUpdate: func(stats *WatchStats) {
+				updates <- stats
+			},
+		})
+	}()
+
+	stats := <-updates
+	if stats.Blocks != 5 || stats.Changed != 3 {
+		t.Fatalf("Initial pass: %+v", stats)
+	}
+
+	_, err = src.WriteAt([]byte("modified"), bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[bs+10:], "modified")
+	stats = <-updates
+	if stats.Changed != 1 {
+		t.Fatalf("Second pass: %+v", stats)
+	}
+
+	err = src.Truncate(3 * bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:3*bs]
+	stats = <-updates
+	if stats.Changed != 0 || stats.Size != 3*bs {
+		t.Fatalf("Third pass: %+v", stats)
+	}
+
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Size: %d", size)
+	}
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data mismatch")
+	}
+}
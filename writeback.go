@@ -0,0 +1,243 @@
+package spgz
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// With Options.WriteBack a modified block is not stored as soon as another block is accessed,
+// it's put into a bounded cache instead and stored by a background goroutine, so that random
+// writes don't wait for compression. When the cache is full, the oldest block is stored
+// synchronously. Only full blocks inside the file are cached, blocks that extend the file are
+// stored right away, so the size of the file is always known from the file itself.
+//
+// With Options.WriteBackDelay the stores are deferred further: a cached block is only stored
+// once it has been in the cache for that long and the current block once it hasn't been written
+// to for that long, so that a burst of small writes scattered over a few blocks compresses each
+// block once rather than on every switch between them.
+//
+// Flush, Sync, Close and the operations that work on the stored blocks directly (PunchHole,
+// Truncate, Snapshot, etc.) store all cached blocks first. PunchHole drops the cached blocks that
+// are inside the hole instead. An error from the background
+// goroutine is returned by the next of them.
+
+type writeBack struct {
+	max     int
+	delay   time.Duration
+	blocks  map[int64]*block
+	order   []wbEntry // oldest first
+	spare   *block    // a stored block whose buffers can be reused
+	touched time.Time // last write to the current block
+	err     error
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type wbEntry struct {
+	num int64
+	at  time.Time
+}
+
+func (f *compFile) startWriteBack(max int, delay time.Duration) {
+	wb := &writeBack{
+		max:    max,
+		delay:  delay,
+		blocks: make(map[int64]*block),
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	f.writeBack = wb
+	go f.writeBackLoop(wb)
+}
+
+func (f *compFile) stopWriteBack() {
+	if wb := f.writeBack; wb != nil {
+		select {
+		case <-wb.stop:
+		default:
+			close(wb.stop)
+		}
+		<-wb.done
+	}
+}
+
+func (f *compFile) writeBackLoop(wb *writeBack) {
+	defer close(wb.done)
+	var tick <-chan time.Time
+	if wb.delay > 0 {
+		ticker := time.NewTicker(wb.delay / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-wb.stop:
+			return
+		case <-wb.kick:
+			if wb.delay > 0 {
+				// Leave them to the ticker
+				continue
+			}
+		case <-tick:
+		}
+		for {
+			select {
+			case <-wb.stop:
+				return
+			default:
+			}
+			f.Lock()
+			more, err := f.writeBackStep()
+			if err != nil && wb.err == nil {
+				wb.err = err
+			}
+			f.Unlock()
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// writeBackStep stores the oldest cached block or the current block if they are due. It returns
+// false if there was nothing to store.
+func (f *compFile) writeBackStep() (bool, error) {
+	wb := f.writeBack
+	due := time.Now().Add(-wb.delay)
+	if len(wb.order) > 0 && !wb.order[0].at.After(due) {
+		return true, f.storeOldest()
+	}
+	if wb.delay > 0 && f.block.dirty && !wb.touched.After(due) {
+		return false, f.block.store(false)
+	}
+	return false, nil
+}
+
+// touch is called when the current block is written to.
+func (f *compFile) touch() {
+	if wb := f.writeBack; wb != nil && wb.delay > 0 {
+		wb.touched = time.Now()
+	}
+}
+
+// evict stores the current block or, if possible, moves it into the write-back cache.
+func (f *compFile) evict() error {
+	wb := f.writeBack
+	if wb == nil || wb.max == 0 || int64(len(f.block.data)) != f.blockSize {
+		return f.block.store(false)
+	}
+	o, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if f.block.num >= (o-f.dataOffset)/(f.blockSize+1) {
+		return f.block.store(false)
+	}
+	if len(wb.order) >= wb.max {
+		err = f.storeOldest()
+		if err != nil {
+			return err
+		}
+	}
+	b := &block{}
+	*b = f.block
+	wb.blocks[b.num] = b
+	wb.order = append(wb.order, wbEntry{
+		num: b.num,
+		at:  time.Now(),
+	})
+
+	f.block = block{}
+	if wb.spare != nil {
+		f.block.rawBlock, f.block.dataBlock = wb.spare.rawBlock, wb.spare.dataBlock
+		wb.spare = nil
+	}
+	f.block.init(f)
+
+	select {
+	case wb.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// takeDirty makes a cached block num the current one. It returns false if it's not cached.
+func (f *compFile) takeDirty(num int64) bool {
+	wb := f.writeBack
+	if wb == nil {
+		return false
+	}
+	b := wb.blocks[num]
+	if b == nil {
+		return false
+	}
+	delete(wb.blocks, num)
+	for i, e := range wb.order {
+		if e.num == num {
+			wb.order = append(wb.order[:i], wb.order[i+1:]...)
+			break
+		}
+	}
+	f.block = *b
+	return true
+}
+
+func (f *compFile) storeOldest() error {
+	wb := f.writeBack
+	num := wb.order[0].num
+	wb.order = wb.order[1:]
+	b := wb.blocks[num]
+	delete(wb.blocks, num)
+	err := b.store(false)
+	wb.spare = b
+	return err
+}
+
+// discardWriteBack drops the cached blocks in [from, to) without storing them.
+func (f *compFile) discardWriteBack(from, to int64) {
+	wb := f.writeBack
+	if wb == nil {
+		return
+	}
+	order := wb.order[:0]
+	for _, e := range wb.order {
+		if e.num >= from && e.num < to {
+			wb.spare = wb.blocks[e.num]
+			delete(wb.blocks, e.num)
+		} else {
+			order = append(order, e)
+		}
+	}
+	wb.order = order
+}
+
+// flushWriteBack stores all cached blocks.
+func (f *compFile) flushWriteBack() error {
+	wb := f.writeBack
+	if wb == nil {
+		return nil
+	}
+	err := wb.err
+	wb.err = nil
+	// In the order of the slots rather than the age, they are all stored anyway
+	sort.Slice(wb.order, func(i, j int) bool {
+		return wb.order[i].num < wb.order[j].num
+	})
+	for len(wb.order) > 0 {
+		if serr := f.storeOldest(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Flush stores all modified blocks, unlike Sync it doesn't wait for the data to reach the disk.
+func (f *compFile) Flush() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.flushBlock()
+}
@@ -0,0 +1,221 @@
+package spgz
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteBack(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "writeback.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 32*bs+100)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDWR, 0666, &Options{
+		WriteBack: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(f *compFile) {
+		buf := make([]byte, len(data)+10)
+		n, _ := f.ReadAt(buf, 0)
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatal("Data differs")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		off := rnd.Int63n(int64(len(data)) - 100)
+		patch := make([]byte, 1+rnd.Intn(100))
+		rnd.Read(patch)
+		copy(data[off:], patch)
+		_, err = f.WriteAt(patch, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			check(f)
+		}
+	}
+	// Extending the file
+	_, err = f.WriteAt([]byte("tail"), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "tail"...)
+	check(f)
+
+	err = f.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.writeBack.order) != 0 {
+		t.Fatal("Blocks left after Flush")
+	}
+	_, err = f.WriteAt([]byte("x"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[3] = 'x'
+	err = f.Truncate(int64(len(data)) - 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)-2]
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	check(f)
+}
+
+func TestWriteBackDelay(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "coalesce.spgz")
+	f, err := OpenFileSize(name, os.O_RDWR|os.O_CREATE, 0666, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := make([]byte, 8*bs)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDWR, 0666, &Options{
+		WriteBack:      4,
+		WriteBackDelay: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	f.SetMetrics(m)
+	stored := func() int64 {
+		return m.BlocksRaw.Value() + m.BlocksCompressed.Value()
+	}
+	for i := 0; i < 100; i++ {
+		_, err = f.WriteAt([]byte{byte(i)}, int64(i%4)*bs+int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stored(); n != 0 {
+		t.Fatalf("%d blocks stored before Flush", n)
+	}
+	err = f.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stored(); n != 4 {
+		t.Fatalf("%d blocks stored after Flush", n)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDWR, 0666, &Options{
+		WriteBackDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.SetMetrics(m)
+	_, err = f.WriteAt([]byte("delayed"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; stored() != 5; i++ {
+		if i == 100 {
+			t.Fatal("The block has not been stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBackPunchHole(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "writeback.spgz")
+	f, err := OpenFileOptions(name, os.O_RDWR|os.O_CREATE, 0666, &Options{
+		BlockSize: 8192,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := f.BlockSize()
+	data := bytes.Repeat([]byte("punched "), int(4*bs/8))
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDWR, 0666, &Options{
+		WriteBack: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Loading the head of the hole moves the modified block 1 into the cache
+	_, err = f.WriteAt([]byte("XYZ"), bs+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.PunchHole(100, 3*bs-100)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < int(3*bs); i++ {
+		data[i] = 0
+	}
+
+	f, err = OpenFileOptions(name, os.O_RDONLY, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data differs")
+	}
+	f.Close()
+}
@@ -0,0 +1,96 @@
+package spgz
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// Extended attributes of the source of a file (which include POSIX ACLs and SELinux contexts) can
+// be recorded in the header with Options.Xattrs and restored from Xattrs(). They are kept in a
+// single metadata record (see metadata.go): for each attribute, sorted by name, a 16-bit length
+// and the name followed by a 16-bit length and the value. The header page limits their total size
+// to a few kilobytes, ErrMetadataTooLarge is returned if they don't fit.
+
+const (
+	XattrACLAccess  = "system.posix_acl_access"
+	XattrACLDefault = "system.posix_acl_default"
+	XattrSELinux    = "security.selinux"
+)
+
+// Xattr classes for FilterXattrs
+const (
+	XattrsUser    = 1 << iota // everything that is not an ACL or an SELinux context
+	XattrsACL                 // POSIX ACLs
+	XattrsSELinux             // the SELinux context
+)
+
+// FilterXattrs returns the attributes that belong to the given classes.
+func FilterXattrs(attrs map[string][]byte, classes int) map[string][]byte {
+	res := make(map[string][]byte)
+	for name, value := range attrs {
+		var class int
+		switch {
+		case name == XattrACLAccess || name == XattrACLDefault:
+			class = XattrsACL
+		case name == XattrSELinux:
+			class = XattrsSELinux
+		case strings.HasPrefix(name, "system."):
+			// Other system attributes are filesystem specific
+			continue
+		default:
+			class = XattrsUser
+		}
+		if class&classes != 0 {
+			res[name] = value
+		}
+	}
+	return res
+}
+
+func marshalXattrs(attrs map[string][]byte) []byte {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(attrs[name])))
+		buf = append(buf, attrs[name]...)
+	}
+	return buf
+}
+
+func unmarshalXattrs(buf []byte) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	for len(buf) > 0 {
+		var fields [2][]byte
+		for i := range fields {
+			if len(buf) < 2 {
+				return nil, ErrInvalidFormat
+			}
+			l := int(binary.LittleEndian.Uint16(buf))
+			if len(buf) < 2+l {
+				return nil, ErrInvalidFormat
+			}
+			fields[i] = buf[2 : 2+l]
+			buf = buf[2+l:]
+		}
+		attrs[string(fields[0])] = append([]byte(nil), fields[1]...)
+	}
+	return attrs, nil
+}
+
+// Xattrs returns the extended attributes recorded in the header, nil if there are none.
+func (f *compFile) Xattrs() (map[string][]byte, error) {
+	f.Lock()
+	data := f.meta[metaXattrs]
+	f.Unlock()
+	if data == nil {
+		return nil, nil
+	}
+	return unmarshalXattrs(data)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+import (
+	"errors"
+)
+
+var ErrXattrsNotSupported = errors.New("Extended attributes are not supported on this platform")
+
+func GetXattrs(name string) (map[string][]byte, error) {
+	return nil, ErrXattrsNotSupported
+}
+
+func SetXattrs(name string, attrs map[string][]byte) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return ErrXattrsNotSupported
+}
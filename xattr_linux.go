@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// GetXattrs returns the extended attributes of the named file, an empty map if the filesystem
+// does not support them.
+func GetXattrs(name string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	size, err := syscall.Listxattr(name, nil)
+	for {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return attrs, nil
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("listxattr", err)
+		}
+		if size == 0 {
+			return attrs, nil
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Listxattr(name, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			// Changed in the meantime
+			size, err = syscall.Listxattr(name, nil)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, n := range bytes.Split(buf[:size], []byte{0}) {
+			if len(n) == 0 {
+				continue
+			}
+			value, err := getXattr(name, string(n))
+			if errors.Is(err, syscall.ENODATA) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			attrs[string(n)] = value
+		}
+		return attrs, nil
+	}
+}
+
+func getXattr(name, attr string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(name, attr, nil)
+		if err != nil {
+			return nil, os.NewSyscallError("getxattr", err)
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Getxattr(name, attr, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("getxattr", err)
+		}
+		return buf[:size], nil
+	}
+}
+
+// SetXattrs sets the extended attributes of the named file. It carries on if an attribute can't
+// be set and returns the first error.
+func SetXattrs(name string, attrs map[string][]byte) error {
+	var first error
+	for attr, value := range attrs {
+		err := syscall.Setxattr(name, attr, value, 0)
+		if err != nil && first == nil {
+			first = &os.PathError{Op: "setxattr " + attr, Path: name, Err: err}
+		}
+	}
+	return first
+}
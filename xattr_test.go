@@ -0,0 +1,54 @@
+package spgz
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	attrs := map[string][]byte{
+		"user.comment":    []byte("test"),
+		XattrACLAccess:    {2, 0, 0, 0, 1, 0, 6, 0},
+		XattrSELinux:      []byte("system_u:object_r:virt_image_t:s0\x00"),
+		"system.nfs4_acl": []byte("x"),
+	}
+	if a := FilterXattrs(attrs, XattrsUser|XattrsACL); len(a) != 2 || a["user.comment"] == nil || a[XattrACLAccess] == nil {
+		t.Fatalf("Unexpected filtered attributes: %v", a)
+	}
+
+	var sf memSparseFile
+	f, err := NewFromSparseFileOptions(&sf, os.O_RDWR|os.O_CREATE, &Options{Xattrs: attrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Seek(0, os.SEEK_SET)
+	f, err = NewFromSparseFile(&sf, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := f.Xattrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(attrs) {
+		t.Fatalf("Unexpected attributes: %v", res)
+	}
+	for name, value := range attrs {
+		if !bytes.Equal(res[name], value) {
+			t.Fatalf("Attribute %s mismatch: %q", name, res[name])
+		}
+	}
+
+	_, err = NewFromSparseFileOptions(&memSparseFile{}, os.O_RDWR|os.O_CREATE, &Options{
+		Xattrs: map[string][]byte{"user.big": make([]byte, 5000)},
+	})
+	if err != ErrMetadataTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
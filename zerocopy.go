@@ -0,0 +1,100 @@
+package spgz
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// WriteTo() copies the blocks that are stored uncompressed from their slots straight into the
+// destination if both the file and the destination are file descriptors (a file, a pipe or a
+// socket, possibly wrapped in a SparseWriter), so that raw-heavy archives are extracted without
+// the data going through memory. On Linux it's done with sendfile(2), which splices the pages of
+// the archive into the destination, on other platforms it's not supported. It's not used when
+// WriteTo() decompresses ahead (Options.PipelineDepth) or writes in chunks
+// (Options.WriteChunkSize), and once the destination refuses it the rest is copied as usual.
+
+var errNoZeroCopy = errors.New("Zero-copy is not supported")
+
+type zeroCopier struct {
+	src, dst syscall.RawConn
+	size     int64 // of the file
+	end      int64 // of the underlying file
+}
+
+// rawConn returns the file descriptor behind w, nil if there is none.
+func rawConn(w any) syscall.RawConn {
+	for {
+		switch v := w.(type) {
+		case *SparseWriter:
+			w = v.SparseFile
+		case *SparseFileWithFallback:
+			w = v.SparseFile
+		case syscall.Conn:
+			rc, err := v.SyscallConn()
+			if err != nil {
+				return nil
+			}
+			return rc
+		default:
+			return nil
+		}
+	}
+}
+
+// newZeroCopier returns nil if the blocks can't be copied to w directly. The current block is
+// stored first, so that the slots are up to date.
+func (f *compFile) newZeroCopier(w io.Writer) (*zeroCopier, error) {
+	src, dst := rawConn(f.f), rawConn(w)
+	if src == nil || dst == nil {
+		return nil, nil
+	}
+	err := f.flushBlock()
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.size()
+	if err != nil {
+		return nil, err
+	}
+	end, err := f.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	return &zeroCopier{
+		src:  src,
+		dst:  dst,
+		size: size,
+		end:  end,
+	}, nil
+}
+
+// copyRaw copies the rest of the block at the current offset to the destination if the block is
+// stored uncompressed. It returns the number of bytes copied, 0 if the block has to be loaded.
+func (f *compFile) copyRaw(zc *zeroCopier, hw *holeWriter) (int64, error) {
+	num := f.offset / f.blockSize
+	if !f.isPresent(num) {
+		return 0, nil
+	}
+	slot := f.slotOf(num)
+	if s := f.shadow; s != nil && s.num == slot {
+		return 0, nil
+	}
+	start := f.blockOffset(slot) + 1 + f.offset - num*f.blockSize
+	l := min((num+1)*f.blockSize, zc.size) - f.offset
+	if l <= 0 || start+l > zc.end {
+		return 0, nil
+	}
+	var typ [1]byte
+	_, err := f.f.ReadAt(typ[:], f.blockOffset(slot))
+	if err != nil || typ[0] != blkUncompressed {
+		return 0, err
+	}
+	// Anything written so far goes first
+	err = hw.flush()
+	if err != nil {
+		return 0, err
+	}
+	return copyFileData(zc.dst, zc.src, start, l)
+}
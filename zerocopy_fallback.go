@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package spgz
+
+import (
+	"syscall"
+)
+
+func copyFileData(dst, src syscall.RawConn, offset, n int64) (int64, error) {
+	return 0, errNoZeroCopy
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package spgz
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// copyFileData copies n bytes at offset of src to dst at its current position with sendfile(2).
+func copyFileData(dst, src syscall.RawConn, offset, n int64) (written int64, err error) {
+	cerr := src.Control(func(sfd uintptr) {
+		werr := dst.Write(func(dfd uintptr) bool {
+			for written < n {
+				var m int
+				m, err = syscall.Sendfile(int(dfd), int(sfd), &offset, int(n-written))
+				if m > 0 {
+					written += int64(m)
+				}
+				switch {
+				case err == syscall.EAGAIN:
+					// Wait until the destination is writable
+					err = nil
+					return false
+				case err == syscall.EINTR:
+					err = nil
+				case err != nil:
+					return true
+				case m == 0:
+					err = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = werr
+		}
+	})
+	if err == nil {
+		err = cerr
+	}
+	if written == 0 && (errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS)) {
+		// The destination doesn't take it (e.g. it's opened with O_APPEND)
+		return 0, errNoZeroCopy
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		err = os.NewSyscallError("sendfile", errno)
+	}
+	return
+}
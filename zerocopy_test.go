@@ -0,0 +1,121 @@
+package spgz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZeroCopy(t *testing.T) {
+	dir := t.TempDir()
+	f, err := OpenFile(filepath.Join(dir, "zerocopy.spgz"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs := f.BlockSize()
+	// Raw, compressible and zero blocks, the last one is raw and partial
+	data := make([]byte, 6*bs+1000)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(data[:2*bs])
+	copy(data[2*bs:3*bs], bytes.Repeat([]byte("zerocopy"), int(bs)))
+	rnd.Read(data[5*bs:])
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extract := func(name string, w io.Writer, offset int64) {
+		f.Seek(offset, io.SeekStart)
+		n, err := f.WriteTo(w)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n != int64(len(data))-offset {
+			t.Fatalf("%s: unexpected n: %d", name, n)
+		}
+	}
+	check := func(name, file string, offset int64) {
+		res, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, data[offset:]) {
+			t.Fatalf("%s: data mismatch", name)
+		}
+	}
+
+	for _, offset := range []int64{0, bs / 2} {
+		name := filepath.Join(dir, "plain")
+		out, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extract("file", out, offset)
+		out.Close()
+		check("file", name, offset)
+
+		name = filepath.Join(dir, "sparse")
+		out, err = os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewSparseWriter(NewSparseFileWithFallback(out))
+		extract("sparse", w, offset)
+		w.Close()
+		check("sparse", name, offset)
+	}
+
+	// Not supported by sendfile, the data is copied as usual
+	name := filepath.Join(dir, "append")
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract("append", out, 0)
+	out.Close()
+	check("append", name, 0)
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		res <- buf
+	}()
+	extract("pipe", pw, 0)
+	pw.Close()
+	if !bytes.Equal(<-res, data) {
+		t.Fatal("pipe: data mismatch")
+	}
+
+	// The raw blocks are not loaded
+	out, err = os.Create(filepath.Join(dir, "direct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	zc, err := f.newZeroCopier(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zc == nil {
+		t.Fatal("No zero-copy")
+	}
+	hw := newHoleWriter(out, 0)
+	for _, num := range []int64{1, 2} {
+		f.offset = num * bs
+		n, err := f.copyRaw(zc, hw)
+		if err != nil && err != errNoZeroCopy {
+			t.Fatal(err)
+		}
+		if num == 1 && n != bs && err != errNoZeroCopy || num == 2 && n != 0 {
+			t.Fatalf("Block %d: unexpected n: %d", num, n)
+		}
+	}
+}